@@ -1,7 +1,27 @@
 package main
 
-import "github.com/zspekt/tcpLogger/internal/cmd"
+import (
+	"os"
+
+	"github.com/zspekt/tcpLogger/internal/cmd"
+)
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			cmd.Bench(os.Args[2:])
+			return
+		case "query":
+			cmd.Query(os.Args[2:])
+			return
+		case "verify":
+			cmd.Verify(os.Args[2:])
+			return
+		case "decrypt":
+			cmd.Decrypt(os.Args[2:])
+			return
+		}
+	}
 	cmd.Run()
 }
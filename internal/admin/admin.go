@@ -0,0 +1,91 @@
+// Package admin is the HTTP side of tcpLogger, for watching what it's doing
+// while it runs. it has no authentication of its own, so it should only be
+// listening where the logs could be read anyway, like on localhost.
+package admin
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/crypt"
+	"github.com/zspekt/tcpLogger/internal/tail"
+)
+
+const (
+	readHeaderTimeout time.Duration = 10 * time.Second
+	shutdownTimeout   time.Duration = 5 * time.Second
+)
+
+// Options says what the admin server serves. whatever is nil isn't served,
+// except for the web UI, which makes do with what there is.
+type Options struct {
+	Tail *tail.Hub // GET /tail streams the messages that reach the writer
+	// GET /recent searches the last messages that reached the writer, and
+	// GET /sources lists who sent them
+	Recent *tail.Ring
+	// GET /peers lists the connections, and POST /peers/disconnect?id=<id>
+	// closes one
+	Peers Peers
+	// GET /search searches one of these files and its backups, like the
+	// query subcommand does. the first one, unless the file parameter names
+	// another. empty for none
+	Search []string
+	// decrypts what Search finds encrypted. nil if that can't be done
+	SearchKey *crypt.Key
+	// GET /disk shows the free space of the file outputs, and what was
+	// done to keep it
+	Disk Disk
+}
+
+// NewHandler returns the admin endpoints for o, and the web UI at /.
+func NewHandler(o Options) http.Handler {
+	mux := http.NewServeMux()
+	if o.Tail != nil {
+		mux.Handle("/tail", &tailHandler{hub: o.Tail})
+	}
+	if o.Recent != nil {
+		mux.Handle("/recent", &recentHandler{ring: o.Recent})
+		mux.Handle("/sources", &sourcesHandler{ring: o.Recent})
+	}
+	if o.Peers != nil {
+		mux.Handle("/peers", &peersHandler{peers: o.Peers})
+		mux.Handle("/peers/disconnect", &disconnectHandler{peers: o.Peers})
+	}
+	if len(o.Search) > 0 {
+		mux.Handle("/search", &searchHandler{paths: o.Search, key: o.SearchKey})
+	}
+	if o.Disk != nil {
+		mux.Handle("/disk", &diskHandler{disk: o.Disk})
+	}
+	mux.Handle("/", uiHandler())
+	return mux
+}
+
+// ServeWithCtx serves h on l until ctx is canceled. requests are canceled
+// along with it, so streams don't hold up the shutdown.
+func ServeWithCtx(l net.Listener, h http.Handler, ctx context.Context) error {
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: readHeaderTimeout,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("admin.ServeWithCtx(): error shutting down", "error", err)
+			srv.Close()
+		}
+	})
+	defer stop()
+
+	err := srv.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,25 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/zspekt/tcpLogger/internal/output"
+)
+
+// Disk is what the file outputs know about the space left for them. see
+// output.Guards.
+type Disk interface {
+	Stats() []output.GuardStats
+}
+
+// diskHandler lists the guarded file outputs.
+type diskHandler struct {
+	disk Disk
+}
+
+func (h *diskHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !onlyGet(w, r) {
+		return
+	}
+	writeJSON(w, r, h.disk.Stats())
+}
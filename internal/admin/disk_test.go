@@ -0,0 +1,42 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zspekt/tcpLogger/internal/output"
+)
+
+type fakeDisk []output.GuardStats
+
+func (f fakeDisk) Stats() []output.GuardStats { return f }
+
+func TestDisk(t *testing.T) {
+	disk := fakeDisk{{Name: "file", Path: "/var/log/app.log", Free: 1 << 20, Low: true, Policy: output.PolicyDrop, Dropped: 7}}
+	srv := httptest.NewServer(NewHandler(Options{Disk: disk}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got []output.GuardStats
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != disk[0] {
+		t.Errorf("got %+v, want %+v", got, disk)
+	}
+
+	resp, err = http.Post(srv.URL+"/disk", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
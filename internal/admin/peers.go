@@ -0,0 +1,71 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/zspekt/tcpLogger/internal/logger"
+)
+
+// Peers is what a server knows about its connections. see logger.Server.
+type Peers interface {
+	Peers() []logger.PeerInfo
+	Disconnect(id uint64) error
+}
+
+// peersHandler lists the connections being handled, oldest first.
+type peersHandler struct {
+	peers Peers
+}
+
+func (h *peersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !onlyGet(w, r) {
+		return
+	}
+	writeJSON(w, r, h.peers.Peers())
+}
+
+// disconnectHandler closes the connection whose id is passed as the id
+// query parameter. it only takes a POST, and only from a page of our own, so
+// a page elsewhere can't have a browser send one for it.
+type disconnectHandler struct {
+	peers Peers
+}
+
+func (h *disconnectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	switch err := h.peers.Disconnect(id); {
+	case errors.Is(err, logger.NoSuchPeerError):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// sameOrigin reports whether r didn't come from a page served by someone
+// else. browsers set Origin on every POST, other clients usually don't.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
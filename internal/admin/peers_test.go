@@ -0,0 +1,92 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zspekt/tcpLogger/internal/logger"
+)
+
+// fakePeers is a server with a single connection, id 1.
+type fakePeers struct {
+	disconnected []uint64
+}
+
+func (f *fakePeers) Peers() []logger.PeerInfo {
+	return []logger.PeerInfo{{ID: 1, Remote: "10.0.0.1:5000", Listener: "tcp", Lines: 3}}
+}
+
+func (f *fakePeers) Disconnect(id uint64) error {
+	if id != 1 {
+		return logger.NoSuchPeerError
+	}
+	f.disconnected = append(f.disconnected, id)
+	return nil
+}
+
+func TestPeers(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(Options{Peers: &fakePeers{}}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got []logger.PeerInfo
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ID != 1 || got[0].Remote != "10.0.0.1:5000" || got[0].Lines != 3 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		query      string
+		origin     string
+		wantStatus int
+	}{
+		{name: "ok", method: http.MethodPost, query: "?id=1", wantStatus: http.StatusNoContent},
+		{name: "same origin", method: http.MethodPost, query: "?id=1", origin: "self", wantStatus: http.StatusNoContent},
+		{name: "no such peer", method: http.MethodPost, query: "?id=2", wantStatus: http.StatusNotFound},
+		{name: "bad id", method: http.MethodPost, query: "?id=one", wantStatus: http.StatusBadRequest},
+		{name: "get", method: http.MethodGet, query: "?id=1", wantStatus: http.StatusMethodNotAllowed},
+		{name: "other origin", method: http.MethodPost, query: "?id=1", origin: "http://evil.example", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peers := &fakePeers{}
+			srv := httptest.NewServer(NewHandler(Options{Peers: peers}))
+			defer srv.Close()
+
+			req, err := http.NewRequest(tt.method, srv.URL+"/peers/disconnect"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch tt.origin {
+			case "":
+			case "self":
+				req.Header.Set("Origin", srv.URL)
+			default:
+				req.Header.Set("Origin", tt.origin)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %v, want %v", resp.StatusCode, tt.wantStatus)
+			}
+			if wantDisconnected := tt.wantStatus == http.StatusNoContent; wantDisconnected != (len(peers.disconnected) == 1) {
+				t.Errorf("disconnected %v", peers.disconnected)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/zspekt/tcpLogger/internal/tail"
+)
+
+const (
+	defLimit int = 500
+	maxLimit int = 100000
+)
+
+// recentHandler searches the messages held by a tail.Ring, newest first.
+// it takes the same source, severity and regex query parameters as
+// tailHandler, and limit, defLimit if not set.
+type recentHandler struct {
+	ring *tail.Ring
+}
+
+func (h *recentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !onlyGet(w, r) {
+		return
+	}
+	f, err := filterParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := intParam(r.URL.Query(), "limit", defLimit, maxLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	found := h.ring.Search(f, limit)
+	entries := make([]entry, len(found))
+	for i, m := range found {
+		entries[i] = newEntry(m)
+	}
+	writeJSON(w, r, entries)
+}
+
+// sourcesHandler lists the sources a tail.Ring heard from, busiest first.
+type sourcesHandler struct {
+	ring *tail.Ring
+}
+
+func (h *sourcesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !onlyGet(w, r) {
+		return
+	}
+	writeJSON(w, r, h.ring.Sources())
+}
+
+// onlyGet answers anything but a GET with a 405, and reports whether r is
+// one.
+func onlyGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	w.Header().Set("Allow", "GET, HEAD")
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("admin.writeJSON(): error writing response", "remote", r.RemoteAddr, "error", err)
+	}
+}
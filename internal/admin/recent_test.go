@@ -0,0 +1,120 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/syslog"
+	"github.com/zspekt/tcpLogger/internal/tail"
+)
+
+func TestRecent(t *testing.T) {
+	ring := tail.NewRing(10)
+	for _, m := range []*message.Message{
+		{Data: []byte("boot\n"), Source: "10.0.0.1:5000"},
+		{Data: []byte("link down\n"), Source: "10.0.0.2:5000", Syslog: &syslog.Header{Severity: 3}},
+		{Data: []byte("link up\n"), Source: "10.0.0.2:5001", Syslog: &syslog.Header{Severity: 6}},
+	} {
+		ring.Publish(m)
+	}
+	srv := httptest.NewServer(NewHandler(Options{Recent: ring}))
+	defer srv.Close()
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		want       []string
+	}{
+		{query: "", wantStatus: http.StatusOK, want: []string{"link up", "link down", "boot"}},
+		{query: "?limit=1", wantStatus: http.StatusOK, want: []string{"link up"}},
+		{query: "?source=10.0.0.2&regex=link", wantStatus: http.StatusOK, want: []string{"link up", "link down"}},
+		{query: "?severity=err", wantStatus: http.StatusOK, want: []string{"link down"}},
+		{query: "?regex=nothing", wantStatus: http.StatusOK, want: []string{}},
+		{query: "?limit=-1", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + "/recent" + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %v, want %v", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var entries []entry
+			if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+				t.Fatal(err)
+			}
+			if entries == nil {
+				t.Fatal("got null, want a JSON array")
+			}
+			got := make([]string, len(entries))
+			for i, e := range entries {
+				got[i] = e.Message
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSources(t *testing.T) {
+	ring := tail.NewRing(10)
+	ring.Publish(&message.Message{Data: []byte("hi\n"), Source: "10.0.0.1:5000"})
+	srv := httptest.NewServer(NewHandler(Options{Recent: ring}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/sources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got []tail.SourceStats
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Source != "10.0.0.1" || got[0].Lines != 1 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestUI(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(Options{}))
+	defer srv.Close()
+
+	for path, want := range map[string]string{
+		"/":          "<title>tcpLogger</title>",
+		"/app.js":    "EventSource",
+		"/style.css": "body",
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(b), want) {
+			t.Errorf("GET %v = %v, want it to contain %q", path, resp.Status, want)
+		}
+	}
+
+	// without a ring, there's nothing to search
+	resp, err := http.Get(srv.URL + "/recent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /recent without a ring = %v, want 404", resp.Status)
+	}
+}
@@ -0,0 +1,94 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/crypt"
+	"github.com/zspekt/tcpLogger/internal/query"
+)
+
+// searchHandler searches an output file and its backups, like the query
+// subcommand, writing the lines it finds as text, oldest first. it takes
+// since, until, source, severity, regex and keyword query parameters, which
+// mean what the flags of the query subcommand do, limit, defLimit if not
+// set, and file, which has to be one of paths. the first one if not set.
+type searchHandler struct {
+	paths []string
+	key   *crypt.Key
+}
+
+func (h *searchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !onlyGet(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	path := h.paths[0]
+	if file := q.Get("file"); file != "" {
+		if !slices.Contains(h.paths, file) {
+			http.Error(w, fmt.Sprintf("unknown file <%v>. it has to be one of %q", file, h.paths), http.StatusBadRequest)
+			return
+		}
+		path = file
+	}
+	f, err := query.NewFilter(q.Get("since"), q.Get("until"), q.Get("source"), q.Get("severity"), q.Get("regex"), q.Get("keyword"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := intParam(q, "limit", defLimit, maxLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	lw := &limitWriter{w: w, left: limit, done: cancel}
+	if err := query.RunWithCtx(path, f, query.Options{Key: h.key}, lw, ctx); err != nil {
+		slog.Error("admin.searchHandler.ServeHTTP(): error searching", "path", path, "error", err)
+		if !lw.wrote {
+			http.Error(w, "error reading logs", http.StatusInternalServerError)
+		}
+	}
+}
+
+// limitWriter passes on the first left lines written to it, then calls
+// done, so whoever's writing can stop.
+type limitWriter struct {
+	w     http.ResponseWriter
+	left  int
+	done  func()
+	wrote bool
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if lw.left <= 0 {
+		return n, nil
+	}
+	for i := 0; i < len(p); {
+		j := bytes.IndexByte(p[i:], '\n')
+		if j < 0 {
+			break
+		}
+		i += j + 1
+		if lw.left--; lw.left == 0 {
+			p = p[:i]
+			lw.done()
+			break
+		}
+	}
+	lw.wrote = true
+	_, err := lw.w.Write(p)
+	return n, err
+}
@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	dir := t.TempDir()
+	path, other := filepath.Join(dir, "app.log"), filepath.Join(dir, "lab.log")
+	data := "<11>1 2024-01-03T10:00:00Z router kernel - - - link down\n" +
+		"<14>1 2024-01-03T10:05:00Z switch app - - - link up\n" +
+		"<14>1 2024-01-03T11:00:00Z router app - - - all good\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(other, []byte("<14>1 2024-01-03T10:00:00Z lab app - - - from the lab\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(Options{Search: []string{path, other}}))
+	defer srv.Close()
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		want       []string // what's after " - - - " on every line
+	}{
+		{query: "", wantStatus: http.StatusOK, want: []string{"link down", "link up", "all good"}},
+		{query: "?limit=2", wantStatus: http.StatusOK, want: []string{"link down", "link up"}},
+		{query: "?keyword=LINK", wantStatus: http.StatusOK, want: []string{"link down", "link up"}},
+		{query: "?keyword=link+up", wantStatus: http.StatusOK, want: []string{"link up"}},
+		{query: "?source=router&severity=err", wantStatus: http.StatusOK, want: []string{"link down"}},
+		{query: "?since=2024-01-03T10:01:00Z&until=2024-01-03T11:00:00Z", wantStatus: http.StatusOK, want: []string{"link up"}},
+		{query: "?keyword=nothing", wantStatus: http.StatusOK, want: []string{}},
+		{query: "?since=yesterday", wantStatus: http.StatusBadRequest},
+		{query: "?limit=0", wantStatus: http.StatusBadRequest},
+		{query: "?file=" + url.QueryEscape(other), wantStatus: http.StatusOK, want: []string{"from the lab"}},
+		{query: "?file=" + url.QueryEscape(path) + "&limit=1", wantStatus: http.StatusOK, want: []string{"link down"}},
+		{query: "?file=%2Fetc%2Fpasswd", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + "/search" + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %v, want %v", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, l := range strings.Split(strings.TrimSuffix(string(body), "\n"), "\n") {
+				if _, msg, ok := strings.Cut(l, " - - - "); ok {
+					got = append(got, msg)
+				}
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
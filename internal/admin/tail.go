@@ -0,0 +1,250 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/syslog"
+	"github.com/zspekt/tcpLogger/internal/tail"
+)
+
+const (
+	// keepAlive is how often an idle event stream gets a comment, so proxies
+	// in between don't time it out
+	keepAlive time.Duration = 15 * time.Second
+	// writeTimeout is how long a client gets to take what's written to it
+	writeTimeout time.Duration = 30 * time.Second
+	maxBuffer    int           = 65536
+)
+
+// entry is how a message is streamed.
+type entry struct {
+	Received time.Time    `json:"received"`
+	Source   string       `json:"source"`
+	Listener string       `json:"listener,omitempty"`
+	Output   string       `json:"output,omitempty"`
+	Syslog   *syslogEntry `json:"syslog,omitempty"`
+	Message  string       `json:"message"`
+}
+
+type syslogEntry struct {
+	Facility string `json:"facility"`
+	Severity string `json:"severity"`
+	Hostname string `json:"hostname,omitempty"`
+	Program  string `json:"program,omitempty"`
+}
+
+func newEntry(m *message.Message) entry {
+	e := entry{
+		Received: m.Received,
+		Source:   m.Source,
+		Listener: m.Listener,
+		Output:   m.Output,
+		Message:  string(bytes.TrimSuffix(m.Data, []byte("\n"))),
+	}
+	if h := m.Syslog; h != nil {
+		e.Syslog = &syslogEntry{
+			Facility: syslog.FacilityName(h.Facility),
+			Severity: syslog.SeverityName(h.Severity),
+			Hostname: h.Hostname,
+			Program:  h.Program,
+		}
+	}
+	return e
+}
+
+// tailHandler streams the messages that reach the writer, as Server-Sent
+// Events if the client asks for text/event-stream or format=sse, and as
+// JSON lines otherwise. the query parameters are:
+//
+//	source    sender address, with or without port, or syslog hostname
+//	severity  this severity or a more severe one, like warning or 4
+//	regex     only messages matching it
+//	buffer    how many messages the client can fall behind by before they
+//	          get dropped. tail.DefBuffer if not set
+//
+// a client that falls behind misses messages rather than slowing anything
+// down. it's told how many with a "dropped" event, or a {"dropped":n} line.
+type tailHandler struct {
+	hub *tail.Hub
+}
+
+func (h *tailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := filterParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	buffer, err := intParam(r.URL.Query(), "buffer", 0, maxBuffer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sse := r.URL.Query().Get("format") == "sse" ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+	sub := h.hub.Subscribe(f, buffer)
+	defer sub.Close()
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx would hold the stream back otherwise
+	w.WriteHeader(http.StatusOK)
+
+	s := &stream{w: w, rc: http.NewResponseController(w), sse: sse, sub: sub}
+	if err := s.flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case m, ok := <-sub.C:
+			if !ok { // shutting down
+				return
+			}
+			err = s.write(m)
+			// send whatever else is waiting along with it
+			for more := len(sub.C); err == nil && more > 0; more-- {
+				if m, ok = <-sub.C; !ok {
+					break
+				}
+				err = s.write(m)
+			}
+			if err == nil {
+				err = s.flush()
+			}
+		case <-ticker.C:
+			err = s.keepAlive()
+		}
+		if err != nil {
+			slog.Debug("tailHandler.ServeHTTP(): client is gone", "remote", r.RemoteAddr, "error", err)
+			return
+		}
+	}
+}
+
+// stream writes messages to a single client.
+type stream struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	sse     bool
+	sub     *tail.Subscription
+	dropped uint64 // what the client was already told about
+	pending bool   // something was written since the last flush
+}
+
+func (s *stream) write(m *message.Message) error {
+	if err := s.reportDropped(); err != nil {
+		return err
+	}
+	return s.event("message", newEntry(m))
+}
+
+// reportDropped tells the client about messages it missed since the last
+// time.
+func (s *stream) reportDropped() error {
+	d := s.sub.Dropped()
+	if d == s.dropped {
+		return nil
+	}
+	n := d - s.dropped
+	s.dropped = d
+	return s.event("dropped", struct {
+		Dropped uint64 `json:"dropped"`
+	}{n})
+}
+
+func (s *stream) event(name string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if s.sse {
+		_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, b)
+	} else {
+		_, err = s.w.Write(append(b, '\n'))
+	}
+	s.pending = true
+	return err
+}
+
+func (s *stream) keepAlive() error {
+	if err := s.reportDropped(); err != nil {
+		return err
+	}
+	if s.sse {
+		s.rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := s.w.Write([]byte(": keep-alive\n\n")); err != nil {
+			return err
+		}
+		s.pending = true
+	}
+	if !s.pending {
+		return nil
+	}
+	return s.flush()
+}
+
+func (s *stream) flush() error {
+	s.pending = false
+	return s.rc.Flush()
+}
+
+// filterParams reads the source, severity and regex query parameters.
+func filterParams(q url.Values) (tail.Filter, error) {
+	f := tail.Any
+	f.Source = q.Get("source")
+
+	if v := q.Get("severity"); v != "" {
+		s, ok := syslog.Severity(v)
+		if !ok {
+			return f, fmt.Errorf("invalid severity <%v>", v)
+		}
+		f.Severity = s
+	}
+	if v := q.Get("regex"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid regex: %w", err)
+		}
+		f.Regexp = re
+	}
+	return f, nil
+}
+
+// intParam reads the query parameter key, which has to be between 1 and
+// max. def if it isn't set.
+func intParam(q url.Values, key string, def, max int) (int, error) {
+	v := q.Get(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 || n > max {
+		return 0, fmt.Errorf("invalid %v <%v>. it has to be between 1 and %d", key, v, max)
+	}
+	return n, nil
+}
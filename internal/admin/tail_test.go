@@ -0,0 +1,143 @@
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/syslog"
+	"github.com/zspekt/tcpLogger/internal/tail"
+)
+
+// subscribe makes a request to the tail endpoint of srv, and waits for it
+// to have subscribed to hub.
+func subscribe(t *testing.T, srv *httptest.Server, hub *tail.Hub, query string, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/tail"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	n := hub.Len()
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		return resp
+	}
+	for deadline := time.Now().Add(time.Second); hub.Len() == n; {
+		if time.Now().After(deadline) {
+			t.Fatal("tail request never subscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return resp
+}
+
+func TestTail_jsonLines(t *testing.T) {
+	hub := tail.NewHub()
+	srv := httptest.NewServer(NewHandler(Options{Tail: hub}))
+	defer srv.Close()
+	defer hub.Close()
+
+	resp := subscribe(t, srv, hub, "?severity=warning&source=router", nil)
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %v, want application/x-ndjson", ct)
+	}
+
+	received := time.Date(2024, time.January, 2, 10, 0, 0, 0, time.UTC)
+	for _, m := range []*message.Message{
+		{Data: []byte("not parsed\n"), Source: "10.0.0.1:5000"},
+		{Data: []byte("just info\n"), Source: "10.0.0.1:5000", Syslog: &syslog.Header{Severity: 6, Hostname: "router"}},
+		{
+			Data:     []byte("disk almost full\n"),
+			Source:   "10.0.0.1:5000",
+			Listener: "tcp",
+			Received: received,
+			Syslog:   &syslog.Header{Facility: 3, Severity: 4, Hostname: "router", Program: "df"},
+		},
+	} {
+		hub.Publish(m)
+	}
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got entry
+	if err := json.Unmarshal([]byte(line), &got); err != nil {
+		t.Fatalf("bad JSON line %q: %v", line, err)
+	}
+	want := entry{
+		Received: received,
+		Source:   "10.0.0.1:5000",
+		Listener: "tcp",
+		Syslog:   &syslogEntry{Facility: "daemon", Severity: "warning", Hostname: "router", Program: "df"},
+		Message:  "disk almost full",
+	}
+	if got.Message != want.Message || got.Source != want.Source || got.Listener != want.Listener ||
+		!got.Received.Equal(want.Received) || got.Syslog == nil || *got.Syslog != *want.Syslog {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestTail_sse(t *testing.T) {
+	hub := tail.NewHub()
+	srv := httptest.NewServer(NewHandler(Options{Tail: hub}))
+	defer srv.Close()
+
+	resp := subscribe(t, srv, hub, "?regex=^hi&buffer=1", http.Header{"Accept": {"text/event-stream"}})
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %v, want text/event-stream", ct)
+	}
+
+	// the second one doesn't fit in the buffer, unless the handler was
+	// quick enough to take the first one already
+	for _, data := range []string{"hi 1\n", "bye\n", "hi 2\n"} {
+		hub.Publish(&message.Message{Data: []byte(data)})
+	}
+	hub.Close()
+
+	var events []string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if ev, ok := strings.CutPrefix(sc.Text(), "event: "); ok {
+			events = append(events, ev)
+		}
+	}
+	if len(events) == 0 || events[0] != "message" {
+		t.Fatalf("got events %v, want a message first", events)
+	}
+	switch strings.Join(events, ",") {
+	case "message,message", "message,dropped,message", "message,dropped":
+	default:
+		t.Errorf("got events %v", events)
+	}
+}
+
+func TestTail_badRequest(t *testing.T) {
+	hub := tail.NewHub()
+	srv := httptest.NewServer(NewHandler(Options{Tail: hub}))
+	defer srv.Close()
+
+	for _, query := range []string{"?severity=loud", "?regex=(", "?buffer=0", "?buffer=many"} {
+		t.Run(query, func(t *testing.T) {
+			resp := subscribe(t, srv, hub, query, nil)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("status = %v, want %v", resp.StatusCode, http.StatusBadRequest)
+			}
+		})
+	}
+	if n := hub.Len(); n != 0 {
+		t.Errorf("%v subscribers left behind", n)
+	}
+}
@@ -0,0 +1,28 @@
+package admin
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// the web UI is plain HTML and JS, with nothing loaded from anywhere else,
+// so it works on a box without internet access.
+//
+//go:embed ui
+var ui embed.FS
+
+func uiHandler() http.Handler {
+	sub, err := fs.Sub(ui, "ui")
+	if err != nil {
+		panic(err) // the directory is embedded, it's there
+	}
+	files := http.FileServer(http.FS(sub))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !onlyGet(w, r) {
+			return
+		}
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,226 @@
+"use strict";
+
+// how many rows the live view keeps before it drops the oldest
+const maxLive = 2000;
+const severities = ["emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"];
+
+const form = document.getElementById("filter");
+const rows = document.querySelector("#messages tbody");
+const status = document.getElementById("status");
+const pause = document.getElementById("pause");
+
+let view = "recent";
+let live = null; // the EventSource of the live view
+let paused = false;
+let dropped = 0;
+
+function params() {
+  const p = new URLSearchParams();
+  for (const [k, v] of new FormData(form)) {
+    if (v !== "") {
+      p.set(k, v);
+    }
+  }
+  return p;
+}
+
+function cell(tr, text, cls) {
+  const td = tr.insertCell();
+  td.textContent = text;
+  if (cls) {
+    td.className = cls;
+  }
+}
+
+function row(e) {
+  const tr = document.createElement("tr");
+  const h = e.syslog || {};
+  if (h.severity) {
+    tr.className = "sev-" + severities.indexOf(h.severity);
+  }
+  cell(tr, new Date(e.received).toLocaleString());
+  cell(tr, h.hostname ? h.hostname + " (" + e.source + ")" : e.source);
+  cell(tr, h.severity || "");
+  cell(tr, h.program || "");
+  cell(tr, e.message);
+  return tr;
+}
+
+function show(text) {
+  status.textContent = text;
+}
+
+async function search() {
+  show("searching...");
+  try {
+    const resp = await fetch("recent?" + params());
+    if (!resp.ok) {
+      show(await resp.text());
+      return;
+    }
+    const entries = await resp.json();
+    rows.replaceChildren(...entries.map(row));
+    show(entries.length + " messages");
+  } catch (err) {
+    show("error: " + err);
+  }
+}
+
+function liveStatus() {
+  show(rows.rows.length + " messages" + (dropped ? ", " + dropped + " missed" : "") + (paused ? ", paused" : ""));
+}
+
+function startLive() {
+  stopLive();
+  rows.replaceChildren();
+  dropped = 0;
+  const p = params();
+  p.set("format", "sse");
+  live = new EventSource("tail?" + p);
+  live.addEventListener("message", (ev) => {
+    if (paused) {
+      return;
+    }
+    rows.prepend(row(JSON.parse(ev.data)));
+    while (rows.rows.length > maxLive) {
+      rows.deleteRow(-1);
+    }
+    liveStatus();
+  });
+  live.addEventListener("dropped", (ev) => {
+    dropped += JSON.parse(ev.data).dropped;
+    liveStatus();
+  });
+  live.onerror = () => show(live.readyState === EventSource.CLOSED ? "stream closed" : "reconnecting...");
+  live.onopen = liveStatus;
+}
+
+function stopLive() {
+  if (live) {
+    live.close();
+    live = null;
+  }
+}
+
+// the lines every peer had sent at the last refresh, to tell its rate by
+let lastPeers = new Map();
+let lastPeersAt = 0;
+
+async function peers() {
+  const tbody = document.querySelector("#peers tbody");
+  try {
+    const resp = await fetch("peers");
+    if (!resp.ok) {
+      return;
+    }
+    const list = await resp.json();
+    const now = Date.now();
+    const secs = (now - lastPeersAt) / 1000;
+    const seen = new Map();
+    tbody.replaceChildren(...list.map((p) => {
+      seen.set(p.id, p.lines);
+      const tr = document.createElement("tr");
+      cell(tr, p.remote);
+      cell(tr, p.listener);
+      cell(tr, lastPeers.has(p.id) ? ((p.lines - lastPeers.get(p.id)) / secs).toFixed(2) : "", "num");
+      cell(tr, p.lines, "num");
+      cell(tr, new Date(p.connected).toLocaleTimeString());
+      const b = document.createElement("button");
+      b.type = "button";
+      b.textContent = "Disconnect";
+      b.onclick = (ev) => {
+        ev.stopPropagation();
+        disconnect(p);
+      };
+      tr.insertCell().append(b);
+      tr.onclick = () => {
+        form.elements.source.value = p.remote;
+        form.requestSubmit();
+      };
+      return tr;
+    }));
+    lastPeers = seen;
+    lastPeersAt = now;
+    document.querySelector("#peers .empty").hidden = list.length > 0;
+  } catch (err) {
+    // the next refresh will try again
+  }
+}
+
+async function disconnect(p) {
+  if (!confirm("Disconnect " + p.remote + "?")) {
+    return;
+  }
+  const resp = await fetch("peers/disconnect?id=" + p.id, { method: "POST" });
+  if (!resp.ok && resp.status !== 404) {
+    alert("Couldn't disconnect " + p.remote + ": " + await resp.text());
+  }
+  peers();
+}
+
+async function sources() {
+  const tbody = document.querySelector("#sources tbody");
+  try {
+    const resp = await fetch("sources");
+    if (!resp.ok) {
+      return;
+    }
+    const stats = await resp.json();
+    tbody.replaceChildren(...stats.map((s) => {
+      const tr = document.createElement("tr");
+      cell(tr, s.source);
+      cell(tr, s.rate.toFixed(2), "num");
+      cell(tr, s.lines, "num");
+      cell(tr, new Date(s.last).toLocaleTimeString());
+      tr.onclick = () => {
+        form.elements.source.value = s.source;
+        form.requestSubmit();
+      };
+      return tr;
+    }));
+    document.querySelector("#sources .empty").hidden = stats.length > 0;
+  } catch (err) {
+    // the next refresh will try again
+  }
+}
+
+form.addEventListener("submit", (ev) => {
+  ev.preventDefault();
+  if (view === "live") {
+    startLive();
+  } else {
+    search();
+  }
+});
+
+pause.onclick = () => {
+  paused = !paused;
+  pause.textContent = paused ? "Resume" : "Pause";
+  liveStatus();
+};
+
+for (const b of document.querySelectorAll("nav button")) {
+  b.onclick = () => {
+    view = b.dataset.view;
+    for (const other of document.querySelectorAll("nav button")) {
+      other.classList.toggle("active", other === b);
+    }
+    pause.hidden = view !== "live";
+    form.querySelector("button[type=submit]").textContent = view === "live" ? "Watch" : "Search";
+    if (view === "live") {
+      startLive();
+    } else {
+      stopLive();
+      search();
+    }
+  };
+}
+
+function refresh() {
+  peers();
+  sources();
+}
+
+refresh();
+setInterval(refresh, 5000);
+search();
@@ -0,0 +1,95 @@
+// Package backup knows how lumberjack names the backups of a file, and what
+// goes with each of them. it's what the file output, query and retention
+// all list backups with, so it imports none of them.
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// timeFormat is how lumberjack stamps the name of a rotated file.
+const timeFormat string = "2006-01-02T15-04-05.000"
+
+// the suffixes of the sidecars, as in index.Suffix and chain.Suffix. chain
+// lists backups with Files, so they can't be imported from here.
+const (
+	indexSuffix string = ".idx"
+	chainSuffix string = ".chain"
+)
+
+// Files returns the backups lumberjack rotated path into, oldest first,
+// followed by path itself if it exists.
+func Files(path string) ([]string, error) {
+	dir := filepath.Dir(path)
+	prefix, ext := nameParts(path)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, e := range entries {
+		if _, ok := parseTime(e.Name(), prefix, ext); ok && e.Type().IsRegular() {
+			backups = append(backups, e.Name())
+		}
+	}
+	// the timestamps sort the same as the times they stand for
+	sort.Strings(backups)
+
+	files := make([]string, 0, len(backups)+1)
+	for _, b := range backups {
+		files = append(files, filepath.Join(dir, b))
+	}
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+// Time is when backup, one of the backups of path, was rotated. the
+// timestamp is UTC or local time, depending on lumberjack's LocalTime, so
+// the later of the two is returned. only used to skip backups, that's on the
+// safe side. it's false if backup isn't a backup of path.
+func Time(path, backup string) (time.Time, bool) {
+	prefix, ext := nameParts(path)
+	return parseTime(filepath.Base(backup), prefix, ext)
+}
+
+// Sidecars are the files that go with the file at path, and go away with it:
+// its search index, and its hash chain.
+func Sidecars(path string) []string {
+	plain := strings.TrimSuffix(path, ".gz")
+	s := []string{path + indexSuffix, plain + chainSuffix}
+	if plain != path {
+		s = append(s, plain+indexSuffix) // from before it was compressed
+	}
+	return s
+}
+
+// nameParts is what the names of the backups of path start and end with,
+// around the timestamp.
+func nameParts(path string) (prefix, ext string) {
+	ext = filepath.Ext(path)
+	return strings.TrimSuffix(filepath.Base(path), ext) + "-", ext
+}
+
+func parseTime(name, prefix, ext string) (time.Time, bool) {
+	name = strings.TrimSuffix(name, ".gz")
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+		return time.Time{}, false
+	}
+	stamp := name[len(prefix) : len(name)-len(ext)]
+	utc, err := time.Parse(timeFormat, stamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	local, _ := time.ParseInLocation(timeFormat, stamp, time.Local)
+	if local.After(utc) {
+		return local, true
+	}
+	return utc, true
+}
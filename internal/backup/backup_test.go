@@ -0,0 +1,107 @@
+package backup_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/backup"
+	"github.com/zspekt/tcpLogger/internal/chain"
+	"github.com/zspekt/tcpLogger/internal/index"
+)
+
+// logDir lays out a log file with a plain and a compressed backup, the
+// way lumberjack leaves them, and a backup of another file.
+func logDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range []string{
+		"app-2024-01-01T11-00-00.000.log.gz",
+		"app-2024-01-02T11-00-00.000.log",
+		"app-2024-01-02T11-00-00.000.log" + index.Suffix,
+		"app.log",
+		"other-2024-01-02T11-00-00.000.log",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFiles(t *testing.T) {
+	dir := logDir(t)
+	got, err := backup.Files(filepath.Join(dir, "app.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"app-2024-01-01T11-00-00.000.log.gz", "app-2024-01-02T11-00-00.000.log", "app.log"}
+	if len(got) != len(want) {
+		t.Fatalf("Files() = %v, want %v", got, want)
+	}
+	for i := range got {
+		if filepath.Base(got[i]) != want[i] {
+			t.Errorf("Files()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	tests := []struct {
+		backup string
+		want   time.Time
+		wantOk bool
+	}{
+		{backup: "app-2024-01-02T11-00-00.000.log", want: time.Date(2024, 1, 2, 11, 0, 0, 0, time.UTC), wantOk: true},
+		{backup: "app-2024-01-02T11-00-00.000.log.gz", want: time.Date(2024, 1, 2, 11, 0, 0, 0, time.UTC), wantOk: true},
+		{backup: "other-2024-01-02T11-00-00.000.log"},
+		{backup: "app-yesterday.log"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.backup, func(t *testing.T) {
+			got, ok := backup.Time("/var/log/app.log", filepath.Join("/var/log", tt.backup))
+			if ok != tt.wantOk {
+				t.Fatalf("Time() ok = %v, want %v", ok, tt.wantOk)
+			}
+			// lumberjack may have stamped it in local time, which is later
+			if ok && got.Before(tt.want) {
+				t.Errorf("Time() = %v, want %v or later", got, tt.want)
+			}
+		})
+	}
+}
+
+// the sidecars are named here, since chain can't be imported there
+func TestSidecars(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{
+			path: "app-2024-01-02T11-00-00.000.log",
+			want: []string{index.Path("app-2024-01-02T11-00-00.000.log"), chain.Path("app-2024-01-02T11-00-00.000.log")},
+		},
+		{
+			path: "app-2024-01-02T11-00-00.000.log.gz",
+			want: []string{
+				index.Path("app-2024-01-02T11-00-00.000.log.gz"),
+				chain.Path("app-2024-01-02T11-00-00.000.log.gz"),
+				index.Path("app-2024-01-02T11-00-00.000.log"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got := backup.Sidecars(tt.path)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Sidecars() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Sidecars()[%d] = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+// Package bench generates syslog traffic against a running tcpLogger, and
+// measures what it takes. with the output file at hand, it also reads the
+// lines back to tell how long they took to get to disk, and whether any got
+// lost.
+package bench
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tailPoll is how often the output file is checked for new lines. it's
+// about as coarse as the latencies can be told apart.
+const tailPoll time.Duration = time.Millisecond
+
+const (
+	defConns    int           = 10
+	defDuration time.Duration = 10 * time.Second
+	defSize     int           = 128
+	defWait     time.Duration = 5 * time.Second
+)
+
+// Config describes a run.
+type Config struct {
+	Network  string // tcp or udp. tcp if empty
+	Address  string
+	Conns    int           // concurrent connections. defConns if 0
+	Rate     int           // lines per second over all connections. 0 sends flat out
+	Duration time.Duration // defDuration if 0
+	Size     int           // bytes per line, newline included. defSize if 0
+	Octet    bool          // octet counting instead of a newline after every line. tcp only
+
+	// File is tcpLogger's output file. empty skips latency and loss
+	File string
+	// Wait is how long the last lines get to show up in File. defWait if 0
+	Wait time.Duration
+}
+
+// Result is what a run measured.
+type Result struct {
+	Sent       int64
+	ConnErrors int64 // connections that failed before the end
+	Elapsed    time.Duration
+
+	// only if Config.File was set
+	Seen    int64 // lines read back
+	Lost    int64
+	Dupes   int64
+	Latency Percentiles // from being sent to being read back
+}
+
+// LinesPerSec is the rate lines were sent at.
+func (r *Result) LinesPerSec() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Sent) / r.Elapsed.Seconds()
+}
+
+type Percentiles struct {
+	P50, P90, P99, Max time.Duration
+}
+
+// RunWithCtx sends lines until c.Duration is up or ctx is canceled.
+func RunWithCtx(c Config, ctx context.Context) (*Result, error) {
+	if c.Network == "" {
+		c.Network = "tcp"
+	}
+	if c.Conns == 0 {
+		c.Conns = defConns
+	}
+	if c.Duration == 0 {
+		c.Duration = defDuration
+	}
+	if c.Size == 0 {
+		c.Size = defSize
+	}
+	if c.Wait == 0 {
+		c.Wait = defWait
+	}
+	switch {
+	case c.Network != "tcp" && c.Network != "udp":
+		return nil, fmt.Errorf("invalid network <%v>", c.Network)
+	case c.Octet && c.Network != "tcp":
+		return nil, errors.New("octet counting is for tcp only")
+	case c.Conns < 0 || c.Rate < 0 || c.Duration < 0 || c.Size < 0 || c.Wait < 0:
+		return nil, errors.New("conns, rate, duration, size and wait can't be negative")
+	}
+
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	run := hex.EncodeToString(id)
+
+	var t *tailer
+	if c.File != "" {
+		var err error
+		if t, err = newTailer(c.File, run); err != nil {
+			return nil, err
+		}
+		go t.run()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Duration)
+	defer cancel()
+
+	var (
+		sent, failed atomic.Int64
+		wg           sync.WaitGroup
+	)
+	start := time.Now()
+	for i := 0; i < c.Conns; i++ {
+		wg.Add(1)
+		go func(conn int) {
+			defer wg.Done()
+			n, err := send(c, run, conn, ctx)
+			sent.Add(n)
+			if err != nil && ctx.Err() == nil {
+				slog.Error("bench.RunWithCtx(): connection failed", "conn", conn, "error", err)
+				failed.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	res := &Result{Sent: sent.Load(), ConnErrors: failed.Load(), Elapsed: time.Since(start)}
+
+	if t != nil {
+		t.waitFor(res.Sent, c.Wait)
+		t.stop()
+		res.Seen, res.Dupes = t.seen, t.dupes
+		res.Lost = res.Sent - (t.seen - t.dupes)
+		res.Latency = percentiles(t.latencies)
+	}
+	return res, nil
+}
+
+// send writes lines to a single connection until ctx is canceled, returning
+// how many went out. lines aren't buffered, so that's exactly how many the
+// other end got.
+func send(c Config, run string, conn int, ctx context.Context) (int64, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return 0, err
+	}
+	defer nc.Close()
+	// a write blocked when the run is over gets as long to finish as the
+	// lines get to show up. cutting it short would leave half a line, that
+	// might be read back or not
+	context.AfterFunc(ctx, func() { nc.SetWriteDeadline(time.Now().Add(c.Wait)) })
+
+	var (
+		msg, frame []byte
+		seq        int64
+		perConn    = float64(c.Rate) / float64(c.Conns)
+		start      = time.Now()
+	)
+	for {
+		if c.Rate > 0 {
+			// paced against the start, so a late line doesn't slow down the
+			// rest
+			next := start.Add(time.Duration(float64(seq) / perConn * float64(time.Second)))
+			if wait := time.Until(next); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return seq, nil
+				case <-time.After(wait):
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return seq, nil
+		}
+
+		msg = line(msg[:0], c.Size, run, conn, seq)
+		out := msg
+		if c.Octet {
+			frame = strconv.AppendInt(frame[:0], int64(len(msg)), 10)
+			frame = append(append(frame, ' '), msg...)
+			out = frame
+		}
+		if _, err := nc.Write(out); err != nil {
+			return seq, err
+		}
+		seq++
+	}
+}
+
+// line appends an RFC 5424 message of size bytes to b, padded with 'x'.
+// what's read back looks for "run=<run> conn=<conn> seq=<seq> ts=<ts>".
+func line(b []byte, size int, run string, conn int, seq int64) []byte {
+	now := time.Now()
+	b = append(b, "<14>1 "...)
+	b = now.UTC().AppendFormat(b, time.RFC3339Nano)
+	b = append(b, " bench tcplogger-bench - - - run="...)
+	b = append(b, run...)
+	b = append(b, " conn="...)
+	b = strconv.AppendInt(b, int64(conn), 10)
+	b = append(b, " seq="...)
+	b = strconv.AppendInt(b, seq, 10)
+	b = append(b, " ts="...)
+	b = strconv.AppendInt(b, now.UnixNano(), 10)
+	b = append(b, ' ')
+	for len(b) < size-1 {
+		b = append(b, 'x')
+	}
+	return append(b, '\n')
+}
+
+// tailer follows the output file from its current end, picking out the
+// lines of a run.
+type tailer struct {
+	f      *os.File
+	marker []byte
+
+	mu        sync.Mutex
+	seen      int64
+	dupes     int64
+	latencies []time.Duration
+	got       map[[2]int64]bool
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newTailer(path, run string) (*tailer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &tailer{
+		f:       f,
+		marker:  []byte("run=" + run + " "),
+		got:     make(map[[2]int64]bool),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}, nil
+}
+
+func (t *tailer) run() {
+	defer close(t.stopped)
+	defer t.f.Close()
+
+	r := bufio.NewReaderSize(t.f, 64*1024)
+	var partial []byte
+	for {
+		b, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// a line being written as we read it comes in pieces
+			partial = append(partial, b...)
+			select {
+			case <-t.done:
+				return
+			case <-time.After(tailPoll):
+			}
+			continue
+		}
+		if err != nil {
+			slog.Error("tailer.run(): error reading output file", "error", err)
+			return
+		}
+		if len(partial) > 0 {
+			b = append(partial, b...)
+			partial = nil
+		}
+		t.parse(b, time.Now())
+	}
+}
+
+func (t *tailer) parse(b []byte, now time.Time) {
+	i := bytes.Index(b, t.marker)
+	if i < 0 {
+		return
+	}
+	fields := bytes.Fields(b[i+len(t.marker):])
+	if len(fields) < 3 {
+		return
+	}
+	var vals [3]int64
+	for j, key := range []string{"conn=", "seq=", "ts="} {
+		v, ok := bytes.CutPrefix(fields[j], []byte(key))
+		if !ok {
+			return
+		}
+		n, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return
+		}
+		vals[j] = n
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seen++
+	k := [2]int64{vals[0], vals[1]}
+	if t.got[k] {
+		t.dupes++
+		return
+	}
+	t.got[k] = true
+	t.latencies = append(t.latencies, now.Sub(time.Unix(0, vals[2])))
+}
+
+// waitFor returns once n lines were seen, or after wait.
+func (t *tailer) waitFor(n int64, wait time.Duration) {
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) {
+		t.mu.Lock()
+		unique := int64(len(t.got))
+		t.mu.Unlock()
+		if unique >= n {
+			return
+		}
+		time.Sleep(10 * tailPoll)
+	}
+}
+
+func (t *tailer) stop() {
+	close(t.done)
+	<-t.stopped
+}
+
+func percentiles(d []time.Duration) Percentiles {
+	if len(d) == 0 {
+		return Percentiles{}
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	at := func(p float64) time.Duration {
+		return d[int(p*float64(len(d)-1))]
+	}
+	return Percentiles{P50: at(0.50), P90: at(0.90), P99: at(0.99), Max: d[len(d)-1]}
+}
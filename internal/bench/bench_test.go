@@ -0,0 +1,121 @@
+package bench
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/zspekt/tcpLogger/tcplogger"
+)
+
+// serve starts a tcpLogger writing to a file, returning its address and
+// the file.
+func serve(t *testing.T, network string, framing string) (string, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "bench.log")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := tcplogger.New(tcplogger.Options{
+		Listeners: []tcplogger.ListenerConfig{{Network: network, Address: "127.0.0.1:0", Framing: framing}},
+		Sinks:     []tcplogger.Sink{tcplogger.NewFileSink("file", &lumberjack.Logger{Filename: path})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background()) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		<-served
+	})
+	return srv.Addr().String(), path
+}
+
+func TestRunWithCtx(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		framing string
+		cfg     Config
+	}{
+		{name: "flat out", network: "tcp", cfg: Config{Conns: 4}},
+		{name: "paced", network: "tcp", cfg: Config{Conns: 2, Rate: 200}},
+		{name: "octet", network: "tcp", framing: tcplogger.FramingOctet, cfg: Config{Conns: 2, Octet: true}},
+		{name: "udp", network: "udp", cfg: Config{Network: "udp", Conns: 1, Rate: 200}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, path := serve(t, tt.network, tt.framing)
+			c := tt.cfg
+			c.Address, c.File = addr, path
+			c.Duration = 200 * time.Millisecond
+
+			res, err := RunWithCtx(c, context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Sent == 0 || res.ConnErrors != 0 {
+				t.Fatalf("RunWithCtx() = %+v, want lines sent without errors", res)
+			}
+			if res.Seen != res.Sent || res.Lost != 0 || res.Dupes != 0 {
+				t.Errorf("RunWithCtx() = %+v, want every line read back once", res)
+			}
+			if res.Latency.P50 <= 0 || res.Latency.Max < res.Latency.P99 {
+				t.Errorf("RunWithCtx() latency = %+v", res.Latency)
+			}
+			if c.Rate > 0 && res.Sent > int64(c.Rate) {
+				t.Errorf("RunWithCtx() sent %d lines in %v at %d/s", res.Sent, c.Duration, c.Rate)
+			}
+		})
+	}
+}
+
+func TestRunWithCtx_invalid(t *testing.T) {
+	for _, c := range []Config{
+		{Network: "sctp", Address: "127.0.0.1:514"},
+		{Network: "udp", Address: "127.0.0.1:514", Octet: true},
+		{Address: "127.0.0.1:514", Rate: -1},
+	} {
+		if _, err := RunWithCtx(c, context.Background()); err == nil {
+			t.Errorf("RunWithCtx(%+v) returned no error", c)
+		}
+	}
+}
+
+func Test_line(t *testing.T) {
+	b := line(nil, 200, "abcd", 3, 42)
+	if len(b) != 200 || b[len(b)-1] != '\n' {
+		t.Errorf("line() is %d bytes, want 200 ending with a newline", len(b))
+	}
+	if !strings.Contains(string(b), " run=abcd conn=3 seq=42 ts=") {
+		t.Errorf("line() = %q", b)
+	}
+
+	tl := &tailer{marker: []byte("run=abcd "), got: make(map[[2]int64]bool)}
+	tl.parse(b, time.Now())
+	tl.parse(b, time.Now())
+	tl.parse([]byte("run=ffff conn=1 seq=1 ts=1\n"), time.Now())
+	if tl.seen != 2 || tl.dupes != 1 || len(tl.latencies) != 1 {
+		t.Errorf("tailer saw %d lines, %d dupes, %d latencies, want 2, 1, 1", tl.seen, tl.dupes, len(tl.latencies))
+	}
+}
+
+func Test_percentiles(t *testing.T) {
+	var d []time.Duration
+	for i := 100; i > 0; i-- {
+		d = append(d, time.Duration(i)*time.Millisecond)
+	}
+	got := percentiles(d)
+	want := Percentiles{P50: 50 * time.Millisecond, P90: 90 * time.Millisecond, P99: 99 * time.Millisecond, Max: 100 * time.Millisecond}
+	if got != want {
+		t.Errorf("percentiles() = %+v, want %+v", got, want)
+	}
+}
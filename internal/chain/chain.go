@@ -0,0 +1,242 @@
+// Package chain makes log files tamper-evident. next to every file it keeps
+// a sidecar with a SHA-256 hash chain over what was written to it, every
+// hash taken over the one before it and a record, along with checkpoints of
+// where the chain got to, signed with an Ed25519 key. the chain of a file
+// carries on from where the one of the file it was rotated from ended, so
+// files that go missing show up too.
+//
+// editing a record breaks the chain from there on. rewriting the sidecar to
+// match can't be done for what a checkpoint covers without the private key,
+// so only what was written after the last checkpoint could be rewritten
+// unnoticed.
+//
+// the sidecar is a run of entries:
+//
+//	's' prev[32] offset[8]      the chain starts here, carrying on from prev
+//	'r' length[4] hash[32]      a record of length bytes, and the chain after it
+//	'c' length[4] json sig[64]  a Checkpoint, and its signature
+//
+// a start entry other than the first one means bytes up to offset weren't
+// written by the chain, like when tcpLogger crashed between writing a
+// record and its entry.
+package chain
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Suffix is added to the name of a log file, without any .gz, to get the
+// name of its chain.
+const Suffix string = ".chain"
+
+const version int = 1
+
+const (
+	kindStart      byte = 's'
+	kindRecord     byte = 'r'
+	kindCheckpoint byte = 'c'
+
+	maxCheckpoint uint32 = 4096 // longer than any checkpoint we write
+)
+
+var InvalidKeyError error = errors.New("not an Ed25519 key")
+
+// Checkpoint is a signed statement of where the chain of a file got to.
+type Checkpoint struct {
+	Version int       `json:"version"`
+	Key     string    `json:"key"`     // hex of the public key that signed it
+	Start   string    `json:"start"`   // hex of the hash the chain of the file started from
+	Hash    string    `json:"hash"`    // hex of the hash after the last record
+	Records int64     `json:"records"` // how many there are up to here
+	Size    int64     `json:"size"`    // of the file up to the last record
+	Time    time.Time `json:"time"`
+	Final   bool      `json:"final,omitempty"` // the file was rotated, nothing more goes in it
+}
+
+// Path is where the chain of file is kept. a backup that was gzipped keeps
+// the chain of the file it was.
+func Path(file string) string {
+	return strings.TrimSuffix(file, ".gz") + Suffix
+}
+
+// next is the hash of the chain after data, given the one before it.
+func next(prev [32]byte, data []byte) [32]byte {
+	h := sha256.New()
+	h.Write(prev[:])
+	h.Write(data)
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// gap is the hash of the chain after a start entry in the middle of a file,
+// so that one can't be slipped in where records were.
+func gap(prev [32]byte, offset int64) [32]byte {
+	var b [9]byte
+	b[0] = kindStart
+	binary.BigEndian.PutUint64(b[1:], uint64(offset))
+	return next(prev, b[:])
+}
+
+// entry is one entry of a sidecar. which fields are set depends on kind.
+type entry struct {
+	kind   byte
+	hash   [32]byte // the prev of a start entry
+	offset int64
+	length uint32
+	cp     []byte
+	sig    []byte
+}
+
+func (e *entry) encode() []byte {
+	switch e.kind {
+	case kindStart:
+		b := append([]byte{kindStart}, e.hash[:]...)
+		return binary.BigEndian.AppendUint64(b, uint64(e.offset))
+	case kindRecord:
+		b := binary.BigEndian.AppendUint32([]byte{kindRecord}, e.length)
+		return append(b, e.hash[:]...)
+	default:
+		b := binary.BigEndian.AppendUint32([]byte{kindCheckpoint}, uint32(len(e.cp)))
+		return append(append(b, e.cp...), e.sig...)
+	}
+}
+
+// reader reads the entries of a sidecar, keeping track of how much of it
+// they took up.
+type reader struct {
+	br  *bufio.Reader
+	off int64 // where the last complete entry ended
+}
+
+func newReader(r io.Reader) *reader {
+	return &reader{br: bufio.NewReader(r)}
+}
+
+// next returns the next entry. it's io.EOF at the end, and
+// io.ErrUnexpectedEOF if the last entry was only partly written.
+func (r *reader) next() (entry, error) {
+	var e entry
+	kind, err := r.br.ReadByte()
+	if err != nil {
+		return e, err
+	}
+	e.kind = kind
+
+	var fixed [40]byte
+	n := 0
+	switch kind {
+	case kindStart:
+		n = 40
+	case kindRecord:
+		n = 36
+	case kindCheckpoint:
+		n = 4
+	default:
+		return e, fmt.Errorf("unknown entry <%q> at offset %d", kind, r.off)
+	}
+	if _, err := io.ReadFull(r.br, fixed[:n]); err != nil {
+		return e, unexpected(err)
+	}
+	size := int64(1 + n)
+
+	switch kind {
+	case kindStart:
+		copy(e.hash[:], fixed[:32])
+		e.offset = int64(binary.BigEndian.Uint64(fixed[32:40]))
+	case kindRecord:
+		e.length = binary.BigEndian.Uint32(fixed[:4])
+		copy(e.hash[:], fixed[4:36])
+	case kindCheckpoint:
+		l := binary.BigEndian.Uint32(fixed[:4])
+		if l > maxCheckpoint {
+			return e, fmt.Errorf("checkpoint of %d bytes at offset %d", l, r.off)
+		}
+		b := make([]byte, int(l)+ed25519.SignatureSize)
+		if _, err := io.ReadFull(r.br, b); err != nil {
+			return e, unexpected(err)
+		}
+		e.cp, e.sig = b[:l], b[l:]
+		size += int64(len(b))
+	}
+	r.off += size
+	return e, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// LoadPrivateKey reads an Ed25519 private key from a PEM file, the way
+// `openssl genpkey -algorithm ed25519` writes one.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, InvalidKeyError
+	}
+	return priv, nil
+}
+
+// LoadPublicKey reads an Ed25519 public key from a PEM file, the way
+// `openssl pkey -pubout` writes one. the private key will do too.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "PRIVATE KEY" {
+		priv, err := LoadPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+		return priv.Public().(ed25519.PublicKey), nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, InvalidKeyError
+	}
+	return pub, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%v: no PEM data", path)
+	}
+	return block, nil
+}
+
+func hexKey(pub ed25519.PublicKey) string {
+	return hex.EncodeToString(pub)
+}
@@ -0,0 +1,224 @@
+package chain
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// BrokenError is where the chain of a set of files is broken, meaning they
+// were changed after they were written.
+type BrokenError struct {
+	File   string
+	Record int64 // which one of the file, from 1. 0 if it's not about one
+	Offset int64 // where in the file, decompressed
+	Reason string
+}
+
+func (e *BrokenError) Error() string {
+	if e.Record == 0 {
+		return fmt.Sprintf("%v: at offset %d: %v", e.File, e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("%v: record %d at offset %d: %v", e.File, e.Record, e.Offset, e.Reason)
+}
+
+// Report is what Verify went through.
+type Report struct {
+	Files       int
+	Records     int64
+	Checkpoints int
+	// the keys the checkpoints were signed with, when Verify wasn't given
+	// one to check them against
+	Keys []string
+	// what isn't a broken chain, but leaves part of the files unprotected
+	Warnings []string
+}
+
+func (r *Report) warn(format string, a ...any) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, a...))
+}
+
+// Verify checks the chains of files, oldest first, like backup.Files lists
+// them, and returns the first place one is broken as a *BrokenError. the
+// checkpoints are checked against pub, or if it's nil, only against the key
+// they name, which only proves they weren't signed by someone else if that's
+// the key it should be.
+func Verify(files []string, pub ed25519.PublicKey) (*Report, error) {
+	v := &verifier{pub: pub, keys: make(map[string]bool)}
+	for i, name := range files {
+		if err := v.file(name, i == len(files)-1); err != nil {
+			return &v.Report, err
+		}
+	}
+	for k := range v.keys {
+		v.Keys = append(v.Keys, k)
+	}
+	sort.Strings(v.Keys)
+	return &v.Report, nil
+}
+
+type verifier struct {
+	Report
+	pub  ed25519.PublicKey
+	keys map[string]bool
+
+	chained  bool      // a file before this one had a chain
+	prev     *[32]byte // where the chain of the file before ended
+	prevName string
+}
+
+func (v *verifier) file(name string, last bool) error {
+	broken := func(record, offset int64, format string, a ...any) error {
+		return &BrokenError{File: name, Record: record, Offset: offset, Reason: fmt.Sprintf(format, a...)}
+	}
+
+	cf, err := os.Open(Path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		if v.chained {
+			return broken(0, 0, "it has no chain, but the file before it does")
+		}
+		v.warn("%v has no chain", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer cf.Close()
+	v.chained = true
+	v.Files++
+
+	lf, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	var lr io.Reader = lf
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(lf)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		lr = gz
+	}
+	log := bufio.NewReader(lr)
+
+	var (
+		r        = newReader(cf)
+		started  bool
+		start, h [32]byte
+		pos      int64 // in the file
+		records  int64
+		unsigned int64
+		final    bool
+	)
+	for {
+		e, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			v.warn("%v: its chain ends with a partly written entry", name)
+			break
+		}
+		if err != nil {
+			return broken(records, pos, "its chain is unreadable: %v", err)
+		}
+		if final {
+			return broken(records, pos, "its chain goes on after its final checkpoint")
+		}
+
+		switch e.kind {
+		case kindStart:
+			if !started {
+				started, start, h = true, e.hash, e.hash
+				switch {
+				case v.prev != nil && e.hash != *v.prev:
+					return broken(0, 0, "its chain doesn't carry on from the one of %v. a file is missing, or was replaced", v.prevName)
+				case v.prev == nil && e.hash != [32]byte{}:
+					v.warn("%v: its chain carries on from one that's not here, the files before it were removed", name)
+				}
+			} else {
+				if e.hash != h {
+					return broken(records, pos, "the chain restarts from somewhere it never got to")
+				}
+				h = gap(h, e.offset)
+			}
+			if e.offset < pos {
+				return broken(records, pos, "the chain restarts at offset %d, before where it got to", e.offset)
+			}
+			if e.offset > pos {
+				v.warn("%v: bytes %d to %d aren't chained", name, pos, e.offset)
+				if n, _ := io.CopyN(io.Discard, log, e.offset-pos); n < e.offset-pos {
+					return broken(records, pos+n, "the file ends before the chain restarts at offset %d. it was truncated", e.offset)
+				}
+				pos = e.offset
+			}
+
+		case kindRecord:
+			if !started {
+				return broken(0, 0, "its chain has no start")
+			}
+			hash := sha256.New()
+			hash.Write(h[:])
+			if n, _ := io.CopyN(hash, log, int64(e.length)); n < int64(e.length) {
+				return broken(records+1, pos, "the file ends before the record does. it was truncated")
+			}
+			hash.Sum(h[:0])
+			if h != e.hash {
+				return broken(records+1, pos, "the record doesn't match its hash. it was changed")
+			}
+			pos += int64(e.length)
+			records++
+			unsigned++
+
+		case kindCheckpoint:
+			var cp Checkpoint
+			if err := json.Unmarshal(e.cp, &cp); err != nil {
+				return broken(records, pos, "unreadable checkpoint: %v", err)
+			}
+			key := v.pub
+			if key == nil {
+				key, _ = hex.DecodeString(cp.Key)
+				v.keys[cp.Key] = true
+			}
+			switch {
+			case cp.Key != hexKey(key):
+				return broken(records, pos, "checkpoint was signed with another key, %v", cp.Key)
+			case len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, e.cp, e.sig):
+				return broken(records, pos, "checkpoint signature doesn't verify")
+			case cp.Start != hex.EncodeToString(start[:]) || cp.Hash != hex.EncodeToString(h[:]) || cp.Records != records || cp.Size != pos:
+				return broken(records, pos, "checkpoint doesn't match the chain")
+			}
+			v.Checkpoints++
+			unsigned = 0
+			final = cp.Final
+		}
+	}
+	if !started {
+		v.warn("%v: its chain is empty", name)
+		return nil
+	}
+
+	if n, _ := io.Copy(io.Discard, log); n > 0 {
+		v.warn("%v: the last %d bytes aren't chained", name, n)
+	}
+	if unsigned > 0 {
+		v.warn("%v: the last %d records aren't covered by a checkpoint", name, unsigned)
+	}
+	if !final && !last {
+		v.warn("%v: it was never sealed with a final checkpoint", name)
+	}
+	v.Records += records
+	v.prev, v.prevName = &h, name
+	return nil
+}
@@ -0,0 +1,204 @@
+package chain
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/zspekt/tcpLogger/internal/backup"
+)
+
+// chained writes three files of chained lines into a new directory: two
+// backups and the file.
+func chained(t *testing.T, key ed25519.PrivateKey) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "app.log")
+	l := &lumberjack.Logger{Filename: path, MaxSize: 1}
+	w := NewWriter(l, key, 0)
+	writeLines(t, w, 0, 2500)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if files, _ := backup.Files(path); len(files) != 3 {
+		t.Fatalf("got files %v, want two backups and the file", files)
+	}
+	return path
+}
+
+func TestVerify(t *testing.T) {
+	key := newKey(t)
+	pub := key.Public().(ed25519.PublicKey)
+
+	tests := []struct {
+		name       string
+		tamper     func(t *testing.T, files []string)
+		pub        ed25519.PublicKey
+		wantFile   int   // index of the file reported broken. -1 if it's not
+		wantRecord int64 // -1 for any
+		wantReason string
+		wantWarn   string
+	}{
+		{
+			name:     "untouched",
+			tamper:   func(*testing.T, []string) {},
+			pub:      pub,
+			wantFile: -1,
+		},
+		{
+			name:     "untouched, without a key",
+			tamper:   func(*testing.T, []string) {},
+			wantFile: -1,
+		},
+		{
+			name: "gzipped backup",
+			tamper: func(t *testing.T, files []string) {
+				data, _ := os.ReadFile(files[0])
+				var gz bytes.Buffer
+				zw := gzip.NewWriter(&gz)
+				zw.Write(data)
+				zw.Close()
+				os.WriteFile(files[0]+".gz", gz.Bytes(), 0o600)
+				os.Remove(files[0])
+			},
+			pub:      pub,
+			wantFile: -1,
+		},
+		{
+			name: "oldest backup removed",
+			tamper: func(t *testing.T, files []string) {
+				os.Remove(files[0])
+			},
+			pub:      pub,
+			wantFile: -1,
+			wantWarn: "carries on from one that's not here",
+		},
+		{
+			name: "record changed",
+			tamper: func(t *testing.T, files []string) {
+				data, _ := os.ReadFile(files[1])
+				lines := bytes.SplitAfter(data, []byte("\n"))
+				copy(lines[4][len("<14>1 2024-01-01T00:00:00Z router app - - - "):], "line 999999")
+				os.WriteFile(files[1], bytes.Join(lines, nil), 0o600)
+			},
+			pub:        pub,
+			wantFile:   1,
+			wantRecord: 5,
+			wantReason: "doesn't match its hash",
+		},
+		{
+			name: "record removed",
+			tamper: func(t *testing.T, files []string) {
+				data, _ := os.ReadFile(files[2])
+				i := bytes.Index(data, []byte("<14>"))
+				os.WriteFile(files[2], data[i+1:], 0o600)
+			},
+			pub:        pub,
+			wantFile:   2,
+			wantRecord: 1,
+			wantReason: "doesn't match its hash",
+		},
+		{
+			name: "file truncated",
+			tamper: func(t *testing.T, files []string) {
+				os.Truncate(files[2], 10)
+			},
+			pub:        pub,
+			wantFile:   2,
+			wantRecord: 1,
+			wantReason: "truncated",
+		},
+		{
+			name: "middle file removed",
+			tamper: func(t *testing.T, files []string) {
+				os.Remove(files[1])
+				os.Remove(Path(files[1]))
+			},
+			pub:        pub,
+			wantFile:   2,
+			wantReason: "doesn't carry on",
+		},
+		{
+			name: "chain removed",
+			tamper: func(t *testing.T, files []string) {
+				os.Remove(Path(files[1]))
+			},
+			pub:        pub,
+			wantFile:   1,
+			wantReason: "has no chain",
+		},
+		{
+			name:       "another key",
+			tamper:     func(*testing.T, []string) {},
+			pub:        newKey(t).Public().(ed25519.PublicKey),
+			wantFile:   0,
+			wantRecord: -1,
+			wantReason: "another key",
+		},
+		{
+			name: "chain rewritten with another key",
+			tamper: func(t *testing.T, files []string) {
+				// a whole new chain over edited files, signed with a key
+				// that isn't ours
+				other := newKey(t)
+				for _, f := range files {
+					os.Remove(f)
+					os.Remove(Path(f))
+				}
+				l := &lumberjack.Logger{Filename: files[2]}
+				w := NewWriter(l, other, 0)
+				writeLines(t, w, 0, 1)
+				w.Close()
+				l.Close()
+			},
+			pub:        pub,
+			wantFile:   0,
+			wantRecord: -1,
+			wantReason: "another key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := chained(t, key)
+			files, _ := backup.Files(path)
+			tt.tamper(t, files)
+
+			report, err := verify(t, path, tt.pub)
+			if tt.wantFile < 0 {
+				if err != nil {
+					t.Fatalf("Verify() = %v, want no error", err)
+				}
+			} else {
+				var broken *BrokenError
+				if !errors.As(err, &broken) {
+					t.Fatalf("Verify() = %v, want a *BrokenError", err)
+				}
+				want := files[tt.wantFile]
+				if tt.name == "chain rewritten with another key" {
+					want = files[2]
+				}
+				if broken.File != want || (tt.wantRecord >= 0 && broken.Record != tt.wantRecord) || !strings.Contains(broken.Reason, tt.wantReason) {
+					t.Errorf("Verify() = %v, want %v, record %d: %v", broken, want, tt.wantRecord, tt.wantReason)
+				}
+			}
+
+			warnings := strings.Join(report.Warnings, "\n")
+			if tt.wantWarn == "" && warnings != "" {
+				t.Errorf("Verify() warned %q", warnings)
+			}
+			if !strings.Contains(warnings, tt.wantWarn) {
+				t.Errorf("Verify() warned %q, want %q", warnings, tt.wantWarn)
+			}
+			if tt.pub == nil && (len(report.Keys) != 1 || report.Keys[0] != hexKey(pub)) {
+				t.Errorf("Verify() listed keys %q, want ours", report.Keys)
+			}
+		})
+	}
+}
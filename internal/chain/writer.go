@@ -0,0 +1,423 @@
+package chain
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/zspekt/tcpLogger/internal/backup"
+)
+
+// lumberjack's default, for a MaxSize of 0
+const defaultMaxSize int64 = 100 * 1024 * 1024
+
+// Writer writes to a lumberjack.Logger, keeping the chain of the file as it
+// goes. it rotates the file itself, so the chain of the old one can be
+// sealed first, which means nothing else should write to the same Logger.
+//
+// the sidecar is locked while it's open. a process taking over from another
+// one, like after a graceful restart, waits for it to let go of the file
+// before writing to it.
+type Writer struct {
+	l     *lumberjack.Logger
+	key   ed25519.PrivateKey
+	every time.Duration
+
+	f        *os.File // the sidecar. nil until the first write
+	opened   bool     // a chain was open before, hash is where it ended
+	start    [32]byte
+	hash     [32]byte
+	size     int64 // of the file, up to the last record
+	records  int64
+	unsigned int64 // records since the last checkpoint
+	signed   time.Time
+}
+
+// NewWriter returns a Writer for l that signs its checkpoints with key, every
+// so often if every isn't 0, and whenever the file is rotated or closed.
+func NewWriter(l *lumberjack.Logger, key ed25519.PrivateKey, every time.Duration) *Writer {
+	return &Writer{l: l, key: key, every: every}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.f == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	// lumberjack would rotate on its own at about the same point
+	if w.size > 0 && w.size+int64(len(p)) >= maxSize(w.l) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.l.Write(p)
+	if n > 0 {
+		if err := w.add(p[:n]); err != nil {
+			return n, err
+		}
+	}
+	if err != nil {
+		return n, err
+	}
+	if w.every > 0 && w.unsigned > 0 && time.Since(w.signed) >= w.every {
+		if err := w.checkpoint(false); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Rotate seals the chain of the file and rotates it, like
+// lumberjack.Logger.Rotate does.
+func (w *Writer) Rotate() error {
+	if w.f == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	return w.rotate()
+}
+
+// Close signs a checkpoint for what's not covered by one yet, and closes
+// the sidecar. the Logger is left open.
+func (w *Writer) Close() error {
+	if w.f == nil {
+		return nil
+	}
+	var err error
+	if w.unsigned > 0 {
+		err = w.checkpoint(false)
+	}
+	if w.f != nil {
+		err = errors.Join(err, w.f.Sync(), w.f.Close())
+		w.f = nil
+	}
+	return err
+}
+
+func (w *Writer) add(data []byte) error {
+	h := next(w.hash, data)
+	if err := w.append(entry{kind: kindRecord, length: uint32(len(data)), hash: h}); err != nil {
+		return err
+	}
+	w.hash = h
+	w.size += int64(len(data))
+	w.records++
+	w.unsigned++
+	return nil
+}
+
+func (w *Writer) checkpoint(final bool) error {
+	cp := Checkpoint{
+		Version: version,
+		Key:     hexKey(w.key.Public().(ed25519.PublicKey)),
+		Start:   hex.EncodeToString(w.start[:]),
+		Hash:    hex.EncodeToString(w.hash[:]),
+		Records: w.records,
+		Size:    w.size,
+		Time:    time.Now().UTC(),
+		Final:   final,
+	}
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err := w.append(entry{kind: kindCheckpoint, cp: b, sig: ed25519.Sign(w.key, b)}); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.unsigned = 0
+	w.signed = time.Now()
+	return nil
+}
+
+// append writes e to the sidecar. if it can't, the sidecar is closed, and
+// reopening it picks up from whatever made it to the disk.
+func (w *Writer) append(e entry) error {
+	if _, err := w.f.Write(e.encode()); err != nil {
+		w.f.Close()
+		w.f = nil
+		return err
+	}
+	return nil
+}
+
+// rotate seals the chain of the file, has lumberjack rotate it, and moves
+// the sidecar along with it.
+func (w *Writer) rotate() error {
+	if err := w.checkpoint(true); err != nil {
+		return err
+	}
+	if err := w.l.Rotate(); err != nil {
+		return err
+	}
+	old := w.f
+	defer old.Close() // only once the new one is locked
+	w.f = nil
+
+	path := Path(w.l.Filename)
+	if backup, ok := newestBackup(w.l.Filename); ok {
+		if err := os.Rename(path, Path(backup)); err != nil {
+			return err
+		}
+	} else {
+		slog.Error("chain.Writer.rotate(): can't find the file that was rotated. moving its chain aside", "file", w.l.Filename)
+		if err := os.Rename(path, path+".broken"); err != nil {
+			return err
+		}
+	}
+	removeOrphans(w.l.Filename)
+	return w.open()
+}
+
+// open locks the sidecar of the file, and picks up where its chain left off
+// if it has one, or starts one, carrying on from the last one.
+func (w *Writer) open() error {
+	path := Path(w.l.Filename)
+	f, err := lock(path)
+	if err != nil {
+		return err
+	}
+	st, err := load(f)
+	if err != nil {
+		slog.Error("chain.Writer.open(): chain is unreadable. moving it aside", "path", path, "error", err)
+		prev := w.hash
+		if !w.opened {
+			prev = lastHash(w.l.Filename)
+		}
+		return w.reopen(f, prev)
+	}
+
+	size, err := fileSize(w.l.Filename)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if !w.opened {
+		w.opened = true
+		removeOrphans(w.l.Filename)
+		if !st.started {
+			w.hash = lastHash(w.l.Filename)
+		}
+	}
+
+	switch {
+	case !st.started:
+		if size > 0 {
+			slog.Warn("chain.Writer.open(): what's already in the file isn't chained", "file", w.l.Filename, "bytes", size)
+		}
+		e := entry{kind: kindStart, hash: w.hash, offset: size}
+		if _, err := f.Write(e.encode()); err != nil {
+			f.Close()
+			return err
+		}
+		st = state{started: true, start: w.hash, hash: w.hash, size: size}
+	case size < st.size:
+		slog.Error("chain.Writer.open(): file is shorter than its chain. it was truncated or replaced. moving the chain aside", "file", w.l.Filename)
+		return w.reopen(f, st.hash)
+	case size > st.size:
+		slog.Warn("chain.Writer.open(): file has bytes that weren't chained", "file", w.l.Filename, "bytes", size-st.size)
+		e := entry{kind: kindStart, hash: st.hash, offset: size}
+		if _, err := f.Write(e.encode()); err != nil {
+			f.Close()
+			return err
+		}
+		st.hash = gap(st.hash, size)
+		st.size = size
+	}
+
+	w.f = f
+	w.start, w.hash, w.size = st.start, st.hash, st.size
+	w.records, w.unsigned = st.records, st.unsigned
+	w.signed = time.Now()
+	return nil
+}
+
+// reopen moves the locked sidecar f aside, and starts a new one carrying on
+// from prev.
+func (w *Writer) reopen(f *os.File, prev [32]byte) error {
+	defer f.Close()
+	path := Path(w.l.Filename)
+	if err := os.Rename(path, path+".broken"); err != nil {
+		return err
+	}
+	w.opened, w.hash = true, prev
+	return w.open()
+}
+
+// state is where the chain in a sidecar got to.
+type state struct {
+	started  bool
+	start    [32]byte
+	hash     [32]byte
+	size     int64
+	records  int64
+	unsigned int64
+}
+
+// load reads the chain in f. an entry that was only partly written, like
+// when we crashed, is cut off.
+func load(f *os.File) (state, error) {
+	var st state
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return st, err
+	}
+	r := newReader(f)
+	for {
+		e, err := r.next()
+		if err == io.EOF {
+			return st, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			slog.Warn("chain.load(): cutting off a partly written entry", "path", f.Name())
+			return st, f.Truncate(r.off)
+		}
+		if err != nil {
+			return st, err
+		}
+
+		switch e.kind {
+		case kindStart:
+			if !st.started {
+				st.started, st.start, st.hash = true, e.hash, e.hash
+			} else {
+				st.hash = gap(st.hash, e.offset)
+			}
+			st.size = e.offset
+		case kindRecord:
+			st.hash = e.hash
+			st.size += int64(e.length)
+			st.records++
+			st.unsigned++
+		case kindCheckpoint:
+			st.unsigned = 0
+		}
+	}
+}
+
+// lock opens and locks the sidecar at path, creating it if it has to.
+func lock(path string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			slog.Info("chain.lock(): another process has the chain. waiting for it...", "path", path)
+			err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		// whoever had it may have rotated it away in the meantime
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if cur, err := os.Stat(path); err == nil && os.SameFile(locked, cur) {
+			return f, nil
+		}
+		f.Close()
+	}
+}
+
+func fileSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// maxSize is how big l lets a file get before rotating it.
+func maxSize(l *lumberjack.Logger) int64 {
+	if l.MaxSize == 0 {
+		return defaultMaxSize
+	}
+	return int64(l.MaxSize) * 1024 * 1024
+}
+
+// newestBackup is the last backup lumberjack rotated file into.
+func newestBackup(file string) (string, bool) {
+	files, err := backup.Files(file)
+	if err != nil {
+		return "", false
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		if files[i] != file {
+			return files[i], true
+		}
+	}
+	return "", false
+}
+
+// lastHash is where the chain of the newest backup of file ended, so the
+// chain of file can carry on from it. all zeroes if there's none.
+func lastHash(file string) [32]byte {
+	backup, ok := newestBackup(file)
+	if !ok {
+		return [32]byte{}
+	}
+	f, err := os.Open(Path(backup))
+	if err != nil {
+		return [32]byte{}
+	}
+	defer f.Close()
+	st, err := load(f)
+	if err != nil {
+		slog.Warn("chain.lastHash(): chain of the last backup is unreadable. starting over", "backup", backup, "error", err)
+		return [32]byte{}
+	}
+	return st.hash
+}
+
+// removeOrphans removes the chains of the backups of file that are gone,
+// like the ones lumberjack removed for being too old.
+func removeOrphans(file string) {
+	dir := filepath.Dir(file)
+	ext := filepath.Ext(file)
+	prefix := strings.TrimSuffix(filepath.Base(file), ext) + "-"
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), Suffix)
+		if !ok || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		log := filepath.Join(dir, name)
+		if _, err := os.Stat(log); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if _, err := os.Stat(log + ".gz"); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		slog.Debug("chain.removeOrphans(): removing chain of a backup that's gone", "backup", name)
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("chain.removeOrphans(): error removing chain", "backup", name, "error", err)
+		}
+	}
+}
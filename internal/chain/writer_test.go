@@ -0,0 +1,168 @@
+package chain
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/zspekt/tcpLogger/internal/backup"
+)
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writeLines writes n lines of about 1KiB through w, numbered from first.
+func writeLines(t *testing.T, w *Writer, first, n int) {
+	t.Helper()
+	pad := strings.Repeat("x", 1000)
+	for i := first; i < first+n; i++ {
+		if _, err := fmt.Fprintf(w, "<14>1 2024-01-01T00:00:00Z router app - - - line %06d %v\n", i, pad); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func verify(t *testing.T, path string, pub ed25519.PublicKey) (*Report, error) {
+	t.Helper()
+	files, err := backup.Files(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Verify(files, pub)
+}
+
+func TestWriter(t *testing.T) {
+	key := newKey(t)
+	pub := key.Public().(ed25519.PublicKey)
+	path := filepath.Join(t.TempDir(), "app.log")
+	l := &lumberjack.Logger{Filename: path, MaxSize: 1}
+
+	w := NewWriter(l, key, 0)
+	writeLines(t, w, 0, 1500) // rotated once, at 1MiB
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	files, _ := backup.Files(path)
+	if len(files) != 2 {
+		t.Fatalf("got files %v, want a backup and the file", files)
+	}
+	for _, f := range files {
+		if _, err := os.Stat(Path(f)); err != nil {
+			t.Errorf("no chain for %v: %v", f, err)
+		}
+	}
+
+	report, err := verify(t, path, pub)
+	if err != nil {
+		t.Fatalf("Verify() = %v", err)
+	}
+	if report.Files != 2 || report.Records != 1500 || report.Checkpoints != 2 || len(report.Warnings) != 0 {
+		t.Errorf("Verify() = %+v, want 2 files, 1500 records, 2 checkpoints and no warnings", report)
+	}
+
+	t.Run("picks up where it left off", func(t *testing.T) {
+		w := NewWriter(l, key, time.Nanosecond) // a checkpoint after every record
+		writeLines(t, w, 1500, 10)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		report, err := verify(t, path, pub)
+		if err != nil {
+			t.Fatalf("Verify() = %v", err)
+		}
+		if report.Records != 1510 || report.Checkpoints != 12 || len(report.Warnings) != 0 {
+			t.Errorf("Verify() = %+v, want 1510 records, 12 checkpoints and no warnings", report)
+		}
+	})
+
+	t.Run("crash", func(t *testing.T) {
+		// a record made it to the file, but not to the chain, and half an
+		// entry made it to the chain
+		f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		f.WriteString("lost\n")
+		f.Close()
+		f, _ = os.OpenFile(Path(path), os.O_APPEND|os.O_WRONLY, 0)
+		f.Write([]byte{kindRecord, 0, 0})
+		f.Close()
+
+		w := NewWriter(l, key, 0)
+		writeLines(t, w, 1510, 1)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		report, err := verify(t, path, pub)
+		if err != nil {
+			t.Fatalf("Verify() = %v", err)
+		}
+		if report.Records != 1511 || len(report.Warnings) != 1 || !strings.Contains(report.Warnings[0], "aren't chained") {
+			t.Errorf("Verify() = %+v, want 1511 records and a warning about what isn't chained", report)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		if err := os.Truncate(path, 0); err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(l, key, 0)
+		writeLines(t, w, 0, 1)
+		w.Close()
+		l.Close()
+		if _, err := os.Stat(Path(path) + ".broken"); err != nil {
+			t.Errorf("the chain that no longer matched wasn't moved aside: %v", err)
+		}
+		// it carries on from the chain of the file as it was, which the
+		// backup's doesn't end with
+		var broken *BrokenError
+		if _, err := verify(t, path, pub); !errors.As(err, &broken) || broken.File != path {
+			t.Errorf("Verify() = %v, want the file reported broken", err)
+		}
+	})
+}
+
+func TestWriter_lock(t *testing.T) {
+	key := newKey(t)
+	path := filepath.Join(t.TempDir(), "app.log")
+	l := &lumberjack.Logger{Filename: path}
+	defer l.Close()
+
+	first := NewWriter(l, key, 0)
+	writeLines(t, first, 0, 1)
+
+	done := make(chan struct{})
+	second := NewWriter(l, key, 0)
+	go func() {
+		defer close(done)
+		if _, err := second.Write([]byte("second\n")); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-done:
+		t.Fatal("a second Writer wrote while the first one had the chain")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Close()
+	<-done
+	second.Close()
+
+	if _, err := verify(t, path, key.Public().(ed25519.PublicKey)); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/bench"
+)
+
+// Bench is the bench subcommand, see bench.Config for what the flags do.
+func Bench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tcplogger bench [flags] <host:port>")
+		fs.PrintDefaults()
+	}
+	var c bench.Config
+	fs.StringVar(&c.Network, "network", "tcp", "tcp or udp")
+	fs.IntVar(&c.Conns, "conns", 10, "concurrent connections")
+	fs.IntVar(&c.Rate, "rate", 0, "lines per second over all connections. 0 sends flat out")
+	fs.DurationVar(&c.Duration, "duration", 10*time.Second, "how long to send for")
+	fs.IntVar(&c.Size, "size", 128, "bytes per line")
+	fs.BoolVar(&c.Octet, "octet", false, "use octet counting framing")
+	fs.StringVar(&c.File, "file", "", "tcpLogger's output file, to measure latency and loss")
+	fs.DurationVar(&c.Wait, "wait", 5*time.Second, "how long the last lines get to show up in -file")
+	if err := fs.Parse(args); err != nil {
+		os.Exit(exitUsage)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	c.Address = fs.Arg(0)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	res, err := bench.RunWithCtx(c, ctx)
+	if err != nil {
+		slog.Error("cmd.Bench(): error running benchmark", "error", err)
+		os.Exit(exitUsage)
+	}
+
+	fmt.Printf("sent         %d lines in %v\n", res.Sent, res.Elapsed.Round(time.Millisecond))
+	fmt.Printf("throughput   %.0f lines/s\n", res.LinesPerSec())
+	if res.ConnErrors > 0 {
+		fmt.Printf("conn errors  %d\n", res.ConnErrors)
+	}
+	if c.File != "" {
+		fmt.Printf("read back    %d lines, %d lost, %d duplicated\n", res.Seen, res.Lost, res.Dupes)
+		fmt.Printf(
+			"latency      p50 %v  p90 %v  p99 %v  max %v\n",
+			res.Latency.P50, res.Latency.P90, res.Latency.P99, res.Latency.Max,
+		)
+	}
+
+	switch {
+	case res.ConnErrors > 0:
+		os.Exit(exitUnavailable)
+	case res.Lost > 0:
+		os.Exit(exitFailure)
+	}
+}
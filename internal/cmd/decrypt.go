@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/zspekt/tcpLogger/internal/backup"
+	"github.com/zspekt/tcpLogger/internal/crypt"
+	"github.com/zspekt/tcpLogger/internal/setup"
+)
+
+// Decrypt is the decrypt subcommand. it writes the encrypted files it's
+// given to stdout, or the file output, FILENAME or the default one, and its
+// rotated backups, oldest first. the ones that aren't encrypted are written
+// as they are.
+func Decrypt(args []string) {
+	fs := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tcplogger decrypt -key file [file...]")
+		fs.PrintDefaults()
+	}
+	keyPath := fs.String("key", "", "file with the key the files were encrypted with, like ENCRYPT_KEY. for an X25519\n"+
+		"key, the private one")
+	if err := fs.Parse(args); err != nil {
+		os.Exit(exitUsage)
+	}
+	if *keyPath == "" {
+		fmt.Fprintln(fs.Output(), "-key is required")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	key, err := crypt.LoadKey(*keyPath)
+	if err != nil {
+		fmt.Fprintln(fs.Output(), "invalid -key:", err)
+		os.Exit(exitUsage)
+	}
+	if !key.CanDecrypt() {
+		fmt.Fprintln(fs.Output(), "invalid -key:", crypt.NoPrivateKeyError)
+		os.Exit(exitUsage)
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		path := os.Getenv("FILENAME")
+		if path == "" {
+			path = setup.DefaultFilename
+		}
+		if files, err = backup.Files(path); err != nil {
+			slog.Error("cmd.Decrypt(): error listing files", "error", err)
+			os.Exit(exitCode(err))
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	for _, name := range files {
+		err := decryptFile(name, key, out)
+		if errors.Is(err, crypt.TruncatedError) {
+			slog.Warn("cmd.Decrypt(): file ends in the middle of a record. it's still being written, or the writer crashed", "file", name)
+			err = nil
+		}
+		if err != nil {
+			out.Flush()
+			slog.Error("cmd.Decrypt(): error decrypting file", "file", name, "error", err)
+			os.Exit(exitCode(err))
+		}
+	}
+	if err := out.Flush(); err != nil {
+		slog.Error("cmd.Decrypt(): error writing to stdout", "error", err)
+		os.Exit(exitFailure)
+	}
+}
+
+func decryptFile(name string, key *crypt.Key, out io.Writer) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(crypt.Magic))
+	if !crypt.IsEncrypted(head) {
+		_, err := io.Copy(out, br)
+		return err
+	}
+
+	cr, err := crypt.NewReader(br, key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, cr)
+	return err
+}
@@ -1,11 +1,242 @@
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/admin"
 	"github.com/zspekt/tcpLogger/internal/logger"
+	"github.com/zspekt/tcpLogger/internal/query"
+	"github.com/zspekt/tcpLogger/internal/restart"
 	"github.com/zspekt/tcpLogger/internal/setup"
+	"github.com/zspekt/tcpLogger/internal/systemd"
+	"github.com/zspekt/tcpLogger/internal/tail"
+	"github.com/zspekt/tcpLogger/tcplogger"
+)
+
+// exit codes, from sysexits.h
+const (
+	exitFailure     int = 1
+	exitUsage       int = 64 // bad flags or arguments to a subcommand
+	exitNoInput     int = 66 // a file we were pointed at can't be read
+	exitUnavailable int = 69 // couldn't listen
+	exitConfig      int = 78 // an env var has a bad value
 )
 
+// stopSignals make Run drain its connections, flush its outputs and exit.
+var stopSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+
+// stopContext is canceled once one of stopSignals is caught.
+func stopContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), stopSignals...)
+}
+
 func Run() {
-	c := setup.Config()
-	logger.Run(c)
+	c, err := setup.Config()
+	if err != nil {
+		exit(err)
+	}
+
+	opts := logger.CfgOptions(c)
+	var (
+		adminL net.Listener
+		ao     admin.Options
+	)
+	switch {
+	case c.AdminListener != nil:
+		adminL = c.AdminListener
+	case c.AdminAddr != "":
+		if adminL, err = net.Listen("tcp", c.AdminAddr); err != nil {
+			exit(err)
+		}
+	}
+	if adminL != nil {
+		ao.Tail = tail.NewHub()
+		tap := tail.Tee{ao.Tail}
+		if c.AdminRecent > 0 {
+			ao.Recent = tail.NewRing(c.AdminRecent)
+			tap = append(tap, ao.Recent)
+		}
+		opts.Tap = tap
+		ao.Search = c.Files
+		if c.EncryptKey != nil && c.EncryptKey.CanDecrypt() {
+			ao.SearchKey = c.EncryptKey
+		}
+		if len(c.Guards) > 0 {
+			ao.Disk = c.Guards
+		}
+	}
+
+	srv, err := tcplogger.New(opts)
+	if err != nil {
+		exit(err)
+	}
+
+	stopCtx, stop := stopContext()
+	defer stop()
+	// also canceled once the listeners were handed over by a restart
+	ctx, cancel := context.WithCancel(stopCtx)
+	defer cancel()
+
+	if c.IndexInterval > 0 {
+		for _, f := range c.Files {
+			go query.IndexWithCtx(f, c.IndexInterval, ctx)
+		}
+	}
+	if c.Retention != nil {
+		go c.Retention.RunWithCtx(ctx)
+	}
+	if c.Filter != nil {
+		go logger.ReloadWithCtx(make(chan os.Signal, 1), c.Filter, ctx)
+	}
+
+	for name, addr := range srv.Addrs() {
+		slog.Info("cmd.Run(): serving", "listener", name, "address", addr.String())
+	}
+	for _, err := range srv.ListenErrors() {
+		slog.Warn("cmd.Run(): not serving", "error", err)
+	}
+	if err := restart.Ready(); err != nil {
+		slog.Error("cmd.Run(): error telling the old process we're ready", "error", err)
+	}
+	if adminL != nil {
+		// it keeps going while the connections drain, and is only stopped
+		// once they're done
+		adminCtx, stopAdmin := context.WithCancel(context.Background())
+		defer stopAdmin()
+		ao.Peers = srv
+		go serveAdmin(adminL, ao, adminCtx)
+		defer ao.Tail.Close()
+	}
+	notify(stopCtx, ctx)
+	go restartWithCtx(srv, adminL, c.RestartTimeout, cancel, ctx)
+	srv.Serve(ctx)
+}
+
+func serveAdmin(l net.Listener, o admin.Options, ctx context.Context) {
+	slog.Info("cmd.Run(): serving admin", "address", l.Addr().String())
+	if err := admin.ServeWithCtx(l, admin.NewHandler(o), ctx); err != nil {
+		slog.Error("cmd.Run(): admin server stopped", "error", err)
+	}
+}
+
+// notify tells systemd, if it started us, that we're ready, that we're
+// stopping once stopCtx is canceled, and keeps its watchdog fed until ctx
+// is. a restart only cancels ctx, the new process is the one running then.
+func notify(stopCtx, ctx context.Context) {
+	if _, err := systemd.Notify(systemd.Ready); err != nil {
+		slog.Error("cmd.Run(): error notifying service manager", "error", err)
+	}
+	context.AfterFunc(stopCtx, func() {
+		if _, err := systemd.Notify(systemd.Stopping); err != nil {
+			slog.Error("cmd.Run(): error notifying service manager", "error", err)
+		}
+	})
+
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		slog.Error("cmd.Run(): not feeding the watchdog", "error", err)
+	}
+	if interval > 0 {
+		go systemd.WatchdogWithCtx(interval, ctx)
+	}
+}
+
+// restartWithCtx hands the listeners, along with adminL if it's set, over
+// to a new copy of ourselves every time a SIGUSR2 is caught, until ctx is
+// canceled. once the new process is accepting, cancel makes this one drain
+// its connections and exit. if it never gets there, we keep serving.
+func restartWithCtx(
+	srv *tcplogger.Server,
+	adminL net.Listener,
+	timeout time.Duration,
+	cancel context.CancelFunc,
+	ctx context.Context,
+) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			slog.Info("cmd.Run(): caught SIGUSR2. handing listeners over to a new process...")
+			files, names := srv.ListenerFiles()
+			if adminL != nil {
+				if f, err := listenerFile(adminL); err != nil {
+					slog.Error("cmd.Run(): leaving admin listener out", "error", err)
+				} else {
+					files, names = append(files, f), append(names, setup.AdminSocket)
+				}
+			}
+			p, err := restart.Start(files, names, timeout)
+			for _, f := range files {
+				f.Close()
+			}
+			if err != nil {
+				slog.Error("cmd.Run(): restart failed. still serving", "error", err)
+				continue
+			}
+
+			srv.KeepSockets()
+			if _, err := systemd.Notify(systemd.MainPID(p.Pid)); err != nil {
+				slog.Error("cmd.Run(): error notifying service manager", "error", err)
+			}
+			slog.Info("cmd.Run(): new process took over. draining...", "pid", p.Pid)
+			cancel()
+			return
+		}
+	}
+}
+
+// listenerFile returns a dup of the socket of l.
+func listenerFile(l net.Listener) (*os.File, error) {
+	f, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("can't get a file out of a %T", l)
+	}
+	return f.File()
+}
+
+func exit(err error) {
+	var configErr *setup.ConfigError
+	if errors.As(err, &configErr) {
+		for _, e := range configErr.Errs {
+			slog.Error("cmd.Run(): invalid config", "error", e)
+		}
+	} else {
+		slog.Error("cmd.Run(): error starting", "error", err)
+	}
+	os.Exit(exitCode(err))
+}
+
+// exitCode picks the exit code for err. if it holds more than one kind of
+// error, the first match in this order wins: unreadable file, bad value,
+// can't listen.
+func exitCode(err error) int {
+	var (
+		pathErr  *fs.PathError
+		envErr   *setup.EnvError
+		argErr   *setup.ArgError
+		netOpErr *net.OpError
+	)
+	switch {
+	case errors.As(err, &pathErr):
+		return exitNoInput
+	case errors.As(err, &envErr), errors.As(err, &argErr):
+		return exitConfig
+	case errors.As(err, &netOpErr):
+		return exitUnavailable
+	default:
+		return exitFailure
+	}
 }
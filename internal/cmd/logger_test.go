@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/zspekt/tcpLogger/tcplogger"
+)
+
+func Test_stopContext(t *testing.T) {
+	tests := []struct {
+		name   string
+		signal syscall.Signal
+	}{
+		{name: "SIGINT", signal: syscall.SIGINT},
+		{name: "SIGTERM", signal: syscall.SIGTERM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out.log")
+			srv, err := tcplogger.New(tcplogger.Options{
+				Address:       "127.0.0.1:0",
+				Sinks:         []tcplogger.Sink{tcplogger.NewFileSink("file", &lumberjack.Logger{Filename: path})},
+				ShutdownGrace: 100 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, stop := stopContext()
+			defer stop()
+			served := make(chan error, 1)
+			go func() { served <- srv.Serve(ctx) }()
+
+			// the connection is left open, so it's drained rather than done
+			conn, err := net.Dial("tcp", srv.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("before the signal\n"))
+			time.Sleep(50 * time.Millisecond)
+
+			if err := syscall.Kill(syscall.Getpid(), tt.signal); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+				t.Fatalf("ctx wasn't canceled by %v", tt.signal)
+			}
+			select {
+			case err := <-served:
+				if !errors.Is(err, tcplogger.ServerClosedError) {
+					t.Errorf("Serve() got error %v, want %v", err, tcplogger.ServerClosedError)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Serve() didn't return once ctx was canceled")
+			}
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "before the signal\n" {
+				t.Errorf("file has %q, want the line sent before the signal", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/crypt"
+	"github.com/zspekt/tcpLogger/internal/query"
+	"github.com/zspekt/tcpLogger/internal/setup"
+)
+
+// Query is the query subcommand. it reads the file output, FILENAME or the
+// default one unless a path is given, along with its rotated backups.
+func Query(args []string) {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tcplogger query [flags] [file]")
+		fs.PrintDefaults()
+	}
+	var (
+		since    = fs.String("since", "", "only lines from then on. RFC 3339, or a duration like 1h for that long ago")
+		until    = fs.String("until", "", "only lines from before then. same as -since")
+		source   = fs.String("source", "", "only lines from this hostname")
+		severity = fs.String("severity", "", "only lines of this severity or a more severe one, like warning or 4")
+		grep     = fs.String("grep", "", "only lines matching this regex")
+		keyword  = fs.String("keyword", "", "only lines with every one of these words, in any case. uses the indexes, if there are")
+		follow   = fs.Bool("follow", false, "keep waiting for new lines, across rotations")
+		keyFile  = fs.String("key", "", "file with the key to read encrypted files with, like ENCRYPT_KEY")
+	)
+	if err := fs.Parse(args); err != nil {
+		os.Exit(exitUsage)
+	}
+
+	f, err := query.NewFilter(*since, *until, *source, *severity, *grep, *keyword, time.Now())
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		os.Exit(exitUsage)
+	}
+
+	var key *crypt.Key
+	if *keyFile != "" {
+		if key, err = crypt.LoadKey(*keyFile); err != nil {
+			fmt.Fprintln(fs.Output(), "invalid key:", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	path := fs.Arg(0)
+	if path == "" {
+		path = os.Getenv("FILENAME")
+	}
+	if path == "" {
+		path = setup.DefaultFilename
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := query.RunWithCtx(path, f, query.Options{Follow: *follow, Key: key}, os.Stdout, ctx); err != nil {
+		slog.Error("cmd.Query(): error reading logs", "error", err)
+		os.Exit(exitCode(err))
+	}
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/zspekt/tcpLogger/internal/backup"
+	"github.com/zspekt/tcpLogger/internal/chain"
+	"github.com/zspekt/tcpLogger/internal/setup"
+)
+
+// Verify is the verify subcommand. it checks the hash chains of the file
+// output, FILENAME or the default one unless a path is given, and of its
+// rotated backups, and reports the first place one is broken.
+func Verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tcplogger verify [flags] [file]")
+		fs.PrintDefaults()
+	}
+	keyPath := fs.String("key", "", "PEM file with the public key the checkpoints should be signed with, like\n"+
+		"`openssl pkey -in private.pem -pubout` prints. without it, they're only checked\n"+
+		"against the keys they name, which are listed")
+	if err := fs.Parse(args); err != nil {
+		os.Exit(exitUsage)
+	}
+
+	var pub ed25519.PublicKey
+	if *keyPath != "" {
+		var err error
+		if pub, err = chain.LoadPublicKey(*keyPath); err != nil {
+			fmt.Fprintln(fs.Output(), "invalid -key:", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	path := fs.Arg(0)
+	if path == "" {
+		path = os.Getenv("FILENAME")
+	}
+	if path == "" {
+		path = setup.DefaultFilename
+	}
+	files, err := backup.Files(path)
+	if err != nil {
+		slog.Error("cmd.Verify(): error listing files", "error", err)
+		os.Exit(exitCode(err))
+	}
+
+	report, err := chain.Verify(files, pub)
+	for _, w := range report.Warnings {
+		fmt.Println("warning:", w)
+	}
+	var broken *chain.BrokenError
+	if errors.As(err, &broken) {
+		fmt.Println("BROKEN:", broken)
+		os.Exit(exitFailure)
+	}
+	if err != nil {
+		slog.Error("cmd.Verify(): error reading logs", "error", err)
+		os.Exit(exitCode(err))
+	}
+
+	fmt.Printf("ok: %d files, %d records, %d checkpoints\n", report.Files, report.Records, report.Checkpoints)
+	if pub == nil {
+		for _, k := range report.Keys {
+			fmt.Println("signed with:", k)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Package crypt encrypts log files as they're written, so what's on disk
+// can only be read with the key.
+//
+// every file gets a key of its own, derived from the configured one and a
+// random header at the start of the file, and every record written to it is
+// sealed with AES-256-GCM on its own, so nothing has to be held back before
+// it can hit the disk:
+//
+//	magic[8] kind[1] salt[32] tag[16]  header. for kindX25519, salt is the ephemeral public key
+//	length[4] sealed[length]           a record, as many as there are
+//
+// tag seals nothing, with the rest of the header as additional data, so a
+// wrong key is told apart from a file that was changed.
+//
+// with an X25519 public key, the files can be written without the private
+// key being anywhere near the machine writing them.
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Magic is what an encrypted file starts with.
+const Magic string = "TCPLENC1"
+
+const (
+	kindSecret byte = 1 // the key is a shared secret
+	kindX25519 byte = 2 // the key is an X25519 key pair
+
+	headerSize int    = len(Magic) + 1 + 32 + 16
+	maxRecord  uint32 = 64 * 1024 * 1024 // sealed, bigger than anything we write
+	info       string = "tcplogger file key"
+
+	headerNonce uint64 = 1<<64 - 1 // records never get this far
+)
+
+var (
+	InvalidKeyError   error = errors.New("not a 32 byte key in hex, nor an X25519 key in PEM")
+	NoPrivateKeyError error = errors.New("files encrypted to a public key need its private key to be read")
+	WrongKeyError     error = errors.New("file was encrypted with another key")
+)
+
+// Key is what files are encrypted with, and what it takes to read them back.
+type Key struct {
+	secret []byte           // a shared secret. nil for an X25519 key
+	pub    *ecdh.PublicKey  // files are encrypted to it
+	priv   *ecdh.PrivateKey // nil if only the public key is known
+}
+
+// LoadKey reads a key from path. it's either 32 bytes written out in hex,
+// like `openssl rand -hex 32` prints, or an X25519 key in a PEM file, like
+// `openssl genpkey -algorithm x25519` writes. a public key, like
+// `openssl pkey -pubout` writes, only encrypts.
+func LoadKey(path string) (*Key, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		return pemKey(block)
+	}
+	secret, err := hex.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil || len(secret) != 32 {
+		return nil, InvalidKeyError
+	}
+	return &Key{secret: secret}, nil
+}
+
+func pemKey(block *pem.Block) (*Key, error) {
+	switch block.Type {
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		priv, ok := k.(*ecdh.PrivateKey)
+		if !ok || priv.Curve() != ecdh.X25519() {
+			return nil, InvalidKeyError
+		}
+		return &Key{pub: priv.PublicKey(), priv: priv}, nil
+	case "PUBLIC KEY":
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := k.(*ecdh.PublicKey)
+		if !ok || pub.Curve() != ecdh.X25519() {
+			return nil, InvalidKeyError
+		}
+		return &Key{pub: pub}, nil
+	default:
+		return nil, InvalidKeyError
+	}
+}
+
+// CanDecrypt reports whether k can read files back, and not only write
+// them.
+func (k *Key) CanDecrypt() bool {
+	return k.secret != nil || k.priv != nil
+}
+
+// newFile returns the header of a new file and the cipher for its records.
+func (k *Key) newFile() ([]byte, cipher.AEAD, error) {
+	header := make([]byte, 0, headerSize)
+	header = append(header, Magic...)
+
+	var ikm, salt []byte
+	if k.secret != nil {
+		salt = make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, nil, err
+		}
+		header = append(append(header, kindSecret), salt...)
+		ikm = k.secret
+	} else {
+		eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ikm, err = eph.ECDH(k.pub); err != nil {
+			return nil, nil, err
+		}
+		header = append(append(header, kindX25519), eph.PublicKey().Bytes()...)
+		salt = append(eph.PublicKey().Bytes(), k.pub.Bytes()...)
+	}
+	aead, err := newAEAD(ikm, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead.Seal(header, nonce(headerNonce), nil, header), aead, nil
+}
+
+// openFile returns the cipher for the records of the file with header.
+func (k *Key) openFile(header []byte) (cipher.AEAD, error) {
+	salt := header[len(Magic)+1 : headerSize-16]
+	var (
+		aead cipher.AEAD
+		err  error
+	)
+	switch header[len(Magic)] {
+	case kindSecret:
+		if k.secret == nil {
+			return nil, WrongKeyError
+		}
+		aead, err = newAEAD(k.secret, salt)
+	case kindX25519:
+		if k.priv == nil {
+			if k.secret == nil {
+				return nil, NoPrivateKeyError
+			}
+			return nil, WrongKeyError
+		}
+		eph, perr := ecdh.X25519().NewPublicKey(salt)
+		if perr != nil {
+			return nil, perr
+		}
+		ikm, xerr := k.priv.ECDH(eph)
+		if xerr != nil {
+			return nil, xerr
+		}
+		aead, err = newAEAD(ikm, append(eph.Bytes(), k.pub.Bytes()...))
+	default:
+		return nil, fmt.Errorf("unknown kind of encryption <%d>", header[len(Magic)])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := aead.Open(nil, nonce(headerNonce), header[headerSize-16:], header[:headerSize-16]); err != nil {
+		return nil, WrongKeyError
+	}
+	return aead, nil
+}
+
+// newAEAD derives the key of a file with HKDF-SHA256, as in RFC 5869, and
+// returns a cipher for it.
+func newAEAD(ikm, salt []byte) (cipher.AEAD, error) {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce is the nonce of the nth record of a file. every file has a key of
+// its own, so counting from 0 in every one of them is fine.
+func nonce(n uint64) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b[4:], n)
+	return b
+}
+
+// IsEncrypted reports whether what a file starts with, head, is the start
+// of an encrypted file.
+func IsEncrypted(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(Magic))
+}
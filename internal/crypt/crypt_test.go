@@ -0,0 +1,250 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// keys writes a secret, an X25519 private key and its public key to files,
+// the way openssl would, and returns their paths.
+func keys(t *testing.T) (secret, priv, pub string) {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	s := make([]byte, 32)
+	rand.Read(s)
+	secret = write("secret", []byte(hex.EncodeToString(s)+"\n"))
+
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv = write("private.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if der, err = x509.MarshalPKIXPublicKey(k.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	pub = write("public.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	return secret, priv, pub
+}
+
+func loadKey(t *testing.T, path string) *Key {
+	t.Helper()
+	k, err := LoadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// file is a File that keeps what's written to it in memory.
+type file struct {
+	name  string
+	cur   bytes.Buffer
+	files [][]byte // the ones rotated away
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	n, _ := f.cur.Write(p)
+	return n, os.WriteFile(f.name, f.cur.Bytes(), 0o600)
+}
+
+func (f *file) Rotate() error {
+	f.files = append(f.files, bytes.Clone(f.cur.Bytes()))
+	f.cur.Reset()
+	return os.WriteFile(f.name, nil, 0o600)
+}
+
+func encrypt(t *testing.T, key *Key, lines ...string) []byte {
+	t.Helper()
+	f := &file{name: filepath.Join(t.TempDir(), "app.log")}
+	w := NewWriter(f, f.name, 1<<20, key)
+	for _, l := range lines {
+		if _, err := io.WriteString(w, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f.cur.Bytes()
+}
+
+func decrypt(b []byte, key *Key) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(b), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestLoadKey(t *testing.T) {
+	secret, priv, pub := keys(t)
+	dir := t.TempDir()
+	short := filepath.Join(dir, "short")
+	os.WriteFile(short, []byte("abcd"), 0o600)
+	notHex := filepath.Join(dir, "not-hex")
+	os.WriteFile(notHex, bytes.Repeat([]byte("z"), 64), 0o600)
+
+	tests := []struct {
+		name       string
+		path       string
+		canDecrypt bool
+		wantErr    error
+	}{
+		{name: "secret", path: secret, canDecrypt: true},
+		{name: "private key", path: priv, canDecrypt: true},
+		{name: "public key", path: pub},
+		{name: "short secret", path: short, wantErr: InvalidKeyError},
+		{name: "not hex", path: notHex, wantErr: InvalidKeyError},
+		{name: "missing", path: filepath.Join(dir, "missing"), wantErr: os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := LoadKey(tt.path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("LoadKey() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && k.CanDecrypt() != tt.canDecrypt {
+				t.Errorf("CanDecrypt() = %v, want %v", k.CanDecrypt(), tt.canDecrypt)
+			}
+		})
+	}
+}
+
+func TestReader(t *testing.T) {
+	secret, priv, pub := keys(t)
+	otherSecret, otherPriv, _ := keys(t)
+	lines := []string{"<14>line one\n", "<14>line two\n", "<11>line three\n"}
+	want := "<14>line one\n<14>line two\n<11>line three\n"
+
+	bySecret := encrypt(t, loadKey(t, secret), lines...)
+	byPub := encrypt(t, loadKey(t, pub), lines...)
+	flip := func(b []byte, i int) []byte {
+		b = bytes.Clone(b)
+		b[i] ^= 1
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		file    []byte
+		key     string
+		want    string
+		wantErr error
+	}{
+		{name: "secret", file: bySecret, key: secret, want: want},
+		{name: "public key, read with the private one", file: byPub, key: priv, want: want},
+		{name: "wrong secret", file: bySecret, key: otherSecret, wantErr: WrongKeyError},
+		{name: "wrong private key", file: byPub, key: otherPriv, wantErr: WrongKeyError},
+		{name: "secret for a public key file", file: byPub, key: secret, wantErr: WrongKeyError},
+		{name: "private key for a secret file", file: bySecret, key: priv, wantErr: WrongKeyError},
+		{name: "only the public key", file: byPub, key: pub, wantErr: NoPrivateKeyError},
+		{name: "header changed", file: flip(bySecret, len(Magic)+3), key: secret, wantErr: WrongKeyError},
+		{name: "not encrypted", file: []byte("<14>plain line\n"), key: secret, wantErr: NotEncryptedError},
+		{name: "empty", file: nil, key: secret, wantErr: NotEncryptedError},
+		{name: "cut off in the header", file: bySecret[:headerSize-1], key: secret, wantErr: TruncatedError},
+		{name: "only the header", file: bySecret[:headerSize], key: secret},
+		{name: "cut off in a record", file: bySecret[:len(bySecret)-1], key: secret, want: "<14>line one\n<14>line two\n", wantErr: TruncatedError},
+		{name: "record changed", file: flip(bySecret, len(bySecret)-1), key: secret, want: "<14>line one\n<14>line two\n", wantErr: &CorruptError{}},
+		{name: "records swapped", file: swap(bySecret), key: secret, wantErr: &CorruptError{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(tt.file, loadKey(t, tt.key))
+			var corrupt *CorruptError
+			switch {
+			case errors.As(tt.wantErr, &corrupt):
+				if !errors.As(err, &corrupt) {
+					t.Fatalf("error = %v, want a *CorruptError", err)
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// swap swaps the first two records of an encrypted file, which are the same
+// size.
+func swap(b []byte) []byte {
+	b = bytes.Clone(b)
+	rec := b[headerSize:]
+	l := 4 + int(rec[3])
+	first := bytes.Clone(rec[:l])
+	copy(rec, rec[l:2*l])
+	copy(rec[l:], first)
+	return b
+}
+
+func TestWriter(t *testing.T) {
+	secret, _, _ := keys(t)
+	key := loadKey(t, secret)
+
+	t.Run("rotates", func(t *testing.T) {
+		f := &file{name: filepath.Join(t.TempDir(), "app.log")}
+		w := NewWriter(f, f.name, 1024, key)
+		var want bytes.Buffer
+		for i := 0; i < 50; i++ {
+			line := fmt.Sprintf("<14>line %02d\n", i)
+			want.WriteString(line)
+			if _, err := io.WriteString(w, line); err != nil {
+				t.Fatal(err)
+			}
+		}
+		files := append(f.files, f.cur.Bytes())
+		if len(files) < 2 {
+			t.Fatalf("got %d files, want it rotated", len(files))
+		}
+		var got []byte
+		for i, b := range files {
+			if len(b) >= 1024 {
+				t.Errorf("file %d is %d bytes, over the max", i, len(b))
+			}
+			plain, err := decrypt(b, key)
+			if err != nil {
+				t.Fatalf("file %d: %v", i, err)
+			}
+			got = append(got, plain...)
+		}
+		if string(got) != want.String() {
+			t.Errorf("got %q, want %q", got, want.String())
+		}
+	})
+
+	t.Run("rotates what's already there", func(t *testing.T) {
+		f := &file{name: filepath.Join(t.TempDir(), "app.log")}
+		f.Write([]byte("<14>from before\n"))
+		w := NewWriter(f, f.name, 1<<20, key)
+		if _, err := io.WriteString(w, "<14>new line\n"); err != nil {
+			t.Fatal(err)
+		}
+		if len(f.files) != 1 || string(f.files[0]) != "<14>from before\n" {
+			t.Fatalf("rotated away %q, want what was there before", f.files)
+		}
+		got, err := decrypt(f.cur.Bytes(), key)
+		if err != nil || string(got) != "<14>new line\n" {
+			t.Errorf("got %q, %v, want the new line", got, err)
+		}
+	})
+}
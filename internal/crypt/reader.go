@@ -0,0 +1,108 @@
+package crypt
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	NotEncryptedError error = errors.New("file isn't encrypted")
+	// the file ends in the middle of a record, like when it's still being
+	// written, or the writer crashed
+	TruncatedError error = errors.New("file ends in the middle of a record")
+)
+
+// CorruptError is a record that doesn't decrypt, because it was changed or
+// the file was put together out of order.
+type CorruptError struct {
+	Record uint64 // from 0
+	Offset int64
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("record %d at offset %d doesn't decrypt. the file was changed", e.Record, e.Offset)
+}
+
+// Reader decrypts an encrypted file.
+type Reader struct {
+	r    *bufio.Reader
+	aead cipher.AEAD
+	n    uint64 // records read
+	off  int64  // in the file
+	buf  []byte // what's left of the last record
+	err  error
+}
+
+// NewReader reads the header of r, and returns a Reader for the records
+// after it.
+func NewReader(r io.Reader, key *Key) (*Reader, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(br, header)
+	if !IsEncrypted(header[:n]) {
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+		return nil, NotEncryptedError
+	}
+	if err != nil {
+		return nil, TruncatedError
+	}
+	aead, err := key.openFile(header)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: br, aead: aead, off: int64(headerSize)}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next decrypts the next record into buf.
+func (r *Reader) next() error {
+	var length [4]byte
+	if _, err := io.ReadFull(r.r, length[:]); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return TruncatedError
+		}
+		return err
+	}
+	l := binary.BigEndian.Uint32(length[:])
+	if l > maxRecord || int(l) < r.aead.Overhead() {
+		return &CorruptError{Record: r.n, Offset: r.off}
+	}
+	sealed := make([]byte, l)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return TruncatedError
+		}
+		return err
+	}
+	plain, err := r.aead.Open(sealed[:0], nonce(r.n), sealed, nil)
+	if err != nil {
+		return &CorruptError{Record: r.n, Offset: r.off}
+	}
+	r.buf = plain
+	r.n++
+	r.off += 4 + int64(l)
+	return nil
+}
@@ -0,0 +1,94 @@
+package crypt
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// File is what a Writer writes to, a file that can be rotated, like a
+// lumberjack.Logger.
+type File interface {
+	io.Writer
+	Rotate() error
+}
+
+// Writer encrypts what's written to it, record by record, and writes it to
+// a File. it rotates the file itself, so every file gets a header.
+//
+// a file can only be added to by whoever wrote its header, so one that's
+// there already when the first record comes is rotated first.
+type Writer struct {
+	f    File
+	name string // what f writes to
+	max  int64  // f's size before rotating
+	key  *Key
+
+	aead cipher.AEAD // nil until the first write
+	n    uint64      // records written
+	size int64
+}
+
+// NewWriter returns a Writer for f, which writes to the file at name and
+// rotates it after max bytes.
+func NewWriter(f File, name string, max int64, key *Key) *Writer {
+	return &Writer{f: f, name: name, max: max, key: key}
+}
+
+// Write encrypts p as one record. it's all or nothing, a record can't be
+// split across writes.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.aead == nil {
+		fi, err := os.Stat(w.name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+		if err == nil && fi.Size() > 0 {
+			if err := w.f.Rotate(); err != nil {
+				return 0, err
+			}
+		}
+		if err := w.start(); err != nil {
+			return 0, err
+		}
+	}
+
+	sealed := make([]byte, 4, 4+len(p)+w.aead.Overhead())
+	sealed = w.aead.Seal(sealed, nonce(w.n), p, nil)
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	if w.size+int64(len(sealed)) >= w.max {
+		if err := w.f.Rotate(); err != nil {
+			return 0, err
+		}
+		if err := w.start(); err != nil {
+			return 0, err
+		}
+		sealed = w.aead.Seal(sealed[:4], nonce(w.n), p, nil)
+	}
+
+	n, err := w.f.Write(sealed)
+	w.size += int64(n)
+	if err != nil {
+		// what made it to the file can't be taken back, so carry on in a
+		// new one
+		w.aead = nil
+		return 0, err
+	}
+	w.n++
+	return len(p), nil
+}
+
+// start writes the header of a new file.
+func (w *Writer) start() error {
+	header, aead, err := w.key.newFile()
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Write(header); err != nil {
+		return err
+	}
+	w.aead, w.n, w.size = aead, 0, int64(len(header))
+	return nil
+}
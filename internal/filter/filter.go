@@ -0,0 +1,272 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"sync"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/syslog"
+)
+
+type Action string
+
+const (
+	ActionKeep  Action = "keep"
+	ActionDrop  Action = "drop"
+	ActionRoute Action = "route"
+)
+
+// Rule is a single entry of the rules file. Every field that is set has to
+// match for the rule to apply. Facility, Severity and Program only match
+// messages that went through syslog parsing.
+type Rule struct {
+	Name     string   `json:"name"`
+	Message  string   `json:"message"`  // regex over the raw message
+	Source   []string `json:"source"`   // IPs or CIDRs
+	Facility []string `json:"facility"` // keywords or numbers
+	Severity []string `json:"severity"` // keywords or numbers
+	Program  string   `json:"program"`  // regex over the program name
+	Action   Action   `json:"action"`
+	Output   string   `json:"output"` // only for ActionRoute
+}
+
+type rules struct {
+	Default Action `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+type compiledRule struct {
+	Rule
+	message  *regexp.Regexp
+	program  *regexp.Regexp
+	source   []*net.IPNet
+	facility map[int]bool
+	severity map[int]bool
+}
+
+// Decision is what the engine wants done with a message.
+type Decision struct {
+	Action Action
+	Output string
+	Rule   string // name of the matching rule, empty if the default was used
+}
+
+// Engine evaluates an ordered list of rules. The first rule that matches
+// wins. It is safe for concurrent use, including while reloading.
+type Engine struct {
+	path string
+
+	mu    sync.RWMutex
+	def   Action
+	rules []compiledRule
+}
+
+// Load reads and compiles the rules file at path.
+func Load(path string) (*Engine, error) {
+	e := &Engine{path: path}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload re-reads the rules file. If the new rules don't compile, the old
+// ones are kept and the error is returned.
+func (e *Engine) Reload() error {
+	b, err := os.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+	def, compiled, err := compile(b)
+	if err != nil {
+		return fmt.Errorf("%v: %w", e.path, err)
+	}
+
+	e.mu.Lock()
+	e.def, e.rules = def, compiled
+	e.mu.Unlock()
+
+	slog.Info("filter.Reload(): loaded rules", "path", e.path, "rules", len(compiled))
+	return nil
+}
+
+// Evaluate runs m through the rules.
+func (e *Engine) Evaluate(m *message.Message) Decision {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for i := range e.rules {
+		r := &e.rules[i]
+		if r.matches(m) {
+			return Decision{Action: r.Action, Output: r.Output, Rule: r.Name}
+		}
+	}
+	return Decision{Action: e.def}
+}
+
+// Filter applies the decision for m: false if it's to be dropped, and
+// m.Output set if it's to be routed.
+func (e *Engine) Filter(m *message.Message) bool {
+	d := e.Evaluate(m)
+	switch d.Action {
+	case ActionDrop:
+		slog.Debug("Engine.Filter(): dropping message", "rule", d.Rule)
+		return false
+	case ActionRoute:
+		m.Output = d.Output
+	}
+	return true
+}
+
+func compile(b []byte) (Action, []compiledRule, error) {
+	var rs rules
+	if err := json.Unmarshal(b, &rs); err != nil {
+		return "", nil, err
+	}
+
+	switch rs.Default {
+	case "":
+		rs.Default = ActionKeep
+	case ActionKeep, ActionDrop:
+	default:
+		return "", nil, fmt.Errorf("invalid default action <%v>", rs.Default)
+	}
+
+	compiled := make([]compiledRule, 0, len(rs.Rules))
+	for i, r := range rs.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i)
+		}
+		c, err := compileRule(r)
+		if err != nil {
+			return "", nil, fmt.Errorf("%v: %w", r.Name, err)
+		}
+		compiled = append(compiled, c)
+	}
+	return rs.Default, compiled, nil
+}
+
+func compileRule(r Rule) (compiledRule, error) {
+	var err error
+	c := compiledRule{Rule: r}
+
+	switch r.Action {
+	case ActionKeep, ActionDrop:
+	case ActionRoute:
+		if r.Output == "" {
+			return c, fmt.Errorf("action <%v> needs an output", r.Action)
+		}
+	default:
+		return c, fmt.Errorf("invalid action <%v>", r.Action)
+	}
+
+	if r.Message != "" {
+		if c.message, err = regexp.Compile(r.Message); err != nil {
+			return c, err
+		}
+	}
+	if r.Program != "" {
+		if c.program, err = regexp.Compile(r.Program); err != nil {
+			return c, err
+		}
+	}
+
+	for _, s := range r.Source {
+		n, err := parseNet(s)
+		if err != nil {
+			return c, err
+		}
+		c.source = append(c.source, n)
+	}
+
+	if c.facility, err = keywords(r.Facility, syslog.Facility); err != nil {
+		return c, err
+	}
+	if c.severity, err = keywords(r.Severity, syslog.Severity); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func (r *compiledRule) matches(m *message.Message) bool {
+	if r.message != nil && !r.message.Match(m.Data) {
+		return false
+	}
+	if r.source != nil && !containsAddr(r.source, m.Source) {
+		return false
+	}
+
+	if r.program == nil && r.facility == nil && r.severity == nil {
+		return true
+	}
+	h := m.Syslog
+	if h == nil {
+		return false
+	}
+	if r.program != nil && !r.program.MatchString(h.Program) {
+		return false
+	}
+	if r.facility != nil && !r.facility[h.Facility] {
+		return false
+	}
+	if r.severity != nil && !r.severity[h.Severity] {
+		return false
+	}
+	return true
+}
+
+func parseNet(s string) (*net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source <%v>", s)
+	}
+	bits := 8 * len(ip)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// containsAddr takes addr with or without a port, and ignores its zone, so
+// fe80::1%eth0 matches fe80::/10.
+func containsAddr(nets []*net.IPNet, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	a, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip := net.IP(a.WithZone("").Unmap().AsSlice())
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func keywords(names []string, lookup func(string) (int, bool)) (map[int]bool, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	m := make(map[int]bool, len(names))
+	for _, n := range names {
+		v, ok := lookup(n)
+		if !ok {
+			return nil, fmt.Errorf("unknown keyword <%v>", n)
+		}
+		m[v] = true
+	}
+	return m, nil
+}
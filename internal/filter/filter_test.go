@@ -0,0 +1,170 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/syslog"
+)
+
+const testRules = `{
+	"default": "keep",
+	"rules": [
+		{
+			"name": "hostapd auth noise",
+			"program": "^hostapd$",
+			"message": "IEEE 802\\.11: authenticated",
+			"action": "drop"
+		},
+		{
+			"name": "lab routers",
+			"source": ["10.0.9.0/24", "192.168.1.1", "fe80::/10"],
+			"action": "route",
+			"output": "lab"
+		},
+		{
+			"name": "debug spam",
+			"severity": ["debug"],
+			"action": "drop"
+		}
+	]
+}`
+
+func writeRules(t *testing.T, rules string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEngine_Evaluate(t *testing.T) {
+	e, err := Load(writeRules(t, testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		msg  *message.Message
+		want Decision
+	}{
+		{
+			name: "hostapd auth line is dropped",
+			msg: &message.Message{
+				Data:   []byte("<30>hostapd: wlan0: STA aa:bb:cc:dd:ee:ff IEEE 802.11: authenticated\n"),
+				Source: "10.0.0.1:5000",
+				Syslog: &syslog.Header{Facility: 3, Severity: 6, Program: "hostapd"},
+			},
+			want: Decision{Action: ActionDrop, Rule: "hostapd auth noise"},
+		},
+		{
+			name: "other hostapd lines are kept",
+			msg: &message.Message{
+				Data:   []byte("<30>hostapd: wlan0: STA aa:bb:cc:dd:ee:ff IEEE 802.11: disassociated\n"),
+				Source: "10.0.0.1:5000",
+				Syslog: &syslog.Header{Facility: 3, Severity: 6, Program: "hostapd"},
+			},
+			want: Decision{Action: ActionKeep},
+		},
+		{
+			name: "program rules don't match without syslog parsing",
+			msg: &message.Message{
+				Data:   []byte("<30>hostapd: wlan0: STA aa:bb:cc:dd:ee:ff IEEE 802.11: authenticated\n"),
+				Source: "10.0.0.1:5000",
+			},
+			want: Decision{Action: ActionKeep},
+		},
+		{
+			name: "source in cidr is routed",
+			msg:  &message.Message{Data: []byte("hi\n"), Source: "10.0.9.77:5000"},
+			want: Decision{Action: ActionRoute, Output: "lab", Rule: "lab routers"},
+		},
+		{
+			name: "single ip source is routed",
+			msg:  &message.Message{Data: []byte("hi\n"), Source: "192.168.1.1:5000"},
+			want: Decision{Action: ActionRoute, Output: "lab", Rule: "lab routers"},
+		},
+		{
+			name: "v4-mapped source is routed",
+			msg:  &message.Message{Data: []byte("hi\n"), Source: "[::ffff:192.168.1.1]:5000"},
+			want: Decision{Action: ActionRoute, Output: "lab", Rule: "lab routers"},
+		},
+		{
+			name: "zoned source is routed",
+			msg:  &message.Message{Data: []byte("hi\n"), Source: "[fe80::1%eth0]:5000"},
+			want: Decision{Action: ActionRoute, Output: "lab", Rule: "lab routers"},
+		},
+		{
+			name: "severity match",
+			msg: &message.Message{
+				Data:   []byte("<31>hi\n"),
+				Source: "10.0.0.1:5000",
+				Syslog: &syslog.Header{Facility: 3, Severity: 7},
+			},
+			want: Decision{Action: ActionDrop, Rule: "debug spam"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := e.Evaluate(tt.msg); got != tt.want {
+				t.Errorf("Evaluate() got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad_invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+	}{
+		{name: "not json", rules: `rules: []`},
+		{name: "bad default", rules: `{"default": "route"}`},
+		{name: "bad action", rules: `{"rules": [{"action": "explode"}]}`},
+		{name: "route without output", rules: `{"rules": [{"action": "route"}]}`},
+		{name: "bad regex", rules: `{"rules": [{"action": "drop", "message": "("}]}`},
+		{name: "bad source", rules: `{"rules": [{"action": "drop", "source": ["nope"]}]}`},
+		{name: "bad severity", rules: `{"rules": [{"action": "drop", "severity": ["loud"]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Load(writeRules(t, tt.rules)); err == nil {
+				t.Errorf("Load() returned no error")
+			}
+		})
+	}
+}
+
+func TestEngine_Reload(t *testing.T) {
+	path := writeRules(t, `{"default": "keep"}`)
+	e, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &message.Message{Data: []byte("hi\n"), Source: "10.0.0.1:5000"}
+
+	if got := e.Evaluate(msg).Action; got != ActionKeep {
+		t.Fatalf("Evaluate() before reload got %v, want %v", got, ActionKeep)
+	}
+
+	os.WriteFile(path, []byte(`{"default": "drop"}`), 0o644)
+	if err := e.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Evaluate(msg).Action; got != ActionDrop {
+		t.Fatalf("Evaluate() after reload got %v, want %v", got, ActionDrop)
+	}
+
+	// broken rules shouldn't replace working ones
+	os.WriteFile(path, []byte(`{"default": "nope"}`), 0o644)
+	if err := e.Reload(); err == nil {
+		t.Fatal("Reload() of broken rules returned no error")
+	}
+	if got := e.Evaluate(msg).Action; got != ActionDrop {
+		t.Errorf("Evaluate() after failed reload got %v, want %v", got, ActionDrop)
+	}
+}
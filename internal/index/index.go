@@ -0,0 +1,421 @@
+// Package index keeps a sidecar file next to every log file, saying which
+// stretches of it hold what, so a search only reads the parts that might
+// match instead of every byte.
+//
+// a file is split into blocks of about blockSize bytes, starting at line
+// boundaries. for every block the index has its time range, and for every
+// hostname and word the blocks it shows up in.
+package index
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/zspekt/tcpLogger/internal/syslog"
+)
+
+// Suffix is added to the name of a log file to get the name of its index.
+const Suffix string = ".idx"
+
+const (
+	version   int   = 1
+	blockSize int64 = 64 * 1024
+	headSize  int64 = 4096 // what's hashed to tell a file from the one it replaced
+	minWord   int   = 3
+	maxWord   int   = 64
+)
+
+var StaleError error = errors.New("index doesn't match its file")
+
+// State is what's known about a line, carried over to the lines after it
+// that have no syslog header, like the rest of a multi-line message.
+type State struct {
+	TS       int64  `json:"ts,omitempty"` // unix nanoseconds. 0 if unknown
+	Host     string `json:"host,omitempty"`
+	Severity int    `json:"severity"` // -1 if unknown
+}
+
+// Time is when the line was logged, zero if unknown.
+func (s State) Time() time.Time {
+	if s.TS == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, s.TS)
+}
+
+// Block is a stretch of a file. Start is the state of the line before it.
+type Block struct {
+	Offset int64 `json:"offset"`
+	Start  State `json:"start"`
+	First  int64 `json:"first,omitempty"` // time range of its lines, in unix nanoseconds
+	Last   int64 `json:"last,omitempty"`
+}
+
+// Index describes the first Size bytes of a log file, or of what it
+// decompresses to if it's gzipped.
+type Index struct {
+	Version int      `json:"version"`
+	Size    int64    `json:"size"`
+	Head    uint32   `json:"head"`            // crc32 of the first headSize bytes
+	End     State    `json:"end"`             // state of the last line
+	First   int64    `json:"first,omitempty"` // time range of its lines, in unix nanoseconds
+	Last    int64    `json:"last,omitempty"`
+	Sources []string `json:"sources"` // hostnames, sorted
+	Blocks  []Block  `json:"blocks"`
+
+	Hosts map[string][]int `json:"hosts"` // hostname to the blocks it's in
+	Words map[string][]int `json:"words"` // lowercased word to the blocks it's in
+
+	head []byte // the first headSize bytes, while they're being read
+}
+
+// Span is a stretch of a file to read. End is -1 for up to the end of it.
+type Span struct {
+	Start, End int64
+	State      State
+}
+
+// Query is what a search looks for. only what can be told from an Index is
+// here, the lines still have to be matched one by one.
+type Query struct {
+	Since, Until time.Time // zero for no bound. Until is exclusive
+	Host         string    // empty for any
+	Words        []string  // every one of them. see Words
+}
+
+// Spans returns the stretches of the file that might hold lines matching
+// q, in order. whatever was written after the index is always included.
+func (idx *Index) Spans(q Query) []Span {
+	var spans []Span
+	add := func(start, end int64, state State) {
+		if n := len(spans); n > 0 && spans[n-1].End == start {
+			spans[n-1].End = end
+			return
+		}
+		spans = append(spans, Span{Start: start, End: end, State: state})
+	}
+
+	candidates := idx.candidates(q)
+	for i, b := range idx.Blocks {
+		if i == 0 && !q.overlaps(Block{First: idx.First, Last: idx.Last}) {
+			break // nothing in the whole file
+		}
+		if !candidates[i] || !q.overlaps(b) {
+			continue
+		}
+		end := idx.Size
+		if i+1 < len(idx.Blocks) {
+			end = idx.Blocks[i+1].Offset
+		}
+		add(b.Offset, end, b.Start)
+	}
+	add(idx.Size, -1, idx.End)
+	return spans
+}
+
+// candidates are the blocks holding the host and every word of q. words too
+// short to be indexed can't rule anything out.
+func (idx *Index) candidates(q Query) []bool {
+	c := make([]bool, len(idx.Blocks))
+	for i := range c {
+		c[i] = true
+	}
+	keep := func(blocks []int) {
+		in := make([]bool, len(c))
+		for _, i := range blocks {
+			in[i] = true
+		}
+		for i := range c {
+			c[i] = c[i] && in[i]
+		}
+	}
+	if q.Host != "" {
+		keep(idx.Hosts[q.Host])
+	}
+	for _, w := range q.Words {
+		if len(w) >= minWord && len(w) <= maxWord {
+			keep(idx.Words[w])
+		}
+	}
+	return c
+}
+
+func (q *Query) overlaps(b Block) bool {
+	if q.Since.IsZero() && q.Until.IsZero() {
+		return true
+	}
+	if b.First == 0 { // no line of it has a known time
+		return false
+	}
+	if !q.Since.IsZero() && b.Last < q.Since.UnixNano() {
+		return false
+	}
+	return q.Until.IsZero() || b.First < q.Until.UnixNano()
+}
+
+// Words splits s into lowercased words, runs of letters and digits, the way
+// lines are indexed.
+func Words(s string) []string {
+	var words []string
+	eachWord(s, func(w string) { words = append(words, w) })
+	return words
+}
+
+func eachWord(s string, fn func(string)) {
+	start := -1
+	for i := 0; i <= len(s); {
+		r, size := rune(-1), 1
+		if i < len(s) {
+			r, size = utf8.DecodeRuneInString(s[i:])
+		}
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			fn(strings.ToLower(s[start:i]))
+			start = -1
+		}
+		i += size
+	}
+}
+
+// HasWords reports whether every one of words is a word of line.
+func HasWords(line []byte, words []string) bool {
+	if len(words) == 0 {
+		return true
+	}
+	found := make(map[string]bool, len(words))
+	for _, w := range words {
+		found[w] = false
+	}
+	left := len(words)
+	eachWord(string(line), func(w string) {
+		if seen, ok := found[w]; ok && !seen {
+			found[w] = true
+			left--
+		}
+	})
+	return left <= 0
+}
+
+// Path is where the index of file is kept.
+func Path(file string) string {
+	return file + Suffix
+}
+
+// Load reads the index of file, without checking it's up to date.
+func Load(file string) (*Index, error) {
+	b, err := os.ReadFile(Path(file))
+	if err != nil {
+		return nil, err
+	}
+	idx := &Index{}
+	if err := json.Unmarshal(b, idx); err != nil {
+		return nil, err
+	}
+	if idx.Version != version {
+		return nil, StaleError
+	}
+	if idx.Hosts == nil {
+		idx.Hosts = make(map[string][]int)
+	}
+	if idx.Words == nil {
+		idx.Words = make(map[string][]int)
+	}
+	return idx, nil
+}
+
+// Save writes idx as the index of file, replacing whatever was there.
+func (idx *Index) Save(file string) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*"+Suffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // a no-op once it's renamed
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), Path(file))
+}
+
+// Update brings idx, the index of file, up to date and reports whether it
+// had to change. idx may be nil, or stale, in which case the index is
+// built from scratch. a plain file that only grew is indexed from where idx
+// left off.
+func Update(file string, idx *Index) (*Index, bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var r io.Reader = f
+	if strings.HasSuffix(file, ".gz") {
+		// gzipped backups never change, there's nothing to check
+		if idx != nil {
+			return idx, false, nil
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, false, err
+		}
+		defer gz.Close()
+		r = gz
+	} else if idx != nil {
+		switch head, ok, err := idx.matches(f, fi.Size()); {
+		case err != nil:
+			return nil, false, err
+		case !ok:
+			idx = nil
+		case fi.Size() == idx.Size:
+			return idx, false, nil
+		default:
+			if _, err := f.Seek(idx.Size, io.SeekStart); err != nil {
+				return nil, false, err
+			}
+			if idx.Size < headSize {
+				idx.head = head
+			}
+		}
+	}
+	fresh := idx == nil
+	if fresh {
+		idx = &Index{
+			Version: version,
+			End:     State{Severity: -1},
+			Hosts:   make(map[string][]int),
+			Words:   make(map[string][]int),
+		}
+	}
+	size := idx.Size
+	if err := idx.read(r, fi.ModTime()); err != nil {
+		return nil, false, err
+	}
+	// nothing more if all there is is the start of a line
+	return idx, fresh || idx.Size != size, nil
+}
+
+// matches reports whether idx is the index of f, or of what f was before
+// more was written to it. it returns what the head was checked against.
+func (idx *Index) matches(f *os.File, size int64) ([]byte, bool, error) {
+	if size < idx.Size {
+		return nil, false, nil
+	}
+	head := make([]byte, min(idx.Size, headSize), headSize)
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return nil, false, err
+	}
+	return head, crc32.ChecksumIEEE(head) == idx.Head, nil
+}
+
+// read indexes the lines of r, which starts at idx.Size. a last line
+// without a newline is left for next time, it's probably still being
+// written.
+func (idx *Index) read(r io.Reader, ref time.Time) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	off := idx.Size
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		idx.add(line, off, ref)
+		off += int64(len(line))
+	}
+	idx.Size = off
+	if idx.head != nil {
+		idx.Head = crc32.ChecksumIEEE(idx.head)
+		idx.head = nil
+	}
+	sort.Strings(idx.Sources)
+	return nil
+}
+
+func (idx *Index) add(line []byte, off int64, ref time.Time) {
+	if off < headSize {
+		if idx.head == nil {
+			idx.head = make([]byte, 0, headSize)
+		}
+		idx.head = append(idx.head, line[:min(int64(len(line)), headSize-off)]...)
+	}
+
+	// new blocks start at a line with a header, unless there's been none
+	// for a while, so they rarely need the state they start with
+	h, err := syslog.Parse(line)
+	n := len(idx.Blocks)
+	if n == 0 || (off-idx.Blocks[n-1].Offset >= blockSize && (err == nil || off-idx.Blocks[n-1].Offset >= 4*blockSize)) {
+		idx.Blocks = append(idx.Blocks, Block{Offset: off, Start: idx.End})
+		n++
+		if idx.End.Host != "" {
+			idx.post(idx.Hosts, idx.End.Host, n-1)
+		}
+	}
+	b := &idx.Blocks[n-1]
+
+	if err == nil {
+		ts, _ := syslog.Timestamp(line, ref)
+		idx.End = State{Host: h.Hostname, Severity: h.Severity}
+		if !ts.IsZero() {
+			idx.End.TS = ts.UnixNano()
+		}
+		if h.Hostname != "" {
+			if _, ok := idx.Hosts[h.Hostname]; !ok {
+				idx.Sources = append(idx.Sources, h.Hostname)
+			}
+			idx.post(idx.Hosts, h.Hostname, n-1)
+		}
+	}
+	if ts := idx.End.TS; ts != 0 {
+		b.First, b.Last = widen(b.First, b.Last, ts)
+		idx.First, idx.Last = widen(idx.First, idx.Last, ts)
+	}
+	eachWord(string(line), func(w string) {
+		if len(w) >= minWord && len(w) <= maxWord {
+			idx.post(idx.Words, w, n-1)
+		}
+	})
+}
+
+// widen returns the range from first to last, stretched to take in ts.
+func widen(first, last, ts int64) (int64, int64) {
+	if first == 0 || ts < first {
+		first = ts
+	}
+	return first, max(last, ts)
+}
+
+// post adds block to the blocks of key, unless it's there already.
+func (idx *Index) post(m map[string][]int, key string, block int) {
+	blocks := m[key]
+	if len(blocks) > 0 && blocks[len(blocks)-1] == block {
+		return
+	}
+	m[key] = append(blocks, block)
+}
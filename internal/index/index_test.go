@@ -0,0 +1,244 @@
+package index
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lines returns n syslog lines from host, a minute apart from start, with
+// a continuation line after every tenth one.
+func lines(host string, start time.Time, n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		ts := start.Add(time.Duration(i) * time.Minute).Format(time.RFC3339)
+		fmt.Fprintf(&b, "<14>1 %v %v app - - - message number %06d from %v with some padding to fill the blocks\n", ts, host, i, host)
+		if i%10 == 0 {
+			b.WriteString(" continued\n")
+		}
+	}
+	return b.String()
+}
+
+func write(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func update(t *testing.T, path string, idx *Index) (*Index, bool) {
+	t.Helper()
+	idx, changed, err := Update(path, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idx, changed
+}
+
+// read returns what spans holds, the way a search would read it.
+func read(t *testing.T, path string, spans []Span) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	for _, sp := range spans {
+		end := sp.End
+		if end < 0 {
+			end = int64(len(data))
+		}
+		b.Write(data[sp.Start:end])
+	}
+	return b.String()
+}
+
+func TestWords(t *testing.T) {
+	got := Words("Link DOWN on ge-0/0/1, état=rouge")
+	want := []string{"link", "down", "on", "ge", "0", "0", "1", "état", "rouge"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Words() = %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		line  string
+		words []string
+		want  bool
+	}{
+		{line: "link down on ge-0/0/1", words: nil, want: true},
+		{line: "link down on ge-0/0/1", words: []string{"down", "link"}, want: true},
+		{line: "link down on ge-0/0/1", words: []string{"down", "up"}, want: false},
+		{line: "linkdown", words: []string{"link"}, want: false},
+	}
+	for _, tt := range tests {
+		if got := HasWords([]byte(tt.line), tt.words); got != tt.want {
+			t.Errorf("HasWords(%q, %q) = %v, want %v", tt.line, tt.words, got, tt.want)
+		}
+	}
+}
+
+func TestIndex_Spans(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "app.log")
+	write(t, path, lines("router", start, 3000)+lines("switch", start.Add(3000*time.Minute), 3000))
+	idx, _ := update(t, path, nil)
+	if len(idx.Blocks) < 4 {
+		t.Fatalf("got %v blocks, want a file big enough for several", len(idx.Blocks))
+	}
+	if want := []string{"router", "switch"}; !reflect.DeepEqual(idx.Sources, want) {
+		t.Errorf("Sources = %q, want %q", idx.Sources, want)
+	}
+
+	tests := []struct {
+		name     string
+		q        Query
+		want     []string // has to be read
+		wantSkip []string // doesn't have to be
+	}{
+		{
+			name: "everything",
+			q:    Query{},
+			want: []string{"000000 from router", "002999 from switch"},
+		},
+		{
+			name:     "time range",
+			q:        Query{Since: start.Add(100 * time.Minute), Until: start.Add(110 * time.Minute)},
+			want:     []string{"000100 from router", "000109 from router"},
+			wantSkip: []string{"002000 from router", "000100 from switch"},
+		},
+		{
+			name:     "host",
+			q:        Query{Host: "switch"},
+			want:     []string{"000000 from switch", "002999 from switch"},
+			wantSkip: []string{"001000 from router"},
+		},
+		{
+			name:     "word",
+			q:        Query{Words: []string{"001234"}},
+			want:     []string{"001234 from router", "001234 from switch"},
+			wantSkip: []string{"000000 from router", "002000 from switch"},
+		},
+		{
+			name:     "word and host",
+			q:        Query{Host: "router", Words: []string{"001234"}},
+			want:     []string{"001234 from router"},
+			wantSkip: []string{"001234 from switch"},
+		},
+		{
+			name:     "nothing",
+			q:        Query{Since: start.Add(-time.Hour), Until: start.Add(-time.Minute)},
+			wantSkip: []string{"000000 from router"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spans := idx.Spans(tt.q)
+			if last := spans[len(spans)-1]; last.End != -1 {
+				t.Errorf("last span = %+v, want it to run to the end of the file", last)
+			}
+			got := read(t, path, spans)
+			for _, w := range tt.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("spans %+v leave out %q", spans, w)
+				}
+			}
+			for _, w := range tt.wantSkip {
+				if strings.Contains(got, w) {
+					t.Errorf("spans %+v take in %q", spans, w)
+				}
+			}
+		})
+	}
+
+	// a span starts where a line starts, and knows what came before it
+	for _, sp := range idx.Spans(Query{Host: "switch"}) {
+		if sp.Start > 0 && sp.Start < idx.Size {
+			if got := read(t, path, []Span{{Start: sp.Start - 1, End: sp.Start}}); got != "\n" {
+				t.Errorf("span %+v doesn't start at a line", sp)
+			}
+			if sp.State.TS == 0 || sp.State.Severity != 6 {
+				t.Errorf("span %+v doesn't carry the state of the line before it", sp)
+			}
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+
+	write(t, path, "<14>1 2024-01-01T00:00:00Z router app - - - first\n<14>1 2024-01-01T00:01:00Z router app - - - still being writ")
+	idx, changed := update(t, path, nil)
+	if !changed || idx.Size != int64(len("<14>1 2024-01-01T00:00:00Z router app - - - first\n")) {
+		t.Fatalf("Update() = size %v, changed %v. want only the complete line indexed", idx.Size, changed)
+	}
+	if err := idx.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("unchanged", func(t *testing.T) {
+		loaded, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, changed := update(t, path, loaded); changed {
+			t.Error("Update() changed an index of a file that didn't change")
+		}
+	})
+
+	t.Run("grew", func(t *testing.T) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString("ten\n" + lines("switch", start, 1000))
+		f.Close()
+
+		loaded, _ := Load(path)
+		grown, changed := update(t, path, loaded)
+		fresh, _ := update(t, path, nil)
+		if !changed {
+			t.Fatal("Update() didn't change the index of a file that grew")
+		}
+		if !reflect.DeepEqual(grown, fresh) {
+			t.Errorf("extending an index got %+v, want what indexing from scratch does, %+v", grown.Blocks, fresh.Blocks)
+		}
+	})
+
+	t.Run("rotated", func(t *testing.T) {
+		old, _ := update(t, path, nil)
+		write(t, path, lines("firewall", start, 2000)) // a new file, bigger than the old one
+		idx, changed := update(t, path, old)
+		if !changed {
+			t.Fatal("Update() didn't rebuild the index of a file that was replaced")
+		}
+		if want := []string{"firewall"}; !reflect.DeepEqual(idx.Sources, want) {
+			t.Errorf("Sources = %q, want %q", idx.Sources, want)
+		}
+	})
+
+	t.Run("gzipped", func(t *testing.T) {
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		zw.Write([]byte(lines("router", start, 100)))
+		zw.Close()
+		gzPath := filepath.Join(dir, "app-2024-01-01T00-00-00.000.log.gz")
+		write(t, gzPath, gz.String())
+
+		idx, changed := update(t, gzPath, nil)
+		if !changed || idx.Size != int64(len(lines("router", start, 100))) {
+			t.Fatalf("Update() = size %v, changed %v. want the decompressed file indexed", idx.Size, changed)
+		}
+		if _, changed := update(t, gzPath, idx); changed {
+			t.Error("Update() changed the index of a gzipped file")
+		}
+	})
+}
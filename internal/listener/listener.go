@@ -0,0 +1,250 @@
+package listener
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+)
+
+const (
+	FramingLF    string = "lf"    // one message per line
+	FramingOctet string = "octet" // RFC 6587 octet counting, "<len> <msg>"
+	FramingAuto  string = "auto"  // octet counting for messages starting with a digit, lf otherwise
+)
+
+// MaxOctetCount is the biggest message octet counting framing accepts.
+const MaxOctetCount int = 1024 * 1024
+
+var InvalidOctetCountError error = errors.New("invalid octet count")
+
+// Config describes a single listener.
+type Config struct {
+	Name      string
+	Network   string      // tcp, tls, udp, unix or unixgram
+	Address   string      // host:port, or the socket path for unix and unixgram
+	TLSConfig *tls.Config // only for tls, needs a certificate
+	Framing   string      // FramingLF if empty. ignored for udp and unixgram, where every datagram is a message
+
+	// V6Only makes a listener bound to an IPv6 address, like [::]:514, only
+	// accept IPv6. by default it's dual-stack and gets IPv4 as well
+	V6Only bool
+
+	// for unix and unixgram. a stale socket left at Address is removed
+	// before binding, and the socket is removed again on shutdown
+	Mode  os.FileMode // permissions of the socket. 0 leaves them to the umask
+	Owner string      // user name or uid. empty leaves it alone
+	Group string      // group name or gid. empty leaves it alone
+
+	// Allow lists the addresses that may send to this listener. empty
+	// allows everyone. not for unix and unixgram, use Mode and Owner
+	Allow []netip.Prefix
+
+	// ProxyProtocol reads a PROXY protocol v1 or v2 header off connections
+	// from TrustedProxies, and takes the client address from it. it's what
+	// Allow, routing and the message source see. other peers are taken as
+	// direct clients, so they can't claim to be someone else. tcp and tls
+	// only
+	ProxyProtocol  bool
+	TrustedProxies []netip.Prefix
+
+	// Output is the sink every message from this listener is routed to.
+	// empty means the default ones. a route rule can still change it
+	Output string
+
+	// Listener is used instead of binding Address, if set. only for tcp,
+	// tls, in which case it's wrapped with TLSConfig, and unix
+	Listener net.Listener
+	// PacketConn is the same for udp and unixgram
+	PacketConn net.PacketConn
+}
+
+// Validate checks everything that can be checked without binding.
+func (c *Config) Validate() error {
+	switch c.Network {
+	case "tcp", "udp":
+	case "unix", "unixgram":
+		if len(c.Allow) > 0 {
+			return errors.New("allow doesn't apply to unix sockets")
+		}
+	case "tls":
+		if c.TLSConfig == nil || (len(c.TLSConfig.Certificates) == 0 && c.TLSConfig.GetCertificate == nil) {
+			return errors.New("tls listener needs a certificate")
+		}
+	default:
+		return fmt.Errorf("invalid network <%v>", c.Network)
+	}
+	switch c.Framing {
+	case "", FramingLF, FramingOctet, FramingAuto:
+	default:
+		return fmt.Errorf("invalid framing <%v>", c.Framing)
+	}
+	if c.Listener == nil && c.PacketConn == nil && c.Address == "" {
+		return errors.New("no address")
+	}
+	if c.Mode&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid mode <%v>", c.Mode)
+	}
+	if !c.IsUnix() && (c.Mode != 0 || c.Owner != "" || c.Group != "") {
+		return errors.New("mode, owner and group only apply to unix sockets")
+	}
+	if c.IsUnix() && c.V6Only {
+		return errors.New("v6only doesn't apply to unix sockets")
+	}
+	if c.ProxyProtocol {
+		if c.Network != "tcp" && c.Network != "tls" {
+			return errors.New("proxy protocol only applies to tcp and tls")
+		}
+		if len(c.TrustedProxies) == 0 {
+			return errors.New("proxy protocol needs trusted proxies")
+		}
+	}
+	return nil
+}
+
+// IsPacket reports whether the listener reads datagrams rather than
+// accepting connections.
+func (c *Config) IsPacket() bool {
+	return c.Network == "udp" || c.Network == "unixgram"
+}
+
+// IsUnix reports whether the listener is a unix socket.
+func (c *Config) IsUnix() bool {
+	return c.Network == "unix" || c.Network == "unixgram"
+}
+
+// Allowed reports whether addr may send to this listener.
+func (c *Config) Allowed(addr net.Addr) bool {
+	if len(c.Allow) == 0 {
+		return true
+	}
+	return contains(c.Allow, addr)
+}
+
+// Trusted reports whether a PROXY protocol header from addr is to be
+// believed.
+func (c *Config) Trusted(addr net.Addr) bool {
+	return c.ProxyProtocol && contains(c.TrustedProxies, addr)
+}
+
+func contains(prefixes []netip.Prefix, addr net.Addr) bool {
+	ap, ok := addrPort(addr)
+	if !ok {
+		return false
+	}
+	ip := ap.Addr().WithZone("") // a prefix never matches a zoned address
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerAddr is how the address of a peer is written down everywhere a
+// message goes: IPv4 peers of a dual-stack listener as plain IPv4, and
+// IPv6 ones in brackets, with their zone if they have one.
+func PeerAddr(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if ap, ok := addrPort(addr); ok {
+		return ap.String()
+	}
+	return addr.String()
+}
+
+// addrPort returns the address of a tcp or udp peer, with v4-mapped
+// addresses turned into plain IPv4.
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	var ap netip.AddrPort
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	case *net.UDPAddr:
+		ap = a.AddrPort()
+	default:
+		return ap, false
+	}
+	if !ap.Addr().IsValid() {
+		return ap, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+// ParsePrefix parses a CIDR, or a single IP as a prefix holding only itself.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if p, err := netip.ParsePrefix(s); err == nil {
+		return p.Masked(), nil
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address <%v>", s)
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// Reader splits a stream into messages according to its framing. octet
+// counted messages get a newline appended if they don't end with one, so
+// they come out one per line like the rest.
+type Reader struct {
+	framing string
+	r       *bufio.Reader
+}
+
+func NewReader(framing string, r io.Reader) *Reader {
+	return &Reader{framing: framing, r: bufio.NewReader(r)}
+}
+
+// ReadBytes reads the next message. delim is only used for messages that
+// aren't octet counted. like bufio.Reader.ReadBytes, it may return part of
+// a message along with an error.
+func (r *Reader) ReadBytes(delim byte) ([]byte, error) {
+	switch r.framing {
+	case FramingOctet:
+		return r.readOctet()
+	case FramingAuto:
+		b, err := r.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		// syslog messages start with '<', so a digit can only be a count
+		if b[0] >= '0' && b[0] <= '9' {
+			return r.readOctet()
+		}
+	}
+	return r.r.ReadBytes(delim)
+}
+
+func (r *Reader) readOctet() ([]byte, error) {
+	prefix, err := r.r.ReadSlice(' ')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("%w: no space after the count", InvalidOctetCountError)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	count := string(prefix[:len(prefix)-1])
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 || n > MaxOctetCount {
+		return nil, fmt.Errorf("%w: <%q>", InvalidOctetCountError, count)
+	}
+
+	msg := make([]byte, n, n+1)
+	read, err := io.ReadFull(r.r, msg)
+	msg = msg[:read]
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	if len(msg) > 0 && msg[len(msg)-1] != '\n' {
+		msg = append(msg, '\n')
+	}
+	return msg, err
+}
@@ -0,0 +1,162 @@
+package listener
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		framing string
+		in      string
+		want    []string
+		wantErr error // returned after the last message
+	}{
+		{
+			name:    "lf",
+			framing: FramingLF,
+			in:      "one\ntwo\n",
+			want:    []string{"one\n", "two\n"},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "octet",
+			framing: FramingOctet,
+			in:      "3 one5 two\n",
+			want:    []string{"one\n", "two\n"},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "octet with a newline inside",
+			framing: FramingOctet,
+			in:      "7 one\ntwo",
+			want:    []string{"one\ntwo\n"},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "octet cut short",
+			framing: FramingOctet,
+			in:      "10 one",
+			want:    []string{"one\n"},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "octet bad count",
+			framing: FramingOctet,
+			in:      "<13>one two\n",
+			wantErr: InvalidOctetCountError,
+		},
+		{
+			name:    "auto",
+			framing: FramingAuto,
+			in:      "<13>one\n7 <13>two<13>three\n",
+			want:    []string{"<13>one\n", "<13>two\n", "<13>three\n"},
+			wantErr: io.EOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(tt.framing, strings.NewReader(tt.in))
+			var (
+				got []string
+				err error
+			)
+			for err == nil {
+				var b []byte
+				b, err = r.ReadBytes('\n')
+				if len(b) > 0 {
+					got = append(got, string(b))
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ReadBytes() got error %v, want %v", err, tt.wantErr)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("ReadBytes() got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_Allowed(t *testing.T) {
+	allow := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+	tests := []struct {
+		name  string
+		allow []netip.Prefix
+		addr  net.Addr
+		want  bool
+	}{
+		{"no list", nil, &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, true},
+		{"v4 in", allow, &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, true},
+		{"v4 out", allow, &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, false},
+		{"v4 mapped", allow, &net.UDPAddr{IP: net.ParseIP("::ffff:10.1.2.3")}, true},
+		{"v6 in", allow, &net.UDPAddr{IP: net.ParseIP("2001:db8::1")}, true},
+		{"v6 out", allow, &net.UDPAddr{IP: net.ParseIP("2001:db9::1")}, false},
+		{"v6 zoned", allow, &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Zone: "eth0"}, true},
+		{"unix", allow, &net.UnixAddr{Name: "/run/x.sock", Net: "unix"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Allow: tt.allow}
+			if got := c.Allowed(tt.addr); got != tt.want {
+				t.Errorf("Allowed(%v) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{in: "10.1.2.3/8", want: "10.0.0.0/8"},
+		{in: "10.1.2.3", want: "10.1.2.3/32"},
+		{in: "2001:db8::1", want: "2001:db8::1/128"},
+		{in: "::ffff:10.1.2.3", want: "10.1.2.3/32"},
+		{in: "router", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParsePrefix(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePrefix() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("ParsePrefix() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeerAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		addr net.Addr
+		want string
+	}{
+		{"nil", nil, ""},
+		{"v4", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 514}, "192.0.2.1:514"},
+		{"v4-mapped", &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 514}, "192.0.2.1:514"},
+		{"v6", &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 514}, "[2001:db8::1]:514"},
+		{"v6 zoned", &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 514, Zone: "eth0"}, "[fe80::1%eth0]:514"},
+		{"unix", &net.UnixAddr{Name: "/run/x.sock", Net: "unix"}, "/run/x.sock"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PeerAddr(tt.addr); got != tt.want {
+				t.Errorf("PeerAddr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
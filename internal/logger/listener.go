@@ -0,0 +1,302 @@
+package logger
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/listener"
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/proxyproto"
+)
+
+// maxDatagram is the biggest UDP payload there is.
+const maxDatagram int = 65535
+
+// proxyHeaderTimeout is how long a trusted proxy gets to send the PROXY
+// protocol header.
+const proxyHeaderTimeout time.Duration = 10 * time.Second
+
+// ListenError is a listener that couldn't be bound. the server still runs
+// with the ones that could.
+type ListenError struct {
+	Name string
+	Err  error
+}
+
+func (e *ListenError) Error() string {
+	return fmt.Sprintf("listener <%v>: %v", e.Name, e.Err)
+}
+
+func (e *ListenError) Unwrap() error {
+	return e.Err
+}
+
+// boundListener is a listener.Config that was bound. only one of stream or
+// packet is set. tls is done per connection, see serveConn.
+type boundListener struct {
+	cfg      listener.Config
+	stream   net.Listener
+	packet   net.PacketConn
+	socket   string // path of a unix socket we created, removed on close
+	pipeline *pipeline
+}
+
+func bind(cfg listener.Config) (*boundListener, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	ownSocket := cfg.IsUnix() && cfg.Listener == nil && cfg.PacketConn == nil
+	if ownSocket {
+		if err := removeStaleSocket(cfg.Network, cfg.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	lc := net.ListenConfig{}
+	if cfg.V6Only {
+		lc.Control = setV6Only
+	}
+
+	bl := &boundListener{cfg: cfg}
+	if cfg.IsPacket() {
+		pc := cfg.PacketConn
+		if pc == nil {
+			var err error
+			if pc, err = lc.ListenPacket(context.Background(), cfg.Network, cfg.Address); err != nil {
+				return nil, err
+			}
+		}
+		bl.packet = pc
+	} else {
+		l := cfg.Listener
+		if l == nil {
+			network := cfg.Network
+			if network == "tls" {
+				network = "tcp"
+			}
+			var err error
+			if l, err = lc.Listen(context.Background(), network, cfg.Address); err != nil {
+				return nil, err
+			}
+		}
+		bl.stream = l
+	}
+
+	if ownSocket {
+		bl.socket = cfg.Address
+		if err := setSocketPerms(cfg.Address, cfg.Mode, cfg.Owner, cfg.Group); err != nil {
+			bl.close()
+			return nil, err
+		}
+	}
+	return bl, nil
+}
+
+// setV6Only is a net.ListenConfig.Control that turns dual-stack off on IPv6
+// sockets. Go turns it on for "tcp" and "udp", and IPv4 sockets don't have
+// the option at all.
+func setV6Only(network, address string, c syscall.RawConn) error {
+	if !strings.HasSuffix(network, "6") {
+		return nil
+	}
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func (bl *boundListener) addr() net.Addr {
+	if bl.packet != nil {
+		return bl.packet.LocalAddr()
+	}
+	return bl.stream.Addr()
+}
+
+// file returns a dup of the socket, for handing it to another process.
+func (bl *boundListener) file() (*os.File, error) {
+	var s any = bl.stream
+	if bl.packet != nil {
+		s = bl.packet
+	}
+	f, ok := s.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("can't get a file out of a %T", s)
+	}
+	return f.File()
+}
+
+func (bl *boundListener) close() error {
+	var err error
+	if bl.packet != nil {
+		err = bl.packet.Close()
+	} else {
+		err = bl.stream.Close()
+	}
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	// a unix listener removes its socket on its own, a unixgram one doesn't
+	if bl.socket != "" {
+		if rmErr := os.Remove(bl.socket); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) && err == nil {
+			err = rmErr
+		}
+	}
+	return err
+}
+
+// accept hands every connection it accepts to a handler, until the listener
+// is closed or ctx is canceled.
+func (s *Server) accept(ctx context.Context, bl *boundListener) {
+	for {
+		slog.Debug("Server.accept(): running main loop...", "listener", bl.cfg.Name)
+		conn, err := AcceptWithCtx(bl.stream, ctx)
+		if err != nil {
+			if errors.Is(err, shutdownErr) {
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("Server.accept(): error accepting connection", "listener", bl.cfg.Name, "error", err)
+			continue
+		}
+		slog.Debug("Server.accept(): accepted connection without error", "listener", bl.cfg.Name)
+		p := s.conns.add(conn, bl.cfg.Name)
+		go func() {
+			defer s.conns.remove(p)
+			s.serveConn(bl, conn, p)
+		}()
+	}
+}
+
+// serveConn reads the PROXY protocol header, if conn is from a trusted
+// proxy, checks the client is allowed, and starts tls if it's a tls
+// listener, before handing it over to handleConnWithCtx. all of that
+// happens here rather than in accept, so a slow peer only holds up itself.
+func (s *Server) serveConn(bl *boundListener, conn net.Conn, p *peer) {
+	if bl.cfg.Trusted(conn.RemoteAddr()) {
+		pc, err := readProxyHeader(conn)
+		if err != nil {
+			slog.Error(
+				"Server.serveConn(): error reading PROXY protocol header. closing connection...",
+				"listener", bl.cfg.Name,
+				"proxy", listener.PeerAddr(conn.RemoteAddr()),
+				"error", err,
+			)
+			conn.Close()
+			return
+		}
+		// shutdown may have set a deadline of its own by now
+		s.conns.resetReadDeadline(p)
+		conn = pc
+		p.setRemote(conn.RemoteAddr())
+	}
+
+	if !bl.cfg.Allowed(conn.RemoteAddr()) {
+		slog.Warn(
+			"Server.serveConn(): connection not allowed. closing it...",
+			"listener", bl.cfg.Name,
+			"source", listener.PeerAddr(conn.RemoteAddr()),
+		)
+		s.denied.Add(1)
+		conn.Close()
+		return
+	}
+
+	if bl.cfg.Network == "tls" {
+		conn = tls.Server(conn, bl.cfg.TLSConfig)
+	}
+	s.handlerDropped.Add(int64(handleConnWithCtx(conn, s.ch, bl.pipeline, p, s.hardCtx)))
+}
+
+// proxyConn is a connection that came through a proxy. it reports the
+// client's address as its remote one.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader // holds whatever was read past the header
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	r := bufio.NewReader(conn)
+	src, err := proxyproto.ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if src == nil { // the proxy talking for itself, like a health check
+		src = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, r: r, remote: src}, nil
+}
+
+// readPackets turns every datagram into a message, until the conn is
+// closed or ctx is canceled. there's no connection to give a grace period
+// to, so closing it is all shutdown does.
+func (s *Server) readPackets(ctx context.Context, bl *boundListener) {
+	stop := context.AfterFunc(ctx, func() { bl.close() })
+	defer stop()
+
+	buf := make([]byte, maxDatagram)
+	for {
+		bl.pipeline.wait(ctx)
+		n, addr, err := bl.packet.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("Server.readPackets(): error reading datagram", "listener", bl.cfg.Name, "error", err)
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+		if addr != nil && !bl.cfg.Allowed(addr) {
+			slog.Debug("Server.readPackets(): datagram not allowed. dropping it", "listener", bl.cfg.Name, "source", listener.PeerAddr(addr))
+			s.denied.Add(1)
+			continue
+		}
+
+		data := make([]byte, n, n+1)
+		copy(data, buf[:n])
+		if data[n-1] != '\n' {
+			data = append(data, '\n')
+		}
+		// unixgram senders usually don't bind a name of their own
+		source := listener.PeerAddr(addr)
+		if source == "" {
+			source = bl.cfg.Address
+		}
+		m := &message.Message{Data: data, Source: source, Received: time.Now()}
+		if !bl.pipeline.process(m) {
+			continue
+		}
+		select {
+		case s.ch <- m:
+		case <-s.hardCtx.Done():
+			s.handlerDropped.Add(1)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/zspekt/tcpLogger/internal/listener"
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/output"
+	"github.com/zspekt/tcpLogger/internal/redact"
+)
+
+var benchLine = []byte("<14>1 2024-05-01T12:00:00.000000Z router dnsmasq 1234 - - query[A] example.com from 192.168.1.23\n")
+
+// benchPayload is n copies of benchLine, octet counted or not.
+func benchPayload(n int, octet bool) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		if octet {
+			buf.WriteString(strconv.Itoa(len(benchLine)) + " ")
+		}
+		buf.Write(benchLine)
+	}
+	return buf.Bytes()
+}
+
+// the read path: splitting a connection into messages and running them
+// through the pipeline
+func BenchmarkHandleConn(b *testing.B) {
+	var rules []redact.Rule
+	for _, d := range redact.Detectors {
+		rules = append(rules, redact.Rule{Detector: d, Mode: redact.ModeHMAC})
+	}
+	redactor, err := redact.New(redact.Config{Rules: rules, Key: []byte("bench key")})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarks := []struct {
+		name string
+		p    *pipeline
+	}{
+		{name: "lf", p: &pipeline{framing: listener.FramingLF}},
+		{name: "octet", p: &pipeline{framing: listener.FramingOctet}},
+		{name: "auto", p: &pipeline{framing: listener.FramingAuto}},
+		{name: "syslog parsing", p: &pipeline{framing: listener.FramingLF, parser: SyslogParser{}}},
+		{name: "redaction", p: &pipeline{framing: listener.FramingLF, redactor: redactor}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			payload := benchPayload(b.N, bm.p.framing == listener.FramingOctet)
+			server, client := net.Pipe()
+			ch := make(chan *message.Message, 1024)
+			go func() {
+				client.Write(payload)
+				client.Close()
+			}()
+			go func() {
+				for range ch {
+				}
+			}()
+
+			b.SetBytes(int64(len(benchLine)))
+			b.ResetTimer()
+			handleConnWithCtx(server, ch, bm.p, nil, context.Background())
+			b.StopTimer()
+			close(ch)
+		})
+	}
+}
+
+// the write path: taking messages off the channel and writing them out
+func BenchmarkLogWithCtx(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		out  func(b *testing.B) output.Output
+	}{
+		{
+			name: "discard",
+			out:  func(*testing.B) output.Output { return output.NewWriter("discard", io.Discard) },
+		},
+		{
+			name: "file",
+			out: func(b *testing.B) output.Output {
+				return output.NewFile("file", &lumberjack.Logger{Filename: filepath.Join(b.TempDir(), "bench.log")})
+			},
+		},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			out := bm.out(b)
+			defer out.Close()
+			ch := make(chan *message.Message, 5) // same as the server's
+			done := make(chan struct{})
+			go func() {
+				logWithCtx(ch, out, context.Background())
+				close(done)
+			}()
+
+			b.SetBytes(int64(len(benchLine)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ch <- &message.Message{Data: benchLine, Received: time.Now()}
+			}
+			close(ch)
+			<-done
+		})
+	}
+}
@@ -3,17 +3,18 @@ package logger
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"io"
 	"log/slog"
 	"net"
 	"os"
 	"strings"
-	"syscall"
 	"testing"
 	"time"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 
+	"github.com/zspekt/tcpLogger/internal/listener"
 	"github.com/zspekt/tcpLogger/internal/setup"
 )
 
@@ -24,7 +25,6 @@ func Test_logger(t *testing.T) {
 		bytes         []byte
 		wantBytes     []byte
 		shutdownDelay time.Duration
-		signal        syscall.Signal
 		//
 		lineStop     int
 		lineStopSig  chan struct{}
@@ -34,9 +34,8 @@ func Test_logger(t *testing.T) {
 		shutdownSig  chan struct{}
 	}{
 		{
-			name: "succesfully logging text3. ending with SIGINT",
+			name: "succesfully logging text3",
 			arg: &setup.Cfg{
-				Port: "",
 				Logger: &lumberjack.Logger{
 					Filename:   "text3_test.txt",
 					MaxSize:    0,
@@ -45,13 +44,10 @@ func Test_logger(t *testing.T) {
 					LocalTime:  true,
 					Compress:   false,
 				},
-				Protocol: "tcp",
-				Address:  "",
 			},
 			bytes:         text3,
 			wantBytes:     text3,
 			shutdownDelay: 75 * time.Millisecond,
-			signal:        syscall.SIGINT,
 			lineStop:      5,
 			lineStopSig:   make(chan struct{}),
 			midPointStop:  5,
@@ -60,9 +56,8 @@ func Test_logger(t *testing.T) {
 			shutdownSig:   make(chan struct{}),
 		},
 		{
-			name: "succesfully logging text4. ending with SIGINT",
+			name: "succesfully logging text4",
 			arg: &setup.Cfg{
-				Port: "",
 				Logger: &lumberjack.Logger{
 					Filename:   "text4_test.txt",
 					MaxSize:    0,
@@ -71,13 +66,10 @@ func Test_logger(t *testing.T) {
 					LocalTime:  true,
 					Compress:   false,
 				},
-				Protocol: "tcp",
-				Address:  "",
 			},
 			bytes:         text4,
 			wantBytes:     text4,
 			shutdownDelay: 75 * time.Millisecond,
-			signal:        syscall.SIGINT,
 			lineStop:      7,
 			lineStopSig:   make(chan struct{}),
 			midPointStop:  10,
@@ -94,20 +86,20 @@ func Test_logger(t *testing.T) {
 			}
 			addr := strings.Split(l.Addr().String(), ":")
 			l.Close()
-			tt.arg.Address = addr[0]
-			tt.arg.Port = addr[1]
+			tt.arg.Listeners = []listener.Config{{Network: "tcp", Address: addr[0] + ":" + addr[1]}}
 
-			// we start a func that will send an INT/TERM sig, which shutdown()
-			// (called concurrently by Run() ) will catch and then notify
-			// both handleConn() and Run(), leading to a graceful shutdown.
+			// canceling ctx has Serve() shut down gracefully, like cmd.Run()
+			// does on SIGINT/SIGTERM
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
 			go func() {
 				time.Sleep(tt.shutdownDelay)
-				syscall.Kill(syscall.Getpid(), tt.signal)
+				cancel()
 			}()
 
 			go dialAndWrite(t, tt.bytes, addr[0]+":"+addr[1], 0, true)
 
-			Run(tt.arg)
+			serve(t, tt.arg, ctx)
 
 			got, err := os.ReadFile(tt.arg.Logger.Filename)
 			if err != nil {
@@ -130,13 +122,14 @@ func Test_logger(t *testing.T) {
 
 			addr := strings.Split(l.Addr().String(), ":")
 			l.Close()
-			tt.arg.Address = addr[0]
-			tt.arg.Port = addr[1]
+			tt.arg.Listeners = []listener.Config{{Network: "tcp", Address: addr[0] + ":" + addr[1]}}
 
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
 			go func() {
 				<-tt.lineStopSig
 				time.Sleep(50 * time.Millisecond)
-				syscall.Kill(syscall.Getpid(), tt.signal)
+				cancel()
 			}()
 
 			go func(t *testing.T, b []byte, addr string) {
@@ -147,7 +140,7 @@ func Test_logger(t *testing.T) {
 					proto = "tcp"
 					r     = bufio.NewReader(bytes.NewReader(b))
 				)
-				conn, err := net.Dial(proto, addr)
+				conn, err := dialRetry(proto, addr)
 				if err != nil {
 					slog.Error("failing from anon go func()", "error", err)
 					t.Fail()
@@ -180,7 +173,7 @@ func Test_logger(t *testing.T) {
 				addr[0]+":"+addr[1],
 			)
 
-			Run(tt.arg)
+			serve(t, tt.arg, ctx)
 
 			got, err := os.ReadFile(tt.arg.Logger.Filename)
 			if err != nil {
@@ -208,14 +201,15 @@ func Test_logger(t *testing.T) {
 
 			addr := strings.Split(l.Addr().String(), ":")
 			l.Close()
-			tt.arg.Address = addr[0]
-			tt.arg.Port = addr[1]
+			tt.arg.Listeners = []listener.Config{{Network: "tcp", Address: addr[0] + ":" + addr[1]}}
 
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
 			go func() {
 				<-tt.shutdownSig
 				slog.Info("test gofunc got shutdownSig")
 				time.Sleep(50 * time.Millisecond)
-				syscall.Kill(syscall.Getpid(), tt.signal)
+				cancel()
 			}()
 
 			go func(t *testing.T, b []byte, addr string) {
@@ -230,7 +224,7 @@ func Test_logger(t *testing.T) {
 					r     = bufio.NewReader(bytes.NewReader(b))
 				)
 
-				conn, err := net.Dial(proto, addr)
+				conn, err := dialRetry(proto, addr)
 				if err != nil {
 					slog.Error("failing from anon go func()", "error", err)
 					t.Fail()
@@ -263,7 +257,7 @@ func Test_logger(t *testing.T) {
 				<-tt.continueSig
 				slog.Info("dialAndWrite got continue sig...")
 
-				conn, err = net.Dial(proto, addr)
+				conn, err = dialRetry(proto, addr)
 				if err != nil {
 					slog.Error("failing from dialAndWrite()", "error", err)
 					t.Fail()
@@ -318,7 +312,7 @@ func Test_logger(t *testing.T) {
 				tt.continueSig <- struct{}{}
 			}()
 
-			Run(tt.arg)
+			serve(t, tt.arg, ctx)
 
 			got, err := os.ReadFile(tt.arg.Logger.Filename)
 			if err != nil {
@@ -337,6 +331,126 @@ func Test_logger(t *testing.T) {
 	}
 }
 
+// (FOR TESTING ONLY) serves c until ctx is canceled, and returns once the
+// server has shut down.
+func serve(t *testing.T, c *setup.Cfg, ctx context.Context) {
+	t.Helper()
+	s, err := NewServer(CfgOptions(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Serve(ctx)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	tests := []struct {
+		name      string
+		grace     time.Duration
+		timeout   time.Duration
+		lateLine  bool // sent after Shutdown() is called, but within the grace period
+		wantBytes []byte
+		maxTime   time.Duration // how long Shutdown() may take
+	}{
+		{
+			name:      "line sent during grace period is kept",
+			grace:     500 * time.Millisecond,
+			timeout:   5 * time.Second,
+			lateLine:  true,
+			wantBytes: []byte("before shutdown\nduring grace\n"),
+			maxTime:   time.Second,
+		},
+		{
+			name:      "idle connection doesn't hold up shutdown past grace",
+			grace:     50 * time.Millisecond,
+			timeout:   5 * time.Second,
+			wantBytes: []byte("before shutdown\n"),
+			maxTime:   time.Second,
+		},
+		{
+			name:      "hard deadline wins over grace",
+			grace:     time.Minute,
+			timeout:   100 * time.Millisecond,
+			wantBytes: []byte("before shutdown\n"),
+			maxTime:   time.Second,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "localhost:0") // just doing this to get an available port
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := strings.Split(l.Addr().String(), ":")
+			l.Close()
+
+			c := &setup.Cfg{
+				Listeners:     []listener.Config{{Network: "tcp", Address: addr[0] + ":" + addr[1]}},
+				Logger:        &lumberjack.Logger{Filename: "shutdown_test.txt"},
+				ShutdownGrace: tt.grace,
+			}
+			t.Cleanup(func() { os.Remove(c.Logger.Filename) })
+			s, err := NewServer(CfgOptions(c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			served := make(chan struct{})
+			go func() {
+				s.Serve(context.Background())
+				close(served)
+			}()
+
+			shutdownNow := make(chan struct{})
+			stop, clientDone := make(chan struct{}), make(chan struct{})
+			go func(lateLine bool) {
+				defer close(clientDone)
+				conn, err := dialRetry("tcp", addr[0]+":"+addr[1])
+				if err != nil {
+					t.Error(err)
+					close(shutdownNow)
+					return
+				}
+				defer conn.Close()
+				conn.Write([]byte("before shutdown\n"))
+				time.Sleep(50 * time.Millisecond)
+				close(shutdownNow)
+				if !lateLine {
+					<-stop // never close on our own
+					return
+				}
+				time.Sleep(100 * time.Millisecond)
+				conn.Write([]byte("during grace\n"))
+			}(tt.lateLine)
+			defer func() {
+				close(stop)
+				<-clientDone
+			}()
+
+			<-shutdownNow
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			start := time.Now()
+			s.Shutdown(ctx)
+			if took := time.Since(start); took > tt.maxTime {
+				t.Errorf("Shutdown() took %v, want at most %v", took, tt.maxTime)
+			}
+			select {
+			case <-served:
+			case <-time.After(time.Second):
+				t.Error("Serve() didn't return once the server was shut down")
+			}
+
+			got, err := os.ReadFile(c.Logger.Filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.wantBytes) {
+				t.Errorf("got:\n<<%v>>\nwant:\n<<%v>>", string(got), string(tt.wantBytes))
+			}
+		})
+	}
+}
+
 var text4 []byte = []byte(`Lorem TEXT2 dolor sit amet, consectetuer adipiscing elit.
 Vestibulum wisi massa, pulvinar vitae, vestibulum id, vestibulum et, erat.
 Cras imperdiet.
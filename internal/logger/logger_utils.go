@@ -1,18 +1,21 @@
 package logger
 
 import (
-	"bufio"
 	"context"
 	"errors"
-	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
-	"gopkg.in/natefinch/lumberjack.v2"
+	"github.com/zspekt/tcpLogger/internal/filter"
+	"github.com/zspekt/tcpLogger/internal/listener"
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/multiline"
+	"github.com/zspekt/tcpLogger/internal/output"
 )
 
 type BytesReader interface {
@@ -21,60 +24,185 @@ type BytesReader interface {
 
 var shutdownErr error = errors.New("got shutdown signal")
 
-func handleConnWithCtx(conn net.Conn, ch chan<- []byte, ctx context.Context) {
+// pipeline holds the stages a message goes through between being read off
+// a connection and reaching logWithCtx. every listener has its own. a nil
+// *pipeline keeps everything.
+type pipeline struct {
+	listener string // stamped on every message
+	output   string // stamped on every message, if set
+	framing  string
+
+	sanitizer Sanitizer
+	parser    Parser
+	lines     *multiline.Aggregator // nil unless Options.Multiline is set
+	filter    Filter
+	redactor  Redactor
+	gate      Gate
+	quit      <-chan struct{} // the server's. waiting on gate stops with it
+}
+
+// wait holds off reading while the gate is closed, or until shutdown starts.
+func (p *pipeline) wait(ctx context.Context) {
+	if p == nil || p.gate == nil {
+		return
+	}
+	for {
+		open := p.gate.Wait()
+		if open == nil {
+			return
+		}
+		select {
+		case <-open:
+		case <-p.quit:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reader splits what's read off conn into messages.
+func (p *pipeline) reader(conn net.Conn) BytesReader {
+	if p == nil {
+		return listener.NewReader(listener.FramingLF, conn)
+	}
+	return listener.NewReader(p.framing, conn)
+}
+
+// process returns false if m should be dropped, or if it was handed to the
+// multiline aggregator, which sends it on once the record it's part of is
+// complete.
+func (p *pipeline) process(m *message.Message) bool {
+	if p == nil {
+		return true
+	}
+	m.Listener = p.listener
+	if p.output != "" {
+		m.Output = p.output
+	}
+	if p.sanitizer != nil {
+		p.sanitizer.Sanitize(m)
+	}
+	if p.parser != nil {
+		if err := p.parser.Parse(m); err != nil {
+			slog.Debug("pipeline.process(): couldn't parse message", "error", err)
+		}
+	}
+	if p.lines != nil {
+		p.lines.Add(m)
+		return false
+	}
+	return p.keep(m)
+}
+
+// keep runs the filter, and redacts what it keeps. records from the
+// multiline aggregator only go through this part.
+func (p *pipeline) keep(m *message.Message) bool {
+	if p.filter != nil && !p.filter.Filter(m) {
+		return false
+	}
+	if p.redactor != nil {
+		p.redactor.Redact(m)
+	}
+	return true
+}
+
+// flush lets go of the multiline records of source, once it's gone.
+func (p *pipeline) flush(source string) {
+	if p != nil && p.lines != nil {
+		p.lines.Flush(source)
+	}
+}
+
+// handleConnWithCtx reads lines off conn until it's closed, a read fails (a
+// read deadline is how shutdown asks it to wrap up) or ctx is canceled.
+// every line is counted on pr, which may be nil. returns how many messages
+// it had to drop because ctx was canceled.
+func handleConnWithCtx(
+	conn net.Conn,
+	ch chan<- *message.Message,
+	p *pipeline,
+	pr *peer,
+	ctx context.Context,
+) int {
 	slog.Info("handleConnWithCtx(): running...")
 	defer conn.Close()
 
-	reader := bufio.NewReader(conn)
+	source := listener.PeerAddr(conn.RemoteAddr())
+	if source == "" { // unix socket peers are usually unnamed
+		source = conn.LocalAddr().String()
+	}
+	defer p.flush(source)
+	reader := p.reader(conn)
 	for {
 		slog.Debug("handleConnWithCtx(): running loop...")
+		p.wait(ctx)
 		msg, err := ReadBytesWithCtx(reader, '\n', ctx)
+
+		// whatever we got before an error is still worth keeping, like the
+		// last line of a sender that doesn't end it with a newline
+		if len(msg) > 0 {
+			pr.received(len(msg))
+			m := &message.Message{Data: msg, Source: source, Received: time.Now()}
+			if p.process(m) {
+				slog.Debug("handleConnWithCtx(): msg not empty. sending to ch...")
+				select {
+				case ch <- m:
+				case <-ctx.Done():
+					slog.Error("handleConnWithCtx(): canceled while sending to ch. dropping msg")
+					return 1
+				}
+			}
+		}
+
 		if err != nil {
-			if errors.Is(err, io.EOF) {
+			switch {
+			case errors.Is(err, io.EOF):
+				slog.Info("handleConnWithCtx(): EOF while reading from net.Conn reader (conn closed?). returning...")
+			case errors.Is(err, shutdownErr):
+				slog.Info("handleConnWithCtx(): caught shutdownErr from ReadBytesWithCtx(). returning...")
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				slog.Info("handleConnWithCtx(): read deadline exceeded (shutting down?). returning...")
+			case errors.Is(err, net.ErrClosed):
+				slog.Info("handleConnWithCtx(): conn was closed (disconnected?). returning...")
+			default:
 				slog.Error(
-					"handleConnWithCtx(): EOF while reading from net.Conn reader (conn closed?). returning...",
-				)
-				return
-			}
-			if errors.Is(err, shutdownErr) {
-				slog.Info(
-					"handleConnWithCtx(): caught shutdownErr from ReadBytesWithShutdown(). returning...",
+					"handleConnWithCtx(): error reading bytes from conn reader. returning...",
+					"error",
+					err,
 				)
-				return
 			}
-			slog.Error(
-				"handleConnWithCtx(): error reading bytes from conn reader. finishing loop...",
-				"error",
-				err,
-			)
-		}
-		if len(msg) > 0 {
-			slog.Debug("handleConnWithCtx(): msg not empty. sending to ch...")
-			ch <- msg
+			return 0
 		}
 	}
 }
 
-func logWithCtx(ch <-chan []byte, logger *lumberjack.Logger, ctx context.Context) {
+// logWithCtx writes everything that comes through ch until it's closed.
+// canceling ctx makes it give up on whatever is still queued, which it
+// counts and returns.
+func logWithCtx(ch <-chan *message.Message, out output.Output, ctx context.Context) int {
 	slog.Info("logWithCtx(): starting routine...")
 	for {
 		select {
 		case <-ctx.Done():
-			slog.Info("logWithCtx(): got cancel signal. writing to logger and returning...")
-			for i := len(ch); i > 0; i-- {
-				logger.Write(<-ch)
+			slog.Error("logWithCtx(): got cancel signal. dropping queued messages...")
+			// senders give up as soon as ctx is canceled, so ch will be
+			// closed shortly
+			dropped := 0
+			for range ch {
+				dropped++
 			}
-			return
+			return dropped
 		case msg, ok := <-ch:
-			slog.Debug("logWithCtx(): got message", "msg", msg)
 			if !ok { // channel is closed == we're shutting down (should be last step)
 				slog.Info("logWithCtx(): channel is closed (shutting down?). returning...")
-				return
+				return 0
 			}
-			_, err := logger.Write(msg)
+			slog.Debug("logWithCtx(): got message", "msg", msg.Data)
+			err := out.Write(msg)
 			if err != nil {
 				slog.Error(
-					"logWithCtx(): lumberjack.Logger error writing entry. continuing loop...",
+					"logWithCtx(): error writing entry. continuing loop...",
 					"error",
 					err,
 				)
@@ -84,19 +212,25 @@ func logWithCtx(ch <-chan []byte, logger *lumberjack.Logger, ctx context.Context
 	}
 }
 
-func shutdown(sigs chan os.Signal, cancel context.CancelFunc) {
-	slog.Info("shutdown(): starting routine...")
-
-	// we register the channel so it will get these sigs
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	s := <-sigs
-	slog.Info(
-		fmt.Sprintf(
-			"shutdown routine caught %v sig. cancelling...",
-			s.String(),
-		),
-	)
-	cancel()
+// ReloadWithCtx re-reads the filter rules every time a SIGHUP is caught,
+// until ctx is canceled. a failed reload keeps the rules that were already
+// loaded.
+func ReloadWithCtx(sigs chan os.Signal, e *filter.Engine, ctx context.Context) {
+	slog.Info("ReloadWithCtx(): starting routine...")
+
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			slog.Info("ReloadWithCtx(): caught SIGHUP. reloading filter rules...")
+			if err := e.Reload(); err != nil {
+				slog.Error("ReloadWithCtx(): error reloading filter rules. keeping old ones", "error", err)
+			}
+		}
+	}
 }
 
 func ReadBytesWithCtx(r BytesReader, delim byte, ctx context.Context) ([]byte, error) {
@@ -4,16 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"log/slog"
 	"net"
 	"os"
-	"sync"
-	"syscall"
 	"testing"
 	"time"
 
 	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/output"
 )
 
 type delayedReader struct {
@@ -32,7 +34,7 @@ func (r *delayedReader) ReadBytes(delim byte) ([]byte, error) {
 func Test_handleConn(t *testing.T) {
 	type args struct {
 		conn net.Conn
-		ch   chan []byte
+		ch   chan *message.Message
 		ctx  context.Context
 	}
 	tests := []struct {
@@ -44,7 +46,6 @@ func Test_handleConn(t *testing.T) {
 		shutdwnDelay   time.Duration
 		connCloseDelay time.Duration
 		shouldClose    bool
-		sigs           chan os.Signal
 		throwawayChan  chan struct{}
 		cancelFunc     context.CancelFunc
 	}{
@@ -52,7 +53,7 @@ func Test_handleConn(t *testing.T) {
 			name: "sending and receiving all the bytes of text1",
 			args: args{
 				conn: nil,
-				ch:   make(chan []byte, 10),
+				ch:   make(chan *message.Message, 10),
 				ctx:  nil,
 			},
 			bytes:          text1,
@@ -61,7 +62,6 @@ func Test_handleConn(t *testing.T) {
 			shutdwnDelay:   3 * time.Millisecond,
 			connCloseDelay: 3 * time.Millisecond,
 			shouldClose:    true,
-			sigs:           make(chan os.Signal, 1),
 			throwawayChan:  make(chan struct{}, 1),
 			cancelFunc:     nil,
 		},
@@ -69,7 +69,7 @@ func Test_handleConn(t *testing.T) {
 			name: "sending and receiving all the bytes of text2",
 			args: args{
 				conn: nil,
-				ch:   make(chan []byte, 10),
+				ch:   make(chan *message.Message, 10),
 				ctx:  nil,
 			},
 			bytes:          text2,
@@ -78,7 +78,6 @@ func Test_handleConn(t *testing.T) {
 			shutdwnDelay:   3 * time.Millisecond,
 			connCloseDelay: 3 * time.Millisecond,
 			shouldClose:    true,
-			sigs:           make(chan os.Signal, 1),
 			throwawayChan:  make(chan struct{}, 1),
 			cancelFunc:     nil,
 		},
@@ -86,7 +85,7 @@ func Test_handleConn(t *testing.T) {
 			name: "shutdwn signal should prevent any work being done",
 			args: args{
 				conn: nil,
-				ch:   make(chan []byte, 10),
+				ch:   make(chan *message.Message, 10),
 				ctx:  nil,
 			},
 			bytes:          text2,
@@ -95,7 +94,6 @@ func Test_handleConn(t *testing.T) {
 			shutdwnDelay:   0 * time.Second,
 			connCloseDelay: 0 * time.Second,
 			shouldClose:    true,
-			sigs:           make(chan os.Signal, 1),
 			throwawayChan:  make(chan struct{}, 1),
 			cancelFunc:     nil,
 		},
@@ -112,11 +110,9 @@ func Test_handleConn(t *testing.T) {
 
 			go receiveAndAppend(t, &tt.gotBytes, tt.args.ch)
 			go dialAndWrite(t, tt.bytes, addr, tt.connCloseDelay, tt.shouldClose)
-			go shutdown(tt.sigs, tt.cancelFunc)
-
 			go func() {
 				time.Sleep(tt.shutdwnDelay)
-				tt.sigs <- syscall.SIGINT // TODO: run all tests with SIGTERM too
+				tt.cancelFunc()
 			}()
 
 			tt.args.conn, err = l.Accept()
@@ -124,7 +120,7 @@ func Test_handleConn(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			handleConnWithCtx(tt.args.conn, tt.args.ch, tt.args.ctx)
+			handleConnWithCtx(tt.args.conn, tt.args.ch, nil, nil, tt.args.ctx)
 
 			// post func checking
 			if !bytes.Equal(tt.gotBytes, tt.wantBytes) {
@@ -142,7 +138,7 @@ func shutterDwn(t *testing.T, d time.Duration) {
 // (FOR TESTING ONLY) receives the messages from handleConn,
 // and appends them to a slice, so we can check if anything was missed
 
-func receiveAndAppend(t *testing.T, b *[]byte, ch <-chan []byte) {
+func receiveAndAppend(t *testing.T, b *[]byte, ch <-chan *message.Message) {
 	t.Helper()
 	for {
 		msg, ok := <-ch
@@ -150,8 +146,24 @@ func receiveAndAppend(t *testing.T, b *[]byte, ch <-chan []byte) {
 			slog.Info("receiveAndAppend(): channel closed? breaking out of loop...")
 			break
 		}
-		*b = append(*b, msg...)
+		*b = append(*b, msg.Data...)
+	}
+}
+
+// (FOR TESTING ONLY) net.Dial, but retrying for a bit, since the tests dial
+// from a goroutine that may run before Run() gets to listen.
+func dialRetry(proto, addr string) (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial(proto, addr); err == nil {
+			return conn, nil
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
+	return nil, err
 }
 
 // (FOR TESTING ONLY) connects via tcp and sends data.
@@ -170,7 +182,7 @@ func dialAndWrite(
 		proto = "tcp"
 		r     = bufio.NewReader(bytes.NewReader(b))
 	)
-	conn, err := net.Dial(proto, addr)
+	conn, err := dialRetry(proto, addr)
 	if err != nil {
 		slog.Error("failing from dialAndWrite()", "error", err)
 		t.Fail()
@@ -207,7 +219,7 @@ func dialAndWrite(
 
 func Test_logWithCtx(t *testing.T) {
 	type args struct {
-		ch     chan []byte
+		ch     chan *message.Message
 		logger *lumberjack.Logger
 		ctx    context.Context
 	}
@@ -220,7 +232,7 @@ func Test_logWithCtx(t *testing.T) {
 		{
 			name: "writing just one line",
 			args: args{
-				ch: make(chan []byte),
+				ch: make(chan *message.Message),
 				logger: &lumberjack.Logger{
 					Filename:   "testOneLine.log",
 					MaxSize:    0,
@@ -237,7 +249,7 @@ func Test_logWithCtx(t *testing.T) {
 		{
 			name: "writing a bunch of lines",
 			args: args{
-				ch: make(chan []byte),
+				ch: make(chan *message.Message),
 				logger: &lumberjack.Logger{
 					Filename:   "testBunchOfLines.log",
 					MaxSize:    0,
@@ -254,7 +266,7 @@ func Test_logWithCtx(t *testing.T) {
 		{
 			name: "writing 1 Lorem",
 			args: args{
-				ch: make(chan []byte),
+				ch: make(chan *message.Message),
 				logger: &lumberjack.Logger{
 					Filename:   "test1Lorem.log",
 					MaxSize:    0,
@@ -270,7 +282,7 @@ func Test_logWithCtx(t *testing.T) {
 		{
 			name: "writing 2 Lorem",
 			args: args{
-				ch: make(chan []byte),
+				ch: make(chan *message.Message),
 				logger: &lumberjack.Logger{
 					Filename:   "test2Lorem.log",
 					MaxSize:    0,
@@ -288,7 +300,7 @@ func Test_logWithCtx(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			tt.args.ctx, tt.cancel = context.WithCancel(context.Background())
 			defer os.Remove(tt.args.logger.Filename)
-			go logWithCtx(tt.args.ch, tt.args.logger, tt.args.ctx)
+			go logWithCtx(tt.args.ch, output.NewFile("test", tt.args.logger), tt.args.ctx)
 
 			// f, err := os.Create(tt.args.logger.Filename)
 			// if err != nil {
@@ -304,13 +316,13 @@ func Test_logWithCtx(t *testing.T) {
 				if err != nil {
 					if err == io.EOF {
 						slog.Info("EOF reached while reading from bytes reader")
-						tt.args.ch <- b
+						tt.args.ch <- &message.Message{Data: b}
 						break
 					}
 					slog.Error("non EOF error while reading from bytes reader", "error", err)
 					t.Fatal(err)
 				}
-				tt.args.ch <- b
+				tt.args.ch <- &message.Message{Data: b}
 			}
 
 			got, err := os.ReadFile(tt.args.logger.Filename)
@@ -332,61 +344,6 @@ func Test_logWithCtx(t *testing.T) {
 	}
 }
 
-func Test_shutdown(t *testing.T) {
-	type args struct {
-		sigs   chan os.Signal
-		cancel context.CancelFunc
-	}
-	tests := []struct {
-		name   string
-		args   args
-		signal os.Signal
-		ctx    context.Context
-	}{
-		{
-			name: "sending SIGINT",
-			args: args{
-				sigs:   make(chan os.Signal, 1),
-				cancel: nil,
-			},
-			signal: syscall.SIGINT,
-			ctx:    nil,
-		},
-		{
-			name: "sending SIGTERM",
-			args: args{
-				sigs:   make(chan os.Signal, 1),
-				cancel: nil,
-			},
-			signal: syscall.SIGTERM,
-			ctx:    nil,
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			tt.ctx, tt.args.cancel = context.WithCancel(context.Background())
-			wg := &sync.WaitGroup{}
-			wg.Add(1)
-			go func() {
-				<-tt.ctx.Done()
-				wg.Done()
-			}()
-
-			go shutdown(tt.args.sigs, tt.args.cancel)
-
-			go func() {
-				time.Sleep(5 * time.Millisecond) // to make sure our goroutine catches it
-				syscall.Kill(syscall.Getpid(), tt.signal.(syscall.Signal))
-			}()
-
-			// if we get here, shutdown has exited, which means it caught the int/term
-			// signal
-			wg.Wait()
-			slog.Info("both channels received shutdown signal and shutdown func has returned")
-		})
-	}
-}
-
 func TestReadBytesWithCtx(t *testing.T) {
 	type args struct {
 		r     BytesReader
@@ -457,6 +414,105 @@ func TestReadBytesWithCtx(t *testing.T) {
 	}
 }
 
+// (FOR TESTING ONLY) closed until open is closed.
+type fakeGate struct {
+	open chan struct{}
+}
+
+func (g *fakeGate) Wait() <-chan struct{} {
+	select {
+	case <-g.open:
+		return nil
+	default:
+		return g.open
+	}
+}
+
+func Test_pipeline_wait(t *testing.T) {
+	tests := []struct {
+		name     string
+		p        *pipeline
+		stop     func(g *fakeGate, quit chan struct{}, cancel context.CancelFunc)
+		wantWait bool
+	}{
+		{name: "no pipeline", p: nil},
+		{name: "no gate", p: &pipeline{}},
+		{name: "gate opens", p: &pipeline{}, stop: func(g *fakeGate, _ chan struct{}, _ context.CancelFunc) { close(g.open) }, wantWait: true},
+		{name: "shutdown starts", p: &pipeline{}, stop: func(_ *fakeGate, quit chan struct{}, _ context.CancelFunc) { close(quit) }, wantWait: true},
+		{name: "ctx canceled", p: &pipeline{}, stop: func(_ *fakeGate, _ chan struct{}, cancel context.CancelFunc) { cancel() }, wantWait: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &fakeGate{open: make(chan struct{})}
+			quit := make(chan struct{})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.p != nil && tt.stop != nil {
+				tt.p.gate, tt.p.quit = g, quit
+			}
+
+			done := make(chan struct{})
+			go func() {
+				tt.p.wait(ctx)
+				close(done)
+			}()
+			select {
+			case <-done:
+				if tt.wantWait {
+					t.Fatal("wait() returned while the gate was closed")
+				}
+				return
+			case <-time.After(20 * time.Millisecond):
+				if !tt.wantWait {
+					t.Fatal("wait() blocked without a gate")
+				}
+			}
+			tt.stop(g, quit, cancel)
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("wait() still blocked")
+			}
+		})
+	}
+}
+
+func Test_connSet_resetReadDeadline(t *testing.T) {
+	tests := []struct {
+		name     string
+		shutdown bool
+		wantErr  error
+	}{
+		{name: "before shutdown", wantErr: nil},
+		// shutdown's deadline must survive the one set for the PROXY header
+		{name: "after shutdown", shutdown: true, wantErr: os.ErrDeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			cs := newConnSet()
+			p := cs.add(server, "test")
+			defer cs.remove(p)
+
+			server.SetReadDeadline(time.Now().Add(-time.Second)) // the header's, already past
+			if tt.shutdown {
+				cs.setReadDeadline(time.Now().Add(-time.Second))
+			}
+			if err := cs.resetReadDeadline(p); err != nil {
+				t.Fatal(err)
+			}
+
+			go client.Write([]byte("x"))
+			_, err := server.Read(make([]byte, 1))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Read() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestAcceptWithCtx(t *testing.T) {
 	type args struct {
 		l   net.Listener
@@ -0,0 +1,193 @@
+package logger
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/listener"
+)
+
+var NoSuchPeerError error = errors.New("no such peer")
+
+// PeerInfo is a connection being handled, as listed by Server.Peers.
+type PeerInfo struct {
+	ID        uint64    `json:"id"`
+	Remote    string    `json:"remote"` // the client's, if it came through a PROXY protocol proxy
+	Listener  string    `json:"listener"`
+	Connected time.Time `json:"connected"`
+	Lines     uint64    `json:"lines"`
+	Bytes     uint64    `json:"bytes"`
+	Last      time.Time `json:"last"` // zero until the first line
+}
+
+// peer is what's kept about a connection. conn is the one that was
+// accepted, before any PROXY protocol header was read or tls started, so
+// it's the one to set deadlines on and close.
+type peer struct {
+	id        uint64
+	conn      net.Conn
+	listener  string
+	connected time.Time
+
+	lines atomic.Uint64
+	bytes atomic.Uint64
+	last  atomic.Int64 // unix nanoseconds
+
+	mu     sync.Mutex
+	remote string
+}
+
+// received counts a line of n bytes. p may be nil.
+func (p *peer) received(n int) {
+	if p == nil {
+		return
+	}
+	p.lines.Add(1)
+	p.bytes.Add(uint64(n))
+	p.last.Store(time.Now().UnixNano())
+}
+
+// setRemote is for when the client turns out to be someone else than who
+// connected, like behind a proxy.
+func (p *peer) setRemote(addr net.Addr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remote = listener.PeerAddr(addr)
+}
+
+func (p *peer) info() PeerInfo {
+	p.mu.Lock()
+	remote := p.remote
+	p.mu.Unlock()
+
+	i := PeerInfo{
+		ID:        p.id,
+		Remote:    remote,
+		Listener:  p.listener,
+		Connected: p.connected,
+		Lines:     p.lines.Load(),
+		Bytes:     p.bytes.Load(),
+	}
+	if last := p.last.Load(); last != 0 {
+		i.Last = time.Unix(0, last)
+	}
+	return i
+}
+
+// connSet keeps track of the connections being handled, so shutdown can
+// wait for them, and so they can be listed and disconnected.
+type connSet struct {
+	wg     sync.WaitGroup
+	nextID atomic.Uint64
+
+	mu       sync.Mutex
+	peers    map[uint64]*peer
+	deadline time.Time // the last one set on every connection
+}
+
+func newConnSet() *connSet {
+	return &connSet{peers: make(map[uint64]*peer)}
+}
+
+func (s *connSet) add(c net.Conn, listenerName string) *peer {
+	p := &peer{
+		id:        s.nextID.Add(1),
+		conn:      c,
+		listener:  listenerName,
+		connected: time.Now(),
+		remote:    listener.PeerAddr(c.RemoteAddr()),
+	}
+	if p.remote == "" { // unix socket peers are usually unnamed
+		p.remote = c.LocalAddr().String()
+	}
+	s.wg.Add(1)
+	s.mu.Lock()
+	s.peers[p.id] = p
+	s.mu.Unlock()
+	return p
+}
+
+func (s *connSet) remove(p *peer) {
+	s.mu.Lock()
+	delete(s.peers, p.id)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+func (s *connSet) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.peers)
+}
+
+// list returns every peer, oldest connection first.
+func (s *connSet) list() []PeerInfo {
+	s.mu.Lock()
+	infos := make([]PeerInfo, 0, len(s.peers))
+	for _, p := range s.peers {
+		infos = append(infos, p.info())
+	}
+	s.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// close closes the connection of the peer with id, which makes its handler
+// return once it's done with what it already read.
+func (s *connSet) close(id uint64) error {
+	s.mu.Lock()
+	p, ok := s.peers[id]
+	s.mu.Unlock()
+	if !ok {
+		return NoSuchPeerError
+	}
+	return p.conn.Close()
+}
+
+// setReadDeadline makes every read past t fail, which is how connections
+// that don't close on their own get told to finish up.
+func (s *connSet) setReadDeadline(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadline = t
+	for _, p := range s.peers {
+		if err := p.conn.SetReadDeadline(t); err != nil {
+			slog.Error("connSet.setReadDeadline(): error setting deadline", "error", err)
+		}
+	}
+}
+
+// resetReadDeadline undoes whatever deadline was set on p's connection on
+// its own, going back to the one set on every connection, if any. it's
+// under the same lock as setReadDeadline, so shutdown's can't get lost.
+func (s *connSet) resetReadDeadline(p *peer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return p.conn.SetReadDeadline(s.deadline)
+}
+
+func (s *connSet) wait() {
+	s.wg.Wait()
+}
+
+// Peers lists the connections being handled, oldest first. datagrams
+// aren't connections, so they're not in it.
+func (s *Server) Peers() []PeerInfo {
+	return s.conns.list()
+}
+
+// Disconnect closes the connection with id, as listed by Peers. whatever
+// was already read off it is still written. it returns NoSuchPeerError if
+// there's no such connection, which might have just closed on its own.
+func (s *Server) Disconnect(id uint64) error {
+	if err := s.conns.close(id); err != nil {
+		return err
+	}
+	slog.Info("Server.Disconnect(): closed connection", "id", id)
+	return nil
+}
@@ -0,0 +1,442 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/listener"
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/multiline"
+	"github.com/zspekt/tcpLogger/internal/output"
+	"github.com/zspekt/tcpLogger/internal/syslog"
+)
+
+var ServerClosedError error = errors.New("server closed")
+
+const defQueueSize int = 1024
+
+// Parser fills in whatever it can work out from m.Data. an error doesn't
+// drop the message, it just goes through unparsed.
+type Parser interface {
+	Parse(m *message.Message) error
+}
+
+// Sanitizer cleans up m.Data before anything else looks at it.
+type Sanitizer interface {
+	Sanitize(m *message.Message)
+}
+
+// Redactor replaces personal data in m, once it's known it's kept, so
+// nothing that gets to the sinks has it.
+type Redactor interface {
+	Redact(m *message.Message)
+}
+
+// Gate holds off reading from the sockets, like while there's no space to
+// write what's read. Wait returns a channel that's closed once reading can
+// go on, or nil if it can right away.
+type Gate interface {
+	Wait() <-chan struct{}
+}
+
+// Tap sees every message that reaches the writer, routed or not, before the
+// sinks do. it's called from the writer, so it must not block.
+type Tap interface {
+	Publish(m *message.Message)
+}
+
+// Filter returns false for messages that should be dropped. it may set
+// m.Output to route a message to a single sink.
+type Filter interface {
+	Filter(m *message.Message) bool
+}
+
+// SyslogParser parses RFC 3164 and RFC 5424 headers into m.Syslog.
+type SyslogParser struct{}
+
+func (SyslogParser) Parse(m *message.Message) error {
+	h, err := syslog.Parse(m.Data)
+	m.Syslog = h
+	return err
+}
+
+// Options configures a Server. either Listeners, or one of Listener or
+// Network/Address has to be set.
+type Options struct {
+	Network  string // tcp, tls or udp. "tcp" if empty
+	Address  string
+	Listener net.Listener
+
+	// Listeners are bound independently of each other. one that can't be
+	// bound is logged and skipped, see NewServer
+	Listeners []listener.Config
+
+	Sinks       []output.Output // get every message
+	RoutedSinks []output.Output // only get messages routed to them by a Filter
+	LossySinks  []string        // names of the sinks that drop messages when their queue is full, instead of waiting
+	QueueSize   int             // per sink
+
+	Sanitizer Sanitizer         // optional, runs before Parser
+	Parser    Parser            // optional
+	Multiline *multiline.Config // optional, joins lines after they're parsed, before Filter
+	Filter    Filter            // optional
+	Redactor  Redactor          // optional, runs on what Filter keeps
+	Tap       Tap               // optional. must not change the messages
+	Gate      Gate              // optional
+
+	ShutdownGrace   time.Duration // how long open connections get to finish
+	ShutdownTimeout time.Duration // used when Serve's ctx is canceled
+}
+
+// Server accepts connections and writes every line it reads to its sinks.
+type Server struct {
+	opts       Options
+	listeners  []*boundListener
+	listenErrs []error
+	out        *output.FanOut
+
+	ch             chan *message.Message
+	conns          *connSet
+	handlerDropped atomic.Int64
+	denied         atomic.Int64 // connections and datagrams turned away by an Allow list
+
+	// hardCtx is only canceled once the shutdown deadline passes. it's what
+	// the connections and the writer run with, so they can finish their work
+	// after we stop accepting
+	hardCtx    context.Context
+	hardCancel context.CancelFunc
+
+	writerDone    chan struct{}
+	writerDropped int
+
+	quit       chan struct{} // closed when shutdown starts
+	quitOnce   sync.Once
+	acceptDone chan struct{} // closed when every listener's loop has returned
+	serving    atomic.Bool
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+	done         chan struct{} // closed when shutdown is complete
+}
+
+// NewServer binds the listeners right away, so Addr can be used before
+// Serve is called. the ones that fail to bind are logged and skipped, and
+// can be looked at with ListenErrors. it only fails if none could be bound,
+// returning every *ListenError.
+func NewServer(opts Options) (*Server, error) {
+	if len(opts.Sinks) == 0 {
+		return nil, errors.New("at least one sink is needed")
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defQueueSize
+	}
+	if opts.ShutdownTimeout <= 0 {
+		opts.ShutdownTimeout = defShutdownTimeout
+	}
+	if opts.Multiline != nil {
+		if err := opts.Multiline.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.Listeners) == 0 {
+		network := opts.Network
+		if network == "" {
+			network = "tcp"
+		}
+		opts.Listeners = []listener.Config{{
+			Network:  network,
+			Address:  opts.Address,
+			Listener: opts.Listener,
+		}}
+	}
+
+	var (
+		bound []*boundListener
+		errs  []error
+	)
+	for _, cfg := range opts.Listeners {
+		if cfg.Name == "" {
+			cfg.Name = cfg.Network + "://" + cfg.Address
+		}
+		bl, err := bind(cfg)
+		if err != nil {
+			slog.Error("NewServer(): couldn't bind listener. skipping it", "listener", cfg.Name, "error", err)
+			errs = append(errs, &ListenError{Name: cfg.Name, Err: err})
+			continue
+		}
+		bl.pipeline = &pipeline{
+			listener:  cfg.Name,
+			output:    cfg.Output,
+			framing:   cfg.Framing,
+			sanitizer: opts.Sanitizer,
+			parser:    opts.Parser,
+			filter:    opts.Filter,
+			redactor:  opts.Redactor,
+			gate:      opts.Gate,
+		}
+		slog.Info("NewServer(): listening", "listener", cfg.Name, "address", bl.addr().String())
+		bound = append(bound, bl)
+	}
+	if len(bound) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	out, err := output.NewFanOut(opts.QueueSize, opts.Sinks, opts.RoutedSinks, opts.LossySinks)
+	if err != nil {
+		for _, bl := range bound {
+			bl.close()
+		}
+		return nil, err
+	}
+
+	s := &Server{
+		opts:       opts,
+		listeners:  bound,
+		listenErrs: errs,
+		out:        out,
+		ch:         make(chan *message.Message, 5),
+		conns:      newConnSet(),
+		writerDone: make(chan struct{}),
+		quit:       make(chan struct{}),
+		acceptDone: make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	s.hardCtx, s.hardCancel = context.WithCancel(context.Background())
+	// a full queue mustn't hold up shutdown past its deadline
+	context.AfterFunc(s.hardCtx, s.out.Abort)
+	for _, bl := range s.listeners {
+		bl.pipeline.quit = s.quit
+	}
+
+	if opts.Multiline != nil {
+		for _, bl := range s.listeners {
+			p := bl.pipeline
+			p.lines = multiline.New(*opts.Multiline, func(m *message.Message) { s.sendRecord(p, m) })
+		}
+	}
+
+	var w output.Output = s.out
+	if opts.Tap != nil {
+		w = &tapped{Output: s.out, tap: opts.Tap}
+	}
+	go func() {
+		defer close(s.writerDone)
+		s.writerDropped = logWithCtx(s.ch, w, s.hardCtx)
+	}()
+	return s, nil
+}
+
+// Addr is the address the first listener that could be bound is listening
+// on. see Addrs for the rest.
+func (s *Server) Addr() net.Addr {
+	return s.listeners[0].addr()
+}
+
+// Addrs maps the name of every listener that could be bound to its address.
+func (s *Server) Addrs() map[string]net.Addr {
+	addrs := make(map[string]net.Addr, len(s.listeners))
+	for _, bl := range s.listeners {
+		addrs[bl.cfg.Name] = bl.addr()
+	}
+	return addrs
+}
+
+// ListenErrors returns a *ListenError for every listener that couldn't be
+// bound.
+func (s *Server) ListenErrors() []error {
+	return s.listenErrs
+}
+
+// ListenerFiles returns a dup of every listener's socket, along with the
+// listener's name, for passing them on to another process. listeners whose
+// socket can't be had, like a custom net.Listener, are logged and left out.
+// closing the files is up to the caller.
+func (s *Server) ListenerFiles() ([]*os.File, []string) {
+	var (
+		files []*os.File
+		names []string
+	)
+	for _, bl := range s.listeners {
+		f, err := bl.file()
+		if err != nil {
+			slog.Error("Server.ListenerFiles(): leaving listener out", "listener", bl.cfg.Name, "error", err)
+			continue
+		}
+		files = append(files, f)
+		names = append(names, bl.cfg.Name)
+	}
+	return files, names
+}
+
+// KeepSockets makes Shutdown leave unix sockets on disk, for when they were
+// handed over to another process with ListenerFiles.
+func (s *Server) KeepSockets() {
+	for _, bl := range s.listeners {
+		bl.socket = ""
+		if ul, ok := bl.stream.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+// Serve accepts connections until Shutdown is called or ctx is canceled. in
+// the latter case it shuts down on its own, giving it Options.ShutdownTimeout.
+// it always returns ServerClosedError, once the shutdown is complete.
+func (s *Server) Serve(ctx context.Context) error {
+	if !s.serving.CompareAndSwap(false, true) {
+		return errors.New("Serve() called twice")
+	}
+
+	acceptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.quit:
+			cancel()
+		case <-acceptCtx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, bl := range s.listeners {
+		wg.Add(1)
+		go func(bl *boundListener) {
+			defer wg.Done()
+			if bl.packet != nil {
+				s.readPackets(acceptCtx, bl)
+			} else {
+				s.accept(acceptCtx, bl)
+			}
+			slog.Info("Server.Serve(): listener stopped", "listener", bl.cfg.Name)
+		}(bl)
+	}
+	wg.Wait()
+	close(s.acceptDone)
+
+	if ctx.Err() != nil {
+		slog.Info("Server.Serve(): received cancel sig. shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+		defer cancel()
+		s.Shutdown(shutdownCtx)
+	}
+	<-s.done
+	return ServerClosedError
+}
+
+// Shutdown stops accepting connections, gives the open ones
+// Options.ShutdownGrace to finish sending, then writes out everything that
+// was queued to every sink, flushes and fsyncs them.
+//
+// if ctx is done before all that, whatever is left is dropped and ctx.Err()
+// is returned. either way a summary is logged.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.quitOnce.Do(func() { close(s.quit) })
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.shutdown(ctx)
+		close(s.done)
+	})
+	<-s.done
+	return s.shutdownErr
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	slog.Info("Server.shutdown(): closing listeners...")
+	for _, bl := range s.listeners {
+		if err := bl.close(); err != nil {
+			slog.Error("Server.shutdown(): error closing listener", "listener", bl.cfg.Name, "error", err)
+		}
+	}
+	if s.serving.Load() {
+		<-s.acceptDone // so no connection gets added after this
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		slog.Error("Server.shutdown(): shutdown deadline passed. dropping whatever is left...")
+		s.hardCancel()
+	})
+	defer stop()
+	defer s.hardCancel()
+
+	slog.Info(
+		"Server.shutdown(): waiting for open connections...",
+		"connections", s.conns.len(),
+		"grace", s.opts.ShutdownGrace,
+	)
+	s.conns.setReadDeadline(time.Now().Add(s.opts.ShutdownGrace))
+	s.conns.wait()
+	for _, bl := range s.listeners {
+		if bl.pipeline.lines != nil {
+			bl.pipeline.lines.Close()
+		}
+	}
+
+	// nobody is sending anymore, so it's safe to close it
+	slog.Info("Server.shutdown(): closing channel...")
+	close(s.ch)
+	<-s.writerDone
+
+	slog.Info("Server.shutdown(): closing outputs...")
+	closed := make(chan error, 1)
+	go func() { closed <- s.out.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			slog.Error("Server.shutdown(): error closing outputs", "error", err)
+		}
+	case <-s.hardCtx.Done():
+		slog.Error("Server.shutdown(): gave up waiting for outputs to flush")
+	}
+
+	summary := []any{
+		"dropped_in_connections", s.handlerDropped.Load(),
+		"dropped_in_writer", s.writerDropped,
+		"denied", s.denied.Load(),
+	}
+	for _, st := range s.out.Stats() {
+		summary = append(summary, slog.Group(st.Name,
+			"written", st.Written,
+			"errors", st.Errors,
+			"dropped", st.Dropped,
+		))
+	}
+	slog.Info("Server.shutdown(): shutdown summary", summary...)
+
+	if s.hardCtx.Err() != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// sendRecord sends on a record the multiline aggregator of p let go of.
+func (s *Server) sendRecord(p *pipeline, m *message.Message) {
+	if !p.keep(m) {
+		return
+	}
+	select {
+	case s.ch <- m:
+	case <-s.hardCtx.Done():
+		s.handlerDropped.Add(1)
+	}
+}
+
+// Stats returns the counters of every sink.
+func (s *Server) Stats() []output.Stats {
+	return s.out.Stats()
+}
+
+// tapped hands every message to tap on its way to the Output.
+type tapped struct {
+	output.Output
+	tap Tap
+}
+
+func (t *tapped) Write(m *message.Message) error {
+	t.tap.Publish(m)
+	return t.Output.Write(m)
+}
@@ -0,0 +1,17 @@
+package message
+
+import (
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/syslog"
+)
+
+// Message is what travels from the connection handlers to the writer.
+type Message struct {
+	Data     []byte
+	Source   string // remote address of the sender
+	Listener string // name of the listener it came in on
+	Received time.Time
+	Syslog   *syslog.Header // nil unless syslog parsing is enabled (and succeeded)
+	Output   string         // set by a route rule. empty means the default output
+}
@@ -0,0 +1,227 @@
+// Package multiline joins messages that are really one, like kernel oopses
+// and tracebacks sent a line at a time, back into a single message.
+package multiline
+
+import (
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+)
+
+const (
+	defTimeout  time.Duration = time.Second
+	defMaxLines int           = 500
+)
+
+// Config says which lines continue the one before them. the rules apply to
+// the syslog content of a message if it was parsed, and to the whole line
+// otherwise. at least one of Indent, Start or MaxGap has to be set.
+type Config struct {
+	// Indent makes lines starting with a space or a tab continue the record
+	// before them
+	Indent bool
+	// Start matches the first line of a record. lines it doesn't match
+	// continue the record before them
+	Start *regexp.Regexp
+	// MaxGap is how long a record waits for its next line. one that comes
+	// later always starts a new record. with neither Indent nor Start set,
+	// every line that comes sooner continues the record
+	MaxGap time.Duration
+
+	// Timeout is how long a record is held after its last line, before it's
+	// let go. defTimeout if 0
+	Timeout time.Duration
+	// MaxLines lets a record go once it has this many lines. defMaxLines
+	// if 0
+	MaxLines int
+}
+
+func (c *Config) Validate() error {
+	if !c.Indent && c.Start == nil && c.MaxGap <= 0 {
+		return errors.New("multiline needs indent, start or a max gap")
+	}
+	if c.MaxGap < 0 || c.Timeout < 0 || c.MaxLines < 0 {
+		return errors.New("multiline max gap, timeout and max lines can't be negative")
+	}
+	return nil
+}
+
+// continues reports whether content, which came in gap after the last
+// line of a record, belongs to it.
+func (c *Config) continues(content []byte, gap time.Duration) bool {
+	if c.MaxGap > 0 && gap > c.MaxGap {
+		return false
+	}
+	if c.Indent && len(content) > 0 && (content[0] == ' ' || content[0] == '\t') {
+		return true
+	}
+	if c.Start != nil && !c.Start.Match(content) {
+		return true
+	}
+	return !c.Indent && c.Start == nil
+}
+
+// key is what records are kept apart by. lines from different programs
+// sharing a connection don't get mixed up.
+type key struct {
+	source  string
+	program string
+}
+
+type record struct {
+	m     *message.Message
+	lines int
+	last  time.Time
+}
+
+// Aggregator joins the messages of every source into records, which it
+// hands to emit. emit is called by Add and Flush, and from a timer once a
+// record times out, so it has to be safe for concurrent use.
+type Aggregator struct {
+	cfg  Config
+	emit func(*message.Message)
+
+	mu      sync.Mutex
+	pending map[key]*record
+	closed  bool
+	emits   sync.WaitGroup // timers that are emitting
+}
+
+// New returns an Aggregator for cfg, which should be valid.
+func New(cfg Config, emit func(*message.Message)) *Aggregator {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defTimeout
+	}
+	if cfg.MaxLines == 0 {
+		cfg.MaxLines = defMaxLines
+	}
+	return &Aggregator{cfg: cfg, emit: emit, pending: make(map[key]*record)}
+}
+
+// Add adds m to the record of its source, or starts a new one with it,
+// emitting the one that was pending.
+func (a *Aggregator) Add(m *message.Message) {
+	k := key{source: m.Source}
+	if m.Syslog != nil {
+		k.program = m.Syslog.Program
+	}
+	now := time.Now()
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		a.emit(m)
+		return
+	}
+	r := a.pending[k]
+	if r != nil && a.cfg.continues(content(m), now.Sub(r.last)) {
+		join(r.m, m)
+		r.lines++
+		r.last = now
+		if r.lines >= a.cfg.MaxLines {
+			delete(a.pending, k)
+			a.mu.Unlock()
+			a.emit(r.m)
+			return
+		}
+		a.mu.Unlock()
+		return
+	}
+
+	nr := &record{m: m, lines: 1, last: now}
+	a.pending[k] = nr
+	a.timeout(k, nr, a.cfg.Timeout)
+	a.mu.Unlock()
+	if r != nil {
+		a.emit(r.m)
+	}
+}
+
+// timeout lets the record at k go after d, if it's still r and nothing was
+// added to it since.
+func (a *Aggregator) timeout(k key, r *record, d time.Duration) {
+	time.AfterFunc(d, func() {
+		a.mu.Lock()
+		if a.closed || a.pending[k] != r {
+			a.mu.Unlock()
+			return
+		}
+		if left := a.cfg.Timeout - time.Since(r.last); left > 0 {
+			a.mu.Unlock()
+			a.timeout(k, r, left)
+			return
+		}
+		delete(a.pending, k)
+		a.emits.Add(1)
+		a.mu.Unlock()
+
+		defer a.emits.Done()
+		a.emit(r.m)
+	})
+}
+
+// Flush emits whatever is pending for source, like when its connection is
+// closed.
+func (a *Aggregator) Flush(source string) {
+	a.mu.Lock()
+	var flushed []*message.Message
+	for k, r := range a.pending {
+		if k.source == source {
+			flushed = append(flushed, r.m)
+			delete(a.pending, k)
+		}
+	}
+	a.mu.Unlock()
+	for _, m := range flushed {
+		a.emit(m)
+	}
+}
+
+// Close emits everything that's pending, and waits for timers that are
+// emitting. anything added after is emitted right away.
+func (a *Aggregator) Close() {
+	a.mu.Lock()
+	a.closed = true
+	pending := a.pending
+	a.pending = make(map[key]*record)
+	a.mu.Unlock()
+
+	for _, r := range pending {
+		a.emit(r.m)
+	}
+	a.emits.Wait()
+}
+
+// content is what the rules look at.
+func content(m *message.Message) []byte {
+	if m.Syslog != nil {
+		return m.Syslog.Content
+	}
+	b := m.Data
+	if len(b) > 0 && b[len(b)-1] == '\n' {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// join appends the line in m to the record in r. a syslog line only adds
+// its content, its header is the same as the first one's anyway.
+func join(r, m *message.Message) {
+	if len(r.Data) > 0 && r.Data[len(r.Data)-1] != '\n' {
+		r.Data = append(r.Data, '\n')
+	}
+	if r.Syslog == nil || m.Syslog == nil {
+		r.Data = append(r.Data, m.Data...)
+		return
+	}
+	c := make([]byte, 0, len(r.Syslog.Content)+len(m.Syslog.Content)+1)
+	c = append(c, r.Syslog.Content...)
+	c = append(c, '\n')
+	r.Syslog.Content = append(c, m.Syslog.Content...)
+
+	r.Data = append(r.Data, m.Syslog.Content...)
+	r.Data = append(r.Data, '\n')
+}
@@ -0,0 +1,186 @@
+package multiline
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/syslog"
+)
+
+// collector keeps everything emitted.
+type collector struct {
+	mu  sync.Mutex
+	got []string
+}
+
+func (c *collector) emit(m *message.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.got = append(c.got, string(m.Data))
+}
+
+func (c *collector) records() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.got...)
+}
+
+func TestAggregator(t *testing.T) {
+	type line struct {
+		source string
+		data   string
+	}
+	tests := []struct {
+		name  string
+		cfg   Config
+		lines []line
+		want  []string
+	}{
+		{
+			name: "indent",
+			cfg:  Config{Indent: true},
+			lines: []line{
+				{"a", "Traceback:\n"}, {"a", "  stack 1\n"}, {"a", "\tstack 2\n"}, {"a", "next\n"},
+			},
+			want: []string{"Traceback:\n  stack 1\n\tstack 2\n", "next\n"},
+		},
+		{
+			name: "start",
+			cfg:  Config{Start: regexp.MustCompile(`^\[`)},
+			lines: []line{
+				{"a", "[ 1.0] Oops\n"}, {"a", "Call Trace:\n"}, {"a", "[ 2.0] fine\n"},
+			},
+			want: []string{"[ 1.0] Oops\nCall Trace:\n", "[ 2.0] fine\n"},
+		},
+		{
+			name:  "sources are kept apart",
+			cfg:   Config{Indent: true},
+			lines: []line{{"a", "one\n"}, {"b", "two\n"}, {"a", " one more\n"}, {"b", " two more\n"}},
+			want:  []string{"one\n one more\n", "two\n two more\n"},
+		},
+		{
+			name:  "gap only",
+			cfg:   Config{MaxGap: time.Minute},
+			lines: []line{{"a", "one\n"}, {"a", "two\n"}},
+			want:  []string{"one\ntwo\n"},
+		},
+		{
+			name:  "max lines",
+			cfg:   Config{Indent: true, MaxLines: 2},
+			lines: []line{{"a", "one\n"}, {"a", " two\n"}, {"a", " three\n"}},
+			want:  []string{"one\n two\n", " three\n"},
+		},
+		{
+			name:  "line without newline",
+			cfg:   Config{Indent: true},
+			lines: []line{{"a", "one"}, {"a", " two\n"}},
+			want:  []string{"one\n two\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &collector{}
+			a := New(tt.cfg, c.emit)
+			for _, l := range tt.lines {
+				a.Add(&message.Message{Data: []byte(l.data), Source: l.source})
+			}
+			a.Flush("a")
+			a.Flush("b")
+			got := c.records()
+			if len(got) != len(tt.want) {
+				t.Fatalf("got records %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("record %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAggregator_syslog(t *testing.T) {
+	c := &collector{}
+	a := New(Config{Indent: true}, c.emit)
+	var first *message.Message
+	for _, data := range []string{
+		"<4>Oct  1 12:00:00 router kernel: Oops: 0000\n",
+		"<14>Oct  1 12:00:00 router dnsmasq: query\n",
+		"<4>Oct  1 12:00:00 router kernel:  Call Trace:\n",
+	} {
+		h, err := syslog.Parse([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &message.Message{Data: []byte(data), Source: "a", Syslog: h}
+		if first == nil {
+			first = m
+		}
+		a.Add(m)
+	}
+	a.Close()
+
+	got := c.records()
+	if len(got) != 2 {
+		t.Fatalf("got records %q, want 2", got)
+	}
+	want := "<4>Oct  1 12:00:00 router kernel: Oops: 0000\n Call Trace:\n"
+	if got[0] != want && got[1] != want {
+		t.Errorf("got records %q, want one to be %q", got, want)
+	}
+	if string(first.Syslog.Content) != "Oops: 0000\n Call Trace:" {
+		t.Errorf("record content = %q", first.Syslog.Content)
+	}
+}
+
+func TestAggregator_timeout(t *testing.T) {
+	c := &collector{}
+	a := New(Config{Indent: true, Timeout: 20 * time.Millisecond}, c.emit)
+	a.Add(&message.Message{Data: []byte("one\n"), Source: "a"})
+	a.Add(&message.Message{Data: []byte(" two\n"), Source: "a"})
+
+	deadline := time.Now().Add(time.Second)
+	for len(c.records()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := c.records(); len(got) != 1 || got[0] != "one\n two\n" {
+		t.Errorf("got records %q after the timeout", got)
+	}
+	a.Close()
+}
+
+func TestAggregator_maxGap(t *testing.T) {
+	c := &collector{}
+	a := New(Config{Indent: true, MaxGap: 10 * time.Millisecond}, c.emit)
+	a.Add(&message.Message{Data: []byte("one\n"), Source: "a"})
+	time.Sleep(30 * time.Millisecond)
+	a.Add(&message.Message{Data: []byte(" two\n"), Source: "a"})
+	a.Close()
+
+	if got := c.records(); len(got) != 2 {
+		t.Errorf("got records %q, want the late line on its own", got)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "indent", cfg: Config{Indent: true}},
+		{name: "gap", cfg: Config{MaxGap: time.Second}},
+		{name: "nothing", wantErr: true},
+		{name: "negative timeout", cfg: Config{Indent: true, Timeout: -time.Second}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package output
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+)
+
+var (
+	ClosedError          error = errors.New("output is closed")
+	DuplicateOutputError error = errors.New("duplicate output name")
+	UnknownOutputError   error = errors.New("no output by that name")
+)
+
+// dropLogInterval is how often a lossy sink that keeps dropping messages
+// says so.
+const dropLogInterval time.Duration = 10 * time.Second
+
+// Stats are the counters kept for every sink of a FanOut.
+type Stats struct {
+	Name    string
+	Written uint64
+	Errors  uint64
+	Dropped uint64 // the sink's queue was full, or it was aborted
+}
+
+type sink struct {
+	out   Output
+	queue chan *message.Message
+	lossy bool // drops messages when queue is full, instead of waiting
+
+	written     atomic.Uint64
+	errors      atomic.Uint64
+	dropped     atomic.Uint64
+	lastDropLog atomic.Int64 // unix nanoseconds
+}
+
+func (s *sink) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for m := range s.queue {
+		if err := s.out.Write(m); err != nil {
+			s.errors.Add(1)
+			slog.Error("sink.run(): error writing entry", "output", s.out.Name(), "error", err)
+			continue
+		}
+		s.written.Add(1)
+	}
+}
+
+// enqueue waits for room in the queue, unless the sink is lossy, or abort is
+// closed, in which case m is dropped.
+func (s *sink) enqueue(m *message.Message, abort <-chan struct{}) {
+	if s.lossy {
+		select {
+		case s.queue <- m:
+		default:
+			s.drop("queue is full")
+		}
+		return
+	}
+	select {
+	case s.queue <- m:
+	case <-abort:
+		s.drop("gave up waiting for room in the queue")
+	}
+}
+
+// drop counts a dropped message. it's logged the first time, and then at
+// most every dropLogInterval, with how many were dropped so far.
+func (s *sink) drop(why string) {
+	n := s.dropped.Add(1)
+	now, last := time.Now().UnixNano(), s.lastDropLog.Load()
+	if last != 0 && now-last < int64(dropLogInterval) {
+		return
+	}
+	if s.lastDropLog.CompareAndSwap(last, now) {
+		slog.Warn("sink.drop(): dropping messages", "output", s.out.Name(), "reason", why, "dropped", n)
+	}
+}
+
+func (s *sink) stats() Stats {
+	return Stats{
+		Name:    s.out.Name(),
+		Written: s.written.Load(),
+		Errors:  s.errors.Load(),
+		Dropped: s.dropped.Load(),
+	}
+}
+
+// FanOut writes every message to all of its default sinks, each one through
+// its own queue. A full queue holds up Write until there's room, which holds
+// up the connections, so nothing is lost. A lossy sink drops messages
+// instead, so only it misses out. A message with Output set goes to that sink
+// alone, which can be a default or a routed one.
+type FanOut struct {
+	defaults  []*sink
+	byName    map[string]*sink
+	wg        sync.WaitGroup
+	abort     chan struct{}
+	abortOnce sync.Once
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewFanOut starts a writer for every output. routed outputs only get the
+// messages a filter rule routed to them. names must be unique across both.
+// the outputs named in lossy drop messages when their queue is full.
+func NewFanOut(queueSize int, defaults, routed []Output, lossy []string) (*FanOut, error) {
+	seen := make(map[string]bool, len(defaults)+len(routed))
+	for _, o := range append(append([]Output(nil), defaults...), routed...) {
+		if seen[o.Name()] {
+			return nil, fmt.Errorf("%w <%v>", DuplicateOutputError, o.Name())
+		}
+		seen[o.Name()] = true
+	}
+	isLossy := make(map[string]bool, len(lossy))
+	for _, name := range lossy {
+		if !seen[name] {
+			return nil, fmt.Errorf("%w <%v>", UnknownOutputError, name)
+		}
+		isLossy[name] = true
+	}
+
+	f := &FanOut{byName: make(map[string]*sink), abort: make(chan struct{})}
+	add := func(o Output) *sink {
+		s := &sink{out: o, queue: make(chan *message.Message, queueSize), lossy: isLossy[o.Name()]}
+		f.byName[o.Name()] = s
+		f.wg.Add(1)
+		go s.run(&f.wg)
+		return s
+	}
+	for _, o := range defaults {
+		f.defaults = append(f.defaults, add(o))
+	}
+	for _, o := range routed {
+		add(o)
+	}
+	return f, nil
+}
+
+func (f *FanOut) Name() string { return "fanout" }
+
+// Write waits for room in the queue of every sink that isn't lossy, until
+// Abort is called. It only fails once the FanOut is closed.
+func (f *FanOut) Write(m *message.Message) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return ClosedError
+	}
+
+	if m.Output != "" {
+		if s, ok := f.byName[m.Output]; ok {
+			s.enqueue(m, f.abort)
+			return nil
+		}
+		slog.Warn("FanOut.Write(): no such output. using defaults", "output", m.Output)
+	}
+	for _, s := range f.defaults {
+		s.enqueue(m, f.abort)
+	}
+	return nil
+}
+
+// Abort makes Write stop waiting for room in full queues, dropping what
+// doesn't fit from then on. It's for when waiting any longer isn't an
+// option, like past the shutdown deadline.
+func (f *FanOut) Abort() {
+	f.abortOnce.Do(func() { close(f.abort) })
+}
+
+// Close waits for every queue to be written out, then closes the sinks.
+func (f *FanOut) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	for _, s := range f.byName {
+		close(s.queue)
+	}
+	f.mu.Unlock()
+
+	f.wg.Wait()
+
+	var errs []error
+	for _, s := range f.byName {
+		st := s.stats()
+		slog.Info(
+			"FanOut.Close(): closing output",
+			"output", st.Name,
+			"written", st.Written,
+			"errors", st.Errors,
+			"dropped", st.Dropped,
+		)
+		if err := s.out.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Stats returns the counters of every sink, sorted by name.
+func (f *FanOut) Stats() []Stats {
+	stats := make([]Stats, 0, len(f.byName))
+	for _, s := range f.byName {
+		stats = append(stats, s.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
@@ -0,0 +1,233 @@
+package output
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+)
+
+// (FOR TESTING ONLY) keeps everything written to it. if block is set,
+// every write waits on it first.
+type memOutput struct {
+	name  string
+	err   error
+	block chan struct{}
+
+	mu     sync.Mutex
+	got    []string
+	closed bool
+}
+
+func (o *memOutput) Name() string { return o.name }
+
+func (o *memOutput) Write(m *message.Message) error {
+	if o.block != nil {
+		<-o.block
+	}
+	if o.err != nil {
+		return o.err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.got = append(o.got, string(m.Data))
+	return nil
+}
+
+func (o *memOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	return nil
+}
+
+func (o *memOutput) lines() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string(nil), o.got...)
+}
+
+func TestFanOut_lossySinkDoesNotBlock(t *testing.T) {
+	fast := &memOutput{name: "fast"}
+	slow := &memOutput{name: "slow", block: make(chan struct{})}
+	f, err := NewFanOut(2, []Output{fast, slow}, nil, []string{"slow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			f.Write(&message.Message{Data: []byte("line\n")})
+			time.Sleep(time.Millisecond) // give the fast sink a chance to keep up
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Write() blocked on the lossy sink")
+	}
+
+	close(slow.block)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(fast.lines()); got != 10 {
+		t.Errorf("fast sink got %v lines, want 10", got)
+	}
+
+	stats := f.Stats()
+	if stats[1].Name != "slow" || stats[1].Dropped == 0 {
+		t.Errorf("slow sink stats %+v, want some dropped", stats[1])
+	}
+	if stats[1].Written+stats[1].Dropped != 10 {
+		t.Errorf("slow sink stats %+v don't add up to 10", stats[1])
+	}
+}
+
+func TestFanOut_fullQueueBlocks(t *testing.T) {
+	tests := []struct {
+		name        string
+		abort       bool
+		wantWritten uint64
+	}{
+		// 1 taken by the sink, 2 queued
+		{name: "until there's room", wantWritten: 5},
+		{name: "until aborted", abort: true, wantWritten: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slow := &memOutput{name: "slow", block: make(chan struct{})}
+			f, err := NewFanOut(2, []Output{slow}, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				for i := 0; i < 5; i++ {
+					f.Write(&message.Message{Data: []byte("line\n")})
+				}
+				close(done)
+			}()
+			select {
+			case <-done:
+				t.Fatal("Write() didn't wait for room in the queue")
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			if tt.abort {
+				f.Abort()
+				f.Abort() // twice is fine
+			} else {
+				close(slow.block)
+			}
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("Write() still blocked")
+			}
+			if tt.abort {
+				close(slow.block)
+			}
+			f.Close()
+
+			st := f.Stats()[0]
+			if st.Written != tt.wantWritten || st.Written+st.Dropped != 5 {
+				t.Errorf("Stats() = %+v, want %v written out of 5", st, tt.wantWritten)
+			}
+		})
+	}
+}
+
+func TestFanOut_routing(t *testing.T) {
+	a := &memOutput{name: "a"}
+	b := &memOutput{name: "b"}
+	lab := &memOutput{name: "lab"}
+	f, err := NewFanOut(10, []Output{a, b}, []Output{lab}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write(&message.Message{Data: []byte("everyone\n")})
+	f.Write(&message.Message{Data: []byte("lab only\n"), Output: "lab"})
+	f.Write(&message.Message{Data: []byte("b only\n"), Output: "b"})
+	f.Write(&message.Message{Data: []byte("unknown route\n"), Output: "nope"})
+	f.Close()
+
+	tests := []struct {
+		out  *memOutput
+		want []string
+	}{
+		{out: a, want: []string{"everyone\n", "unknown route\n"}},
+		{out: b, want: []string{"everyone\n", "b only\n", "unknown route\n"}},
+		{out: lab, want: []string{"lab only\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.out.name, func(t *testing.T) {
+			got := tt.out.lines()
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %q, want %q", got, tt.want)
+				}
+			}
+			if !tt.out.closed {
+				t.Errorf("output wasn't closed")
+			}
+		})
+	}
+}
+
+func TestFanOut_errorsAndClose(t *testing.T) {
+	broken := &memOutput{name: "broken", err: errors.New("disk on fire")}
+	f, err := NewFanOut(10, []Output{broken}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		f.Write(&message.Message{Data: []byte("line\n")})
+	}
+	f.Close()
+
+	if got := f.Stats()[0].Errors; got != 3 {
+		t.Errorf("got %v errors, want 3", got)
+	}
+	if err := f.Write(&message.Message{Data: []byte("late\n")}); err != ClosedError {
+		t.Errorf("Write() after Close() got %v, want %v", err, ClosedError)
+	}
+}
+
+func TestNewFanOut_duplicateNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults []Output
+		routed   []Output
+	}{
+		{name: "in the defaults", defaults: []Output{&memOutput{name: "file"}, &memOutput{name: "file"}}},
+		{name: "in the routed", routed: []Output{&memOutput{name: "lab"}, &memOutput{name: "lab"}}},
+		{name: "in both", defaults: []Output{&memOutput{name: "file"}}, routed: []Output{&memOutput{name: "file"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewFanOut(10, tt.defaults, tt.routed, nil); !errors.Is(err, DuplicateOutputError) {
+				t.Errorf("NewFanOut() error = %v, want %v", err, DuplicateOutputError)
+			}
+		})
+	}
+}
+
+func TestNewFanOut_unknownLossy(t *testing.T) {
+	_, err := NewFanOut(10, []Output{&memOutput{name: "file"}}, nil, []string{"stdout"})
+	if !errors.Is(err, UnknownOutputError) {
+		t.Errorf("NewFanOut() error = %v, want %v", err, UnknownOutputError)
+	}
+}
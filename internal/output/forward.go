@@ -0,0 +1,343 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/syslog"
+)
+
+const (
+	FormatRaw     string = "raw"
+	FormatRFC5424 string = "rfc5424"
+)
+
+// ForwardConfig describes an upstream collector.
+type ForwardConfig struct {
+	Name      string
+	Network   string // tcp, tls or udp
+	Address   string // host:port
+	TLSConfig *tls.Config
+	Format    string // FormatRaw or FormatRFC5424
+
+	// SpoolDir is where messages wait while the upstream is down. if it's
+	// empty they are dropped instead. SpoolMax caps the spool file in bytes.
+	SpoolDir string
+	SpoolMax int64
+
+	DialTimeout time.Duration
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+// Forward relays messages to an upstream collector. When the upstream can't
+// be reached, messages go to the spool and are replayed, in order, once it
+// comes back.
+type Forward struct {
+	cfg    ForwardConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu       sync.Mutex
+	conn     net.Conn
+	backoff  time.Duration
+	nextDial time.Time
+	spool    *spool
+}
+
+func NewForward(cfg ForwardConfig) (*Forward, error) {
+	switch cfg.Network {
+	case "tcp", "udp":
+	case "tls":
+		if cfg.TLSConfig == nil {
+			cfg.TLSConfig = &tls.Config{}
+		}
+	default:
+		return nil, fmt.Errorf("invalid forward network <%v>", cfg.Network)
+	}
+	switch cfg.Format {
+	case "":
+		cfg.Format = FormatRaw
+	case FormatRaw, FormatRFC5424:
+	default:
+		return nil, fmt.Errorf("invalid forward format <%v>", cfg.Format)
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 5 * time.Second
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 500 * time.Millisecond
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = max(cfg.MinBackoff, time.Minute)
+	}
+
+	f := &Forward{cfg: cfg, done: make(chan struct{})}
+	if cfg.SpoolDir != "" {
+		s, err := openSpool(filepath.Join(cfg.SpoolDir, cfg.Name+".spool"), cfg.SpoolMax)
+		if err != nil {
+			return nil, err
+		}
+		f.spool = s
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	go f.retry(ctx)
+	return f, nil
+}
+
+func (f *Forward) Name() string { return f.cfg.Name }
+
+// Write only returns an error if the message was lost for good.
+func (f *Forward) Write(m *message.Message) error {
+	line := f.format(m)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// anything already spooled has to go out first, or we'd reorder
+	if f.conn == nil || f.spool.pending() {
+		if !f.connect() || !f.replay() {
+			return f.spool.append(line)
+		}
+	}
+	if err := f.send(line); err != nil {
+		slog.Warn("Forward.Write(): lost upstream", "output", f.cfg.Name, "error", err)
+		f.disconnect()
+		return f.spool.append(line)
+	}
+	return nil
+}
+
+// Close stops retrying and closes the connection. whatever is still spooled
+// stays on disk for the next run.
+func (f *Forward) Close() error {
+	f.cancel()
+	<-f.done
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.disconnect()
+	return f.spool.close()
+}
+
+// retry keeps trying to empty the spool while no messages are coming in.
+func (f *Forward) retry(ctx context.Context) {
+	defer close(f.done)
+	t := time.NewTicker(f.cfg.MinBackoff)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			f.mu.Lock()
+			if f.spool.pending() && f.connect() {
+				f.replay()
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+func (f *Forward) format(m *message.Message) []byte {
+	if f.cfg.Format == FormatRFC5424 {
+		h := m.Syslog
+		if h == nil {
+			var err error
+			if h, err = syslog.Parse(m.Data); err != nil {
+				h = &syslog.Header{Facility: 1, Severity: 5, Content: bytes.TrimRight(m.Data, "\r\n")}
+			}
+		}
+		if h.Hostname == "" {
+			if host, _, err := net.SplitHostPort(m.Source); err == nil {
+				h = &syslog.Header{
+					Facility: h.Facility,
+					Severity: h.Severity,
+					Hostname: host,
+					Program:  h.Program,
+					Content:  h.Content,
+				}
+			}
+		}
+		return syslog.Format5424(h, m.Received)
+	}
+
+	if bytes.HasSuffix(m.Data, []byte("\n")) {
+		return m.Data
+	}
+	return append(m.Data[:len(m.Data):len(m.Data)], '\n')
+}
+
+// connect dials the upstream unless we're connected or still backing off.
+// must be called with f.mu held.
+func (f *Forward) connect() bool {
+	if f.conn != nil {
+		return true
+	}
+	if time.Now().Before(f.nextDial) {
+		return false
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	d := &net.Dialer{Timeout: f.cfg.DialTimeout}
+	if f.cfg.Network == "tls" {
+		conn, err = tls.DialWithDialer(d, "tcp", f.cfg.Address, f.cfg.TLSConfig)
+	} else {
+		conn, err = d.Dial(f.cfg.Network, f.cfg.Address)
+	}
+	if err != nil {
+		if f.backoff == 0 {
+			f.backoff = f.cfg.MinBackoff
+		} else {
+			f.backoff = min(2*f.backoff, f.cfg.MaxBackoff)
+		}
+		f.nextDial = time.Now().Add(f.backoff)
+		slog.Warn(
+			"Forward.connect(): error dialing upstream",
+			"output", f.cfg.Name,
+			"error", err,
+			"retry_in", f.backoff,
+		)
+		return false
+	}
+
+	slog.Info("Forward.connect(): connected to upstream", "output", f.cfg.Name, "address", f.cfg.Address)
+	f.conn, f.backoff = conn, 0
+	return true
+}
+
+func (f *Forward) disconnect() {
+	if f.conn == nil {
+		return
+	}
+	f.conn.Close()
+	f.conn = nil
+	f.nextDial = time.Now().Add(f.cfg.MinBackoff)
+}
+
+func (f *Forward) send(line []byte) error {
+	if f.cfg.Network == "udp" {
+		line = bytes.TrimRight(line, "\n") // one datagram is one message
+	}
+	f.conn.SetWriteDeadline(time.Now().Add(f.cfg.DialTimeout))
+	_, err := f.conn.Write(line)
+	return err
+}
+
+// replay sends everything in the spool. returns false if the upstream went
+// away again, in which case whatever wasn't sent stays spooled.
+func (f *Forward) replay() bool {
+	if !f.spool.pending() {
+		return true
+	}
+	err := f.spool.drain(f.send)
+	if err != nil {
+		slog.Warn("Forward.replay(): lost upstream while replaying", "output", f.cfg.Name, "error", err)
+		f.disconnect()
+		return false
+	}
+	slog.Info("Forward.replay(): spool replayed", "output", f.cfg.Name)
+	return true
+}
+
+var SpoolFullError error = errors.New("forward spool is full")
+
+// spool is an append-only file of newline terminated messages. a nil *spool
+// is a valid, always empty one that drops whatever is appended to it.
+type spool struct {
+	path string
+	max  int64
+	file *os.File
+	size int64
+}
+
+func openSpool(path string, max int64) (*spool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() > 0 {
+		slog.Info("openSpool(): found messages from a previous run", "path", path, "bytes", info.Size())
+	}
+	return &spool{path: path, max: max, file: file, size: info.Size()}, nil
+}
+
+func (s *spool) pending() bool {
+	return s != nil && s.size > 0
+}
+
+func (s *spool) append(line []byte) error {
+	if s == nil {
+		return errors.New("upstream is down and there's no spool")
+	}
+	if s.max > 0 && s.size+int64(len(line)) > s.max {
+		return SpoolFullError
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// drain hands every spooled line to send. if send fails, the lines that
+// weren't sent are written back.
+func (s *spool) drain(send func([]byte) error) error {
+	if _, err := s.file.Seek(0, 0); err != nil {
+		return err
+	}
+	r := bufio.NewReader(s.file)
+	var sendErr error
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			break
+		}
+		if sendErr = send(line); sendErr != nil {
+			// put back the line that failed, and everything after it
+			var rest bytes.Buffer
+			rest.Write(line)
+			rest.ReadFrom(r)
+			return errors.Join(sendErr, s.rewrite(rest.Bytes()))
+		}
+	}
+	return s.rewrite(nil)
+}
+
+func (s *spool) rewrite(b []byte) error {
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	n, err := s.file.Write(b) // O_APPEND, so this lands at the new end
+	s.size = int64(n)
+	return err
+}
+
+func (s *spool) close() error {
+	if s == nil {
+		return nil
+	}
+	return errors.Join(s.file.Sync(), s.file.Close())
+}
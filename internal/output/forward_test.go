@@ -0,0 +1,176 @@
+package output
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+)
+
+// (FOR TESTING ONLY) stands in for the upstream collector. every line it
+// reads is sent on the returned channel.
+func upstream(t *testing.T, l net.Listener) <-chan string {
+	t.Helper()
+	ch := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					ch <- line
+				}
+			}()
+		}
+	}()
+	return ch
+}
+
+func expectLines(t *testing.T, ch <-chan string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-ch:
+			if got != w {
+				t.Fatalf("upstream got %q, want %q", got, w)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for %q", w)
+		}
+	}
+}
+
+func TestForward_tcp(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := upstream(t, l)
+
+	f, err := NewForward(ForwardConfig{Name: "up", Network: "tcp", Address: l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	f.Write(&message.Message{Data: []byte("one\n")})
+	f.Write(&message.Message{Data: []byte("two without newline")})
+	expectLines(t, lines, "one\n", "two without newline\n")
+}
+
+func TestForward_spoolsWhileDown(t *testing.T) {
+	// grab a free port, then let it go so the upstream starts out down
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	f, err := NewForward(ForwardConfig{
+		Name:       "up",
+		Network:    "tcp",
+		Address:    addr,
+		SpoolDir:   t.TempDir(),
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, s := range []string{"a\n", "b\n", "c\n"} {
+		if err := f.Write(&message.Message{Data: []byte(s)}); err != nil {
+			t.Fatalf("Write() while down got error %v, want it spooled", err)
+		}
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := upstream(t, l)
+
+	// the retry loop should replay without any new message coming in
+	expectLines(t, lines, "a\n", "b\n", "c\n")
+
+	f.Write(&message.Message{Data: []byte("d\n")})
+	expectLines(t, lines, "d\n")
+}
+
+func TestForward_rfc5424OverUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	f, err := NewForward(ForwardConfig{
+		Name:    "up",
+		Network: "udp",
+		Address: pc.LocalAddr().String(),
+		Format:  FormatRFC5424,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	received := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		msg  *message.Message
+		want string
+	}{
+		{
+			name: "openwrt line gets the sender as hostname",
+			msg: &message.Message{
+				Data:     []byte("<30>Mar  1 12:30:00 hostapd: wlan0: hi\n"),
+				Source:   "10.0.0.7:40000",
+				Received: received,
+			},
+			want: "<30>1 2024-03-01T12:30:00Z 10.0.0.7 hostapd - - - wlan0: hi",
+		},
+		{
+			name: "no syslog header at all",
+			msg: &message.Message{
+				Data:     []byte("plain text\n"),
+				Source:   "10.0.0.7:40000",
+				Received: received,
+			},
+			want: "<13>1 2024-03-01T12:30:00Z 10.0.0.7 - - - - plain text",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := f.Write(tt.msg); err != nil {
+				t.Fatal(err)
+			}
+			pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+			b := make([]byte, 2048)
+			n, _, err := pc.ReadFrom(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(b[:n]); got != tt.want {
+				t.Errorf("upstream got %q, want %q", got, tt.want)
+			}
+			if strings.HasSuffix(string(b[:n]), "\n") {
+				t.Errorf("datagram shouldn't end in a newline")
+			}
+		})
+	}
+}
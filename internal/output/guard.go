@@ -0,0 +1,353 @@
+package output
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/zspekt/tcpLogger/internal/backup"
+	"github.com/zspekt/tcpLogger/internal/message"
+)
+
+// Policy is what a Guard does once removing backups didn't free enough
+// space.
+type Policy string
+
+const (
+	PolicyDrop  Policy = "drop"  // new messages are dropped
+	PolicyPause Policy = "pause" // reading from the sockets stops, see Guard.Wait
+	PolicySpill Policy = "spill" // messages go to a file in GuardConfig.SpillDir
+)
+
+const defCheckInterval time.Duration = 10 * time.Second
+
+var InvalidPolicyError error = errors.New("invalid disk policy")
+
+// GuardConfig is how a Guard keeps a File from filling up its filesystem.
+type GuardConfig struct {
+	// below MinFree bytes, the oldest backups of the file are removed until
+	// there's ResumeFree again. if that's not enough, Policy kicks in until
+	// there is. ResumeFree is raised to MinFree if it's lower
+	MinFree    uint64
+	ResumeFree uint64
+	Policy     Policy
+	SpillDir   string        // for PolicySpill. it should be on another filesystem
+	Interval   time.Duration // how often free space is checked. 10s if 0
+}
+
+// GuardStats are the counters of a Guard.
+type GuardStats struct {
+	Name           string `json:"name"`
+	Path           string `json:"path"`
+	Free           uint64 `json:"free"` // bytes, as of the last check
+	Low            bool   `json:"low"`  // Policy is in effect
+	Policy         Policy `json:"policy"`
+	RemovedBackups uint64 `json:"removed_backups"`
+	RemovedBytes   uint64 `json:"removed_bytes"`
+	Dropped        uint64 `json:"dropped"`
+	Spilled        uint64 `json:"spilled"`
+}
+
+// Guard is a File that watches the free space of the filesystem it's on.
+type Guard struct {
+	out    *File
+	spill  *File // nil unless the policy is PolicySpill
+	cfg    GuardConfig
+	statfs func(path string) (uint64, error) // free bytes at path
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu       sync.Mutex    // held while checking
+	low      atomic.Bool   // Policy is in effect
+	resumed  chan struct{} // closed once low is false again
+	resumeMu sync.Mutex
+
+	free           atomic.Uint64
+	removedBackups atomic.Uint64
+	removedBytes   atomic.Uint64
+	dropped        atomic.Uint64
+	spilled        atomic.Uint64
+}
+
+// NewGuardedFile is a File, protected as c says, guarded as c.Guard says,
+// which must not be nil. a spilled file is named like the file, and
+// protected the same way.
+func NewGuardedFile(name string, l *lumberjack.Logger, c FileConfig) (*Guard, error) {
+	g := c.Guard
+	switch g.Policy {
+	case PolicyDrop, PolicyPause:
+	case PolicySpill:
+		if g.SpillDir == "" {
+			return nil, errors.New("spilling needs a directory to spill to")
+		}
+	default:
+		return nil, fmt.Errorf("%w <%v>", InvalidPolicyError, g.Policy)
+	}
+
+	var spill *File
+	if g.Policy == PolicySpill {
+		spill = NewProtectedFile(name, &lumberjack.Logger{
+			Filename:   filepath.Join(g.SpillDir, filepath.Base(l.Filename)),
+			MaxSize:    l.MaxSize,
+			MaxAge:     l.MaxAge,
+			MaxBackups: l.MaxBackups,
+			LocalTime:  l.LocalTime,
+			Compress:   l.Compress,
+		}, c)
+	}
+	return newGuard(NewProtectedFile(name, l, c), spill, *g, freeSpace), nil
+}
+
+func newGuard(out, spill *File, c GuardConfig, statfs func(string) (uint64, error)) *Guard {
+	if c.ResumeFree < c.MinFree {
+		c.ResumeFree = c.MinFree
+	}
+	if c.Interval <= 0 {
+		c.Interval = defCheckInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &Guard{
+		out:    out,
+		spill:  spill,
+		cfg:    c,
+		statfs: statfs,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	g.check()
+	go g.runWithCtx(ctx)
+	return g
+}
+
+func (g *Guard) runWithCtx(ctx context.Context) {
+	defer close(g.done)
+	t := time.NewTicker(g.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			g.check()
+		}
+	}
+}
+
+func (g *Guard) Name() string { return g.out.Name() }
+
+// Filename is the path of the file being written to, when there's space.
+func (g *Guard) Filename() string { return g.out.Filename() }
+
+// SpillFilename is the path of the file written to when there isn't, if
+// it's spilled.
+func (g *Guard) SpillFilename() string {
+	if g.spill == nil {
+		return ""
+	}
+	return g.spill.Filename()
+}
+
+func (g *Guard) Write(m *message.Message) error {
+	if !g.low.Load() {
+		err := g.out.Write(m)
+		if !errors.Is(err, syscall.ENOSPC) {
+			return err
+		}
+		// don't wait for the next check to find out
+		if g.check(); !g.low.Load() {
+			return err
+		}
+	}
+
+	switch g.cfg.Policy {
+	case PolicySpill:
+		if err := g.spill.Write(m); err != nil {
+			return err
+		}
+		g.spilled.Add(1)
+		return nil
+	case PolicyPause:
+		// what was read before the sockets were paused. there's still
+		// the space between the thresholds and a full disk for it
+		return g.out.Write(m)
+	default:
+		g.dropped.Add(1)
+		return nil
+	}
+}
+
+// Wait returns a channel that's closed once reading from the sockets can go
+// on, or nil if it can right away. it's only ever not nil under
+// PolicyPause.
+func (g *Guard) Wait() <-chan struct{} {
+	if g.cfg.Policy != PolicyPause || !g.low.Load() {
+		return nil
+	}
+	g.resumeMu.Lock()
+	defer g.resumeMu.Unlock()
+	return g.resumed
+}
+
+// Close stops checking, and closes the file, and the spilled one.
+func (g *Guard) Close() error {
+	g.cancel()
+	<-g.done
+	st := g.Stats()
+	slog.Info(
+		"Guard.Close(): closing output",
+		"output", st.Name,
+		"removed_backups", st.RemovedBackups,
+		"removed_bytes", st.RemovedBytes,
+		"dropped", st.Dropped,
+		"spilled", st.Spilled,
+	)
+	err := g.out.Close()
+	if g.spill != nil {
+		err = errors.Join(err, g.spill.Close())
+	}
+	return err
+}
+
+func (g *Guard) Stats() GuardStats {
+	return GuardStats{
+		Name:           g.Name(),
+		Path:           g.Filename(),
+		Free:           g.free.Load(),
+		Low:            g.low.Load(),
+		Policy:         g.cfg.Policy,
+		RemovedBackups: g.removedBackups.Load(),
+		RemovedBytes:   g.removedBytes.Load(),
+		Dropped:        g.dropped.Load(),
+		Spilled:        g.spilled.Load(),
+	}
+}
+
+// check looks at the free space, removes backups if it's low, and puts
+// Policy in effect, or lifts it.
+func (g *Guard) check() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	dir := existingDir(filepath.Dir(g.Filename()))
+	free, err := g.statfs(dir)
+	if err != nil {
+		slog.Error("Guard.check(): can't tell how much space is left", "output", g.Name(), "dir", dir, "error", err)
+		return
+	}
+	if free < g.cfg.MinFree {
+		free = g.removeBackups(dir, free)
+	}
+	g.free.Store(free)
+
+	switch low := g.low.Load(); {
+	case !low && free < g.cfg.MinFree:
+		g.resumeMu.Lock()
+		g.resumed = make(chan struct{})
+		g.resumeMu.Unlock()
+		g.low.Store(true)
+		slog.Error("Guard.check(): disk space is low, and there are no backups left to remove. "+policyEffect[g.cfg.Policy],
+			"output", g.Name(), "free", free, "resume_free", g.cfg.ResumeFree, "spill", g.SpillFilename())
+	case low && free >= g.cfg.ResumeFree:
+		g.low.Store(false)
+		g.resumeMu.Lock()
+		close(g.resumed)
+		g.resumeMu.Unlock()
+		st := g.Stats()
+		slog.Warn("Guard.check(): disk space recovered. writing to the file again",
+			"output", g.Name(), "free", free, "dropped", st.Dropped, "spilled", st.Spilled)
+	}
+}
+
+var policyEffect = map[Policy]string{
+	PolicyDrop:  "dropping messages",
+	PolicyPause: "pausing reading from the sockets",
+	PolicySpill: "spilling messages to another file",
+}
+
+// removeBackups removes the backups of the file, oldest first, until
+// there's ResumeFree, and returns how much there is then.
+func (g *Guard) removeBackups(dir string, free uint64) uint64 {
+	files, err := backup.Files(g.Filename())
+	if err != nil {
+		slog.Error("Guard.removeBackups(): can't list backups", "output", g.Name(), "error", err)
+		return free
+	}
+	for _, f := range files {
+		if f == g.Filename() || free >= g.cfg.ResumeFree {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			slog.Error("Guard.removeBackups(): error removing backup", "output", g.Name(), "backup", f, "error", err)
+			continue
+		}
+		for _, sidecar := range backup.Sidecars(f) {
+			os.Remove(sidecar)
+		}
+		g.removedBackups.Add(1)
+		g.removedBytes.Add(uint64(fi.Size()))
+		slog.Warn("Guard.removeBackups(): disk space is low. removed the oldest backup", "output", g.Name(), "backup", f, "bytes", fi.Size(), "free", free)
+
+		if free, err = g.statfs(dir); err != nil {
+			slog.Error("Guard.removeBackups(): can't tell how much space is left", "output", g.Name(), "dir", dir, "error", err)
+			return 0
+		}
+	}
+	return free
+}
+
+// existingDir is dir, or the closest parent of it that exists, since
+// lumberjack only makes the directory of a file on the first write.
+func existingDir(dir string) string {
+	for {
+		_, err := os.Stat(dir)
+		if !errors.Is(err, os.ErrNotExist) || dir == filepath.Dir(dir) {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// freeSpace is how many bytes unprivileged users can still write to the
+// filesystem at path.
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// Guards lets reading from the sockets go on only while every one of them
+// does. see Guard.Wait.
+type Guards []*Guard
+
+func (gs Guards) Wait() <-chan struct{} {
+	for _, g := range gs {
+		if ch := g.Wait(); ch != nil {
+			return ch
+		}
+	}
+	return nil
+}
+
+// Stats returns the counters of every Guard.
+func (gs Guards) Stats() []GuardStats {
+	stats := make([]GuardStats, 0, len(gs))
+	for _, g := range gs {
+		stats = append(stats, g.Stats())
+	}
+	return stats
+}
@@ -0,0 +1,231 @@
+package output
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/zspekt/tcpLogger/internal/chain"
+	"github.com/zspekt/tcpLogger/internal/index"
+	"github.com/zspekt/tcpLogger/internal/message"
+)
+
+// (FOR TESTING ONLY) a filesystem of size bytes, holding what's in dir,
+// plus whatever else takes up the rest of it.
+type fakeDisk struct {
+	dir  string
+	size uint64
+
+	mu    sync.Mutex
+	other uint64
+}
+
+func (d *fakeDisk) statfs(string) (uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	used := d.other
+	filepath.Walk(d.dir, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			used += uint64(fi.Size())
+		}
+		return nil
+	})
+	if used > d.size {
+		return 0, nil
+	}
+	return d.size - used, nil
+}
+
+func (d *fakeDisk) fill(n uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.other = n
+}
+
+// backups writes n backups of 100 bytes of the file at path, oldest first,
+// each with a search index, and returns their paths.
+func backups(t *testing.T, path string, n int) []string {
+	t.Helper()
+	var paths []string
+	for i := 0; i < n; i++ {
+		b := strings.TrimSuffix(path, ".log") + "-2024-01-0" + string(rune('1'+i)) + "T10-00-00.000.log"
+		if err := os.WriteFile(b, []byte(strings.Repeat("x", 99)+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(index.Path(b), []byte("idx"), 0o644)
+		paths = append(paths, b)
+	}
+	return paths
+}
+
+func newTestGuard(t *testing.T, d *fakeDisk, c GuardConfig) *Guard {
+	t.Helper()
+	path := filepath.Join(d.dir, "app.log")
+	out := NewFile("file", &lumberjack.Logger{Filename: path})
+	var spill *File
+	if c.Policy == PolicySpill {
+		spill = NewFile("file", &lumberjack.Logger{Filename: filepath.Join(c.SpillDir, "app.log")})
+	}
+	g := newGuard(out, spill, c, d.statfs)
+	t.Cleanup(func() { g.Close() })
+	return g
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestGuard_removesOldestBackups(t *testing.T) {
+	d := &fakeDisk{dir: t.TempDir(), size: 1000}
+	path := filepath.Join(d.dir, "app.log")
+	old := backups(t, path, 3)
+	os.WriteFile(chain.Path(old[0]), []byte("chain"), 0o644)
+
+	// the backups and what goes with them take 314 of it, which leaves 95.
+	// 250 needs the oldest two gone, but not the last one
+	d.fill(1000 - 314 - 95)
+	g := newTestGuard(t, d, GuardConfig{MinFree: 150, ResumeFree: 250, Policy: PolicyDrop, Interval: time.Hour})
+
+	for i, b := range old {
+		removed := i < 2
+		if exists(b) == removed {
+			t.Errorf("backup %d exists = %v, want %v", i, exists(b), !removed)
+		}
+		if exists(index.Path(b)) == removed {
+			t.Errorf("index of backup %d exists = %v, want %v", i, exists(index.Path(b)), !removed)
+		}
+	}
+	if exists(chain.Path(old[0])) {
+		t.Error("chain of the oldest backup is still there")
+	}
+	st := g.Stats()
+	if st.Low || st.RemovedBackups != 2 || st.RemovedBytes != 200 {
+		t.Errorf("Stats() = %+v, want 2 backups of 100 bytes removed, and not low", st)
+	}
+}
+
+func TestGuard_policies(t *testing.T) {
+	tests := []struct {
+		policy      Policy
+		wantFile    []string
+		wantSpilled []string
+		wantDropped uint64
+	}{
+		{policy: PolicyDrop, wantFile: []string{"before"}, wantDropped: 1},
+		{policy: PolicySpill, wantFile: []string{"before"}, wantSpilled: []string{"while low"}},
+		// what was already read still makes it
+		{policy: PolicyPause, wantFile: []string{"before", "while low"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			d := &fakeDisk{dir: t.TempDir(), size: 1000}
+			spillDir := t.TempDir()
+			g := newTestGuard(t, d, GuardConfig{MinFree: 100, ResumeFree: 200, Policy: tt.policy, SpillDir: spillDir, Interval: time.Hour})
+
+			g.Write(&message.Message{Data: []byte("before\n")})
+			if g.Wait() != nil {
+				t.Fatal("Wait() != nil with enough space")
+			}
+			d.fill(950)
+			g.check()
+			wait := g.Wait()
+			if (wait != nil) != (tt.policy == PolicyPause) {
+				t.Errorf("Wait() = %v while low", wait)
+			}
+			if err := g.Write(&message.Message{Data: []byte("while low\n")}); err != nil {
+				t.Fatal(err)
+			}
+
+			// not enough to lift it yet
+			d.fill(850)
+			g.check()
+			if !g.Stats().Low {
+				t.Fatal("lifted below ResumeFree")
+			}
+			d.fill(0)
+			g.check()
+			if g.Stats().Low {
+				t.Fatal("still low above ResumeFree")
+			}
+			if wait != nil {
+				select {
+				case <-wait:
+				default:
+					t.Error("Wait() channel not closed once there's space")
+				}
+			}
+
+			if got := readLines(t, g.Filename()); !equal(got, tt.wantFile) {
+				t.Errorf("file has %q, want %q", got, tt.wantFile)
+			}
+			if got := readLines(t, filepath.Join(spillDir, "app.log")); !equal(got, tt.wantSpilled) {
+				t.Errorf("spilled %q, want %q", got, tt.wantSpilled)
+			}
+			if st := g.Stats(); st.Dropped != tt.wantDropped || st.Spilled != uint64(len(tt.wantSpilled)) {
+				t.Errorf("Stats() = %+v", st)
+			}
+		})
+	}
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNewGuardedFile(t *testing.T) {
+	l := &lumberjack.Logger{Filename: filepath.Join(t.TempDir(), "app.log")}
+	if _, err := NewGuardedFile("file", l, FileConfig{Guard: &GuardConfig{Policy: "panic"}}); err == nil {
+		t.Error("NewGuardedFile() with a bad policy = nil, want an error")
+	}
+	if _, err := NewGuardedFile("file", l, FileConfig{Guard: &GuardConfig{Policy: PolicySpill}}); err == nil {
+		t.Error("NewGuardedFile() spilling nowhere = nil, want an error")
+	}
+}
+
+func TestGuards_Wait(t *testing.T) {
+	dropDisk := &fakeDisk{dir: t.TempDir(), size: 1000}
+	pauseDisk := &fakeDisk{dir: t.TempDir(), size: 1000}
+	drop := newTestGuard(t, dropDisk, GuardConfig{MinFree: 100, Policy: PolicyDrop, Interval: time.Hour})
+	pause := newTestGuard(t, pauseDisk, GuardConfig{MinFree: 100, Policy: PolicyPause, Interval: time.Hour})
+	gs := Guards{drop, pause}
+
+	dropDisk.fill(1000)
+	drop.check()
+	if gs.Wait() != nil {
+		t.Error("Wait() != nil with only a dropping guard low")
+	}
+	pauseDisk.fill(1000)
+	pause.check()
+	if gs.Wait() == nil {
+		t.Error("Wait() = nil with a pausing guard low")
+	}
+	if got := gs.Stats(); len(got) != 2 || !got[0].Low || !got[1].Low {
+		t.Errorf("Stats() = %+v", got)
+	}
+}
@@ -0,0 +1,165 @@
+package output
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/zspekt/tcpLogger/internal/chain"
+	"github.com/zspekt/tcpLogger/internal/crypt"
+	"github.com/zspekt/tcpLogger/internal/message"
+)
+
+// Output is anything messages can be written to.
+type Output interface {
+	Name() string
+	Write(m *message.Message) error
+	Close() error
+}
+
+// File writes to a rotating file.
+type File struct {
+	name   string
+	logger *lumberjack.Logger
+	w      io.Writer     // what writes to logger
+	chain  *chain.Writer // nil unless the file is hash chained
+
+	onRotate func()      // nil unless FileConfig.OnRotate is set
+	cur      os.FileInfo // the file, as of the last look at it
+	left     int64       // about how much can be written before it's rotated
+}
+
+func NewFile(name string, l *lumberjack.Logger) *File {
+	return &File{name: name, logger: l, w: l}
+}
+
+// FileConfig is what a File does on top of writing.
+type FileConfig struct {
+	Chain   ChainConfig
+	Encrypt *crypt.Key   // nil to write in the clear
+	Guard   *GuardConfig // nil to not watch free space. see NewGuardedFile
+	// called once the file was rotated, a little after, by Write. it must
+	// not block
+	OnRotate func()
+}
+
+// ChainConfig is how a File keeps a hash chain of what it writes. see
+// package chain.
+type ChainConfig struct {
+	Key   ed25519.PrivateKey // checkpoints are signed with it. nil for no chain
+	Every time.Duration      // how often one is. 0 for only on rotation and Close
+}
+
+// NewProtectedFile is a File that encrypts what it writes, and keeps a hash
+// chain of what ends up in the file, as c says. the chain is over what's
+// written, so it can be verified without the key to decrypt it.
+func NewProtectedFile(name string, l *lumberjack.Logger, c FileConfig) *File {
+	f := NewFile(name, l)
+	f.onRotate = c.OnRotate
+	var under crypt.File = l
+	if c.Chain.Key != nil {
+		f.chain = chain.NewWriter(l, c.Chain.Key, c.Chain.Every)
+		f.w, under = f.chain, f.chain
+	}
+	if c.Encrypt != nil {
+		f.w = crypt.NewWriter(under, l.Filename, fileMaxSize(l), c.Encrypt)
+	}
+	return f
+}
+
+func (f *File) Name() string { return f.name }
+
+// Filename is the path of the file being written to.
+func (f *File) Filename() string { return f.logger.Filename }
+
+func (f *File) Write(m *message.Message) error {
+	_, err := f.w.Write(m.Data)
+	if f.onRotate != nil {
+		f.watchRotation(len(m.Data))
+	}
+	return err
+}
+
+// watchRotation calls onRotate once the file was rotated. lumberjack doesn't
+// tell, so the file is looked at once about as much was written as it takes
+// to fill it. an encrypted file fills up sooner, so it's noticed later.
+func (f *File) watchRotation(n int) {
+	if f.left -= int64(n); f.cur != nil && f.left > 0 {
+		return
+	}
+	fi, err := os.Stat(f.logger.Filename)
+	if err != nil {
+		return
+	}
+	if f.cur != nil && !os.SameFile(f.cur, fi) {
+		f.onRotate()
+	}
+	f.cur, f.left = fi, fileMaxSize(f.logger)-fi.Size()
+}
+
+// Close closes the file and fsyncs it, so nothing is left in the page cache
+// if we're shutting down. a chained file gets a last checkpoint first.
+func (f *File) Close() error {
+	var err error
+	if f.chain != nil {
+		err = f.chain.Close()
+	}
+	if cerr := f.logger.Close(); cerr != nil {
+		return errors.Join(err, cerr)
+	}
+	return errors.Join(err, syncFile(f.logger.Filename))
+}
+
+// fileMaxSize is how big l lets a file get before rotating it.
+func fileMaxSize(l *lumberjack.Logger) int64 {
+	if l.MaxSize == 0 {
+		return 100 * 1024 * 1024 // lumberjack's default
+	}
+	return int64(l.MaxSize) * 1024 * 1024
+}
+
+// syncFile fsyncs the file at path. lumberjack doesn't expose its *os.File,
+// but any descriptor for the file will do.
+func syncFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) { // nothing was ever written
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Writer writes to an io.Writer it doesn't own, like os.Stdout. Close is a
+// no-op.
+type Writer struct {
+	name string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriter(name string, w io.Writer) *Writer {
+	return &Writer{name: name, w: w}
+}
+
+func (w *Writer) Name() string { return w.name }
+
+func (w *Writer) Write(m *message.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.w.Write(m.Data)
+	return err
+}
+
+func (w *Writer) Close() error { return nil }
@@ -0,0 +1,28 @@
+package output
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+)
+
+func TestFile_OnRotate(t *testing.T) {
+	var rotations int
+	l := &lumberjack.Logger{Filename: filepath.Join(t.TempDir(), "app.log"), MaxSize: 1}
+	f := NewProtectedFile("file", l, FileConfig{OnRotate: func() { rotations++ }})
+	defer f.Close()
+
+	m := &message.Message{Data: append(bytes.Repeat([]byte("x"), 400*1024-1), '\n')}
+	for i, want := range []int{0, 0, 1, 1, 2, 2} {
+		if err := f.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		if rotations != want {
+			t.Fatalf("after write %d, rotations = %d, want %d", i+1, rotations, want)
+		}
+	}
+}
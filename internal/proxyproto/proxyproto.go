@@ -0,0 +1,143 @@
+// Package proxyproto reads the PROXY protocol headers load balancers put in
+// front of a connection, see
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const v1MaxLen int = 107 // including the CRLF
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	NoHeaderError      error = errors.New("no PROXY protocol header")
+	InvalidHeaderError error = errors.New("invalid PROXY protocol header")
+)
+
+// ReadHeader reads a v1 or v2 header off the start of r, and returns the
+// address of the client it describes. the address is nil for connections
+// the proxy opened itself, like health checks, and for clients that aren't
+// on tcp or udp.
+func ReadHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 'P':
+		return readV1(r)
+	case '\r':
+		return readV2(r)
+	default:
+		return nil, NoHeaderError
+	}
+}
+
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header without CRLF", InvalidHeaderError)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("%w: <%q>", InvalidHeaderError, line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: unknown protocol <%v>", InvalidHeaderError, fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: <%q>", InvalidHeaderError, line)
+	}
+
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: bad source address <%v>", InvalidHeaderError, fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad source port <%v>", InvalidHeaderError, fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:12], v2Signature) {
+		return nil, NoHeaderError
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", InvalidHeaderError, hdr[12]>>4)
+	}
+	cmd, family, proto := hdr[12]&0x0f, hdr[13]>>4, hdr[13]&0x0f
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unknown command %d", InvalidHeaderError, cmd)
+	}
+
+	var (
+		ip   netip.Addr
+		port uint16
+	)
+	switch family {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 addresses", InvalidHeaderError)
+		}
+		ip = netip.AddrFrom4([4]byte(body[0:4]))
+		port = binary.BigEndian.Uint16(body[8:10])
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 addresses", InvalidHeaderError)
+		}
+		ip = netip.AddrFrom16([16]byte(body[0:16]))
+		port = binary.BigEndian.Uint16(body[32:34])
+	default: // AF_UNSPEC, AF_UNIX
+		return nil, nil
+	}
+
+	ap := netip.AddrPortFrom(ip, port)
+	switch proto {
+	case 2: // DGRAM
+		return net.UDPAddrFromAddrPort(ap), nil
+	default:
+		return net.TCPAddrFromAddrPort(ap), nil
+	}
+}
@@ -0,0 +1,103 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// v2 builds a v2 header, version and command in verCmd, family and protocol
+// in famProto.
+func v2(verCmd, famProto byte, body ...byte) string {
+	hdr := append([]byte{}, v2Signature...)
+	hdr = append(hdr, verCmd, famProto, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(body)))
+	return string(append(hdr, body...))
+}
+
+func TestReadHeader(t *testing.T) {
+	v4 := []byte{
+		192, 0, 2, 1, // source
+		10, 0, 0, 1, // destination
+		0x30, 0x39, // source port, 12345
+		0x02, 0x02, // destination port, 514
+	}
+	v6 := make([]byte, 36)
+	v6[0], v6[1], v6[15] = 0x20, 0x01, 1
+	v6[32], v6[33] = 0x30, 0x39
+
+	tests := []struct {
+		name     string
+		in       string
+		want     string // "" for no address
+		wantRest string
+		wantErr  error
+	}{
+		{
+			name:     "v1 tcp4",
+			in:       "PROXY TCP4 192.0.2.1 10.0.0.1 12345 514\r\nhello\n",
+			want:     "192.0.2.1:12345",
+			wantRest: "hello\n",
+		},
+		{
+			name:     "v1 tcp6",
+			in:       "PROXY TCP6 2001:db8::1 2001:db8::2 12345 514\r\nhello\n",
+			want:     "[2001:db8::1]:12345",
+			wantRest: "hello\n",
+		},
+		{name: "v1 unknown", in: "PROXY UNKNOWN ff:ff::1 ::1 1 2\r\nhello\n", wantRest: "hello\n"},
+		{
+			name:     "v2 tcp over ipv4",
+			in:       v2(0x21, 0x11, v4...) + "hello\n",
+			want:     "192.0.2.1:12345",
+			wantRest: "hello\n",
+		},
+		{
+			name:     "v2 tcp over ipv6",
+			in:       v2(0x21, 0x21, v6...) + "hello\n",
+			want:     "[2001::1]:12345",
+			wantRest: "hello\n",
+		},
+		{
+			name:     "v2 with tlvs",
+			in:       v2(0x21, 0x11, append(v4, 0x04, 0x00, 0x01, 0xff)...) + "hello\n",
+			want:     "192.0.2.1:12345",
+			wantRest: "hello\n",
+		},
+		{name: "v2 local", in: v2(0x20, 0x00) + "hello\n", wantRest: "hello\n"},
+		{name: "no header", in: "<13>hello\n", wantErr: NoHeaderError},
+		{name: "v1 too long", in: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", wantErr: InvalidHeaderError},
+		{name: "v1 bad protocol", in: "PROXY UDP4 192.0.2.1 10.0.0.1 1 2\r\n", wantErr: InvalidHeaderError},
+		{name: "v1 mismatched family", in: "PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n", wantErr: InvalidHeaderError},
+		{name: "v1 bad port", in: "PROXY TCP4 192.0.2.1 10.0.0.1 http 2\r\n", wantErr: InvalidHeaderError},
+		{name: "v1 truncated", in: "PROXY TCP4 192.0.2.1", wantErr: io.EOF},
+		{name: "v2 bad version", in: v2(0x11, 0x11, v4...), wantErr: InvalidHeaderError},
+		{name: "v2 short addresses", in: v2(0x21, 0x11, v4[:4]...), wantErr: InvalidHeaderError},
+		{name: "v2 truncated", in: v2(0x21, 0x11, v4...)[:20], wantErr: io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.in))
+			got, err := ReadHeader(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadHeader() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (got == nil) != (tt.want == "") || (got != nil && got.String() != tt.want) {
+				t.Errorf("ReadHeader() = %v, want <%v>", got, tt.want)
+			}
+			if _, ok := got.(*net.TCPAddr); got != nil && !ok {
+				t.Errorf("ReadHeader() = %T, want *net.TCPAddr", got)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != tt.wantRest {
+				t.Errorf("left %q after the header, want %q", rest, tt.wantRest)
+			}
+		})
+	}
+}
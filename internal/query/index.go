@@ -0,0 +1,169 @@
+package query
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/backup"
+	"github.com/zspekt/tcpLogger/internal/crypt"
+	"github.com/zspekt/tcpLogger/internal/index"
+)
+
+// openIndex returns an up to date index of name, building it if it has to,
+// or nil if it can't. an index that was built or brought up to date is
+// saved for next time, if it can be.
+func openIndex(name string) *index.Index {
+	idx, changed, err := index.Update(name, loadIndex(name))
+	if err != nil {
+		slog.Debug("query.openIndex(): reading the whole file", "file", name, "error", err)
+		return nil
+	}
+	if changed {
+		if err := idx.Save(name); err != nil {
+			slog.Debug("query.openIndex(): couldn't save index", "file", name, "error", err)
+		}
+	}
+	return idx
+}
+
+// loadIndex returns the index saved for name, if there's one. a backup
+// lumberjack just compressed can use the index of the file it was.
+func loadIndex(name string) *index.Index {
+	idx, err := index.Load(name)
+	if err == nil {
+		return idx
+	}
+	if plain, ok := strings.CutSuffix(name, ".gz"); ok {
+		if idx, err := index.Load(plain); err == nil {
+			return idx
+		}
+	}
+	return nil
+}
+
+// IndexWithCtx keeps the indexes of path and of its backups up to date,
+// every interval, until ctx is canceled. the indexes of files that are
+// gone, like backups that were compressed or deleted, are removed.
+func IndexWithCtx(path string, interval time.Duration, ctx context.Context) {
+	slog.Info("query.IndexWithCtx(): starting routine...", "path", path, "interval", interval)
+	var (
+		cur  *index.Index        // kept around, it only has to be extended
+		done = map[string]bool{} // backups never change once indexed
+	)
+	for {
+		files, err := backup.Files(path)
+		if err != nil {
+			slog.Error("query.IndexWithCtx(): error listing files", "path", path, "error", err)
+		}
+		indexed := make(map[string]bool, len(files))
+		for _, name := range files {
+			if ctx.Err() != nil {
+				return
+			}
+			indexed[name] = true
+			if name != path && done[name] {
+				continue
+			}
+
+			if encrypted(name) {
+				if name != path {
+					done[name] = true
+				}
+				continue
+			}
+
+			idx := cur
+			if name != path || idx == nil {
+				idx = loadIndex(name)
+			}
+			idx, changed, err := index.Update(name, idx)
+			if err != nil {
+				if name == path {
+					cur = nil // it may have been left half updated
+				}
+				if !errors.Is(err, os.ErrNotExist) {
+					slog.Error("query.IndexWithCtx(): error indexing file", "file", name, "error", err)
+				}
+				continue
+			}
+			if changed {
+				if err := idx.Save(name); err != nil {
+					slog.Error("query.IndexWithCtx(): error saving index", "file", name, "error", err)
+					continue
+				}
+			}
+			if name == path {
+				cur = idx
+			} else {
+				done[name] = true
+			}
+		}
+		for name := range done {
+			if !indexed[name] {
+				delete(done, name)
+			}
+		}
+		removeOrphans(path)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// removeOrphans removes the indexes of path and its backups whose file is
+// gone.
+func removeOrphans(path string) {
+	dir := filepath.Dir(path)
+	base := filepath.Base(path)
+	prefix := strings.TrimSuffix(base, filepath.Ext(base)) + "-"
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), index.Suffix)
+		if !ok || (name != base && !strings.HasPrefix(name, prefix)) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		slog.Debug("query.removeOrphans(): removing index of a file that's gone", "file", name)
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("query.removeOrphans(): error removing index", "file", name, "error", err)
+		}
+	}
+}
+
+// encrypted reports whether name is an encrypted file, which can't be
+// indexed.
+func encrypted(name string) bool {
+	file, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return false
+		}
+		defer gz.Close()
+		r = gz
+	}
+	head := make([]byte, len(crypt.Magic))
+	n, _ := io.ReadFull(r, head)
+	return crypt.IsEncrypted(head[:n])
+}
@@ -0,0 +1,62 @@
+package query
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIndexWithCtx(t *testing.T) {
+	dir := logDir(t)
+	path := filepath.Join(dir, "app.log")
+	orphan := filepath.Join(dir, "app-2023-12-31T11-00-00.000.log.idx")
+	other := filepath.Join(dir, "other.log.idx")
+	for _, name := range []string{orphan, other} {
+		if err := os.WriteFile(name, []byte("{}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		IndexWithCtx(path, 10*time.Millisecond, ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	want := []string{
+		"app-2024-01-01T11-00-00.000.log.gz.idx",
+		"app-2024-01-02T11-00-00.000.log.idx",
+		"app.log.idx",
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, name := range want {
+		for {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%v was never written", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(orphan); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("the index of a file that's gone is still there")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("the index of some other file was removed: %v", err)
+	}
+}
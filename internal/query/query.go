@@ -0,0 +1,405 @@
+// Package query reads back what the file output wrote, rotated backups and
+// all, picking out the lines that match a Filter.
+package query
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/backup"
+	"github.com/zspekt/tcpLogger/internal/crypt"
+	"github.com/zspekt/tcpLogger/internal/index"
+	"github.com/zspekt/tcpLogger/internal/syslog"
+)
+
+// followPoll is how often a followed file is checked for new lines, and
+// for having been rotated.
+const followPoll time.Duration = 250 * time.Millisecond
+
+var (
+	NoKeyError           error = errors.New("file is encrypted, and no key was given to decrypt it")
+	FollowEncryptedError error = errors.New("an encrypted file can't be followed")
+)
+
+// Filter picks lines. see Any for one that picks all of them.
+//
+// the files only hold what was received, so Source is matched against the
+// hostname in the syslog header. a line without a syslog header is taken
+// as part of the one before it, like the continuation lines of a multi-line
+// message, and gets its timestamp, hostname and severity. a line whose
+// timestamp is unknown never matches Since or Until.
+type Filter struct {
+	Since, Until time.Time // zero for no bound. Until is exclusive
+	Source       string    // hostname. empty for any
+	Severity     int       // this severity or a more severe one. -1 for any
+	Regexp       *regexp.Regexp
+	Words        []string // every one of them, as split by index.Words
+}
+
+// Any is a Filter that matches everything.
+var Any = Filter{Severity: -1}
+
+// NewFilter builds a Filter out of the flags or parameters a user gave,
+// any of them empty for no restriction. since and until are as ParseTime
+// takes them, words are split the way index.Words does.
+func NewFilter(since, until, source, severity, regex, words string, now time.Time) (Filter, error) {
+	f := Any
+	f.Source = source
+	f.Words = index.Words(words)
+
+	var err error
+	if f.Since, err = ParseTime(since, now); err != nil {
+		return f, fmt.Errorf("invalid since: %w", err)
+	}
+	if f.Until, err = ParseTime(until, now); err != nil {
+		return f, fmt.Errorf("invalid until: %w", err)
+	}
+	if severity != "" {
+		s, ok := syslog.Severity(severity)
+		if !ok {
+			return f, fmt.Errorf("invalid severity <%v>", severity)
+		}
+		f.Severity = s
+	}
+	if regex != "" {
+		if f.Regexp, err = regexp.Compile(regex); err != nil {
+			return f, fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// ParseTime takes an RFC 3339 time, or a duration for that long before now.
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// line is what's known about a line after reading it, carried over to
+// the ones after it that have no syslog header.
+type line struct {
+	ts       time.Time
+	hostname string
+	severity int // -1 if unknown
+}
+
+// header fills in l from b, leaving it as it was if b has no syslog header.
+func (l *line) header(b []byte, ref time.Time) {
+	h, err := syslog.Parse(b)
+	if err != nil {
+		return
+	}
+	ts, _ := syslog.Timestamp(b, ref)
+	*l = line{ts: ts, hostname: h.Hostname, severity: h.Severity}
+}
+
+func (f *Filter) match(b []byte, l line) bool {
+	if !f.Since.IsZero() && (l.ts.IsZero() || l.ts.Before(f.Since)) {
+		return false
+	}
+	if !f.Until.IsZero() && (l.ts.IsZero() || !l.ts.Before(f.Until)) {
+		return false
+	}
+	if f.Source != "" && l.hostname != f.Source {
+		return false
+	}
+	if f.Severity >= 0 && (l.severity < 0 || l.severity > f.Severity) {
+		return false
+	}
+	if !index.HasWords(b, f.Words) {
+		return false
+	}
+	return f.Regexp == nil || f.Regexp.Match(b)
+}
+
+// indexed reports whether an index can narrow down what's read for f.
+func (f *Filter) indexed() bool {
+	return !f.Since.IsZero() || !f.Until.IsZero() || f.Source != "" || len(f.Words) > 0
+}
+
+func (f *Filter) indexQuery() index.Query {
+	return index.Query{Since: f.Since, Until: f.Until, Host: f.Source, Words: f.Words}
+}
+
+// write writes b to out if it matches, making sure it ends with a newline.
+func (f *Filter) write(out *bufio.Writer, b []byte, l line) {
+	if !f.match(b, l) {
+		return
+	}
+	out.Write(b)
+	if b[len(b)-1] != '\n' {
+		out.WriteByte('\n')
+	}
+}
+
+// Options are how RunWithCtx reads the files.
+type Options struct {
+	// keep waiting for more lines, across rotations, until ctx is canceled.
+	// the file can't be encrypted
+	Follow bool
+	// decrypts the files that were encrypted. they're read in full, the
+	// indexes only cover files in the clear
+	Key *crypt.Key
+}
+
+// RunWithCtx writes every line of the files of path that matches f to w.
+func RunWithCtx(path string, f Filter, o Options, w io.Writer, ctx context.Context) error {
+	files, err := backup.Files(path)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	for _, name := range files {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if name == path && o.Follow {
+			break // read below, so it's not opened twice
+		}
+		// a backup rotated before Since only holds older lines
+		if rotated, ok := backup.Time(path, name); ok && rotated.Before(f.Since) {
+			continue
+		}
+		if err := readFile(name, f, o.Key, out, ctx); err != nil {
+			return err
+		}
+	}
+	if !o.Follow {
+		return nil
+	}
+	return followWithCtx(path, f, out, ctx)
+}
+
+// readFile writes the lines of name that match f to out. if f can make use
+// of an index, only the parts of the file it points to are read. an
+// encrypted file is decrypted with key.
+func readFile(name string, f Filter, key *crypt.Key, out *bufio.Writer, ctx context.Context) error {
+	file, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) { // rotated away while we were at it
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	var (
+		gz *gzip.Reader
+		br *bufio.Reader // of gz, or of file
+	)
+	if strings.HasSuffix(name, ".gz") {
+		if gz, err = gzip.NewReader(file); err != nil {
+			return err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	} else {
+		br = bufio.NewReader(file)
+	}
+	if head, _ := br.Peek(len(crypt.Magic)); crypt.IsEncrypted(head) {
+		if key == nil {
+			return fmt.Errorf("%v: %w", name, NoKeyError)
+		}
+		r, err := crypt.NewReader(br, key)
+		if err != nil {
+			return fmt.Errorf("%v: %w", name, err)
+		}
+		err = readLines(r, line{severity: -1}, fi.ModTime(), f, out, ctx)
+		if errors.Is(err, crypt.TruncatedError) {
+			// likely still being written
+			slog.Debug("query.readFile(): file ends in the middle of a record", "file", name)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %w", name, err)
+		}
+		return nil
+	}
+
+	spans := []index.Span{{Start: 0, End: -1, State: index.State{Severity: -1}}}
+	if f.indexed() {
+		if idx := openIndex(name); idx != nil {
+			spans = idx.Spans(f.indexQuery())
+		}
+	}
+
+	var pos int64 // how far into gz we are
+	for _, sp := range spans {
+		if ctx.Err() != nil {
+			return nil
+		}
+		n := int64(math.MaxInt64) - sp.Start
+		if sp.End >= 0 {
+			n = sp.End - sp.Start
+		}
+		var r io.Reader
+		if gz != nil {
+			// there's no seeking in a gzip stream
+			if _, err := io.CopyN(io.Discard, br, sp.Start-pos); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			r = io.LimitReader(br, n)
+			pos = sp.End
+		} else {
+			r = io.NewSectionReader(file, sp.Start, n)
+		}
+
+		l := line{ts: sp.State.Time(), hostname: sp.State.Host, severity: sp.State.Severity}
+		if err := readLines(r, l, fi.ModTime(), f, out, ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLines writes the lines of r that match f to out, starting with l as
+// what's known about the line before them.
+func readLines(r io.Reader, l line, ref time.Time, f Filter, out *bufio.Writer, ctx context.Context) error {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		b, err := br.ReadBytes('\n')
+		if len(b) > 0 {
+			l.header(b, ref)
+			f.write(out, b, l)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n%1024 == 0 && ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// followWithCtx reads path from the start, then keeps reading what's
+// written to it. once it's rotated, what's left of the old file is read
+// before the new one is opened.
+func followWithCtx(path string, f Filter, out *bufio.Writer, ctx context.Context) error {
+	var (
+		file    *os.File
+		br      *bufio.Reader
+		partial []byte
+		l       = line{severity: -1}
+		checked bool // the file isn't encrypted
+	)
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	for {
+		if file == nil {
+			var err error
+			file, err = os.Open(path)
+			switch {
+			case errors.Is(err, os.ErrNotExist): // nothing was written yet
+			case err != nil:
+				return err
+			default:
+				br = bufio.NewReader(file)
+				checked = false
+			}
+		}
+		if file != nil && !checked {
+			head := make([]byte, len(crypt.Magic))
+			if n, _ := file.ReadAt(head, 0); n == len(head) {
+				if crypt.IsEncrypted(head) {
+					return fmt.Errorf("%v: %w", path, FollowEncryptedError)
+				}
+				checked = true
+			}
+		}
+
+		for br != nil {
+			b, err := br.ReadBytes('\n')
+			if err == io.EOF {
+				// the rest of the line hasn't been written yet
+				partial = append(partial, b...)
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if len(partial) > 0 {
+				b = append(partial, b...)
+				partial = nil
+			}
+			l.header(b, time.Now())
+			f.write(out, b, l)
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(followPoll):
+		}
+
+		if file != nil && rotated(file, path) {
+			slog.Debug("query.followWithCtx(): file was rotated. reopening it...", "path", path)
+			// lumberjack renames the file and creates a new one, so whatever
+			// was written since we last looked is still in the old one
+			if rest, _ := io.ReadAll(br); len(rest) > 0 {
+				for _, b := range bytes.SplitAfter(append(partial, rest...), []byte("\n")) {
+					if len(b) == 0 {
+						continue
+					}
+					l.header(b, time.Now())
+					f.write(out, b, l)
+				}
+			}
+			partial = nil
+			file.Close()
+			file, br = nil, nil
+		}
+	}
+}
+
+// rotated reports whether path is no longer the file that's open.
+func rotated(file *os.File, path string) bool {
+	open, err := file.Stat()
+	if err != nil {
+		return true
+	}
+	cur, err := os.Stat(path)
+	if err != nil {
+		return errors.Is(err, os.ErrNotExist)
+	}
+	if !os.SameFile(open, cur) {
+		return true
+	}
+	// truncated in place, like by copytruncate
+	pos, err := file.Seek(0, io.SeekCurrent)
+	return err == nil && cur.Size() < pos
+}
@@ -0,0 +1,288 @@
+package query
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/zspekt/tcpLogger/internal/crypt"
+)
+
+// logDir lays out a log file with a plain and a compressed backup, the
+// way lumberjack leaves them.
+func logDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(name, data string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("<11>1 2024-01-01T10:00:00Z router kernel - - - oldest\n"))
+	zw.Close()
+	write("app-2024-01-01T11-00-00.000.log.gz", gz.String())
+
+	write("app-2024-01-02T11-00-00.000.log",
+		"<14>1 2024-01-02T10:00:00Z router app - - - older\n"+
+			"<12>1 2024-01-02T10:30:00Z switch app - - - older warning\n")
+	write("app.log",
+		"<11>1 2024-01-03T10:00:00Z router kernel - - - Oops\n"+
+			" Call Trace:\n"+
+			"<14>1 2024-01-03T11:00:00Z router app - - - newest\n")
+	write("other-2024-01-02T11-00-00.000.log", "<14>1 2024-01-02T10:00:00Z router app - - - not ours\n")
+	return dir
+}
+
+func TestRunWithCtx(t *testing.T) {
+	day := func(d, h int) time.Time { return time.Date(2024, time.January, d, h, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name   string
+		filter func(f *Filter)
+		want   []string // what's after " - - - " on every line
+	}{
+		{
+			name:   "everything",
+			filter: func(*Filter) {},
+			want:   []string{"oldest", "older", "older warning", "Oops", " Call Trace:", "newest"},
+		},
+		{
+			name:   "since",
+			filter: func(f *Filter) { f.Since = day(2, 10) },
+			want:   []string{"older", "older warning", "Oops", " Call Trace:", "newest"},
+		},
+		{
+			name:   "time range",
+			filter: func(f *Filter) { f.Since, f.Until = day(2, 10), day(3, 11) },
+			want:   []string{"older", "older warning", "Oops", " Call Trace:"},
+		},
+		{
+			name:   "source",
+			filter: func(f *Filter) { f.Source = "switch" },
+			want:   []string{"older warning"},
+		},
+		{
+			name:   "severity",
+			filter: func(f *Filter) { f.Severity = 4 },
+			want:   []string{"oldest", "older warning", "Oops", " Call Trace:"},
+		},
+		{
+			name:   "regexp",
+			filter: func(f *Filter) { f.Regexp = regexp.MustCompile(`^<14>`) },
+			want:   []string{"older", "newest"},
+		},
+		{
+			name:   "keyword",
+			filter: func(f *Filter) { f.Words = []string{"oops"} },
+			want:   []string{"Oops"},
+		},
+		{
+			name:   "every keyword",
+			filter: func(f *Filter) { f.Words = []string{"older", "warning"} },
+			want:   []string{"older warning"},
+		},
+		{
+			name:   "keyword and source",
+			filter: func(f *Filter) { f.Source, f.Words = "router", []string{"app"} },
+			want:   []string{"older", "newest"},
+		},
+	}
+	dir := logDir(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Any
+			tt.filter(&f)
+			var out bytes.Buffer
+			if err := RunWithCtx(filepath.Join(dir, "app.log"), f, Options{}, &out, context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if len(got) != len(tt.want) {
+				t.Fatalf("RunWithCtx() got %q, want %q", got, tt.want)
+			}
+			for i, l := range got {
+				if _, msg, _ := strings.Cut(l, " - - - "); msg != tt.want[i] && l != tt.want[i] {
+					t.Errorf("line %d = %q, want %q", i, l, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRunWithCtx_index(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	var b strings.Builder
+	for i := 0; b.Len() < 512*1024; i++ {
+		fmt.Fprintf(&b, "<14>1 2024-01-03T10:%02d:%02dZ router app - - - line %06d padding\n", i/60%60, i%60, i)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(f Filter) []string {
+		t.Helper()
+		var out bytes.Buffer
+		if err := RunWithCtx(path, f, Options{}, &out, context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Fields(out.String())
+	}
+	f := Any
+	f.Words = []string{"000100"}
+	if got := search(f); !slices.Contains(got, "000100") {
+		t.Fatalf("RunWithCtx() = %q, want line 000100", got)
+	}
+	if _, err := os.Stat(path + ".idx"); err != nil {
+		t.Fatalf("no index was saved: %v", err)
+	}
+
+	// a word the index doesn't know about is in a block it rules out, so
+	// it's not found. the file isn't supposed to change like that, but
+	// it shows the block wasn't read
+	data := []byte(b.String())
+	at := bytes.LastIndex(data, []byte("padding"))
+	copy(data[at:], "hidden!")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f.Words = []string{"hidden"}
+	if got := search(f); len(got) != 0 {
+		t.Errorf("RunWithCtx() = %q, want nothing from the blocks the index ruled out", got)
+	}
+	f = Any
+	f.Regexp = regexp.MustCompile("hidden")
+	if got := search(f); len(got) == 0 {
+		t.Error("RunWithCtx() found nothing, want the line read without the index")
+	}
+}
+
+func TestRunWithCtx_encrypted(t *testing.T) {
+	dir := logDir(t)
+	path := filepath.Join(dir, "app.log")
+	keyPath := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyPath, []byte(strings.Repeat("ab", 32)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypt.LoadKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want bytes.Buffer
+	if err := RunWithCtx(path, Any, Options{}, &want, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same lines, encrypted, with the last one only partly written
+	plain, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path)
+	l := &lumberjack.Logger{Filename: path}
+	w := crypt.NewWriter(l, path, 1<<20, key)
+	for _, line := range strings.SplitAfter(string(plain), "\n") {
+		if line != "" {
+			w.Write([]byte(line))
+		}
+	}
+	io.WriteString(w, "<14>1 2024-01-03T12:00:00Z router app - - - cut off\n")
+	l.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, fi.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+	if err := RunWithCtx(path, Any, Options{Key: key}, &got, context.Background()); err != nil {
+		t.Fatalf("RunWithCtx() = %v", err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("RunWithCtx() = %q, want %q", got.String(), want.String())
+	}
+
+	if err := RunWithCtx(path, Any, Options{}, io.Discard, context.Background()); !errors.Is(err, NoKeyError) {
+		t.Errorf("RunWithCtx() without a key = %v, want %v", err, NoKeyError)
+	}
+	if err := RunWithCtx(path, Any, Options{Follow: true, Key: key}, io.Discard, context.Background()); !errors.Is(err, FollowEncryptedError) {
+		t.Errorf("RunWithCtx() following = %v, want %v", err, FollowEncryptedError)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be written while it's looked at.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRunWithCtx_follow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	l := &lumberjack.Logger{Filename: path}
+	defer l.Close()
+	l.Write([]byte("<14>1 2024-01-03T10:00:00Z router app - - - one\n"))
+
+	out := &syncBuffer{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- RunWithCtx(path, Any, Options{Follow: true}, out, ctx) }()
+
+	waitFor := func(s string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(out.String(), s) {
+			if time.Now().After(deadline) {
+				t.Fatalf("never got %q, got %q", s, out.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("one\n")
+
+	l.Write([]byte("<14>1 2024-01-03T10:00:01Z router app - - - two\n"))
+	// written right before the rotation, before the old file is looked at again
+	l.Write([]byte("<14>1 2024-01-03T10:00:02Z router app - - - three\n"))
+	if err := l.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	l.Write([]byte("<14>1 2024-01-03T10:00:03Z router app - - - four\n"))
+	waitFor("four\n")
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); strings.Count(got, "\n") != 4 || !strings.Contains(got, "three\n") {
+		t.Errorf("followed %q, want every line once", got)
+	}
+}
@@ -0,0 +1,215 @@
+package redact
+
+import (
+	"bytes"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// the built in detectors are written out by hand, except for the one for
+// emails, which only runs on what has an @. the regexes they'd take are
+// about 10 times slower, and they'd run on every message.
+
+type detector struct {
+	find      func(b []byte) [][2]int
+	normalize func(v []byte) []byte
+}
+
+var detectors = map[string]detector{
+	DetectorMAC:   {find: findMAC, normalize: normalizeMAC},
+	DetectorEmail: {find: findEmail, normalize: bytes.ToLower},
+	DetectorIPv6:  {find: findIPv6, normalize: normalizeIPv6},
+	DetectorIPv4:  {find: findIPv4},
+}
+
+// findMAC finds MAC addresses written as 6 pairs of hex digits split by
+// colons or dashes, or as 3 groups of 4 split by dots, the way Cisco does.
+// the ones that are part of a longer run of them aren't, they're something
+// else.
+func findMAC(b []byte) [][2]int {
+	var found [][2]int
+	for i := 0; i < len(b); i++ {
+		if !isHex(b[i]) || (i > 0 && isWord(b[i-1])) || carriesOn(b, i-1, ":-.", isHex) {
+			continue
+		}
+		e := macAt(b, i)
+		if e < 0 || (e < len(b) && isWord(b[e])) || carriesOn(b, e, ":-.", isHex) {
+			continue
+		}
+		found = append(found, [2]int{i, e})
+		i = e - 1
+	}
+	return found
+}
+
+// macAt returns where the MAC address at b[i:] ends, or -1 if there's none.
+func macAt(b []byte, i int) int {
+	if i+17 <= len(b) && (b[i+2] == ':' || b[i+2] == '-') {
+		sep := b[i+2]
+		for g := 0; g < 6; g++ {
+			at := i + 3*g
+			if !isHex(b[at]) || !isHex(b[at+1]) || (g < 5 && b[at+2] != sep) {
+				return -1
+			}
+		}
+		return i + 17
+	}
+	if i+14 <= len(b) && b[i+4] == '.' {
+		for g := 0; g < 3; g++ {
+			at := i + 5*g
+			for _, c := range b[at : at+4] {
+				if !isHex(c) {
+					return -1
+				}
+			}
+			if g < 2 && b[at+4] != '.' {
+				return -1
+			}
+		}
+		return i + 14
+	}
+	return -1
+}
+
+func normalizeMAC(v []byte) []byte {
+	out := make([]byte, 0, 12)
+	for _, c := range bytes.ToLower(v) {
+		if isHex(c) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// findIPv4 finds IPv4 addresses in dotted decimal. the ones that are part of
+// a longer run of numbers and dots, like version 1.2.3.4.5, aren't.
+func findIPv4(b []byte) [][2]int {
+	var found [][2]int
+	for i := 0; i < len(b); i++ {
+		if !isDigit(b[i]) || (i > 0 && isWord(b[i-1])) || carriesOn(b, i-1, ".", isDigit) {
+			continue
+		}
+		e := ipv4At(b, i)
+		if e < 0 || (e < len(b) && isWord(b[e])) || carriesOn(b, e, ".", isDigit) {
+			// not from the middle of it either
+			for i+1 < len(b) && (isDigit(b[i+1]) || b[i+1] == '.') {
+				i++
+			}
+			continue
+		}
+		found = append(found, [2]int{i, e})
+		i = e - 1
+	}
+	return found
+}
+
+// ipv4At returns where the IPv4 address at b[i:] ends, or -1 if there's
+// none.
+func ipv4At(b []byte, i int) int {
+	for part := 0; part < 4; part++ {
+		if part > 0 {
+			if i >= len(b) || b[i] != '.' {
+				return -1
+			}
+			i++
+		}
+		n, digits := 0, 0
+		for i < len(b) && isDigit(b[i]) && digits < 4 {
+			n = n*10 + int(b[i]-'0')
+			digits++
+			i++
+		}
+		if digits == 0 || digits > 3 || n > 255 || (digits > 1 && b[i-digits] == '0') {
+			return -1
+		}
+	}
+	return i
+}
+
+// findIPv6 finds IPv6 addresses, which can be written in so many ways that
+// netip tells whether a run of what they're made of is one.
+func findIPv6(b []byte) [][2]int {
+	var found [][2]int
+	for i := 0; i < len(b); i++ {
+		if c := b[i]; !isHex(c) && c != ':' {
+			continue
+		}
+		if i > 0 && (isWord(b[i-1]) || b[i-1] == ':' || b[i-1] == '.') {
+			continue
+		}
+		e := i
+		colons := 0
+		for e < len(b) && (isHex(b[e]) || b[e] == ':' || b[e] == '.') {
+			if b[e] == ':' {
+				colons++
+			}
+			e++
+		}
+		if colons >= 2 && (e == len(b) || !isWord(b[e])) {
+			// what comes after it, like the end of a sentence
+			end := e
+			if !isIPv6(b[i:end]) && (b[end-1] == '.' || b[end-1] == ':') {
+				end--
+			}
+			if isIPv6(b[i:end]) {
+				found = append(found, [2]int{i, end})
+			}
+		}
+		i = e - 1
+	}
+	return found
+}
+
+func isIPv6(v []byte) bool {
+	if !bytes.ContainsFunc(v, func(r rune) bool { return r != ':' }) {
+		return false // :: is one, but it's not what anyone would want redacted
+	}
+	a, err := netip.ParseAddr(string(v))
+	return err == nil && a.Is6()
+}
+
+func normalizeIPv6(v []byte) []byte {
+	a, err := netip.ParseAddr(string(v))
+	if err != nil {
+		return v
+	}
+	return []byte(a.String())
+}
+
+var email = regexp.MustCompile(`(?i)[a-z0-9._%+-]+@[a-z0-9-]+(?:\.[a-z0-9-]+)*\.[a-z]{2,}\b`)
+
+func findEmail(b []byte) [][2]int {
+	if bytes.IndexByte(b, '@') < 0 {
+		return nil
+	}
+	var found [][2]int
+	for _, m := range email.FindAllIndex(b, -1) {
+		found = append(found, [2]int{m[0], m[1]})
+	}
+	return found
+}
+
+// carriesOn reports whether b[at] is one of seps, with a digit, as digit
+// tells, on its other side. at is next to something that was found, so if
+// it does, that's part of something bigger.
+func carriesOn(b []byte, at int, seps string, digit func(byte) bool) bool {
+	if at < 0 || at >= len(b) || strings.IndexByte(seps, b[at]) < 0 {
+		return false
+	}
+	// which side at is on isn't known, so both are looked at. the side that
+	// was found is a digit anyway
+	return (at > 0 && digit(b[at-1])) && (at+1 < len(b) && digit(b[at+1]))
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isWord(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
@@ -0,0 +1,242 @@
+// Package redact replaces personal data in messages, like MAC and IP
+// addresses, before they're written anywhere.
+//
+// what's found by a rule can be masked, replaced with a fixed token, or
+// replaced with a keyed hash of it, so the same address always gets the same
+// token and can still be followed across the logs without being known.
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+)
+
+type Mode string
+
+const (
+	ModeMask  Mode = "mask"  // every letter and digit is replaced with a *
+	ModeToken Mode = "token" // the whole thing is replaced with Rule.Token
+	ModeHMAC  Mode = "hmac"  // replaced with a keyed hash of it, the same for the same value
+)
+
+// the built in detectors
+const (
+	DetectorMAC   string = "mac"
+	DetectorEmail string = "email"
+	DetectorIPv6  string = "ipv6"
+	DetectorIPv4  string = "ipv4"
+)
+
+// Detectors are the built in detectors, in the order they're best run in.
+// an IPv6 address can end in an IPv4 one, and a MAC address can look like
+// the start of an IPv6 one.
+var Detectors = []string{DetectorMAC, DetectorEmail, DetectorIPv6, DetectorIPv4}
+
+// how many bytes of the hash go in a ModeHMAC token
+const hashSize int = 8
+
+var (
+	InvalidModeError     error = errors.New("invalid redaction mode")
+	UnknownDetectorError error = errors.New("unknown detector")
+	InvalidRuleError     error = errors.New("a rule needs either a detector or a regex")
+	NoKeyError           error = errors.New("hmac mode needs a key")
+)
+
+// Rule is what to look for, and what to replace it with.
+type Rule struct {
+	Name     string `json:"name"`     // goes in the tokens. the detector if empty
+	Detector string `json:"detector"` // one of Detectors
+	Regex    string `json:"regex"`    // or a regex. if it has groups, only the first one is replaced
+	Mode     Mode   `json:"mode"`     // ModeMask if empty
+	Token    string `json:"token"`    // for ModeToken. [name] if empty
+}
+
+type rules struct {
+	Rules []Rule `json:"rules"`
+}
+
+// LoadRules reads a rules file, a JSON object with a list of Rule under
+// "rules".
+func LoadRules(path string) ([]Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r rules
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return r.Rules, nil
+}
+
+// Config describes what a Redactor does.
+type Config struct {
+	Rules []Rule // run in order, each over what the ones before it left
+	Key   []byte // what ModeHMAC hashes with
+}
+
+type rule struct {
+	name  string
+	mode  Mode
+	token []byte
+
+	// find returns where in b what the rule looks for is, in order, as
+	// start and end offsets
+	find func(b []byte) [][2]int
+	// normalize turns the ways of writing the same value into one, so it
+	// gets the same ModeHMAC token. nil to take it as is
+	normalize func(v []byte) []byte
+}
+
+// Redactor replaces what its rules find. it's safe for concurrent use.
+type Redactor struct {
+	rules []rule
+	key   []byte
+}
+
+func New(c Config) (*Redactor, error) {
+	r := &Redactor{key: c.Key}
+	for i, cr := range c.Rules {
+		var ru rule
+		switch {
+		case cr.Detector != "" && cr.Regex == "":
+			d, ok := detectors[cr.Detector]
+			if !ok {
+				return nil, fmt.Errorf("rule %d: %w <%v>", i, UnknownDetectorError, cr.Detector)
+			}
+			ru = rule{name: cr.Detector, find: d.find, normalize: d.normalize}
+		case cr.Regex != "" && cr.Detector == "":
+			re, err := regexp.Compile(cr.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+			ru = rule{name: "redacted", find: findRegexp(re)}
+		default:
+			return nil, fmt.Errorf("rule %d: %w", i, InvalidRuleError)
+		}
+		if cr.Name != "" {
+			ru.name = cr.Name
+		}
+
+		ru.mode = cr.Mode
+		switch ru.mode {
+		case "":
+			ru.mode = ModeMask
+		case ModeMask:
+		case ModeToken:
+			ru.token = []byte(cr.Token)
+			if cr.Token == "" {
+				ru.token = []byte("[" + ru.name + "]")
+			}
+		case ModeHMAC:
+			if len(c.Key) == 0 {
+				return nil, fmt.Errorf("rule %d: %w", i, NoKeyError)
+			}
+		default:
+			return nil, fmt.Errorf("rule %d: %w <%v>", i, InvalidModeError, cr.Mode)
+		}
+		r.rules = append(r.rules, ru)
+	}
+	return r, nil
+}
+
+// Redact redacts m.Data, and whatever else of m ends up in the outputs: its
+// source address, and the hostname and content of its syslog header.
+func (r *Redactor) Redact(m *message.Message) {
+	m.Data = r.Bytes(m.Data)
+	m.Source = string(r.Bytes([]byte(m.Source)))
+	if m.Syslog != nil {
+		m.Syslog.Hostname = string(r.Bytes([]byte(m.Syslog.Hostname)))
+		m.Syslog.Content = r.Bytes(m.Syslog.Content)
+	}
+}
+
+// Bytes returns b redacted. b is returned as is if there's nothing to do.
+func (r *Redactor) Bytes(b []byte) []byte {
+	for i := range r.rules {
+		b = r.replace(&r.rules[i], b)
+	}
+	return b
+}
+
+func (r *Redactor) replace(ru *rule, b []byte) []byte {
+	found := ru.find(b)
+	if len(found) == 0 {
+		return b
+	}
+	out := make([]byte, 0, len(b)+16*len(found))
+	last := 0
+	for _, f := range found {
+		out = append(out, b[last:f[0]]...)
+		out = r.replacement(out, ru, b[f[0]:f[1]])
+		last = f[1]
+	}
+	return append(out, b[last:]...)
+}
+
+// findRegexp finds what re matches, or its first group if it has groups.
+func findRegexp(re *regexp.Regexp) func(b []byte) [][2]int {
+	if re.NumSubexp() == 0 {
+		return func(b []byte) [][2]int {
+			var found [][2]int
+			for _, m := range re.FindAllIndex(b, -1) {
+				if m[0] < m[1] {
+					found = append(found, [2]int{m[0], m[1]})
+				}
+			}
+			return found
+		}
+	}
+	return func(b []byte) [][2]int {
+		var found [][2]int
+		for _, m := range re.FindAllSubmatchIndex(b, -1) {
+			if m[2] >= 0 && m[2] < m[3] {
+				found = append(found, [2]int{m[2], m[3]})
+			}
+		}
+		return found
+	}
+}
+
+// replacement appends what v is replaced with to out.
+func (r *Redactor) replacement(out []byte, ru *rule, v []byte) []byte {
+	switch ru.mode {
+	case ModeToken:
+		return append(out, ru.token...)
+	case ModeHMAC:
+		if ru.normalize != nil {
+			v = ru.normalize(v)
+		}
+		h := hmac.New(sha256.New, r.key)
+		h.Write([]byte(ru.name))
+		h.Write([]byte{0})
+		h.Write(v)
+		sum := h.Sum(nil)
+		out = append(out, '[')
+		out = append(out, ru.name...)
+		out = append(out, ':')
+		out = append(out, hex.EncodeToString(sum[:hashSize])...)
+		return append(out, ']')
+	default:
+		for len(v) > 0 {
+			c, size := utf8.DecodeRune(v)
+			if unicode.IsLetter(c) || unicode.IsDigit(c) {
+				out = append(out, '*')
+			} else {
+				out = append(out, v[:size]...)
+			}
+			v = v[size:]
+		}
+		return out
+	}
+}
@@ -0,0 +1,179 @@
+package redact
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/syslog"
+)
+
+// builtin is a rule for every built in detector, in mode.
+func builtin(mode Mode) []Rule {
+	var rules []Rule
+	for _, d := range Detectors {
+		rules = append(rules, Rule{Detector: d, Mode: mode})
+	}
+	return rules
+}
+
+func TestRedactor_Bytes(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	tests := []struct {
+		name string
+		cfg  Config
+		in   string
+		want string
+	}{
+		{name: "nothing to do", cfg: Config{Rules: builtin(ModeMask)}, in: "<14>nothing here\n", want: "<14>nothing here\n"},
+		{
+			name: "mac masked",
+			cfg:  Config{Rules: builtin(ModeMask)},
+			in:   "DHCPACK to 00:1A:2b:3c:4d:5e (phone)\n",
+			want: "DHCPACK to **:**:**:**:**:** (phone)\n",
+		},
+		{name: "mac with dashes", cfg: Config{Rules: builtin(ModeToken)}, in: "sta 00-1a-2b-3c-4d-5e left", want: "sta [mac] left"},
+		{name: "cisco mac", cfg: Config{Rules: builtin(ModeToken)}, in: "sta 001a.2b3c.4d5e left", want: "sta [mac] left"},
+		{name: "longer than a mac", cfg: Config{Rules: builtin(ModeToken)}, in: "id 00:1a:2b:3c:4d:5e:6f", want: "id 00:1a:2b:3c:4d:5e:6f"},
+		{name: "ipv4", cfg: Config{Rules: builtin(ModeToken)}, in: "from 192.168.1.20:5353 to 10.0.0.1.", want: "from [ipv4]:5353 to [ipv4]."},
+		{name: "not an ipv4", cfg: Config{Rules: builtin(ModeToken)}, in: "version 1.2.3.4.5, 256.1.1.1", want: "version 1.2.3.4.5, 256.1.1.1"},
+		{name: "ipv6", cfg: Config{Rules: builtin(ModeToken)}, in: "from fe80::1ff:fe23:4567:890a and [2001:db8::1]:53", want: "from [ipv6] and [[ipv6]]:53"},
+		{name: "ipv6 ending a sentence", cfg: Config{Rules: builtin(ModeToken)}, in: "lease for fe80::1. renewed 2001:db8::2:", want: "lease for [ipv6]. renewed [ipv6]:"},
+		{name: "ipv6 with an ipv4", cfg: Config{Rules: builtin(ModeToken)}, in: "from ::ffff:192.0.2.1 ok", want: "from [ipv6] ok"},
+		{
+			name: "not an ipv6",
+			cfg:  Config{Rules: builtin(ModeToken)},
+			in:   "<14>1 2024-01-03T10:00:00Z at 10:00:00 std::vector ::",
+			want: "<14>1 2024-01-03T10:00:00Z at 10:00:00 std::vector ::",
+		},
+		{name: "email", cfg: Config{Rules: builtin(ModeToken)}, in: "login Jane.Doe+x@Example.co.uk ok", want: "login [email] ok"},
+		{name: "custom token", cfg: Config{Rules: []Rule{{Detector: DetectorIPv4, Mode: ModeToken, Token: "x.x.x.x"}}}, in: "from 10.0.0.1", want: "from x.x.x.x"},
+		{
+			name: "custom regex group",
+			cfg:  Config{Rules: []Rule{{Name: "user", Regex: `user=(\S+)`, Mode: ModeToken}}},
+			in:   "auth ok user=jdoe from 10.0.0.1",
+			want: "auth ok user=[user] from 10.0.0.1",
+		},
+		{
+			name: "custom regex masked",
+			cfg:  Config{Rules: []Rule{{Regex: `jdoe|asmith`}}},
+			in:   "jdoe and asmith",
+			want: "**** and ******",
+		},
+		{
+			name: "hmac",
+			cfg:  Config{Rules: builtin(ModeHMAC), Key: key},
+			in:   "00:1a:2b:3c:4d:5e",
+			want: "[mac:" + hash(key, "mac", "001a2b3c4d5e") + "]",
+		},
+		{
+			name: "hmac, written another way",
+			cfg:  Config{Rules: builtin(ModeHMAC), Key: key},
+			in:   "001A.2B3C.4D5E",
+			want: "[mac:" + hash(key, "mac", "001a2b3c4d5e") + "]",
+		},
+		{
+			name: "hmac ipv6",
+			cfg:  Config{Rules: builtin(ModeHMAC), Key: key},
+			in:   "2001:DB8:0:0::1",
+			want: "[ipv6:" + hash(key, "ipv6", "2001:db8::1") + "]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Bytes([]byte(tt.in)); string(got) != tt.want {
+				t.Errorf("Bytes(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// hash is the ModeHMAC token of v without the brackets and the name,
+// worked out through another rule that replaces the whole of it.
+func hash(key []byte, name, v string) string {
+	r, _ := New(Config{Rules: []Rule{{Name: name, Regex: `.+`, Mode: ModeHMAC}}, Key: key})
+	out := string(r.Bytes([]byte(v)))
+	return strings.TrimSuffix(strings.TrimPrefix(out, "["+name+":"), "]")
+}
+
+func TestRedactor_hmacKeys(t *testing.T) {
+	in := []byte("10.0.0.1")
+	a, _ := New(Config{Rules: builtin(ModeHMAC), Key: []byte("one key")})
+	b, _ := New(Config{Rules: builtin(ModeHMAC), Key: []byte("another key")})
+	if string(a.Bytes(in)) == string(b.Bytes(in)) {
+		t.Errorf("got %q for both keys, want different tokens", a.Bytes(in))
+	}
+	if string(a.Bytes(in)) != string(a.Bytes(in)) {
+		t.Error("got different tokens for the same value")
+	}
+}
+
+func TestRedactor_Redact(t *testing.T) {
+	r, err := New(Config{Rules: builtin(ModeToken)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &message.Message{
+		Data:   []byte("<14>Jan  3 10:00:00 10.0.0.5 dnsmasq: query from 10.0.0.7\n"),
+		Source: "10.0.0.5:41234",
+		Syslog: &syslog.Header{Hostname: "10.0.0.5", Program: "dnsmasq", Content: []byte("query from 10.0.0.7")},
+	}
+	r.Redact(m)
+	if got, want := string(m.Data), "<14>Jan  3 10:00:00 [ipv4] dnsmasq: query from [ipv4]\n"; got != want {
+		t.Errorf("Data = %q, want %q", got, want)
+	}
+	if m.Source != "[ipv4]:41234" {
+		t.Errorf("Source = %q, want it redacted", m.Source)
+	}
+	if m.Syslog.Hostname != "[ipv4]" || string(m.Syslog.Content) != "query from [ipv4]" {
+		t.Errorf("Syslog = %+v, want its hostname and content redacted", m.Syslog)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr error
+	}{
+		{name: "no rules"},
+		{name: "built in", cfg: Config{Rules: builtin(ModeMask)}},
+		{name: "unknown detector", cfg: Config{Rules: []Rule{{Detector: "ssn"}}}, wantErr: UnknownDetectorError},
+		{name: "neither", cfg: Config{Rules: []Rule{{Name: "empty"}}}, wantErr: InvalidRuleError},
+		{name: "both", cfg: Config{Rules: []Rule{{Detector: DetectorMAC, Regex: "x"}}}, wantErr: InvalidRuleError},
+		{name: "bad mode", cfg: Config{Rules: []Rule{{Detector: DetectorMAC, Mode: "hide"}}}, wantErr: InvalidModeError},
+		{name: "hmac without a key", cfg: Config{Rules: builtin(ModeHMAC)}, wantErr: NoKeyError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.cfg); !errors.Is(err, tt.wantErr) {
+				t.Errorf("New() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	if _, err := New(Config{Rules: []Rule{{Regex: "("}}}); err == nil {
+		t.Error("New() with a bad regex = nil, want an error")
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redact.json")
+	data := `{"rules": [{"detector": "mac", "mode": "hmac"}, {"name": "user", "regex": "user=(\\S+)"}]}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Mode != ModeHMAC || rules[1].Regex != `user=(\S+)` {
+		t.Errorf("LoadRules() = %+v", rules)
+	}
+}
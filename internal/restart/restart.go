@@ -0,0 +1,135 @@
+// Package restart hands our listeners over to a new copy of ourselves, so a
+// new version can be deployed without closing them. the sockets are passed
+// the way systemd passes them, see package systemd.
+package restart
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readyFDEnv holds the fd the new process writes to once it's ready.
+const readyFDEnv string = "TCPLOGGER_READY_FD"
+
+var NotReadyError error = errors.New("new process exited before it was ready")
+
+// Start execs the binary we were started from, with the same arguments and
+// environment, passing it files as LISTEN_FDS named names. it waits up to
+// timeout for the new process to call Ready, and kills it if it doesn't.
+func Start(files []*os.File, names []string, timeout time.Duration) (*os.Process, error) {
+	exe, err := executable()
+	if err != nil {
+		return nil, err
+	}
+	return start(exe, os.Args, files, names, timeout)
+}
+
+func start(
+	exe string,
+	args []string,
+	files []*os.File,
+	names []string,
+	timeout time.Duration,
+) (*os.Process, error) {
+	if len(files) != len(names) {
+		return nil, fmt.Errorf("%d files, but %d names", len(files), len(names))
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	procFiles := append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...)
+	procFiles = append(procFiles, w)
+	readyFD := len(procFiles) - 1
+
+	p, err := os.StartProcess(exe, args, &os.ProcAttr{
+		Env:   environ(names, readyFD),
+		Files: procFiles,
+	})
+	// only the new process may hold the write end, so a read fails as soon
+	// as it exits
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+		if err == nil {
+			return p, nil
+		}
+		err = NotReadyError
+	case <-time.After(timeout):
+		err = fmt.Errorf("new process wasn't ready after %v", timeout)
+	}
+	p.Kill()
+	go p.Wait()
+	return nil, err
+}
+
+// environ is ours, with whatever sockets we were passed swapped for the
+// ones we're passing on.
+func environ(names []string, readyFD int) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		switch k, _, _ := strings.Cut(kv, "="); k {
+		// WATCHDOG_PID would be ours, which would keep the new process
+		// from feeding the watchdog
+		case "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "WATCHDOG_PID", readyFDEnv:
+		default:
+			env = append(env, kv)
+		}
+	}
+
+	escaped := make([]string, len(names))
+	for i, n := range names {
+		escaped[i] = url.QueryEscape(n)
+	}
+	return append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(names)),
+		"LISTEN_FDNAMES="+strings.Join(escaped, ":"),
+		readyFDEnv+"="+strconv.Itoa(readyFD),
+	)
+}
+
+// executable is the path of our binary. if it was replaced on disk, which
+// is the point of restarting, the kernel reports the old one as deleted.
+func executable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(exe, " (deleted)"), nil
+}
+
+// Ready tells the process that started us, if this is a restart, that
+// we've taken over the listeners. it's a no-op otherwise.
+func Ready() error {
+	s := os.Getenv(readyFDEnv)
+	if s == "" {
+		return nil
+	}
+	os.Unsetenv(readyFDEnv)
+
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid %v <%v>", readyFDEnv, s)
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
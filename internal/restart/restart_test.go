@@ -0,0 +1,129 @@
+package restart
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/systemd"
+)
+
+const helperEnv string = "RESTART_TEST_HELPER"
+
+// TestHelperProcess is the new process the tests start. it does nothing
+// unless run by one of them.
+func TestHelperProcess(t *testing.T) {
+	switch os.Getenv(helperEnv) {
+	case "":
+		return
+	case "serve":
+		socks, err := systemd.Sockets()
+		if err != nil || len(socks) != 1 || socks[0].Name != "tcp://127.0.0.1:514" || socks[0].Listener == nil {
+			os.Exit(2)
+		}
+		if os.Getenv("WATCHDOG_PID") != "" {
+			os.Exit(3)
+		}
+		if err := Ready(); err != nil {
+			os.Exit(4)
+		}
+		conn, err := socks[0].Listener.Accept()
+		if err != nil {
+			os.Exit(5)
+		}
+		conn.Write([]byte("new process\n"))
+		conn.Close()
+		os.Exit(0)
+	case "die":
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+}
+
+func startHelper(t *testing.T, mode string, timeout time.Duration) (net.Listener, *os.Process, error) {
+	t.Helper()
+	t.Setenv(helperEnv, mode)
+	t.Setenv("WATCHDOG_PID", "1")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	p, err := start(
+		os.Args[0],
+		[]string{os.Args[0], "-test.run=^TestHelperProcess$"},
+		[]*os.File{f},
+		[]string{"tcp://127.0.0.1:514"},
+		timeout,
+	)
+	return l, p, err
+}
+
+func TestStart(t *testing.T) {
+	l, p, err := startHelper(t, "serve", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// once we stop accepting, only the new process can take the connection
+	addr := l.Addr().String()
+	l.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "new process\n" {
+		t.Errorf("got %q (%v) from the listener, want it answered by the new process", line, err)
+	}
+
+	state, err := p.Wait()
+	if err != nil || !state.Success() {
+		t.Errorf("new process exited with %v (%v)", state, err)
+	}
+}
+
+func TestStart_notReady(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		timeout time.Duration
+		wantErr string
+	}{
+		{name: "exits", mode: "die", timeout: 5 * time.Second, wantErr: NotReadyError.Error()},
+		{name: "hangs", mode: "hang", timeout: 200 * time.Millisecond, wantErr: "wasn't ready"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			l, p, err := startHelper(t, tt.mode, tt.timeout)
+			defer l.Close()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("start() = %v, %v, want error %q", p, err, tt.wantErr)
+			}
+			if took := time.Since(start); took > tt.timeout+2*time.Second {
+				t.Errorf("start() took %v", took)
+			}
+		})
+	}
+}
+
+func TestReady_notRestarted(t *testing.T) {
+	t.Setenv(readyFDEnv, "")
+	if err := Ready(); err != nil {
+		t.Errorf("Ready() = %v, want nil", err)
+	}
+}
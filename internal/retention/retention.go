@@ -0,0 +1,259 @@
+// Package retention keeps the files the file outputs write, and their
+// backups, under a budget of bytes, removing or archiving the oldest backups
+// first. there's one budget for all of them, and one for each of them.
+//
+// lumberjack's MaxAge and MaxBackups are per file, and say nothing about how
+// much space that ends up being. a budget is over the whole of it, search
+// indexes and hash chains included.
+package retention
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/backup"
+)
+
+const defInterval time.Duration = 5 * time.Minute
+
+// Config is what a Manager keeps the files under.
+type Config struct {
+	Budget int64 // bytes, for all the files together. 0 for none
+	// bytes, for the file of each file output, and its backups. 0 for none.
+	// sources aren't told apart, only the files they end up in
+	PerOutput int64
+	// backups are moved here instead of being removed, if set. what's in it
+	// doesn't count, so it should be on another filesystem
+	ArchiveDir string
+	Interval   time.Duration // how often the budgets are enforced. 5m if 0
+}
+
+// Stats is what a Manager did last time it enforced the budgets, and since
+// it started.
+type Stats struct {
+	Used     int64     `json:"used"` // bytes, as of the last time
+	Last     time.Time `json:"last"`
+	Removed  uint64    `json:"removed"`
+	Archived uint64    `json:"archived"`
+	Bytes    int64     `json:"bytes"` // removed or archived
+}
+
+// Manager enforces the budgets of a Config over the files it's given.
+type Manager struct {
+	cfg     Config
+	rotated chan struct{}
+
+	mu    sync.Mutex // held while enforcing
+	files []string
+	stats Stats
+}
+
+func New(c Config) *Manager {
+	if c.Interval <= 0 {
+		c.Interval = defInterval
+	}
+	return &Manager{cfg: c, rotated: make(chan struct{}, 1)}
+}
+
+// Add has the budgets cover the file at path, and its backups.
+func (m *Manager) Add(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range m.files {
+		if f == path {
+			return
+		}
+	}
+	m.files = append(m.files, path)
+}
+
+// Rotated has the budgets enforced right away, since a file was just
+// rotated. it never blocks, so it can be called from the writer.
+func (m *Manager) Rotated() {
+	select {
+	case m.rotated <- struct{}{}:
+	default: // it's going to be enforced anyway
+	}
+}
+
+// RunWithCtx enforces the budgets every Interval, and after every rotation,
+// until ctx is canceled.
+func (m *Manager) RunWithCtx(ctx context.Context) {
+	slog.Info("Manager.RunWithCtx(): starting routine...", "budget", m.cfg.Budget, "per_output", m.cfg.PerOutput, "interval", m.cfg.Interval)
+	t := time.NewTicker(m.cfg.Interval)
+	defer t.Stop()
+	for {
+		m.Enforce()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-m.rotated:
+		}
+	}
+}
+
+func (m *Manager) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// candidate is a backup that can go to make room, and what goes with it.
+type candidate struct {
+	path    string
+	size    int64 // with the sidecars
+	modTime time.Time
+}
+
+// Enforce removes or archives backups, oldest first, until every file is
+// under PerOutput, and all of them together are under Budget, if they can be.
+// the files being written to are never touched.
+func (m *Manager) Enforce() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var (
+		used int64
+		all  []candidate
+	)
+	for _, path := range m.files {
+		fileUsed, backups := m.scan(path)
+		for len(backups) > 0 && m.cfg.PerOutput > 0 && fileUsed > m.cfg.PerOutput {
+			if m.drop(backups[0]) {
+				fileUsed -= backups[0].size
+			}
+			backups = backups[1:]
+		}
+		if m.cfg.PerOutput > 0 && fileUsed > m.cfg.PerOutput {
+			slog.Warn("Manager.Enforce(): file is over its budget, with no backups left to drop", "file", path, "used", fileUsed, "budget", m.cfg.PerOutput)
+		}
+		used += fileUsed
+		all = append(all, backups...)
+	}
+
+	sort.SliceStable(all, func(i, j int) bool { return all[i].modTime.Before(all[j].modTime) })
+	for len(all) > 0 && m.cfg.Budget > 0 && used > m.cfg.Budget {
+		if m.drop(all[0]) {
+			used -= all[0].size
+		}
+		all = all[1:]
+	}
+	if m.cfg.Budget > 0 && used > m.cfg.Budget {
+		slog.Warn("Manager.Enforce(): files are over the budget, with no backups left to drop", "used", used, "budget", m.cfg.Budget)
+	}
+	m.stats.Used, m.stats.Last = used, time.Now()
+}
+
+// scan returns how much the file at path and its backups take, and the
+// backups, oldest first.
+func (m *Manager) scan(path string) (int64, []candidate) {
+	files, err := backup.Files(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) { // nothing was written yet
+			slog.Error("Manager.scan(): can't list backups", "file", path, "error", err)
+		}
+		return 0, nil
+	}
+	var (
+		used    int64
+		backups []candidate
+	)
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil { // compressed, or removed, while we were looking
+			continue
+		}
+		b := candidate{path: f, size: fi.Size(), modTime: fi.ModTime()}
+		for _, s := range backup.Sidecars(f) {
+			if fi, err := os.Stat(s); err == nil {
+				b.size += fi.Size()
+			}
+		}
+		used += b.size
+		if f != path {
+			backups = append(backups, b)
+		}
+	}
+	return used, backups
+}
+
+// drop removes or archives b, and reports whether it's gone.
+func (m *Manager) drop(b candidate) bool {
+	if m.cfg.ArchiveDir == "" {
+		if err := os.Remove(b.path); err != nil {
+			slog.Error("Manager.drop(): error removing backup", "backup", b.path, "error", err)
+			return false
+		}
+		for _, s := range backup.Sidecars(b.path) {
+			os.Remove(s)
+		}
+		m.stats.Removed++
+		m.stats.Bytes += b.size
+		slog.Info("Manager.drop(): removed backup to stay under the budget", "backup", b.path, "bytes", b.size)
+		return true
+	}
+
+	err := os.MkdirAll(m.cfg.ArchiveDir, 0o755)
+	if err == nil {
+		err = move(b.path, filepath.Join(m.cfg.ArchiveDir, filepath.Base(b.path)))
+	}
+	if err != nil {
+		slog.Error("Manager.drop(): error archiving backup", "backup", b.path, "archive", m.cfg.ArchiveDir, "error", err)
+		return false
+	}
+	for _, s := range backup.Sidecars(b.path) {
+		err := move(s, filepath.Join(m.cfg.ArchiveDir, filepath.Base(s)))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Manager.drop(): error archiving sidecar", "sidecar", s, "error", err)
+		}
+	}
+	m.stats.Archived++
+	m.stats.Bytes += b.size
+	slog.Info("Manager.drop(): archived backup to stay under the budget", "backup", b.path, "archive", m.cfg.ArchiveDir, "bytes", b.size)
+	return true
+}
+
+// move renames from to to, or copies it over if they're on different
+// filesystems. it won't replace what's already at to.
+func move(from, to string) error {
+	if _, err := os.Lstat(to); err == nil {
+		return &os.LinkError{Op: "move", Old: from, New: to, Err: os.ErrExist}
+	}
+	err := os.Rename(from, to)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(to)
+		return err
+	}
+	if err := errors.Join(out.Sync(), out.Close()); err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
@@ -0,0 +1,191 @@
+package retention
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/chain"
+	"github.com/zspekt/tcpLogger/internal/index"
+)
+
+// write writes a file of size bytes at path, last modified at mod.
+func write(t *testing.T, path string, size int, mod time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Repeat("x", size)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tree writes app.log and db.log in dir, with 100 bytes each, and 3
+// backups of 100 bytes each. app's are older than db's, but for the newest
+// one, and the oldest of app has a search index of 10 bytes.
+func tree(t *testing.T, dir string) (app, db string) {
+	t.Helper()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	app, db = filepath.Join(dir, "app.log"), filepath.Join(dir, "db.log")
+	for i, mod := range []int{1, 2, 10} {
+		b := filepath.Join(dir, "app-2024-01-0"+string(rune('1'+i))+"T00-00-00.000.log")
+		write(t, b, 100, base.Add(time.Duration(mod)*time.Hour))
+		if i == 0 {
+			write(t, index.Path(b), 10, base)
+		}
+	}
+	for i, mod := range []int{3, 4, 5} {
+		write(t, filepath.Join(dir, "db-2024-01-0"+string(rune('1'+i))+"T00-00-00.000.log"), 100, base.Add(time.Duration(mod)*time.Hour))
+	}
+	write(t, app, 100, base.Add(11*time.Hour))
+	write(t, db, 100, base.Add(11*time.Hour))
+	return app, db
+}
+
+func names(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, e := range entries {
+		out = append(out, e.Name())
+	}
+	return out
+}
+
+func TestManager_Enforce(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         Config
+		wantLeft    []string
+		wantUsed    int64
+		wantRemoved uint64
+	}{
+		{
+			name: "under the budget",
+			cfg:  Config{Budget: 1000},
+			wantLeft: []string{
+				"app-2024-01-01T00-00-00.000.log", "app-2024-01-01T00-00-00.000.log" + index.Suffix,
+				"app-2024-01-02T00-00-00.000.log", "app-2024-01-03T00-00-00.000.log", "app.log",
+				"db-2024-01-01T00-00-00.000.log", "db-2024-01-02T00-00-00.000.log", "db-2024-01-03T00-00-00.000.log", "db.log",
+			},
+			wantUsed: 810,
+		},
+		{
+			// the oldest backups go, whichever file they're of
+			name: "total",
+			cfg:  Config{Budget: 500},
+			wantLeft: []string{
+				"app-2024-01-03T00-00-00.000.log", "app.log",
+				"db-2024-01-02T00-00-00.000.log", "db-2024-01-03T00-00-00.000.log", "db.log",
+			},
+			wantUsed:    500,
+			wantRemoved: 3,
+		},
+		{
+			name: "per output",
+			cfg:  Config{PerOutput: 300},
+			wantLeft: []string{
+				"app-2024-01-02T00-00-00.000.log", "app-2024-01-03T00-00-00.000.log", "app.log",
+				"db-2024-01-02T00-00-00.000.log", "db-2024-01-03T00-00-00.000.log", "db.log",
+			},
+			wantUsed:    600,
+			wantRemoved: 2,
+		},
+		{
+			name:        "never the files being written to",
+			cfg:         Config{Budget: 50},
+			wantLeft:    []string{"app.log", "db.log"},
+			wantUsed:    200,
+			wantRemoved: 6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			app, db := tree(t, dir)
+			m := New(tt.cfg)
+			m.Add(app)
+			m.Add(db)
+			m.Add(app)
+			m.Enforce()
+
+			if got := names(t, dir); strings.Join(got, " ") != strings.Join(tt.wantLeft, " ") {
+				t.Errorf("left %q, want %q", got, tt.wantLeft)
+			}
+			if st := m.Stats(); st.Used != tt.wantUsed || st.Removed != tt.wantRemoved {
+				t.Errorf("Stats() = %+v, want %d used and %d removed", st, tt.wantUsed, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestManager_archive(t *testing.T) {
+	dir, archive := t.TempDir(), filepath.Join(t.TempDir(), "archive")
+	app, db := tree(t, dir)
+	oldest := filepath.Join(dir, "app-2024-01-01T00-00-00.000.log")
+	write(t, chain.Path(oldest), 5, time.Now())
+
+	m := New(Config{PerOutput: 300, ArchiveDir: archive})
+	m.Add(app)
+	m.Add(db)
+	m.Enforce()
+
+	want := []string{
+		"app-2024-01-01T00-00-00.000.log", "app-2024-01-01T00-00-00.000.log" + chain.Suffix, "app-2024-01-01T00-00-00.000.log" + index.Suffix,
+		"db-2024-01-01T00-00-00.000.log",
+	}
+	if got := names(t, archive); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("archived %q, want %q", got, want)
+	}
+	if st := m.Stats(); st.Archived != 2 || st.Removed != 0 || st.Bytes != 215 {
+		t.Errorf("Stats() = %+v", st)
+	}
+	if _, err := os.Stat(oldest); err == nil {
+		t.Error("archived backup is still there")
+	}
+}
+
+func TestManager_RunWithCtx(t *testing.T) {
+	dir := t.TempDir()
+	app, db := tree(t, dir)
+	m := New(Config{Budget: 200, Interval: time.Hour})
+	m.Add(app)
+	m.Add(db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.RunWithCtx(ctx)
+		close(done)
+	}()
+	waitFor := func(what string, ok func(Stats) bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for !ok(m.Stats()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %v. Stats() = %+v", what, m.Stats())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitFor("the first run", func(st Stats) bool { return st.Removed == 6 })
+
+	// a rotation doesn't wait for the next interval
+	write(t, filepath.Join(dir, "db-2024-01-04T00-00-00.000.log"), 100, time.Now())
+	m.Rotated()
+	m.Rotated() // doesn't block
+	waitFor("the run after the rotation", func(st Stats) bool { return st.Removed == 7 })
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RunWithCtx() didn't return once ctx was canceled")
+	}
+}
@@ -0,0 +1,199 @@
+// Package sanitize cleans up the bytes of incoming messages before they go
+// anywhere, so the files they end up in can be grepped and looked at in a
+// terminal.
+package sanitize
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+)
+
+type Control string
+
+const (
+	ControlKeep   Control = "keep"   // leave control characters alone
+	ControlEscape Control = "escape" // write them as #ooo, their octal value
+	ControlStrip  Control = "strip"  // drop them, along with whole ANSI escape sequences
+)
+
+const (
+	CharsetUTF8        string = "utf-8"
+	CharsetLatin1      string = "iso-8859-1"
+	CharsetWindows1252 string = "windows-1252"
+)
+
+var (
+	InvalidControlError     error = errors.New("invalid control character handling")
+	UnsupportedCharsetError error = errors.New("unsupported charset")
+)
+
+// Config describes what a Sanitizer does. CRLF line endings are always
+// turned into LF.
+type Config struct {
+	// Charset is what messages that aren't valid UTF-8 are transcoded from.
+	// valid UTF-8 is left as is, whatever the charset, since plain ASCII is
+	// valid in all of them. with CharsetUTF8, or if empty, invalid bytes are
+	// handled like control characters, except they're replaced with U+FFFD
+	// under ControlKeep
+	Charset string
+
+	// Control is what's done with control characters. tabs and newlines
+	// aren't touched. ControlEscape if empty
+	Control Control
+}
+
+// Sanitizer cleans up messages as described by its Config. it's safe for
+// concurrent use.
+type Sanitizer struct {
+	control Control
+	decode  *[256]rune // nil for utf-8
+}
+
+func New(c Config) (*Sanitizer, error) {
+	s := &Sanitizer{control: c.Control}
+	switch s.control {
+	case "":
+		s.control = ControlEscape
+	case ControlKeep, ControlEscape, ControlStrip:
+	default:
+		return nil, fmt.Errorf("%w <%v>", InvalidControlError, c.Control)
+	}
+	switch c.Charset {
+	case "", CharsetUTF8:
+	case CharsetLatin1:
+		s.decode = &latin1
+	case CharsetWindows1252:
+		s.decode = &windows1252
+	default:
+		return nil, fmt.Errorf("%w <%v>", UnsupportedCharsetError, c.Charset)
+	}
+	return s, nil
+}
+
+// Sanitize replaces m.Data with its sanitized version.
+func (s *Sanitizer) Sanitize(m *message.Message) {
+	m.Data = s.Bytes(m.Data)
+}
+
+// Bytes returns b sanitized. b is returned as is if there's nothing to do.
+func (s *Sanitizer) Bytes(b []byte) []byte {
+	if s.decode != nil && !utf8.Valid(b) {
+		b = transcode(b, s.decode)
+	}
+	if clean(b) {
+		return b
+	}
+
+	out := make([]byte, 0, len(b)+8)
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		switch {
+		case r == '\r' && i+1 < len(b) && b[i+1] == '\n':
+			// the \n is written on the next go
+		case r == utf8.RuneError && size == 1:
+			switch s.control {
+			case ControlKeep:
+				out = utf8.AppendRune(out, utf8.RuneError)
+			case ControlEscape:
+				out = escape(out, b[i:i+1])
+			}
+		case r == '\x1b' && s.control == ControlStrip:
+			size = ansiLen(b[i:])
+		case isControl(r):
+			switch s.control {
+			case ControlKeep:
+				out = append(out, b[i:i+size]...)
+			case ControlEscape:
+				out = escape(out, b[i:i+size])
+			}
+		default:
+			out = append(out, b[i:i+size]...)
+		}
+		i += size
+	}
+	return out
+}
+
+// clean reports whether b is valid UTF-8 without anything to sanitize, which
+// is what nearly every message is.
+func clean(b []byte) bool {
+	for i := 0; i < len(b); {
+		if c := b[i]; c < utf8.RuneSelf {
+			if c == '\r' || isControl(rune(c)) {
+				return false
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(b[i:])
+		if (r == utf8.RuneError && size == 1) || isControl(r) {
+			return false
+		}
+		i += size
+	}
+	return true
+}
+
+// isControl is true for C0 and C1 control characters and DEL, except for
+// tabs and newlines.
+func isControl(r rune) bool {
+	if r == '\t' || r == '\n' {
+		return false
+	}
+	return r < 0x20 || (r >= 0x7f && r < 0xa0)
+}
+
+// escape writes every byte of b as #ooo, the way rsyslog does.
+func escape(out, b []byte) []byte {
+	for _, c := range b {
+		out = append(out, '#', '0'+c>>6, '0'+(c>>3)&7, '0'+c&7)
+	}
+	return out
+}
+
+// ansiLen is the length of the ANSI escape sequence at the start of b, or 1
+// for a lone ESC. only CSI sequences, like colors and cursor movement, are
+// recognized, which is about all a log line ever has.
+func ansiLen(b []byte) int {
+	if len(b) < 2 || b[1] != '[' {
+		return 1
+	}
+	for i := 2; i < len(b); i++ {
+		switch c := b[i]; {
+		case c >= 0x40 && c <= 0x7e: // final byte
+			return i + 1
+		case c < 0x20 || c > 0x3f: // not a parameter or intermediate byte
+			return 1
+		}
+	}
+	return 1
+}
+
+func transcode(b []byte, table *[256]rune) []byte {
+	out := make([]byte, 0, len(b)+len(b)/4)
+	for _, c := range b {
+		out = utf8.AppendRune(out, table[c])
+	}
+	return out
+}
+
+var latin1, windows1252 [256]rune
+
+func init() {
+	for i := range latin1 {
+		latin1[i] = rune(i)
+		windows1252[i] = rune(i)
+	}
+	// windows-1252 has printable characters where latin-1 has C1 controls.
+	// the 5 bytes it leaves undefined are kept as the C1 control they'd be
+	// in latin-1
+	for i, r := range [32]rune{
+		'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+		0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+	} {
+		windows1252[0x80+i] = r
+	}
+}
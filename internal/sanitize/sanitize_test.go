@@ -0,0 +1,69 @@
+package sanitize
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSanitizer_Bytes(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		in   string
+		want string
+	}{
+		{name: "clean", in: "<13>hello wörld\n", want: "<13>hello wörld\n"},
+		{name: "tabs are fine", in: "a\tb\n", want: "a\tb\n"},
+		{name: "crlf", in: "one\r\ntwo\r\n", want: "one\ntwo\n"},
+		{name: "lone cr", in: "one\rtwo\n", want: "one#015two\n"},
+		{name: "nul", in: "a\x00b\n", want: "a#000b\n"},
+		{name: "del", in: "a\x7fb\n", want: "a#177b\n"},
+		{name: "c1 control", in: "a\u0085b\n", want: "a#302#205b\n"},
+		{name: "ansi escaped", in: "\x1b[31mred\x1b[0m\n", want: "#033[31mred#033[0m\n"},
+		{name: "invalid utf-8 escaped", in: "caf\xe9\n", want: "caf#351\n"},
+		{
+			name: "ansi stripped",
+			cfg:  Config{Control: ControlStrip},
+			in:   "\x1b[1;31mred\x1b[0m \x1b(B\x00\n",
+			want: "red (B\n",
+		},
+		{name: "invalid utf-8 stripped", cfg: Config{Control: ControlStrip}, in: "caf\xe9\n", want: "caf\n"},
+		{name: "kept", cfg: Config{Control: ControlKeep}, in: "a\x00\x1b[0m\r\n", want: "a\x00\x1b[0m\n"},
+		{name: "invalid utf-8 kept", cfg: Config{Control: ControlKeep}, in: "caf\xe9\n", want: "caf�\n"},
+		{name: "latin-1", cfg: Config{Charset: CharsetLatin1}, in: "caf\xe9 \xb0C\n", want: "café °C\n"},
+		{name: "latin-1 leaves utf-8 alone", cfg: Config{Charset: CharsetLatin1}, in: "café\n", want: "café\n"},
+		{name: "latin-1 c1 control", cfg: Config{Charset: CharsetLatin1}, in: "\xe9\x80\n", want: "é#302#200\n"},
+		{name: "windows-1252", cfg: Config{Charset: CharsetWindows1252}, in: "\x80 \x93hi\x94\n", want: "€ “hi”\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Bytes([]byte(tt.in)); string(got) != tt.want {
+				t.Errorf("Bytes(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr error
+	}{
+		{name: "defaults"},
+		{name: "all set", cfg: Config{Charset: CharsetWindows1252, Control: ControlStrip}},
+		{name: "bad control", cfg: Config{Control: "hide"}, wantErr: InvalidControlError},
+		{name: "bad charset", cfg: Config{Charset: "ebcdic"}, wantErr: UnsupportedCharsetError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.cfg); !errors.Is(err, tt.wantErr) {
+				t.Errorf("New() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,23 +1,74 @@
 package setup
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 
-	"github.com/zspekt/tcpLogger/internal/utils"
+	"github.com/zspekt/tcpLogger/internal/chain"
+	"github.com/zspekt/tcpLogger/internal/crypt"
+	"github.com/zspekt/tcpLogger/internal/filter"
+	"github.com/zspekt/tcpLogger/internal/listener"
+	"github.com/zspekt/tcpLogger/internal/multiline"
+	"github.com/zspekt/tcpLogger/internal/output"
+	"github.com/zspekt/tcpLogger/internal/redact"
+	"github.com/zspekt/tcpLogger/internal/retention"
+	"github.com/zspekt/tcpLogger/internal/sanitize"
+	"github.com/zspekt/tcpLogger/internal/systemd"
 )
 
 type Cfg struct {
-	Port     string
-	Protocol string
-	Address  string
-	Logger   *lumberjack.Logger
+	Listeners   []listener.Config
+	Logger      *lumberjack.Logger
+	ParseSyslog bool
+	Sanitizer   *sanitize.Sanitizer // nil if sanitizing is off
+	Multiline   *multiline.Config   // nil if lines aren't joined
+	Filter      *filter.Engine      // nil if no rules file was configured
+	Redactor    *redact.Redactor    // nil if nothing is redacted
+
+	Outputs       []output.Output // get every message
+	RoutedOutputs []output.Output // only get messages routed to them by name
+	LossyOutputs  []string        // names of the outputs that drop messages when their queue is full
+	OutputQueue   int             // per output
+	// the files the file outputs write, in the order they were configured.
+	// they're what's indexed and searched
+	Files []string
+
+	ShutdownGrace   time.Duration // how long open connections get to finish
+	ShutdownTimeout time.Duration // hard deadline for the whole shutdown
+	RestartTimeout  time.Duration // how long a graceful restart waits for the new process
+
+	// the admin HTTP server listens on AdminListener if a socket named
+	// AdminSocket was inherited, or on AdminAddr. it's off if both are unset
+	AdminListener net.Listener
+	AdminAddr     string
+	AdminRecent   int // how many messages the admin server keeps for searching. 0 for none
+
+	IndexInterval time.Duration // how often the search indexes are brought up to date. 0 if they aren't kept
+
+	EncryptKey *crypt.Key // file outputs encrypt what they write to it. nil if they don't
+
+	Guards    output.Guards      // the file outputs, if they watch free space. see diskGuard
+	Retention *retention.Manager // keeps the file outputs under a budget. nil if there's none
 }
 
+// AdminSocket is the name an inherited socket for the admin server goes by,
+// whether systemd or a restart passed it on.
+const AdminSocket string = "admin"
+
 type ArgError struct {
 	Err   string
 	Param []string
@@ -35,6 +86,60 @@ func (e *ArgError) Error() string {
 	return e.Err + ": " + fmt.Sprint(e.Param)
 }
 
+// EnvError is an env var set to something we can't use. unlike ArgError,
+// which means the code is wrong, this means the environment is.
+type EnvError struct {
+	Key   string
+	Value string
+	Err   error
+}
+
+func (e *EnvError) Error() string {
+	return fmt.Sprintf("invalid value <%v> for env var <%v>: %v", e.Value, e.Key, e.Err)
+}
+
+func (e *EnvError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigError holds every problem Config ran into, so they can all be fixed
+// in one go instead of one restart at a time.
+type ConfigError struct {
+	Errs []error
+}
+
+func (e *ConfigError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d config error(s): %v", len(e.Errs), strings.Join(msgs, "; "))
+}
+
+func (e *ConfigError) Unwrap() []error {
+	return e.Errs
+}
+
+// add ignores nil errors and flattens other ConfigErrors into e.
+func (e *ConfigError) add(err error) {
+	var ce *ConfigError
+	switch {
+	case err == nil:
+	case errors.As(err, &ce):
+		e.Errs = append(e.Errs, ce.Errs...)
+	default:
+		e.Errs = append(e.Errs, err)
+	}
+}
+
+// err returns nil if nothing was added, so callers can return it as is.
+func (e *ConfigError) err() error {
+	if len(e.Errs) == 0 {
+		return nil
+	}
+	return e
+}
+
 func getEnvOrDefaultLogLevel(key string, def slog.Level) (slog.Level, error) {
 	v, err := getEnvOrDefaultGen(key, def)
 	if err != nil {
@@ -67,6 +172,23 @@ func getEnvOrDefaultBool(key string, def bool) (bool, error) {
 	return v, nil
 }
 
+// getEnvOptionalString is for settings that are off unless set, where there's
+// no sensible default to hand to getEnvOrDefaultString.
+func getEnvOptionalString(key string) (string, error) {
+	if key == "" {
+		return "", &ArgError{
+			Err:   "empty string passed as argument",
+			Param: []string{"key"},
+		}
+	}
+	env, ok := os.LookupEnv(key)
+	if !ok || env == "" {
+		slog.Info(fmt.Sprintf("env var <%v> not set. leaving it disabled", key))
+		return "", nil
+	}
+	return env, nil
+}
+
 func getEnvOrDefaultGen[T string | bool | int | slog.Level](key string, def T) (T, error) {
 	var v T
 
@@ -112,13 +234,13 @@ func getEnvOrDefaultGen[T string | bool | int | slog.Level](key string, def T) (
 	case int:
 		i, err := strconv.Atoi(env)
 		if err != nil {
-			return v, err
+			return v, &EnvError{Key: key, Value: env, Err: errors.New("not an integer")}
 		}
 		v = any(i).(T)
 	case bool:
 		b, err := strconv.ParseBool(env)
 		if err != nil {
-			return v, err
+			return v, &EnvError{Key: key, Value: env, Err: errors.New("not a boolean")}
 		}
 		v = any(b).(T)
 	case slog.Level:
@@ -131,17 +253,19 @@ func getEnvOrDefaultGen[T string | bool | int | slog.Level](key string, def T) (
 
 		v, ok := levelMapper[env]
 		if !ok {
-			slog.Error(fmt.Sprintf("invalid log level <%v> defaulting to <%v>", env, any(def).(slog.Level).Level().String()))
-			return def, nil
+			return def, &EnvError{Key: key, Value: env, Err: errors.New("not one of DEBUG, INFO, WARN, ERROR")}
 		}
 		return any(v).(T), nil
 	}
 	return v, nil
 }
 
-func logger() *lumberjack.Logger {
+// DefaultFilename is where the file output writes if FILENAME isn't set.
+const DefaultFilename string = "/var/log/openwrt/openwrt.log"
+
+func logger() (*lumberjack.Logger, error) {
 	const (
-		defFilename     string = "/var/log/openwrt/openwrt.log"
+		defFilename     string = DefaultFilename
 		defMaxSize      int    = 0
 		defMaxAge       int    = 180
 		defMaxBackups   int    = 0
@@ -149,23 +273,25 @@ func logger() *lumberjack.Logger {
 		defUseLocalTime bool   = true
 	)
 
+	errs := &ConfigError{}
+
 	filename, err := getEnvOrDefaultString("FILENAME", defFilename)
-	utils.Must(err)
+	errs.add(err)
 
 	maxSize, err := getEnvOrDefaultInt("MAXSIZE", defMaxSize)
-	utils.Must(err)
+	errs.add(err)
 
 	maxAge, err := getEnvOrDefaultInt("MAXAGE", defMaxAge)
-	utils.Must(err)
+	errs.add(err)
 
 	maxBackups, err := getEnvOrDefaultInt("MAXBACKUP", defMaxBackups)
-	utils.Must(err)
+	errs.add(err)
 
 	compress, err := getEnvOrDefaultBool("COMPRESS", defCompress)
-	utils.Must(err)
+	errs.add(err)
 
 	useLocalTime, err := getEnvOrDefaultBool("USELOCALTIME", defUseLocalTime)
-	utils.Must(err)
+	errs.add(err)
 
 	return &lumberjack.Logger{
 		Filename:   filename,
@@ -174,15 +300,715 @@ func logger() *lumberjack.Logger {
 		MaxBackups: maxBackups,
 		LocalTime:  useLocalTime,
 		Compress:   compress,
+	}, errs.err()
+}
+
+// sanitizer is nil unless SANITIZE is set. SANITIZE_CONTROL is one of keep,
+// escape or strip, and SANITIZE_CHARSET is what messages that aren't valid
+// UTF-8 are transcoded from, see sanitize.Config.
+func sanitizer() (*sanitize.Sanitizer, error) {
+	const (
+		defSanitize bool   = false
+		defControl  string = string(sanitize.ControlEscape)
+		defCharset  string = sanitize.CharsetUTF8
+	)
+
+	errs := &ConfigError{}
+
+	enabled, err := getEnvOrDefaultBool("SANITIZE", defSanitize)
+	errs.add(err)
+
+	control, err := getEnvOrDefaultString("SANITIZE_CONTROL", defControl)
+	errs.add(err)
+
+	charset, err := getEnvOrDefaultString("SANITIZE_CHARSET", defCharset)
+	errs.add(err)
+
+	s, err := sanitize.New(sanitize.Config{Charset: strings.ToLower(charset), Control: sanitize.Control(control)})
+	switch {
+	case errors.Is(err, sanitize.InvalidControlError):
+		errs.add(&EnvError{Key: "SANITIZE_CONTROL", Value: control, Err: err})
+	case errors.Is(err, sanitize.UnsupportedCharsetError):
+		errs.add(&EnvError{Key: "SANITIZE_CHARSET", Value: charset, Err: err})
+	}
+	if err := errs.err(); err != nil || !enabled {
+		return nil, err
+	}
+	return s, nil
+}
+
+// multilineConfig is nil unless one of MULTILINE_INDENT, MULTILINE_START or
+// MULTILINE_MAX_GAP_MS is set, see multiline.Config. the durations are in
+// milliseconds, since a second is a long time between two lines of a
+// traceback.
+func multilineConfig() (*multiline.Config, error) {
+	const (
+		defIndent   bool = false
+		defMaxGap   int  = 0
+		defTimeout  int  = 1000
+		defMaxLines int  = 500
+	)
+
+	errs := &ConfigError{}
+
+	indent, err := getEnvOrDefaultBool("MULTILINE_INDENT", defIndent)
+	errs.add(err)
+
+	start, err := getEnvOptionalString("MULTILINE_START")
+	errs.add(err)
+	var startRe *regexp.Regexp
+	if start != "" {
+		if startRe, err = regexp.Compile(start); err != nil {
+			errs.add(&EnvError{Key: "MULTILINE_START", Value: start, Err: err})
+		}
+	}
+
+	maxGap, err := getEnvOrDefaultInt("MULTILINE_MAX_GAP_MS", defMaxGap)
+	errs.add(err)
+
+	timeout, err := getEnvOrDefaultInt("MULTILINE_TIMEOUT_MS", defTimeout)
+	errs.add(err)
+
+	maxLines, err := getEnvOrDefaultInt("MULTILINE_MAX_LINES", defMaxLines)
+	errs.add(err)
+
+	for key, n := range map[string]int{
+		"MULTILINE_MAX_GAP_MS": maxGap,
+		"MULTILINE_TIMEOUT_MS": timeout,
+		"MULTILINE_MAX_LINES":  maxLines,
+	} {
+		if n < 0 {
+			errs.add(&EnvError{Key: key, Value: strconv.Itoa(n), Err: errors.New("can't be negative")})
+		}
+	}
+
+	if err := errs.err(); err != nil || (!indent && start == "" && maxGap == 0) {
+		return nil, err
+	}
+	return &multiline.Config{
+		Indent:   indent,
+		Start:    startRe,
+		MaxGap:   time.Duration(maxGap) * time.Millisecond,
+		Timeout:  time.Duration(timeout) * time.Millisecond,
+		MaxLines: maxLines,
+	}, nil
+}
+
+func filterEngine() (*filter.Engine, error) {
+	const key = "FILTER_RULES"
+	path, err := getEnvOptionalString(key)
+	if err != nil || path == "" {
+		return nil, err
+	}
+
+	e, err := filter.Load(path)
+	if err != nil {
+		return nil, &EnvError{Key: key, Value: path, Err: err}
+	}
+	return e, nil
+}
+
+// redactor is nil unless REDACT lists built in detectors, see
+// redact.Detectors, or REDACT_RULES names a rules file, see redact.LoadRules.
+// the detectors run first, in the order of redact.Detectors, and then the
+// rules of the file, in its order. REDACT_MODE is the redact.Mode of the
+// detectors, and of the rules that don't have one of their own. REDACT_KEY
+// is a file with the key the hmac mode hashes with.
+func redactor() (*redact.Redactor, error) {
+	const defMode string = string(redact.ModeMask)
+
+	errs := &ConfigError{}
+
+	detectors, err := getEnvOptionalString("REDACT")
+	errs.add(err)
+
+	mode, err := getEnvOrDefaultString("REDACT_MODE", defMode)
+	errs.add(err)
+
+	rulesPath, err := getEnvOptionalString("REDACT_RULES")
+	errs.add(err)
+
+	keyPath, err := getEnvOptionalString("REDACT_KEY")
+	errs.add(err)
+
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	switch redact.Mode(mode) {
+	case redact.ModeMask, redact.ModeToken, redact.ModeHMAC:
+	default:
+		errs.add(&EnvError{Key: "REDACT_MODE", Value: mode, Err: redact.InvalidModeError})
+	}
+
+	var c redact.Config
+	enabled := make(map[string]bool)
+	for _, d := range strings.Split(detectors, ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d == "" {
+			continue
+		}
+		if !slices.Contains(redact.Detectors, d) {
+			errs.add(&EnvError{Key: "REDACT", Value: detectors, Err: fmt.Errorf("%w <%v>", redact.UnknownDetectorError, d)})
+			continue
+		}
+		enabled[d] = true
+	}
+	for _, d := range redact.Detectors {
+		if enabled[d] {
+			c.Rules = append(c.Rules, redact.Rule{Detector: d, Mode: redact.Mode(mode)})
+		}
+	}
+	if rulesPath != "" {
+		rules, err := redact.LoadRules(rulesPath)
+		if err != nil {
+			errs.add(&EnvError{Key: "REDACT_RULES", Value: rulesPath, Err: err})
+		}
+		for _, r := range rules {
+			if r.Mode == "" {
+				r.Mode = redact.Mode(mode)
+			}
+			c.Rules = append(c.Rules, r)
+		}
+	}
+	if keyPath != "" {
+		key, err := os.ReadFile(keyPath)
+		if err == nil && len(bytes.TrimSpace(key)) == 0 {
+			err = errors.New("key is empty")
+		}
+		if err != nil {
+			errs.add(&EnvError{Key: "REDACT_KEY", Value: keyPath, Err: err})
+		}
+		c.Key = bytes.TrimSpace(key)
+	}
+	if err := errs.err(); err != nil || len(c.Rules) == 0 {
+		return nil, err
+	}
+
+	// whatever else is wrong is in the rules file
+	r, err := redact.New(c)
+	switch {
+	case errors.Is(err, redact.NoKeyError):
+		return nil, &EnvError{Key: "REDACT_KEY", Value: keyPath, Err: err}
+	case err != nil:
+		return nil, &EnvError{Key: "REDACT_RULES", Value: rulesPath, Err: err}
+	}
+	return r, nil
+}
+
+// parseOutputs turns a comma separated list of [name=]type[:arg] into
+// outputs. the types are
+//
+//	file                        the file configured through FILENAME, MAXSIZE etc.
+//	file:<path>                 another file, rotated with the same settings
+//	stdout, stderr
+//	forward:<tcp|tls|udp>://<host:port>  an upstream collector, see FORWARD_*
+//
+// the name defaults to the type, or to the path/address for files and
+// forwards.
+func parseOutputs(
+	spec string,
+	file *lumberjack.Logger,
+	fwd output.ForwardConfig,
+	protect output.FileConfig,
+) ([]output.Output, error) {
+	var outs []output.Output
+	fail := func(err error) ([]output.Output, error) {
+		for _, o := range outs { // forwards have already started dialing
+			o.Close()
+		}
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, kind, named := strings.Cut(entry, "=")
+		if !named {
+			kind = name
+		}
+		kind, arg, _ := strings.Cut(kind, ":")
+
+		newFile := func(name string, l *lumberjack.Logger) (output.Output, error) {
+			if protect.Guard != nil {
+				return output.NewGuardedFile(name, l, protect)
+			}
+			if protect.Chain.Key != nil || protect.Encrypt != nil || protect.OnRotate != nil {
+				return output.NewProtectedFile(name, l, protect), nil
+			}
+			return output.NewFile(name, l), nil
+		}
+
+		var (
+			o   output.Output
+			err error
+		)
+		switch {
+		case kind == "file" && arg == "":
+			o, err = newFile(name, file)
+		case kind == "file":
+			if !named {
+				name = arg
+			}
+			o, err = newFile(name, &lumberjack.Logger{
+				Filename:   arg,
+				MaxSize:    file.MaxSize,
+				MaxAge:     file.MaxAge,
+				MaxBackups: file.MaxBackups,
+				LocalTime:  file.LocalTime,
+				Compress:   file.Compress,
+			})
+		case kind == "stdout":
+			o = output.NewWriter(name, os.Stdout)
+		case kind == "stderr":
+			o = output.NewWriter(name, os.Stderr)
+		case kind == "forward":
+			network, addr, ok := strings.Cut(arg, "://")
+			if !ok || addr == "" {
+				return fail(&ArgError{Err: "invalid forward address", Param: []string{entry}})
+			}
+			if !named {
+				name = addr
+			}
+			fwd.Name, fwd.Network, fwd.Address = name, network, addr
+			f, err := output.NewForward(fwd)
+			if err != nil {
+				return fail(err)
+			}
+			o = f
+		default:
+			return fail(&ArgError{Err: "invalid output", Param: []string{entry}})
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		if seen[o.Name()] {
+			o.Close()
+			return fail(&ArgError{Err: "duplicate output name", Param: []string{o.Name()}})
+		}
+		seen[o.Name()] = true
+		outs = append(outs, o)
+	}
+	return outs, nil
+}
+
+// parseListeners turns a comma separated list of
+//
+//	[name=]<tcp|tls|udp>://<host:port>[?option=value&...]
+//	[name=]<unix|unixgram>://<path>[?option=value&...]
+//	[name=]systemd://<fdname>[?option=value&...]
+//
+// into listener configs. IPv6 hosts go in brackets, like [::]:514. the
+// options are
+//
+//	framing=<lf|octet|auto>  how a stream is split into messages, lf by default
+//	allow=<ip|cidr>          may be repeated. if set, everybody else is turned away
+//	output=<name>            send everything to this output instead of the default ones
+//	cert=<path>, key=<path>  the certificate of a tls listener
+//	v6only=<bool>            don't take IPv4 on an IPv6 address like [::]
+//	mode=<octal>             permissions of a unix socket
+//	owner=<user>, group=<group>  ownership of a unix socket, names or ids
+//	proxy=<bool>             read PROXY protocol headers from trusted proxies
+//	trust=<ip|cidr>          may be repeated. the proxies whose headers are believed
+//
+// the name defaults to network://address. systemd:// takes the next one of
+// the inherited sockets with that FileDescriptorName, or, after a graceful
+// restart, the one named after the listener. it's tls if cert and key are
+// set, and whatever the socket is otherwise. any other listener
+// takes the inherited socket named after it, if there is one, instead of
+// binding its address. that's how a graceful restart hands them over.
+func parseListeners(spec string, inherited []systemd.Socket) ([]listener.Config, error) {
+	used := make([]bool, len(inherited))
+	var cfgs []listener.Config
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var c listener.Config
+		rest := entry
+		if i, j := strings.Index(entry, "="), strings.Index(entry, "://"); i >= 0 && (j < 0 || i < j) {
+			c.Name, rest = entry[:i], entry[i+1:]
+		}
+		network, addr, ok := strings.Cut(rest, "://")
+		if !ok {
+			return nil, &ArgError{Err: "invalid listener", Param: []string{entry}}
+		}
+		addr, query, _ := strings.Cut(addr, "?")
+		c.Network, c.Address = network, addr
+		if c.Name == "" {
+			c.Name = network + "://" + addr
+		}
+
+		opts, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, &ArgError{Err: "invalid listener options", Param: []string{entry}}
+		}
+		c.Framing = opts.Get("framing")
+		c.Output = opts.Get("output")
+		if v6only := opts.Get("v6only"); v6only != "" {
+			if c.V6Only, err = strconv.ParseBool(v6only); err != nil {
+				return nil, fmt.Errorf("listener <%v>: invalid v6only <%v>", c.Name, v6only)
+			}
+		}
+		c.Owner = opts.Get("owner")
+		c.Group = opts.Get("group")
+		if mode := opts.Get("mode"); mode != "" {
+			m, err := strconv.ParseUint(mode, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("listener <%v>: invalid mode <%v>", c.Name, mode)
+			}
+			c.Mode = os.FileMode(m)
+		}
+		for _, a := range opts["allow"] {
+			p, err := listener.ParsePrefix(a)
+			if err != nil {
+				return nil, fmt.Errorf("listener <%v>: %w", c.Name, err)
+			}
+			c.Allow = append(c.Allow, p)
+		}
+		if proxy := opts.Get("proxy"); proxy != "" {
+			if c.ProxyProtocol, err = strconv.ParseBool(proxy); err != nil {
+				return nil, fmt.Errorf("listener <%v>: invalid proxy <%v>", c.Name, proxy)
+			}
+		}
+		for _, a := range opts["trust"] {
+			p, err := listener.ParsePrefix(a)
+			if err != nil {
+				return nil, fmt.Errorf("listener <%v>: %w", c.Name, err)
+			}
+			c.TrustedProxies = append(c.TrustedProxies, p)
+		}
+		if cert, key := opts.Get("cert"), opts.Get("key"); cert != "" || key != "" {
+			pair, err := tls.LoadX509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("listener <%v>: %w", c.Name, err)
+			}
+			c.TLSConfig = &tls.Config{Certificates: []tls.Certificate{pair}}
+		}
+
+		next := func(name string) int {
+			for i := range inherited {
+				if !used[i] && inherited[i].Name == name {
+					used[i] = true
+					return i
+				}
+			}
+			return -1
+		}
+		if c.Network == "systemd" {
+			// a restart hands sockets over under the listener's name, not
+			// systemd's
+			i := next(c.Address)
+			if i < 0 {
+				i = next(c.Name)
+			}
+			if i < 0 {
+				return nil, fmt.Errorf("listener <%v>: no inherited socket named <%v> left", c.Name, c.Address)
+			}
+			c.Listener, c.PacketConn = inherited[i].Listener, inherited[i].PacketConn
+			if c.Listener != nil {
+				c.Network = c.Listener.Addr().Network()
+			} else {
+				c.Network = c.PacketConn.LocalAddr().Network()
+			}
+			if c.Network == "tcp" && c.TLSConfig != nil {
+				c.Network = "tls"
+			}
+		} else if i := next(c.Name); i >= 0 {
+			c.Listener, c.PacketConn = inherited[i].Listener, inherited[i].PacketConn
+			if (c.PacketConn != nil) != c.IsPacket() {
+				return nil, fmt.Errorf("listener <%v>: inherited socket is of the wrong type", c.Name)
+			}
+		}
+
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("listener <%v>: %w", c.Name, err)
+		}
+		if seen[c.Name] {
+			return nil, &ArgError{Err: "duplicate listener name", Param: []string{c.Name}}
+		}
+		seen[c.Name] = true
+		cfgs = append(cfgs, c)
 	}
+	return cfgs, nil
 }
 
-func Config() *Cfg {
+// systemdListeners is a LISTENERS spec using every inherited socket, named
+// after it. sockets sharing a name get a number appended.
+func systemdListeners(sockets []systemd.Socket) string {
+	count := make(map[string]int)
+	entries := make([]string, len(sockets))
+	for i, s := range sockets {
+		count[s.Name]++
+		name := s.Name
+		if n := count[s.Name]; n > 1 {
+			name = fmt.Sprintf("%v#%d", s.Name, n)
+		}
+		entries[i] = name + "=systemd://" + s.Name
+	}
+	return strings.Join(entries, ",")
+}
+
+// takeAdminSocket takes the socket named AdminSocket out of sockets, so it
+// isn't mistaken for a syslog one.
+func takeAdminSocket(sockets []systemd.Socket) (net.Listener, []systemd.Socket) {
+	for i, s := range sockets {
+		if s.Name == AdminSocket && s.Listener != nil {
+			return s.Listener, slices.Delete(slices.Clone(sockets), i, i+1)
+		}
+	}
+	return nil, sockets
+}
+
+func usesSocket(cfgs []listener.Config, s systemd.Socket) bool {
+	for _, c := range cfgs {
+		if (s.Listener != nil && c.Listener == s.Listener) || (s.PacketConn != nil && c.PacketConn == s.PacketConn) {
+			return true
+		}
+	}
+	return false
+}
+
+// chainConfig is how file outputs keep their hash chains, if INTEGRITY_KEY
+// points to an Ed25519 private key in a PEM file. a checkpoint is signed
+// every INTEGRITY_CHECKPOINT seconds, on top of when files are rotated or
+// closed.
+func chainConfig() (output.ChainConfig, error) {
+	const defEvery int = 300 // seconds
+
+	errs := &ConfigError{}
+
+	path, err := getEnvOptionalString("INTEGRITY_KEY")
+	errs.add(err)
+
+	every, err := getEnvOrDefaultInt("INTEGRITY_CHECKPOINT", defEvery)
+	errs.add(err)
+	if every < 0 {
+		errs.add(&EnvError{Key: "INTEGRITY_CHECKPOINT", Value: strconv.Itoa(every), Err: errors.New("can't be negative")})
+	}
+
+	c := output.ChainConfig{Every: time.Duration(every) * time.Second}
+	if path != "" {
+		if c.Key, err = chain.LoadPrivateKey(path); err != nil {
+			errs.add(&EnvError{Key: "INTEGRITY_KEY", Value: path, Err: err})
+		}
+	}
+	return c, errs.err()
+}
+
+// diskGuard is how file outputs keep from filling up their filesystem, or
+// nil if DISK_MIN_FREE_MB isn't set. below it, the oldest backups are
+// removed until there's DISK_RESUME_FREE_MB free, and if that's not enough,
+// DISK_POLICY kicks in until there is. see output.Policy. spilled files go
+// in DISK_SPILL_DIR.
+func diskGuard() (*output.GuardConfig, error) {
+	const (
+		defMinFree  int    = 0 // MB
+		defPolicy   string = string(output.PolicyDrop)
+		defInterval int    = 10 // seconds
+	)
+
+	errs := &ConfigError{}
+
+	minFree, err := getEnvOrDefaultInt("DISK_MIN_FREE_MB", defMinFree)
+	errs.add(err)
+	if minFree < 0 {
+		errs.add(&EnvError{Key: "DISK_MIN_FREE_MB", Value: strconv.Itoa(minFree), Err: errors.New("can't be negative")})
+	}
+
+	resumeFree, err := getEnvOrDefaultInt("DISK_RESUME_FREE_MB", 2*minFree)
+	errs.add(err)
+	if resumeFree < minFree {
+		errs.add(&EnvError{Key: "DISK_RESUME_FREE_MB", Value: strconv.Itoa(resumeFree), Err: errors.New("can't be lower than DISK_MIN_FREE_MB")})
+	}
+
+	policy, err := getEnvOrDefaultString("DISK_POLICY", defPolicy)
+	errs.add(err)
+	switch output.Policy(policy) {
+	case output.PolicyDrop, output.PolicyPause, output.PolicySpill:
+	default:
+		errs.add(&EnvError{Key: "DISK_POLICY", Value: policy, Err: output.InvalidPolicyError})
+	}
+
+	spillDir, err := getEnvOptionalString("DISK_SPILL_DIR")
+	errs.add(err)
+	if output.Policy(policy) == output.PolicySpill && spillDir == "" && minFree > 0 {
+		errs.add(&EnvError{Key: "DISK_SPILL_DIR", Value: spillDir, Err: errors.New("has to be set to spill")})
+	}
+
+	interval, err := getEnvOrDefaultInt("DISK_CHECK_INTERVAL", defInterval)
+	errs.add(err)
+	if interval <= 0 {
+		errs.add(&EnvError{Key: "DISK_CHECK_INTERVAL", Value: strconv.Itoa(interval), Err: errors.New("has to be positive")})
+	}
+
+	if err := errs.err(); err != nil || minFree == 0 {
+		return nil, err
+	}
+	return &output.GuardConfig{
+		MinFree:    uint64(minFree) << 20,
+		ResumeFree: uint64(resumeFree) << 20,
+		Policy:     output.Policy(policy),
+		SpillDir:   spillDir,
+		Interval:   time.Duration(interval) * time.Second,
+	}, nil
+}
+
+// retentionConfig is the budget of bytes the file outputs, their backups,
+// and what goes with them are kept under, or nil if neither
+// RETENTION_BUDGET_MB nor RETENTION_PER_OUTPUT_MB is set.
+// RETENTION_BUDGET_MB is for all of them together, and
+// RETENTION_PER_OUTPUT_MB for each file output. there's no budget per
+// sending host: a source only gets one of its own if a listener or a filter
+// rule sends it to a file output of its own. the oldest backups are moved to
+// RETENTION_ARCHIVE_DIR if it's set, and removed if it isn't, every
+// RETENTION_INTERVAL seconds and after every rotation.
+func retentionConfig() (*retention.Config, error) {
+	const (
+		defBudget   int = 0 // MB
+		defInterval int = 300
+	)
+
+	errs := &ConfigError{}
+
+	budget, err := getEnvOrDefaultInt("RETENTION_BUDGET_MB", defBudget)
+	errs.add(err)
+	if budget < 0 {
+		errs.add(&EnvError{Key: "RETENTION_BUDGET_MB", Value: strconv.Itoa(budget), Err: errors.New("can't be negative")})
+	}
+
+	perOutput, err := getEnvOrDefaultInt("RETENTION_PER_OUTPUT_MB", defBudget)
+	errs.add(err)
+	if perOutput < 0 {
+		errs.add(&EnvError{Key: "RETENTION_PER_OUTPUT_MB", Value: strconv.Itoa(perOutput), Err: errors.New("can't be negative")})
+	}
+
+	archive, err := getEnvOptionalString("RETENTION_ARCHIVE_DIR")
+	errs.add(err)
+
+	interval, err := getEnvOrDefaultInt("RETENTION_INTERVAL", defInterval)
+	errs.add(err)
+	if interval <= 0 {
+		errs.add(&EnvError{Key: "RETENTION_INTERVAL", Value: strconv.Itoa(interval), Err: errors.New("has to be positive")})
+	}
+
+	if err := errs.err(); err != nil || (budget == 0 && perOutput == 0) {
+		return nil, err
+	}
+	return &retention.Config{
+		Budget:     int64(budget) << 20,
+		PerOutput:  int64(perOutput) << 20,
+		ArchiveDir: archive,
+		Interval:   time.Duration(interval) * time.Second,
+	}, nil
+}
+
+// encryptionKey is what file outputs encrypt to, read from the file at
+// ENCRYPT_KEY. nil if it isn't set. see crypt.LoadKey.
+func encryptionKey() (*crypt.Key, error) {
+	path, err := getEnvOptionalString("ENCRYPT_KEY")
+	if err != nil || path == "" {
+		return nil, err
+	}
+	key, err := crypt.LoadKey(path)
+	if err != nil {
+		return nil, &EnvError{Key: "ENCRYPT_KEY", Value: path, Err: err}
+	}
+	return key, nil
+}
+
+func forwardConfig() (output.ForwardConfig, error) {
+	const (
+		defFormat     string = output.FormatRaw
+		defSpoolMax   int    = 100 // MB
+		defMaxBackoff int    = 60  // seconds
+	)
+
+	errs := &ConfigError{}
+
+	format, err := getEnvOrDefaultString("FORWARD_FORMAT", defFormat)
+	errs.add(err)
+
+	spoolDir, err := getEnvOptionalString("FORWARD_SPOOL_DIR")
+	errs.add(err)
+
+	spoolMax, err := getEnvOrDefaultInt("FORWARD_SPOOL_MAX", defSpoolMax)
+	errs.add(err)
+
+	maxBackoff, err := getEnvOrDefaultInt("FORWARD_MAX_BACKOFF", defMaxBackoff)
+	errs.add(err)
+
+	ca, err := getEnvOptionalString("FORWARD_TLS_CA")
+	errs.add(err)
+
+	cert, err := getEnvOptionalString("FORWARD_TLS_CERT")
+	errs.add(err)
+
+	key, err := getEnvOptionalString("FORWARD_TLS_KEY")
+	errs.add(err)
+
+	tlsCfg, err := tlsConfig(ca, cert, key)
+	errs.add(err)
+
+	return output.ForwardConfig{
+		TLSConfig:  tlsCfg,
+		Format:     format,
+		SpoolDir:   spoolDir,
+		SpoolMax:   int64(spoolMax) * 1024 * 1024,
+		MaxBackoff: time.Duration(maxBackoff) * time.Second,
+	}, errs.err()
+}
+
+// tlsConfig returns nil if nothing was configured, so the system roots get
+// used.
+func tlsConfig(ca, cert, key string) (*tls.Config, error) {
+	if ca == "" && cert == "" && key == "" {
+		return nil, nil
+	}
+	c := &tls.Config{}
+	if ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, &EnvError{Key: "FORWARD_TLS_CA", Value: ca, Err: err}
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, &EnvError{Key: "FORWARD_TLS_CA", Value: ca, Err: errors.New("no certificates found")}
+		}
+	}
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, &EnvError{Key: "FORWARD_TLS_CERT", Value: cert, Err: err}
+		}
+		c.Certificates = []tls.Certificate{pair}
+	}
+	return c, nil
+}
+
+// Config reads the whole config from env vars. instead of stopping at the
+// first bad one, it goes through all of them and returns a *ConfigError
+// listing every problem.
+func Config() (*Cfg, error) {
 	const (
 		defLogLevel slog.Level = slog.LevelInfo
 		defPort     string     = "8080"
 		defProtocol string     = "tcp"
 		defAddress  string     = "0.0.0.0"
+		defSyslog   bool       = false
+		defOutputs  string     = "file"
+		defQueue    int        = 1024
+		defGrace    int        = 5  // seconds
+		defTimeout  int        = 30 // seconds
+		defRestart  int        = 30 // seconds
+		defRecent   int        = 5000
+		defIndex    bool       = false
+		defInterval int        = 60 // seconds
 	)
 
 	// https://stackoverflow.com/a/76970969
@@ -192,26 +1018,283 @@ func Config() *Cfg {
 		slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: l})),
 	)
 
+	errs := &ConfigError{}
+
 	logLevel, err := getEnvOrDefaultLogLevel("LOGLEVEL", defLogLevel)
-	utils.Must(err)
+	errs.add(err)
 
 	if logLevel != slog.LevelInfo {
 		l.Set(logLevel)
 	}
 
 	port, err := getEnvOrDefaultString("PORT", defPort)
-	utils.Must(err)
+	errs.add(err)
 
 	protocol, err := getEnvOrDefaultString("PROTOCOL", defProtocol)
-	utils.Must(err)
+	errs.add(err)
 
 	address, err := getEnvOrDefaultString("ADDRESS", defAddress)
-	utils.Must(err)
+	errs.add(err)
 
-	return &Cfg{
-		Port:     port,
-		Protocol: protocol,
-		Address:  address,
-		Logger:   logger(),
+	listenFDs := os.Getenv("LISTEN_FDS")
+	sockets, err := systemd.Sockets()
+	if err != nil {
+		errs.add(&EnvError{Key: "LISTEN_FDS", Value: listenFDs, Err: err})
+	}
+	adminListener, sockets := takeAdminSocket(sockets)
+
+	// LISTENERS replaces the three above, which are kept for a single
+	// listener. for unix sockets ADDRESS is the path. if systemd passed us
+	// sockets, the default is to use all of them instead
+	defListener := protocol + "://" + net.JoinHostPort(address, port)
+	if protocol == "unix" || protocol == "unixgram" {
+		defListener = protocol + "://" + address
+	}
+	if len(sockets) > 0 && !slices.ContainsFunc(sockets, func(s systemd.Socket) bool { return s.Name == defListener }) {
+		defListener = systemdListeners(sockets)
+	}
+	listenerSpec, err := getEnvOrDefaultString("LISTENERS", defListener)
+	errs.add(err)
+	listeners, err := parseListeners(listenerSpec, sockets)
+	if err != nil {
+		errs.add(&EnvError{Key: "LISTENERS", Value: listenerSpec, Err: err})
+	}
+	closeSockets := func(all bool) {
+		for _, s := range sockets {
+			if !all && usesSocket(listeners, s) {
+				continue
+			}
+			if !all {
+				slog.Warn("setup.Config(): closing inherited socket no listener uses", "name", s.Name)
+			}
+			if s.Listener != nil {
+				s.Listener.Close()
+			} else {
+				s.PacketConn.Close()
+			}
+		}
+	}
+
+	parseSyslog, err := getEnvOrDefaultBool("SYSLOG_PARSE", defSyslog)
+	errs.add(err)
+
+	file, err := logger()
+	errs.add(err)
+
+	sanitizer, err := sanitizer()
+	errs.add(err)
+
+	lines, err := multilineConfig()
+	errs.add(err)
+
+	rules, err := filterEngine()
+	errs.add(err)
+
+	redactor, err := redactor()
+	errs.add(err)
+
+	fwd, err := forwardConfig()
+	errs.add(err)
+
+	chained, err := chainConfig()
+	errs.add(err)
+
+	encryptKey, err := encryptionKey()
+	errs.add(err)
+
+	guard, err := diskGuard()
+	errs.add(err)
+	protect := output.FileConfig{Chain: chained, Encrypt: encryptKey, Guard: guard}
+
+	retain, err := retentionConfig()
+	errs.add(err)
+	var keeper *retention.Manager
+	if retain != nil {
+		keeper = retention.New(*retain)
+		protect.OnRotate = keeper.Rotated
+	}
+
+	outputSpec, err := getEnvOrDefaultString("OUTPUTS", defOutputs)
+	errs.add(err)
+	outputs, err := parseOutputs(outputSpec, file, fwd, protect)
+	if err != nil {
+		errs.add(&EnvError{Key: "OUTPUTS", Value: outputSpec, Err: err})
+	}
+
+	routedSpec, err := getEnvOptionalString("ROUTED_OUTPUTS")
+	errs.add(err)
+	routed, err := parseOutputs(routedSpec, file, fwd, protect)
+	if err != nil {
+		errs.add(&EnvError{Key: "ROUTED_OUTPUTS", Value: routedSpec, Err: err})
+	}
+
+	// the others hold up the connections until there's room
+	lossySpec, err := getEnvOptionalString("LOSSY_OUTPUTS")
+	errs.add(err)
+	var lossy []string
+	for _, name := range strings.Split(lossySpec, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			lossy = append(lossy, name)
+		}
+	}
+
+	queue, err := getEnvOrDefaultInt("OUTPUT_QUEUE", defQueue)
+	errs.add(err)
+	if queue <= 0 {
+		errs.add(&EnvError{Key: "OUTPUT_QUEUE", Value: strconv.Itoa(queue), Err: errors.New("has to be positive")})
+	}
+
+	grace, err := getEnvOrDefaultInt("SHUTDOWN_GRACE", defGrace)
+	errs.add(err)
+	if grace < 0 {
+		errs.add(&EnvError{Key: "SHUTDOWN_GRACE", Value: strconv.Itoa(grace), Err: errors.New("can't be negative")})
+	}
+
+	timeout, err := getEnvOrDefaultInt("SHUTDOWN_TIMEOUT", defTimeout)
+	errs.add(err)
+	if timeout <= 0 {
+		errs.add(&EnvError{Key: "SHUTDOWN_TIMEOUT", Value: strconv.Itoa(timeout), Err: errors.New("has to be positive")})
+	}
+
+	restartTimeout, err := getEnvOrDefaultInt("RESTART_TIMEOUT", defRestart)
+	errs.add(err)
+	if restartTimeout <= 0 {
+		errs.add(&EnvError{Key: "RESTART_TIMEOUT", Value: strconv.Itoa(restartTimeout), Err: errors.New("has to be positive")})
+	}
+
+	adminAddr, err := getEnvOptionalString("ADMIN_ADDR")
+	errs.add(err)
+	if adminAddr != "" {
+		if _, _, err := net.SplitHostPort(adminAddr); err != nil {
+			errs.add(&EnvError{Key: "ADMIN_ADDR", Value: adminAddr, Err: err})
+		}
+	}
+
+	recent, err := getEnvOrDefaultInt("ADMIN_RECENT", defRecent)
+	errs.add(err)
+	if recent < 0 {
+		errs.add(&EnvError{Key: "ADMIN_RECENT", Value: strconv.Itoa(recent), Err: errors.New("can't be negative")})
 	}
+
+	indexing, err := getEnvOrDefaultBool("INDEX", defIndex)
+	errs.add(err)
+
+	interval, err := getEnvOrDefaultInt("INDEX_INTERVAL", defInterval)
+	errs.add(err)
+	if interval <= 0 {
+		errs.add(&EnvError{Key: "INDEX_INTERVAL", Value: strconv.Itoa(interval), Err: errors.New("has to be positive")})
+	}
+	if !indexing {
+		interval = 0
+	}
+
+	names := make(map[string]bool)
+	protectedFiles := make(map[string]bool)
+	var files []string
+	spilledFiles := make(map[string]string) // spill file -> the file it's for
+	var guards output.Guards
+	for _, o := range append(outputs, routed...) {
+		// each list is checked on its own by parseOutputs
+		if names[o.Name()] {
+			errs.add(&EnvError{
+				Key:   "ROUTED_OUTPUTS",
+				Value: routedSpec,
+				Err:   fmt.Errorf("%w <%v>. it's in OUTPUTS too", output.DuplicateOutputError, o.Name()),
+			})
+		}
+		names[o.Name()] = true
+		if g, ok := o.(*output.Guard); ok {
+			guards = append(guards, g)
+			if keeper != nil && g.SpillFilename() != "" {
+				keeper.Add(g.SpillFilename())
+			}
+			// the spill file is named after the file, without its directory
+			other, ok := spilledFiles[g.SpillFilename()]
+			switch {
+			case g.SpillFilename() == "":
+			case !ok:
+				spilledFiles[g.SpillFilename()] = g.Filename()
+			case other != g.Filename():
+				errs.add(&EnvError{
+					Key:   "DISK_SPILL_DIR",
+					Value: protect.Guard.SpillDir,
+					Err:   fmt.Errorf("files <%v> and <%v> would both spill into <%v>. give them different names", other, g.Filename(), g.SpillFilename()),
+				})
+			}
+		}
+		f, ok := o.(interface{ Filename() string })
+		if ok && !slices.Contains(files, f.Filename()) {
+			files = append(files, f.Filename())
+		}
+		if ok && keeper != nil {
+			keeper.Add(f.Filename())
+		}
+		// two chains or headers in one file would break each other
+		if ok && (protect.Chain.Key != nil || protect.Encrypt != nil) {
+			if protectedFiles[f.Filename()] {
+				errs.add(&EnvError{
+					Key:   "OUTPUTS",
+					Value: outputSpec,
+					Err:   fmt.Errorf("file <%v> is written by more than one output. it can't be chained or encrypted", f.Filename()),
+				})
+			}
+			protectedFiles[f.Filename()] = true
+		}
+	}
+	for _, name := range lossy {
+		if !names[name] {
+			errs.add(&EnvError{Key: "LOSSY_OUTPUTS", Value: lossySpec, Err: fmt.Errorf("%w <%v>", output.UnknownOutputError, name)})
+		}
+	}
+	for _, l := range listeners {
+		if l.Output != "" && !names[l.Output] {
+			errs.add(&EnvError{
+				Key:   "LISTENERS",
+				Value: listenerSpec,
+				Err:   fmt.Errorf("listener <%v>: unknown output <%v>", l.Name, l.Output),
+			})
+		}
+	}
+
+	if err := errs.err(); err != nil {
+		for _, o := range append(outputs, routed...) {
+			o.Close()
+		}
+		closeSockets(true)
+		if adminListener != nil {
+			adminListener.Close()
+		}
+		return nil, err
+	}
+	closeSockets(false)
+
+	return &Cfg{
+		Listeners:     listeners,
+		Logger:        file,
+		ParseSyslog:   parseSyslog,
+		Sanitizer:     sanitizer,
+		Multiline:     lines,
+		Filter:        rules,
+		Redactor:      redactor,
+		Outputs:       outputs,
+		RoutedOutputs: routed,
+		LossyOutputs:  lossy,
+		OutputQueue:   queue,
+		Files:         files,
+
+		ShutdownGrace:   time.Duration(grace) * time.Second,
+		ShutdownTimeout: time.Duration(timeout) * time.Second,
+		RestartTimeout:  time.Duration(restartTimeout) * time.Second,
+
+		AdminListener: adminListener,
+		AdminAddr:     adminAddr,
+		AdminRecent:   recent,
+
+		IndexInterval: time.Duration(interval) * time.Second,
+
+		EncryptKey: encryptKey,
+
+		Guards:    guards,
+		Retention: keeper,
+	}, nil
 }
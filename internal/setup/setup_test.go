@@ -1,7 +1,15 @@
 package setup
 
 import (
+	"errors"
+	"net"
+	"strings"
 	"testing"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/zspekt/tcpLogger/internal/output"
+	"github.com/zspekt/tcpLogger/internal/systemd"
 )
 
 func Test_getEnvOrDefault(t *testing.T) {
@@ -132,27 +140,520 @@ func Test_getEnvOrDefault(t *testing.T) {
 }
 
 func Test_setupConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantErr  bool
+		wantKeys []string // env vars the *ConfigError should name
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{"FILENAME": "config_test.log"},
+		},
+		{
+			name: "every bad value is reported",
+			env: map[string]string{
+				"FILENAME":     "config_test.log",
+				"LOGLEVEL":     "LOUD",
+				"MAXSIZE":      "big",
+				"SYSLOG_PARSE": "maybe",
+				"OUTPUTS":      "file,carrier-pigeon",
+			},
+			wantErr:  true,
+			wantKeys: []string{"LOGLEVEL", "MAXSIZE", "SYSLOG_PARSE", "OUTPUTS"},
+		},
+		{
+			name: "listener routed to an unknown output",
+			env: map[string]string{
+				"FILENAME":  "config_test.log",
+				"LISTENERS": "tcp://127.0.0.1:514?output=nowhere",
+			},
+			wantErr:  true,
+			wantKeys: []string{"LISTENERS"},
+		},
+		{
+			name: "bad sanitize settings",
+			env: map[string]string{
+				"FILENAME":         "config_test.log",
+				"SANITIZE":         "true",
+				"SANITIZE_CHARSET": "ebcdic",
+			},
+			wantErr:  true,
+			wantKeys: []string{"SANITIZE_CHARSET"},
+		},
+		{
+			name: "bad multiline settings",
+			env: map[string]string{
+				"FILENAME":             "config_test.log",
+				"MULTILINE_START":      "^(",
+				"MULTILINE_TIMEOUT_MS": "-1",
+			},
+			wantErr:  true,
+			wantKeys: []string{"MULTILINE_START", "MULTILINE_TIMEOUT_MS"},
+		},
+		{
+			name: "bad admin settings",
+			env: map[string]string{
+				"FILENAME":     "config_test.log",
+				"ADMIN_ADDR":   "localhost",
+				"ADMIN_RECENT": "-1",
+			},
+			wantErr:  true,
+			wantKeys: []string{"ADMIN_ADDR", "ADMIN_RECENT"},
+		},
+		{
+			name: "bad index settings",
+			env: map[string]string{
+				"FILENAME":       "config_test.log",
+				"INDEX":          "sometimes",
+				"INDEX_INTERVAL": "0",
+			},
+			wantErr:  true,
+			wantKeys: []string{"INDEX", "INDEX_INTERVAL"},
+		},
+		{
+			name: "bad integrity settings",
+			env: map[string]string{
+				"FILENAME":             "config_test.log",
+				"INTEGRITY_KEY":        "/this/key/does/not/exist.pem",
+				"INTEGRITY_CHECKPOINT": "-1",
+			},
+			wantErr:  true,
+			wantKeys: []string{"INTEGRITY_KEY", "INTEGRITY_CHECKPOINT"},
+		},
+		{
+			name: "missing encryption key",
+			env: map[string]string{
+				"FILENAME":    "config_test.log",
+				"ENCRYPT_KEY": "/this/key/does/not/exist",
+			},
+			wantErr:  true,
+			wantKeys: []string{"ENCRYPT_KEY"},
+		},
+		{
+			name: "bad redaction settings",
+			env: map[string]string{
+				"FILENAME":    "config_test.log",
+				"REDACT":      "mac,ssn",
+				"REDACT_MODE": "hide",
+			},
+			wantErr:  true,
+			wantKeys: []string{"REDACT", "REDACT_MODE"},
+		},
+		{
+			name: "output in both lists",
+			env: map[string]string{
+				"FILENAME":       "config_test.log",
+				"OUTPUTS":        "file,stdout",
+				"ROUTED_OUTPUTS": "file",
+			},
+			wantErr:  true,
+			wantKeys: []string{"ROUTED_OUTPUTS"},
+		},
+		{
+			name: "bad queue and timeouts",
+			env: map[string]string{
+				"FILENAME":         "config_test.log",
+				"OUTPUT_QUEUE":     "-1",
+				"SHUTDOWN_GRACE":   "-5",
+				"SHUTDOWN_TIMEOUT": "0",
+				"RESTART_TIMEOUT":  "-30",
+			},
+			wantErr:  true,
+			wantKeys: []string{"OUTPUT_QUEUE", "SHUTDOWN_GRACE", "SHUTDOWN_TIMEOUT", "RESTART_TIMEOUT"},
+		},
+		{
+			name: "unknown lossy output",
+			env: map[string]string{
+				"FILENAME":      "config_test.log",
+				"OUTPUTS":       "file,stdout",
+				"LOSSY_OUTPUTS": "stdout, forward",
+			},
+			wantErr:  true,
+			wantKeys: []string{"LOSSY_OUTPUTS"},
+		},
+		{
+			name: "bad disk settings",
+			env: map[string]string{
+				"FILENAME":            "config_test.log",
+				"DISK_MIN_FREE_MB":    "100",
+				"DISK_RESUME_FREE_MB": "50",
+				"DISK_POLICY":         "spill",
+				"DISK_CHECK_INTERVAL": "0",
+			},
+			wantErr:  true,
+			wantKeys: []string{"DISK_RESUME_FREE_MB", "DISK_SPILL_DIR", "DISK_CHECK_INTERVAL"},
+		},
+		{
+			name: "outputs spilling into the same file",
+			env: map[string]string{
+				"FILENAME":         "config_test.log",
+				"OUTPUTS":          "file:a/app.log,file:b/app.log",
+				"ROUTED_OUTPUTS":   "c/app.log=file:a/app.log",
+				"DISK_MIN_FREE_MB": "100",
+				"DISK_POLICY":      "spill",
+				"DISK_SPILL_DIR":   "spill",
+			},
+			wantErr:  true,
+			wantKeys: []string{"DISK_SPILL_DIR"},
+		},
+		{
+			name: "bad disk policy",
+			env: map[string]string{
+				"FILENAME":         "config_test.log",
+				"DISK_MIN_FREE_MB": "100",
+				"DISK_POLICY":      "panic",
+			},
+			wantErr:  true,
+			wantKeys: []string{"DISK_POLICY"},
+		},
+		{
+			name: "bad retention settings",
+			env: map[string]string{
+				"FILENAME":                "config_test.log",
+				"RETENTION_BUDGET_MB":     "-1",
+				"RETENTION_PER_OUTPUT_MB": "lots",
+				"RETENTION_INTERVAL":      "0",
+			},
+			wantErr:  true,
+			wantKeys: []string{"RETENTION_BUDGET_MB", "RETENTION_PER_OUTPUT_MB", "RETENTION_INTERVAL"},
+		},
+		{
+			name: "redaction hmac without a key",
+			env: map[string]string{
+				"FILENAME":    "config_test.log",
+				"REDACT":      "mac, ipv4",
+				"REDACT_MODE": "hmac",
+			},
+			wantErr:  true,
+			wantKeys: []string{"REDACT_KEY"},
+		},
+		{
+			name: "missing rules file",
+			env: map[string]string{
+				"FILENAME":     "config_test.log",
+				"FILTER_RULES": "/this/file/does/not/exist.json",
+			},
+			wantErr:  true,
+			wantKeys: []string{"FILTER_RULES"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			got, err := Config()
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("Config() got error <%v>", err)
+				}
+				if got == nil {
+					t.Fatal("Config() returned a nil *Cfg without an error")
+				}
+				return
+			}
+
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) {
+				t.Fatalf("Config() got error <%v>, want a *ConfigError", err)
+			}
+			if got != nil {
+				t.Errorf("Config() returned a *Cfg along with an error")
+			}
+			if len(configErr.Errs) != len(tt.wantKeys) {
+				t.Errorf("Config() got %v errors <%v>, want %v", len(configErr.Errs), err, len(tt.wantKeys))
+			}
+			for _, key := range tt.wantKeys {
+				found := false
+				for _, e := range configErr.Errs {
+					var envErr *EnvError
+					if errors.As(e, &envErr) && envErr.Key == key {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("Config() error <%v> doesn't name <%v>", err, key)
+				}
+			}
+		})
+	}
+}
+
+func Test_setupConfig_ipv6Address(t *testing.T) {
+	t.Setenv("FILENAME", "config_test.log")
+	t.Setenv("ADDRESS", "::1")
+	t.Setenv("PORT", "514")
+
+	c, err := Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Listeners) != 1 || c.Listeners[0].Address != "[::1]:514" {
+		t.Errorf("Config() got listeners %+v, want one on [::1]:514", c.Listeners)
+	}
+}
+
+func Test_setupConfig_files(t *testing.T) {
 	tests := []struct {
 		name string
+		env  map[string]string
+		want []string
 	}{
-		// TODO: Add test cases.
+		{name: "default", want: []string{"config_test.log"}},
+		{name: "no file output", env: map[string]string{"OUTPUTS": "stdout"}},
+		{
+			name: "only other files, and routed ones",
+			env: map[string]string{
+				"OUTPUTS":        "stdout,file:other_test.log",
+				"ROUTED_OUTPUTS": "lab=file:lab_test.log,again=file:other_test.log",
+			},
+			want: []string{"other_test.log", "lab_test.log"},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			Config()
+			t.Setenv("FILENAME", "config_test.log")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			c, err := Config()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(c.Files, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("Config() got files %q, want %q", c.Files, tt.want)
+			}
 		})
 	}
 }
 
 func Test_setupLogger(t *testing.T) {
 	tests := []struct {
-		name string
+		name    string
+		env     map[string]string
+		want    *lumberjack.Logger
+		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{
+			name: "defaults",
+			env:  map[string]string{},
+			want: &lumberjack.Logger{
+				Filename:  "/var/log/openwrt/openwrt.log",
+				MaxAge:    180,
+				LocalTime: true,
+			},
+		},
+		{
+			name: "everything set",
+			env: map[string]string{
+				"FILENAME":     "/tmp/x.log",
+				"MAXSIZE":      "10",
+				"MAXAGE":       "7",
+				"MAXBACKUP":    "3",
+				"COMPRESS":     "true",
+				"USELOCALTIME": "false",
+			},
+			want: &lumberjack.Logger{
+				Filename:   "/tmp/x.log",
+				MaxSize:    10,
+				MaxAge:     7,
+				MaxBackups: 3,
+				Compress:   true,
+			},
+		},
+		{
+			name:    "bad int",
+			env:     map[string]string{"MAXAGE": "forever"},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			logger()
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			got, err := logger()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("logger() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Filename != tt.want.Filename ||
+				got.MaxSize != tt.want.MaxSize ||
+				got.MaxAge != tt.want.MaxAge ||
+				got.MaxBackups != tt.want.MaxBackups ||
+				got.LocalTime != tt.want.LocalTime ||
+				got.Compress != tt.want.Compress {
+				t.Errorf("logger() got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseOutputs(t *testing.T) {
+	file := &lumberjack.Logger{Filename: "main.log", MaxAge: 3}
+	tests := []struct {
+		name      string
+		spec      string
+		wantNames []string
+		wantErr   bool
+	}{
+		{name: "default", spec: "file", wantNames: []string{"file"}},
+		{name: "file and stdout", spec: "file, stdout", wantNames: []string{"file", "stdout"}},
+		{name: "named extra file", spec: "lab=file:/tmp/lab.log", wantNames: []string{"lab"}},
+		{name: "unnamed extra file", spec: "file:/tmp/lab.log", wantNames: []string{"/tmp/lab.log"}},
+		{name: "empty", spec: "", wantNames: nil},
+		{name: "forward", spec: "forward:tcp://127.0.0.1:1", wantNames: []string{"127.0.0.1:1"}},
+		{name: "named forward", spec: "central=forward:udp://127.0.0.1:1", wantNames: []string{"central"}},
+		{name: "forward without scheme", spec: "forward:127.0.0.1:1", wantErr: true},
+		{name: "forward with bad network", spec: "forward:sctp://127.0.0.1:1", wantErr: true},
+		{name: "unknown type", spec: "file,carrier-pigeon", wantErr: true},
+		{name: "duplicate name", spec: "stdout,stdout", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOutputs(tt.spec, file, output.ForwardConfig{}, output.FileConfig{})
+			for _, o := range got {
+				defer o.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseOutputs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.wantNames) {
+				t.Fatalf("parseOutputs() got %v outputs, want %v", len(got), len(tt.wantNames))
+			}
+			for i, o := range got {
+				if o.Name() != tt.wantNames[i] {
+					t.Errorf("parseOutputs() output %v named <%v>, want <%v>", i, o.Name(), tt.wantNames[i])
+				}
+			}
 		})
 	}
 }
+
+func Test_parseListeners(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      string
+		wantNames []string
+		wantErr   bool
+	}{
+		{name: "single", spec: "tcp://0.0.0.0:514", wantNames: []string{"tcp://0.0.0.0:514"}},
+		{
+			name:      "tcp and udp",
+			spec:      "tcp://0.0.0.0:514, udp://0.0.0.0:514",
+			wantNames: []string{"tcp://0.0.0.0:514", "udp://0.0.0.0:514"},
+		},
+		{
+			name:      "named with options",
+			spec:      "lan=tcp://0.0.0.0:514?framing=octet&allow=10.0.0.0/8&allow=192.168.1.1&output=lan",
+			wantNames: []string{"lan"},
+		},
+		{
+			name:      "unix sockets",
+			spec:      "unix:///run/tcplogger.sock?mode=0660&group=docker,unixgram:///dev/log",
+			wantNames: []string{"unix:///run/tcplogger.sock", "unixgram:///dev/log"},
+		},
+		{name: "bad mode", spec: "unix:///run/tcplogger.sock?mode=rw", wantErr: true},
+		{name: "mode on tcp", spec: "tcp://0.0.0.0:514?mode=0660", wantErr: true},
+		{name: "allow on unix", spec: "unix:///run/tcplogger.sock?allow=10.0.0.0/8", wantErr: true},
+		{
+			name:      "ipv6",
+			spec:      "tcp://[::]:514?v6only=true,udp://[fe80::1%eth0]:514",
+			wantNames: []string{"tcp://[::]:514", "udp://[fe80::1%eth0]:514"},
+		},
+		{
+			name:      "proxy protocol",
+			spec:      "lb=tcp://0.0.0.0:514?proxy=true&trust=10.0.0.0/8&trust=192.168.1.1&allow=203.0.113.0/24",
+			wantNames: []string{"lb"},
+		},
+		{name: "proxy without trust", spec: "tcp://0.0.0.0:514?proxy=true", wantErr: true},
+		{name: "proxy on udp", spec: "udp://0.0.0.0:514?proxy=true&trust=10.0.0.0/8", wantErr: true},
+		{name: "bad proxy", spec: "tcp://0.0.0.0:514?proxy=maybe&trust=10.0.0.0/8", wantErr: true},
+		{name: "bad trust", spec: "tcp://0.0.0.0:514?proxy=true&trust=lb", wantErr: true},
+		{name: "bad v6only", spec: "tcp://[::]:514?v6only=sure", wantErr: true},
+		{name: "no scheme", spec: "0.0.0.0:514", wantErr: true},
+		{name: "bad network", spec: "sctp://0.0.0.0:514", wantErr: true},
+		{name: "bad framing", spec: "tcp://0.0.0.0:514?framing=json", wantErr: true},
+		{name: "bad allow", spec: "tcp://0.0.0.0:514?allow=lan", wantErr: true},
+		{name: "tls without cert", spec: "tls://0.0.0.0:6514", wantErr: true},
+		{name: "tls with missing cert", spec: "tls://0.0.0.0:6514?cert=/nope.pem&key=/nope.key", wantErr: true},
+		{name: "duplicate name", spec: "a=tcp://0.0.0.0:514,a=udp://0.0.0.0:514", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseListeners(tt.spec, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseListeners() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.wantNames) {
+				t.Fatalf("parseListeners() got %v listeners, want %v", len(got), len(tt.wantNames))
+			}
+			for i, l := range got {
+				if l.Name != tt.wantNames[i] {
+					t.Errorf("parseListeners() listener %v named <%v>, want <%v>", i, l.Name, tt.wantNames[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_parseListeners_systemd(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	inherited := []systemd.Socket{{Name: "syslog", Listener: l}, {Name: "syslog", PacketConn: pc}}
+
+	got, err := parseListeners(systemdListeners(inherited), inherited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("parseListeners() got %v listeners, want 2", len(got))
+	}
+	if got[0].Name != "syslog" || got[0].Network != "tcp" || got[0].Listener != l {
+		t.Errorf("parseListeners()[0] = %+v, want the inherited tcp listener named syslog", got[0])
+	}
+	if got[1].Name != "syslog#2" || got[1].Network != "udp" || got[1].PacketConn != pc {
+		t.Errorf("parseListeners()[1] = %+v, want the inherited udp conn named syslog#2", got[1])
+	}
+
+	if _, err := parseListeners("systemd://syslog,systemd://syslog,systemd://syslog", inherited); err == nil {
+		t.Error("parseListeners() took more sockets than were inherited")
+	}
+
+	// handed over by a restart, named after the listener
+	handed := []systemd.Socket{{Name: "tcp://127.0.0.1:514", Listener: l}}
+	got, err = parseListeners("tcp://127.0.0.1:514", handed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Listener != l {
+		t.Errorf("parseListeners() = %+v, want the listener that was handed over", got)
+	}
+	if _, err := parseListeners("udp://127.0.0.1:514", []systemd.Socket{{Name: "udp://127.0.0.1:514", Listener: l}}); err == nil {
+		t.Error("parseListeners() took a stream socket for a udp listener")
+	}
+
+	// named systemd listeners, handed over by a restart under those names
+	handed = []systemd.Socket{{Name: "rsyslog", Listener: l}, {Name: "syslog#2", PacketConn: pc}}
+	got, err = parseListeners("rsyslog=systemd://syslog,syslog#2=systemd://syslog", handed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Listener != l || got[0].Network != "tcp" || got[1].PacketConn != pc || got[1].Network != "udp" {
+		t.Errorf("parseListeners() = %+v, want the sockets that were handed over", got)
+	}
+}
@@ -0,0 +1,239 @@
+package syslog
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var (
+	NoPriorityError      error = errors.New("message has no syslog priority")
+	InvalidPriorityError error = errors.New("invalid syslog priority")
+)
+
+// Header holds the bits of an RFC 3164 or RFC 5424 header we care about.
+// Fields the sender did not provide are left empty.
+type Header struct {
+	Facility int
+	Severity int
+	Hostname string
+	Program  string
+	Content  []byte // what comes after the header, without the trailing newline
+}
+
+var facilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "clock",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var severities = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+// FacilityName returns the keyword for facility f, or its number if unknown.
+func FacilityName(f int) string {
+	if f < 0 || f >= len(facilities) {
+		return strconv.Itoa(f)
+	}
+	return facilities[f]
+}
+
+// SeverityName returns the keyword for severity s, or its number if unknown.
+func SeverityName(s int) string {
+	if s < 0 || s >= len(severities) {
+		return strconv.Itoa(s)
+	}
+	return severities[s]
+}
+
+// Facility accepts either a keyword ("daemon") or a number ("3").
+func Facility(name string) (int, bool) {
+	return lookup(facilities, name)
+}
+
+// Severity accepts either a keyword ("err") or a number ("3").
+func Severity(name string) (int, bool) {
+	switch name { // aliases found in the wild
+	case "error":
+		name = "err"
+	case "warn":
+		name = "warning"
+	case "panic":
+		name = "emerg"
+	}
+	return lookup(severities, name)
+}
+
+func lookup(names []string, name string) (int, bool) {
+	for i, n := range names {
+		if n == name {
+			return i, true
+		}
+	}
+	i, err := strconv.Atoi(name)
+	if err != nil || i < 0 || i >= len(names) {
+		return 0, false
+	}
+	return i, true
+}
+
+// Parse reads the priority, hostname and program out of a syslog line.
+// Anything after the header is ignored; the raw line is what gets logged.
+func Parse(b []byte) (*Header, error) {
+	if len(b) < 3 || b[0] != '<' {
+		return nil, NoPriorityError
+	}
+	end := bytes.IndexByte(b[:min(len(b), 5)], '>')
+	if end < 2 {
+		return nil, InvalidPriorityError
+	}
+	pri, err := strconv.Atoi(string(b[1:end]))
+	if err != nil || pri < 0 || pri > 191 {
+		return nil, InvalidPriorityError
+	}
+
+	h := &Header{Facility: pri / 8, Severity: pri % 8}
+	rest := bytes.TrimRight(b[end+1:], "\r\n")
+
+	if bytes.HasPrefix(rest, []byte("1 ")) {
+		parse5424(h, rest)
+	} else {
+		parse3164(h, rest)
+	}
+	return h, nil
+}
+
+// VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func parse5424(h *Header, b []byte) {
+	fields := bytes.SplitN(b, []byte(" "), 7)
+	if len(fields) > 2 && string(fields[2]) != "-" {
+		h.Hostname = string(fields[2])
+	}
+	if len(fields) > 3 && string(fields[3]) != "-" {
+		h.Program = string(fields[3])
+	}
+	if len(fields) == 7 {
+		h.Content = skipStructuredData(fields[6])
+	}
+}
+
+// skipStructuredData returns what follows the STRUCTURED-DATA field, which
+// is either "-" or a run of [...] elements that may contain spaces.
+func skipStructuredData(b []byte) []byte {
+	if bytes.HasPrefix(b, []byte("-")) {
+		return bytes.TrimPrefix(b[1:], []byte(" "))
+	}
+	for len(b) > 0 && b[0] == '[' {
+		i := 1
+		for ; i < len(b) && b[i] != ']'; i++ {
+			if b[i] == '\\' {
+				i++ // escaped ] or "
+			}
+		}
+		if i >= len(b) {
+			return nil
+		}
+		b = b[i+1:]
+	}
+	return bytes.TrimPrefix(b, []byte(" "))
+}
+
+// [TIMESTAMP] [HOSTNAME] TAG[PID]: MSG
+//
+// OpenWrt's logd usually leaves the hostname out, so the first token after
+// the timestamp is only taken as a hostname if it doesn't look like a tag.
+func parse3164(h *Header, b []byte) {
+	const stamp = time.Stamp // "Jan _2 15:04:05"
+	if len(b) > len(stamp) {
+		if _, err := time.Parse(stamp, string(b[:len(stamp)])); err == nil {
+			b = bytes.TrimLeft(b[len(stamp):], " ")
+		}
+	}
+
+	h.Content = b
+	first, rest, _ := bytes.Cut(b, []byte(" "))
+	if tag, ok := parseTag(first); ok {
+		h.Program, h.Content = tag, rest
+		return
+	}
+	second, content, _ := bytes.Cut(rest, []byte(" "))
+	if tag, ok := parseTag(second); ok {
+		h.Hostname, h.Program, h.Content = string(first), tag, content
+	}
+}
+
+// Timestamp reads the timestamp of a syslog line. RFC 3164 ones have no
+// year or zone, so they're taken as local time in the year that puts them
+// closest before ref, like the time the line was written down.
+func Timestamp(b []byte, ref time.Time) (time.Time, bool) {
+	end := bytes.IndexByte(b[:min(len(b), 5)], '>')
+	if len(b) < 3 || b[0] != '<' || end < 2 {
+		return time.Time{}, false
+	}
+	rest := b[end+1:]
+
+	if bytes.HasPrefix(rest, []byte("1 ")) {
+		stamp, _, _ := bytes.Cut(rest[2:], []byte(" "))
+		ts, err := time.Parse(time.RFC3339Nano, string(stamp))
+		return ts, err == nil
+	}
+
+	const stamp = time.Stamp
+	if len(rest) < len(stamp) {
+		return time.Time{}, false
+	}
+	ts, err := time.ParseInLocation(stamp, string(rest[:len(stamp)]), ref.Location())
+	if err != nil {
+		return time.Time{}, false
+	}
+	ts = ts.AddDate(ref.Year(), 0, 0)
+	// a day of slack for clocks that are a bit off
+	if ts.After(ref.AddDate(0, 0, 1)) {
+		ts = ts.AddDate(-1, 0, 0)
+	}
+	return ts, true
+}
+
+// Format5424 renders h as a newline terminated RFC 5424 line. ts is used as
+// the timestamp since RFC 3164 ones don't carry a year or a zone.
+func Format5424(h *Header, ts time.Time) []byte {
+	hostname, program := h.Hostname, h.Program
+	if hostname == "" {
+		hostname = "-"
+	}
+	if program == "" {
+		program = "-"
+	}
+
+	b := make([]byte, 0, 64+len(h.Content))
+	b = append(b, '<')
+	b = strconv.AppendInt(b, int64(h.Facility*8+h.Severity), 10)
+	b = append(b, ">1 "...)
+	b = ts.AppendFormat(b, time.RFC3339Nano)
+	b = append(b, ' ')
+	b = append(b, hostname...)
+	b = append(b, ' ')
+	b = append(b, program...)
+	b = append(b, " - - -"...)
+	if len(h.Content) > 0 {
+		b = append(b, ' ')
+		b = append(b, h.Content...)
+	}
+	return append(b, '\n')
+}
+
+func parseTag(b []byte) (string, bool) {
+	if !bytes.HasSuffix(b, []byte(":")) {
+		return "", false
+	}
+	b = b[:len(b)-1]
+	if i := bytes.IndexByte(b, '['); i >= 0 {
+		b = b[:i]
+	}
+	if len(b) == 0 {
+		return "", false
+	}
+	return string(b), true
+}
@@ -0,0 +1,180 @@
+package syslog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []byte
+		want    *Header
+		wantErr error
+	}{
+		{
+			name: "openwrt line without hostname",
+			msg:  []byte("<30>Oct 19 12:00:00 hostapd: wlan0: STA aa:bb:cc:dd:ee:ff IEEE 802.11: authenticated\n"),
+			want: &Header{
+				Facility: 3,
+				Severity: 6,
+				Program:  "hostapd",
+				Content:  []byte("wlan0: STA aa:bb:cc:dd:ee:ff IEEE 802.11: authenticated"),
+			},
+		},
+		{
+			name: "rfc3164 with hostname and pid",
+			msg:  []byte("<86>Oct  9 08:01:02 router dropbear[1234]: Password auth succeeded\n"),
+			want: &Header{
+				Facility: 10,
+				Severity: 6,
+				Hostname: "router",
+				Program:  "dropbear",
+				Content:  []byte("Password auth succeeded"),
+			},
+		},
+		{
+			name: "rfc5424",
+			msg:  []byte("<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 - hi\n"),
+			want: &Header{
+				Facility: 20,
+				Severity: 5,
+				Hostname: "mymachine.example.com",
+				Program:  "evntslog",
+				Content:  []byte("hi"),
+			},
+		},
+		{
+			name: "rfc5424 with structured data",
+			msg:  []byte(`<165>1 2003-10-11T22:14:15.003Z host app - ID47 [exampleSDID@32473 iut="3" eventSource="Application \] x"][b@1 c="d"] hello there`),
+			want: &Header{
+				Facility: 20,
+				Severity: 5,
+				Hostname: "host",
+				Program:  "app",
+				Content:  []byte("hello there"),
+			},
+		},
+		{
+			name: "rfc5424 with nil values",
+			msg:  []byte("<0>1 - - - - - -\n"),
+			want: &Header{Content: []byte{}},
+		},
+		{
+			name:    "no priority",
+			msg:     []byte("just a line\n"),
+			wantErr: NoPriorityError,
+		},
+		{
+			name:    "priority out of range",
+			msg:     []byte("<192>Oct 19 12:00:00 hostapd: hi\n"),
+			wantErr: InvalidPriorityError,
+		},
+		{
+			name:    "unterminated priority",
+			msg:     []byte("<30 hostapd: hi\n"),
+			wantErr: InvalidPriorityError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.msg)
+			if err != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   int
+		wantOk bool
+	}{
+		{name: "err", want: 3, wantOk: true},
+		{name: "error", want: 3, wantOk: true},
+		{name: "7", want: 7, wantOk: true},
+		{name: "8", want: 0, wantOk: false},
+		{name: "loud", want: 0, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Severity(tt.name)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("Severity() got %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestFormat5424(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		h    *Header
+		want string
+	}{
+		{
+			name: "full header",
+			h:    &Header{Facility: 3, Severity: 6, Hostname: "ap1", Program: "hostapd", Content: []byte("hi")},
+			want: "<30>1 2024-03-01T12:30:00Z ap1 hostapd - - - hi\n",
+		},
+		{
+			name: "nothing but a priority",
+			h:    &Header{Facility: 1, Severity: 5},
+			want: "<13>1 2024-03-01T12:30:00Z - - - - -\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(Format5424(tt.h, ts)); got != tt.want {
+				t.Errorf("Format5424() got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	ref := time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		line   string
+		want   time.Time
+		wantOk bool
+	}{
+		{
+			name:   "rfc5424",
+			line:   "<14>1 2024-01-01T10:00:00.5+01:00 router app - - - hi\n",
+			want:   time.Date(2024, time.January, 1, 9, 0, 0, 5e8, time.UTC),
+			wantOk: true,
+		},
+		{
+			name:   "rfc3164 this year",
+			line:   "<30>Jan  2 11:00:00 hostapd: hi\n",
+			want:   time.Date(2024, time.January, 2, 11, 0, 0, 0, time.UTC),
+			wantOk: true,
+		},
+		{
+			name:   "rfc3164 last year",
+			line:   "<30>Dec 31 23:00:00 hostapd: hi\n",
+			want:   time.Date(2023, time.December, 31, 23, 0, 0, 0, time.UTC),
+			wantOk: true,
+		},
+		{name: "rfc5424 without timestamp", line: "<14>1 - router app - - - hi\n"},
+		{name: "no timestamp", line: "<30>hostapd: hi\n"},
+		{name: "not syslog", line: "  at foo.lua:12\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Timestamp([]byte(tt.line), ref)
+			if ok != tt.wantOk || !got.Equal(tt.want) {
+				t.Errorf("Timestamp() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Package systemd implements the bits of socket activation and sd_notify
+// that tcpLogger uses, see sd_listen_fds(3) and sd_notify(3).
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	listenFDsStart int = 3 // SD_LISTEN_FDS_START
+
+	Ready    string = "READY=1"
+	Stopping string = "STOPPING=1"
+	Watchdog string = "WATCHDOG=1"
+)
+
+// Socket is a socket passed to us by systemd. only one of Listener or
+// PacketConn is set.
+type Socket struct {
+	Name       string // FileDescriptorName= of the socket unit, "unknown" if not set
+	Listener   net.Listener
+	PacketConn net.PacketConn
+}
+
+// Sockets returns the sockets passed through LISTEN_FDS, or nil if there
+// aren't any for this process. the env vars are unset, so the sockets
+// aren't passed on to anything we start.
+//
+// LISTEN_PID may be left out by whoever can't know our pid before exec'ing
+// us, like a graceful restart. names are query-unescaped, so they can hold
+// the ':' LISTEN_FDNAMES is split on.
+func Sockets() ([]Socket, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	return sockets(listenFDsStart)
+}
+
+func sockets(start int) ([]Socket, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil // meant for someone else
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS <%v>", fds)
+	}
+
+	var names []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+
+	socks := make([]Socket, 0, n)
+	for i := 0; i < n; i++ {
+		fd := start + i
+		syscall.CloseOnExec(fd)
+
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			if name, err = url.QueryUnescape(names[i]); err != nil {
+				name = names[i]
+			}
+		}
+		s, err := socket(fd, name)
+		if err != nil {
+			for _, s := range socks {
+				s.close()
+			}
+			return nil, fmt.Errorf("fd %d <%v>: %w", fd, name, err)
+		}
+		socks = append(socks, s)
+	}
+	return socks, nil
+}
+
+func socket(fd int, name string) (Socket, error) {
+	typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return Socket{}, err
+	}
+
+	// the net package dups the fd, so ours can go once it's done
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+
+	s := Socket{Name: name}
+	switch typ {
+	case syscall.SOCK_STREAM:
+		s.Listener, err = net.FileListener(f)
+	case syscall.SOCK_DGRAM:
+		s.PacketConn, err = net.FilePacketConn(f)
+	default:
+		err = fmt.Errorf("unsupported socket type %d", typ)
+	}
+	return s, err
+}
+
+func (s Socket) close() {
+	if s.Listener != nil {
+		s.Listener.Close()
+	}
+	if s.PacketConn != nil {
+		s.PacketConn.Close()
+	}
+}
+
+// Notify sends state to the service manager. it returns false, and no
+// error, if we weren't started by one that wants to hear about it.
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+	// net understands a leading '@' as an abstract socket, same as systemd
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// MainPID is the state that tells the service manager another process took
+// over as the main one. sent by the one that's still the main one, the
+// default NotifyAccess=main is enough.
+func MainPID(pid int) string {
+	return "MAINPID=" + strconv.Itoa(pid)
+}
+
+// WatchdogInterval returns how often WATCHDOG=1 has to be sent, or 0 if the
+// watchdog isn't enabled for us.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC <%v>", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// WatchdogWithCtx sends WATCHDOG=1 every half interval, as
+// sd_watchdog_enabled(3) recommends, until ctx is canceled.
+func WatchdogWithCtx(interval time.Duration, ctx context.Context) {
+	slog.Info("WatchdogWithCtx(): starting routine...", "interval", interval)
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := Notify(Watchdog); err != nil {
+				slog.Error("WatchdogWithCtx(): error notifying service manager", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket stands in for the socket systemd listens on, and points
+// NOTIFY_SOCKET at it.
+func fakeNotifySocket(t *testing.T) net.PacketConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return pc
+}
+
+func readState(t *testing.T, pc net.PacketConn) string {
+	t.Helper()
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	t.Run("not under systemd", func(t *testing.T) {
+		t.Setenv("NOTIFY_SOCKET", "")
+		sent, err := Notify(Ready)
+		if sent || err != nil {
+			t.Errorf("Notify() = %v, %v, want false, nil", sent, err)
+		}
+	})
+
+	t.Run("ready and stopping", func(t *testing.T) {
+		pc := fakeNotifySocket(t)
+		for _, state := range []string{Ready, Stopping} {
+			sent, err := Notify(state)
+			if !sent || err != nil {
+				t.Fatalf("Notify() = %v, %v, want true, nil", sent, err)
+			}
+			if got := readState(t, pc); got != state {
+				t.Errorf("notify socket got %q, want %q", got, state)
+			}
+		}
+	})
+
+	t.Run("abstract socket", func(t *testing.T) {
+		name := "@tcplogger-test-" + strconv.Itoa(os.Getpid())
+		pc, err := net.ListenPacket("unixgram", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		t.Setenv("NOTIFY_SOCKET", name)
+
+		if _, err := Notify(Ready); err != nil {
+			t.Fatal(err)
+		}
+		if got := readState(t, pc); got != Ready {
+			t.Errorf("notify socket got %q, want %q", got, Ready)
+		}
+	})
+
+	t.Run("socket gone", func(t *testing.T) {
+		t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "nope.sock"))
+		if _, err := Notify(Ready); err == nil {
+			t.Error("Notify() to a missing socket returned no error")
+		}
+	})
+}
+
+func TestWatchdogWithCtx(t *testing.T) {
+	pc := fakeNotifySocket(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchdogWithCtx(20*time.Millisecond, ctx)
+
+	for i := 0; i < 2; i++ {
+		if got := readState(t, pc); got != Watchdog {
+			t.Errorf("notify socket got %q, want %q", got, Watchdog)
+		}
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		name    string
+		usec    string
+		pid     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "disabled"},
+		{name: "enabled", usec: "30000000", want: 30 * time.Second},
+		{name: "for us", usec: "1000", pid: strconv.Itoa(os.Getpid()), want: time.Millisecond},
+		{name: "for someone else", usec: "1000", pid: "1"},
+		{name: "garbage", usec: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tt.usec)
+			t.Setenv("WATCHDOG_PID", tt.pid)
+			got, err := WatchdogInterval()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WatchdogInterval() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("WatchdogInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// passSockets puts dups of fds at start, start+1... like systemd does at 3.
+func passSockets(t *testing.T, start int, files ...*os.File) {
+	t.Helper()
+	for i, f := range files {
+		if err := syscall.Dup3(int(f.Fd()), start+i, 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+}
+
+func TestSockets(t *testing.T) {
+	const start = 100 // well clear of anything the test binary has open
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf, _ := l.(*net.TCPListener).File()
+	pf, _ := pc.(*net.UDPConn).File()
+	addr := l.Addr().String()
+	l.Close()
+	pc.Close()
+	passSockets(t, start, lf, pf)
+
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "2")
+	if socks, err := sockets(start); socks != nil || err != nil {
+		t.Fatalf("sockets() meant for another pid = %v, %v, want nil, nil", socks, err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDNAMES", "syslog-tcp")
+	socks, err := sockets(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, s := range socks {
+			s.close()
+		}
+	}()
+
+	if len(socks) != 2 {
+		t.Fatalf("sockets() returned %v sockets, want 2", len(socks))
+	}
+	if socks[0].Name != "syslog-tcp" || socks[0].Listener == nil {
+		t.Errorf("sockets()[0] = %+v, want a listener named syslog-tcp", socks[0])
+	}
+	if socks[1].Name != "unknown" || socks[1].PacketConn == nil {
+		t.Errorf("sockets()[1] = %+v, want a packet conn named unknown", socks[1])
+	}
+
+	// the inherited listener is the one we bound
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, err := socks[0].Listener.Accept(); err != nil {
+		t.Errorf("Accept() on inherited listener got error %v", err)
+	}
+}
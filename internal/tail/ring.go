@@ -0,0 +1,179 @@
+package tail
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+)
+
+const (
+	// rateWindow is how many seconds a source's rate is averaged over
+	rateWindow int = 60
+	// sourceTTL is how long a source that went quiet is still listed
+	sourceTTL time.Duration = time.Hour
+	// maxSources is how many sources are kept track of before the ones that
+	// went quiet are let go early
+	maxSources int = 4096
+)
+
+// Publisher is what a Hub and a Ring have in common.
+type Publisher interface {
+	Publish(m *message.Message)
+}
+
+// Tee publishes every message to all of its Publishers, in order.
+type Tee []Publisher
+
+func (t Tee) Publish(m *message.Message) {
+	for _, p := range t {
+		p.Publish(m)
+	}
+}
+
+// Ring holds on to the last messages published to it, and keeps count of
+// what every source sent. it's safe for concurrent use.
+type Ring struct {
+	mu      sync.RWMutex
+	buf     []*message.Message
+	next    int // where the next message goes
+	full    bool
+	sources map[string]*source
+}
+
+// NewRing returns a Ring for the last size messages, which has to be more
+// than 0.
+func NewRing(size int) *Ring {
+	return &Ring{buf: make([]*message.Message, size), sources: make(map[string]*source)}
+}
+
+// Publish adds m, pushing out the oldest message if the Ring is full. m must
+// not be changed after.
+func (r *Ring) Publish(m *message.Message) {
+	now := time.Now()
+	host := sourceHost(m.Source)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf[r.next] = m
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+
+	s := r.sources[host]
+	if s == nil {
+		if len(r.sources) >= maxSources {
+			r.prune(now, 0)
+		}
+		s = &source{}
+		r.sources[host] = s
+	}
+	s.add(now)
+}
+
+// Search returns the newest messages f matches, newest first, up to limit
+// of them. all of them if limit is 0 or less.
+func (r *Ring) Search(f Filter, limit int) []*message.Message {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var found []*message.Message
+	n := r.next
+	if r.full {
+		n = len(r.buf)
+	}
+	for i := 1; i <= n; i++ {
+		m := r.buf[(r.next-i+len(r.buf))%len(r.buf)]
+		if !f.match(m) {
+			continue
+		}
+		found = append(found, m)
+		if len(found) == limit {
+			break
+		}
+	}
+	return found
+}
+
+// SourceStats is what a source sent. sources are told apart by address,
+// whatever port they connect from.
+type SourceStats struct {
+	Source string    `json:"source"`
+	Lines  uint64    `json:"lines"`
+	Rate   float64   `json:"rate"` // lines per second over the last minute
+	Last   time.Time `json:"last"`
+}
+
+// Sources returns the stats of every source heard from in the last hour,
+// busiest first.
+func (r *Ring) Sources() []SourceStats {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune(now, sourceTTL)
+
+	stats := make([]SourceStats, 0, len(r.sources))
+	for host, s := range r.sources {
+		stats = append(stats, SourceStats{Source: host, Lines: s.lines, Rate: s.rate(now), Last: s.last})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Rate != stats[j].Rate {
+			return stats[i].Rate > stats[j].Rate
+		}
+		return stats[i].Source < stats[j].Source
+	})
+	return stats
+}
+
+// prune lets go of the sources that have been quiet for longer than ttl,
+// or, with a ttl of 0, for longer than the rate window.
+func (r *Ring) prune(now time.Time, ttl time.Duration) {
+	if ttl == 0 {
+		ttl = time.Duration(rateWindow) * time.Second
+	}
+	for host, s := range r.sources {
+		if now.Sub(s.last) > ttl {
+			delete(r.sources, host)
+		}
+	}
+}
+
+// source counts lines per second, over the last rateWindow seconds.
+type source struct {
+	lines  uint64
+	last   time.Time
+	secs   [rateWindow]int64 // the unix second every slot of counts is for
+	counts [rateWindow]uint64
+}
+
+func (s *source) add(now time.Time) {
+	s.lines++
+	s.last = now
+	sec := now.Unix()
+	i := sec % int64(rateWindow)
+	if s.secs[i] != sec {
+		s.secs[i], s.counts[i] = sec, 0
+	}
+	s.counts[i]++
+}
+
+func (s *source) rate(now time.Time) float64 {
+	var n uint64
+	for i, sec := range s.secs {
+		if now.Unix()-sec < int64(rateWindow) {
+			n += s.counts[i]
+		}
+	}
+	return float64(n) / float64(rateWindow)
+}
+
+// sourceHost is the address of a source without its port, which changes
+// with every connection.
+func sourceHost(src string) string {
+	if host, _, err := net.SplitHostPort(src); err == nil {
+		return host
+	}
+	return src
+}
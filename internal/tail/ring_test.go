@@ -0,0 +1,83 @@
+package tail
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+)
+
+func TestRing_Search(t *testing.T) {
+	r := NewRing(3)
+	for i := 1; i <= 5; i++ {
+		r.Publish(&message.Message{Data: []byte(fmt.Sprintf("line %d\n", i)), Source: "10.0.0.1:5000"})
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		limit  int
+		want   []string
+	}{
+		{name: "everything kept", filter: Any, want: []string{"line 5\n", "line 4\n", "line 3\n"}},
+		{name: "limit", filter: Any, limit: 2, want: []string{"line 5\n", "line 4\n"}},
+		{name: "filter", filter: Filter{Severity: -1, Regexp: regexp.MustCompile(`[34]`)}, want: []string{"line 4\n", "line 3\n"}},
+		{name: "pushed out", filter: Filter{Severity: -1, Regexp: regexp.MustCompile(`1`)}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := r.Search(tt.filter, tt.limit)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Search() got %v messages, want %q", len(got), tt.want)
+			}
+			for i := range got {
+				if string(got[i].Data) != tt.want[i] {
+					t.Errorf("Search()[%d] = %q, want %q", i, got[i].Data, tt.want[i])
+				}
+			}
+		})
+	}
+
+	if got := NewRing(3).Search(Any, 0); len(got) != 0 {
+		t.Errorf("Search() on an empty ring got %v messages", len(got))
+	}
+}
+
+func TestRing_Sources(t *testing.T) {
+	r := NewRing(10)
+	for _, src := range []string{"10.0.0.1:5000", "10.0.0.1:5001", "[fe80::1]:5000", "10.0.0.1:5002", "/run/log.sock"} {
+		r.Publish(&message.Message{Data: []byte("hi\n"), Source: src})
+	}
+
+	got := r.Sources()
+	want := []struct {
+		source string
+		lines  uint64
+	}{{"10.0.0.1", 3}, {"/run/log.sock", 1}, {"fe80::1", 1}}
+	if len(got) != len(want) {
+		t.Fatalf("Sources() = %+v, want %v sources", got, len(want))
+	}
+	for i, w := range want {
+		if got[i].Source != w.source || got[i].Lines != w.lines {
+			t.Errorf("Sources()[%d] = %+v, want %v with %v lines", i, got[i], w.source, w.lines)
+		}
+		if got[i].Rate <= 0 || time.Since(got[i].Last) > time.Minute {
+			t.Errorf("Sources()[%d] = %+v, want a rate and a recent last time", i, got[i])
+		}
+	}
+}
+
+func TestTee(t *testing.T) {
+	hub, ring := NewHub(), NewRing(1)
+	sub := hub.Subscribe(Any, 1)
+	Tee{hub, ring}.Publish(&message.Message{Data: []byte("hi\n")})
+
+	if m := <-sub.C; string(m.Data) != "hi\n" {
+		t.Errorf("hub got %q", m.Data)
+	}
+	if got := ring.Search(Any, 0); len(got) != 1 {
+		t.Errorf("ring got %v messages, want 1", len(got))
+	}
+}
@@ -0,0 +1,145 @@
+// Package tail hands every message that reaches the writer to whoever is
+// watching, without ever making the writer wait for them.
+package tail
+
+import (
+	"net"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+)
+
+// DefBuffer is how many messages a subscriber can fall behind by before
+// they're dropped, if Subscribe isn't told otherwise.
+const DefBuffer int = 256
+
+// Filter picks the messages a subscriber gets. see Any for one that picks
+// all of them.
+type Filter struct {
+	// Source is the sender's address, with or without its port, or the
+	// hostname in its syslog header. empty for any
+	Source   string
+	Severity int // this severity or a more severe one. -1 for any
+	Regexp   *regexp.Regexp
+}
+
+// Any is a Filter that matches everything.
+var Any = Filter{Severity: -1}
+
+func (f *Filter) match(m *message.Message) bool {
+	if f.Source != "" && !f.source(m) {
+		return false
+	}
+	if f.Severity >= 0 && (m.Syslog == nil || m.Syslog.Severity > f.Severity) {
+		return false
+	}
+	return f.Regexp == nil || f.Regexp.Match(m.Data)
+}
+
+func (f *Filter) source(m *message.Message) bool {
+	if m.Source == f.Source {
+		return true
+	}
+	if host, _, err := net.SplitHostPort(m.Source); err == nil && host == f.Source {
+		return true
+	}
+	return m.Syslog != nil && m.Syslog.Hostname == f.Source
+}
+
+// Hub fans messages out to its subscribers. it's safe for concurrent use.
+type Hub struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*Subscription]struct{})}
+}
+
+// Publish hands m to every subscriber it matches. a subscriber whose buffer
+// is full misses it, Publish never blocks. m must not be changed after.
+func (h *Hub) Publish(m *message.Message) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs {
+		if !s.filter.match(m) {
+			continue
+		}
+		select {
+		case s.ch <- m:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Subscribe starts handing the messages f matches to the returned
+// Subscription, up to buffer of them at a time. DefBuffer if buffer is 0 or
+// less. subscribing to a closed Hub returns a closed Subscription.
+func (h *Hub) Subscribe(f Filter, buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = DefBuffer
+	}
+	s := &Subscription{hub: h, filter: f, ch: make(chan *message.Message, buffer)}
+	s.C = s.ch
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(s.ch)
+		return s
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+// Len is how many subscribers there are.
+func (h *Hub) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs)
+}
+
+// Close closes every Subscription, like when the server is shutting down.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for s := range h.subs {
+		delete(h.subs, s)
+		close(s.ch)
+	}
+}
+
+// Subscription is a single subscriber of a Hub.
+type Subscription struct {
+	// C gets the messages. it's closed by Close, or once the Hub is
+	C <-chan *message.Message
+
+	hub     *Hub
+	filter  Filter
+	ch      chan *message.Message
+	dropped atomic.Uint64
+}
+
+// Dropped is how many messages were missed so far because C was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close unsubscribes s. it's fine to call it more than once.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if _, ok := s.hub.subs[s]; !ok {
+		return
+	}
+	delete(s.hub.subs, s)
+	close(s.ch)
+}
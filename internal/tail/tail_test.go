@@ -0,0 +1,83 @@
+package tail
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/syslog"
+)
+
+func TestFilter_match(t *testing.T) {
+	warning := &message.Message{
+		Data:   []byte("<12>1 2024-01-02T10:00:00Z router app - - - disk almost full\n"),
+		Source: "10.0.0.1:5000",
+		Syslog: &syslog.Header{Severity: 4, Hostname: "router"},
+	}
+	plain := &message.Message{Data: []byte("hello\n"), Source: "[fe80::1]:5000"}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		msg    *message.Message
+		want   bool
+	}{
+		{name: "any", filter: Any, msg: plain, want: true},
+		{name: "source with port", filter: Filter{Source: "10.0.0.1:5000", Severity: -1}, msg: warning, want: true},
+		{name: "source without port", filter: Filter{Source: "10.0.0.1", Severity: -1}, msg: warning, want: true},
+		{name: "ipv6 source without port", filter: Filter{Source: "fe80::1", Severity: -1}, msg: plain, want: true},
+		{name: "syslog hostname", filter: Filter{Source: "router", Severity: -1}, msg: warning, want: true},
+		{name: "other source", filter: Filter{Source: "10.0.0.2", Severity: -1}, msg: warning, want: false},
+		{name: "as severe", filter: Filter{Severity: 4}, msg: warning, want: true},
+		{name: "less severe", filter: Filter{Severity: 3}, msg: warning, want: false},
+		{name: "severity of unparsed", filter: Filter{Severity: 7}, msg: plain, want: false},
+		{name: "regexp", filter: Filter{Severity: -1, Regexp: regexp.MustCompile(`disk \w+ full`)}, msg: warning, want: true},
+		{name: "regexp no match", filter: Filter{Severity: -1, Regexp: regexp.MustCompile(`^hi`)}, msg: plain, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.match(tt.msg); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHub(t *testing.T) {
+	h := NewHub()
+	all := h.Subscribe(Any, 2)
+	hi := h.Subscribe(Filter{Severity: -1, Regexp: regexp.MustCompile(`^hi`)}, 2)
+
+	for _, data := range []string{"hi 1\n", "bye\n", "hi 2\n", "hi 3\n"} {
+		h.Publish(&message.Message{Data: []byte(data)})
+	}
+
+	// full buffers drop instead of blocking Publish
+	if got := all.Dropped(); got != 2 {
+		t.Errorf("all.Dropped() = %v, want 2", got)
+	}
+	if got := hi.Dropped(); got != 1 {
+		t.Errorf("hi.Dropped() = %v, want 1", got)
+	}
+	for _, want := range []string{"hi 1\n", "hi 2\n"} {
+		if m := <-hi.C; string(m.Data) != want {
+			t.Errorf("hi got %q, want %q", m.Data, want)
+		}
+	}
+
+	hi.Close()
+	hi.Close()
+	if _, ok := <-hi.C; ok {
+		t.Error("hi.C is still open after Close()")
+	}
+	if got := h.Len(); got != 1 {
+		t.Errorf("Len() = %v, want 1", got)
+	}
+
+	h.Close()
+	for range all.C {
+	}
+	if _, ok := <-h.Subscribe(Any, 0).C; ok {
+		t.Error("Subscribe() on a closed hub returned an open subscription")
+	}
+}
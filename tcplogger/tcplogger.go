@@ -0,0 +1,143 @@
+// Package tcplogger embeds the tcpLogger listener in another program.
+//
+//	srv, err := tcplogger.New(tcplogger.Options{
+//		Address: "127.0.0.1:5514",
+//		Sinks:   []tcplogger.Sink{tcplogger.NewWriterSink("stdout", os.Stdout)},
+//		Parser:  tcplogger.SyslogParser{},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	go srv.Serve(ctx)
+//	...
+//	srv.Shutdown(shutdownCtx)
+package tcplogger
+
+import (
+	"io"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/zspekt/tcpLogger/internal/filter"
+	"github.com/zspekt/tcpLogger/internal/listener"
+	"github.com/zspekt/tcpLogger/internal/logger"
+	"github.com/zspekt/tcpLogger/internal/message"
+	"github.com/zspekt/tcpLogger/internal/multiline"
+	"github.com/zspekt/tcpLogger/internal/output"
+	"github.com/zspekt/tcpLogger/internal/sanitize"
+	"github.com/zspekt/tcpLogger/internal/syslog"
+)
+
+type (
+	// Server accepts connections and writes every line it reads to its sinks.
+	// See New.
+	Server = logger.Server
+	// Options configures a Server.
+	Options = logger.Options
+
+	// PeerInfo is a connection being handled. See Server.Peers.
+	PeerInfo = logger.PeerInfo
+
+	// ListenerConfig describes one of the listeners of a Server.
+	ListenerConfig = listener.Config
+	// ListenError is a listener that couldn't be bound. See
+	// Server.ListenErrors.
+	ListenError = logger.ListenError
+
+	// Message is a single line read off a connection, with what's known
+	// about it.
+	Message = message.Message
+	// SyslogHeader is set on a Message by SyslogParser.
+	SyslogHeader = syslog.Header
+
+	// Sink is anything messages can be written to. Every sink gets its own
+	// queue. A full one holds up the connections, unless the sink is named in
+	// Options.LossySinks, in which case it drops messages instead.
+	Sink = output.Output
+	// SinkStats are the counters kept for every sink.
+	SinkStats = output.Stats
+	// ForwardConfig describes an upstream collector for NewForwardSink.
+	ForwardConfig = output.ForwardConfig
+
+	// Sanitizer cleans up a message before it's parsed.
+	Sanitizer = logger.Sanitizer
+	// TextSanitizer validates UTF-8, transcodes from another charset and
+	// deals with control characters. See NewSanitizer.
+	TextSanitizer = sanitize.Sanitizer
+	// SanitizeConfig describes a TextSanitizer.
+	SanitizeConfig = sanitize.Config
+
+	// Parser fills in whatever it can work out from a message.
+	Parser = logger.Parser
+	// SyslogParser parses RFC 3164 and RFC 5424 headers.
+	SyslogParser = logger.SyslogParser
+
+	// MultilineConfig says which lines of a source are joined into one
+	// message. See Options.Multiline.
+	MultilineConfig = multiline.Config
+
+	// Tap sees every message on its way to the sinks. See Options.Tap.
+	Tap = logger.Tap
+
+	// Filter drops messages by returning false, or routes them by setting
+	// Message.Output.
+	Filter = logger.Filter
+	// Rules is a Filter backed by a JSON rules file. See LoadRules.
+	Rules = filter.Engine
+)
+
+var (
+	ServerClosedError error = logger.ServerClosedError
+	NoSuchPeerError   error = logger.NoSuchPeerError
+)
+
+// How a listener splits a stream into messages.
+const (
+	FramingLF    = listener.FramingLF
+	FramingOctet = listener.FramingOctet
+	FramingAuto  = listener.FramingAuto
+)
+
+// What a TextSanitizer does with control characters, and the charsets it can
+// transcode from.
+const (
+	ControlKeep   = sanitize.ControlKeep
+	ControlEscape = sanitize.ControlEscape
+	ControlStrip  = sanitize.ControlStrip
+
+	CharsetUTF8        = sanitize.CharsetUTF8
+	CharsetLatin1      = sanitize.CharsetLatin1
+	CharsetWindows1252 = sanitize.CharsetWindows1252
+)
+
+// New binds the listeners and starts the writer. Call Serve to start
+// accepting connections, and Shutdown to stop.
+func New(opts Options) (*Server, error) {
+	return logger.NewServer(opts)
+}
+
+// NewFileSink writes to a file rotated by lumberjack.
+func NewFileSink(name string, l *lumberjack.Logger) Sink {
+	return output.NewFile(name, l)
+}
+
+// NewWriterSink writes to w, which is never closed.
+func NewWriterSink(name string, w io.Writer) Sink {
+	return output.NewWriter(name, w)
+}
+
+// NewForwardSink relays messages to an upstream collector.
+func NewForwardSink(cfg ForwardConfig) (Sink, error) {
+	return output.NewForward(cfg)
+}
+
+// LoadRules reads a filter rules file. Call Reload on the result to pick up
+// changes.
+func LoadRules(path string) (*Rules, error) {
+	return filter.Load(path)
+}
+
+// NewSanitizer returns a TextSanitizer for Options.Sanitizer.
+func NewSanitizer(cfg SanitizeConfig) (*TextSanitizer, error) {
+	return sanitize.New(cfg)
+}
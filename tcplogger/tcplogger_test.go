@@ -0,0 +1,692 @@
+package tcplogger_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zspekt/tcpLogger/tcplogger"
+)
+
+// memSink keeps everything written to it.
+type memSink struct {
+	name string // "mem" if empty
+
+	mu    sync.Mutex
+	lines []string
+}
+
+func (s *memSink) Name() string {
+	if s.name == "" {
+		return "mem"
+	}
+	return s.name
+}
+
+func (s *memSink) got() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.lines...)
+}
+
+func (s *memSink) Write(m *tcplogger.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines = append(s.lines, string(m.Data))
+	return nil
+}
+
+func (s *memSink) Close() error { return nil }
+
+// upperParser is a Parser that isn't the syslog one.
+type upperParser struct{}
+
+func (upperParser) Parse(m *tcplogger.Message) error {
+	m.Data = bytes.ToUpper(m.Data)
+	return nil
+}
+
+// dropFilter drops every line containing a word.
+type dropFilter string
+
+func (f dropFilter) Filter(m *tcplogger.Message) bool {
+	return !bytes.Contains(m.Data, []byte(f))
+}
+
+func TestServer(t *testing.T) {
+	tests := []struct {
+		name   string
+		parser tcplogger.Parser
+		filter tcplogger.Filter
+		send   []string
+		want   []string
+	}{
+		{
+			name: "plain",
+			send: []string{"one\n", "two\n"},
+			want: []string{"one\n", "two\n"},
+		},
+		{
+			name:   "custom parser and filter",
+			parser: upperParser{},
+			filter: dropFilter("NOISE"),
+			send:   []string{"one\n", "noise\n", "two\n"},
+			want:   []string{"ONE\n", "TWO\n"},
+		},
+		{
+			name:   "syslog parser",
+			parser: tcplogger.SyslogParser{},
+			send:   []string{"<30>hostapd: hi\n"},
+			want:   []string{"<30>hostapd: hi\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &memSink{}
+			srv, err := tcplogger.New(tcplogger.Options{
+				Address: "127.0.0.1:0",
+				Sinks:   []tcplogger.Sink{sink},
+				Parser:  tt.parser,
+				Filter:  tt.filter,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			served := make(chan error, 1)
+			go func() { served <- srv.Serve(context.Background()) }()
+
+			conn, err := net.Dial("tcp", srv.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Write([]byte(strings.Join(tt.send, "")))
+			conn.Close()
+
+			// give the server a moment to read it before telling it to stop
+			time.Sleep(50 * time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				t.Fatalf("Shutdown() got error %v", err)
+			}
+			if err := <-served; !errors.Is(err, tcplogger.ServerClosedError) {
+				t.Errorf("Serve() got error %v, want %v", err, tcplogger.ServerClosedError)
+			}
+
+			if strings.Join(sink.lines, "") != strings.Join(tt.want, "") {
+				t.Errorf("sink got %q, want %q", sink.lines, tt.want)
+			}
+			if got := srv.Stats()[0].Written; got != uint64(len(tt.want)) {
+				t.Errorf("Stats() written = %v, want %v", got, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestServer_ServeCtxCanceled(t *testing.T) {
+	sink := &memSink{}
+	srv, err := tcplogger.New(tcplogger.Options{
+		Address:         "127.0.0.1:0",
+		Sinks:           []tcplogger.Sink{sink},
+		ShutdownGrace:   time.Minute,
+		ShutdownTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx) }()
+
+	// this one never closes, so only the shutdown timeout gets us out
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("still here\n"))
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve() didn't return after its ctx was canceled")
+	}
+
+	if len(sink.lines) != 1 || sink.lines[0] != "still here\n" {
+		t.Errorf("sink got %q", sink.lines)
+	}
+}
+
+func TestNew_noSinks(t *testing.T) {
+	if _, err := tcplogger.New(tcplogger.Options{Address: "127.0.0.1:0"}); err == nil {
+		t.Error("New() without sinks returned no error")
+	}
+}
+
+func TestServer_listeners(t *testing.T) {
+	// holding a port, so the listener that wants it can't be bound
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	sink, routed := &memSink{}, &memSink{name: "routed"}
+	srv, err := tcplogger.New(tcplogger.Options{
+		Listeners: []tcplogger.ListenerConfig{
+			{Name: "plain", Network: "tcp", Address: "127.0.0.1:0"},
+			{Name: "octet", Network: "tcp", Address: "127.0.0.1:0", Framing: tcplogger.FramingOctet, Output: "routed"},
+			{Name: "udp", Network: "udp", Address: "127.0.0.1:0"},
+			{Name: "taken", Network: "tcp", Address: taken.Addr().String()},
+			{
+				Name:    "denied",
+				Network: "tcp",
+				Address: "127.0.0.1:0",
+				Allow:   []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+			},
+		},
+		Sinks:       []tcplogger.Sink{sink},
+		RoutedSinks: []tcplogger.Sink{routed},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := srv.ListenErrors()
+	var listenErr *tcplogger.ListenError
+	if len(errs) != 1 || !errors.As(errs[0], &listenErr) || listenErr.Name != "taken" {
+		t.Fatalf("ListenErrors() = %v, want only the one for <taken>", errs)
+	}
+	addrs := srv.Addrs()
+	if len(addrs) != 4 {
+		t.Fatalf("Addrs() = %v, want 4 listeners", addrs)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background()) }()
+
+	send := func(listener, network, data string) {
+		conn, err := net.Dial(network, addrs[listener].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(data))
+		conn.Close()
+	}
+	send("plain", "tcp", "plain\n")
+	send("octet", "tcp", "5 octet")
+	send("udp", "udp", "udp")
+	send("denied", "tcp", "denied\n")
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() got error %v", err)
+	}
+	<-served
+
+	got := sink.got()
+	sort.Strings(got)
+	if strings.Join(got, "") != "plain\nudp\n" {
+		t.Errorf("default sink got %q", got)
+	}
+	if got := routed.got(); strings.Join(got, "") != "octet\n" {
+		t.Errorf("routed sink got %q", got)
+	}
+}
+
+func TestNew_noListeners(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	_, err = tcplogger.New(tcplogger.Options{
+		Address: taken.Addr().String(),
+		Sinks:   []tcplogger.Sink{&memSink{}},
+	})
+	var listenErr *tcplogger.ListenError
+	if !errors.As(err, &listenErr) {
+		t.Errorf("New() got error %v, want a *ListenError", err)
+	}
+}
+
+func TestServer_unix(t *testing.T) {
+	dir := t.TempDir()
+	stream, gram, file := filepath.Join(dir, "stream.sock"), filepath.Join(dir, "gram.sock"), filepath.Join(dir, "file")
+
+	// a unixgram socket isn't removed on close, so this leaves a stale one
+	stale, err := net.ListenPacket("unixgram", gram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Close()
+	if err := os.WriteFile(file, []byte("not a socket"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &memSink{}
+	srv, err := tcplogger.New(tcplogger.Options{
+		Listeners: []tcplogger.ListenerConfig{
+			{Name: "stream", Network: "unix", Address: stream, Mode: 0o660},
+			{Name: "gram", Network: "unixgram", Address: gram},
+			{Name: "file", Network: "unix", Address: file},
+		},
+		Sinks: []tcplogger.Sink{sink},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := srv.ListenErrors(); len(errs) != 1 {
+		t.Errorf("ListenErrors() = %v, want only the one for <file>", errs)
+	}
+	if b, _ := os.ReadFile(file); string(b) != "not a socket" {
+		t.Errorf("file that isn't a socket was touched")
+	}
+	if fi, err := os.Stat(stream); err != nil || fi.Mode().Perm() != 0o660 {
+		t.Errorf("socket mode = %v (%v), want 0660", fi.Mode().Perm(), err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background()) }()
+
+	for _, dest := range []struct{ network, path, data string }{
+		{"unix", stream, "stream\n"},
+		{"unixgram", gram, "gram"},
+	} {
+		conn, err := net.Dial(dest.network, dest.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(dest.data))
+		conn.Close()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() got error %v", err)
+	}
+	<-served
+
+	got := sink.got()
+	sort.Strings(got)
+	if strings.Join(got, "") != "gram\nstream\n" {
+		t.Errorf("sink got %q", got)
+	}
+	for _, path := range []string{stream, gram} {
+		if _, err := os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("socket <%v> still there after shutdown (%v)", path, err)
+		}
+	}
+}
+
+// sourceSink keeps the source of everything written to it.
+type sourceSink struct {
+	memSink
+}
+
+func (s *sourceSink) Write(m *tcplogger.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines = append(s.lines, m.Source)
+	return nil
+}
+
+func TestServer_ipv6(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("no IPv6 here:", err)
+	} else {
+		l.Close()
+	}
+
+	sink := &sourceSink{}
+	srv, err := tcplogger.New(tcplogger.Options{
+		Listeners: []tcplogger.ListenerConfig{
+			{Name: "dual", Network: "tcp", Address: "[::]:0"},
+			{Name: "v6only", Network: "tcp", Address: "[::]:0", V6Only: true},
+			{Name: "loopback", Network: "udp", Address: "[::1]:0"},
+		},
+		Sinks: []tcplogger.Sink{sink},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := srv.ListenErrors(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background()) }()
+
+	addrs := srv.Addrs()
+	port := func(name string) string {
+		_, p, _ := net.SplitHostPort(addrs[name].String())
+		return p
+	}
+
+	conn, err := net.Dial("tcp4", "127.0.0.1:"+port("dual"))
+	if err != nil {
+		t.Fatalf("dual-stack listener refused IPv4: %v", err)
+	}
+	conn.Write([]byte("v4\n"))
+	conn.Close()
+
+	if conn, err := net.Dial("tcp4", "127.0.0.1:"+port("v6only")); err == nil {
+		conn.Close()
+		t.Errorf("v6only listener took IPv4")
+	}
+
+	conn, err = net.Dial("udp6", addrs["loopback"].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("v6"))
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+	<-served
+
+	got := sink.got()
+	sort.Strings(got)
+	if len(got) != 2 || !strings.HasPrefix(got[0], "127.0.0.1:") || !strings.HasPrefix(got[1], "[::1]:") {
+		t.Errorf("sources = %q, want one plain IPv4 and one bracketed IPv6", got)
+	}
+}
+
+func TestServer_proxyProtocol(t *testing.T) {
+	sink := &sourceSink{}
+	srv, err := tcplogger.New(tcplogger.Options{
+		Listeners: []tcplogger.ListenerConfig{
+			{
+				Name:           "trusted",
+				Network:        "tcp",
+				Address:        "127.0.0.1:0",
+				ProxyProtocol:  true,
+				TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+				Allow:          []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+			},
+			{
+				Name:           "untrusted",
+				Network:        "tcp",
+				Address:        "127.0.0.1:0",
+				ProxyProtocol:  true,
+				TrustedProxies: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+			},
+		},
+		Sinks: []tcplogger.Sink{sink},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background()) }()
+
+	addrs := srv.Addrs()
+	send := func(name, data string) {
+		conn, err := net.Dial("tcp", addrs[name].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(data))
+		conn.Close()
+	}
+	send("trusted", "PROXY TCP4 192.0.2.1 10.0.0.1 12345 514\r\nhello\n")
+	// not allowed once the header says who it is
+	send("trusted", "PROXY TCP4 198.51.100.1 10.0.0.1 12345 514\r\nhello\n")
+	// a trusted proxy has to send a header
+	send("trusted", "hello\n")
+	// and anybody else can't, it's just data
+	send("untrusted", "PROXY TCP4 192.0.2.1 10.0.0.1 12345 514\r\n")
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+	<-served
+
+	got := sink.got()
+	sort.Strings(got)
+	if len(got) != 2 || !strings.HasPrefix(got[0], "127.0.0.1:") || got[1] != "192.0.2.1:12345" {
+		t.Errorf("sources = %q, want the proxied client and the untrusted peer", got)
+	}
+}
+
+func TestServer_sanitizer(t *testing.T) {
+	san, err := tcplogger.NewSanitizer(tcplogger.SanitizeConfig{Charset: tcplogger.CharsetLatin1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &memSink{}
+	srv, err := tcplogger.New(tcplogger.Options{
+		Address:   "127.0.0.1:0",
+		Sinks:     []tcplogger.Sink{sink},
+		Sanitizer: san,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background()) }()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("caf\xe9 \x1b[31mhot\x1b[0m\r\n"))
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+	<-served
+
+	if got := sink.got(); len(got) != 1 || got[0] != "café #033[31mhot#033[0m\n" {
+		t.Errorf("sink got %q", got)
+	}
+}
+
+func TestServer_multiline(t *testing.T) {
+	sink := &memSink{}
+	srv, err := tcplogger.New(tcplogger.Options{
+		Address:   "127.0.0.1:0",
+		Sinks:     []tcplogger.Sink{sink},
+		Multiline: &tcplogger.MultilineConfig{Indent: true, Timeout: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background()) }()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("Traceback:\n  one\n  two\nnext\n"))
+	conn.Close() // lets go of "next" well before the timeout
+	time.Sleep(50 * time.Millisecond)
+
+	if got := sink.got(); len(got) != 2 || got[0] != "Traceback:\n  one\n  two\n" || got[1] != "next\n" {
+		t.Errorf("sink got %q", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+	<-served
+}
+
+func TestServer_handOver(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "log.sock")
+	srv, err := tcplogger.New(tcplogger.Options{
+		Listeners: []tcplogger.ListenerConfig{
+			{Name: "tcp", Network: "tcp", Address: "127.0.0.1:0"},
+			{Name: "udp", Network: "udp", Address: "127.0.0.1:0"},
+			{Name: "unix", Network: "unix", Address: sock},
+		},
+		Sinks: []tcplogger.Sink{&memSink{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, names := srv.ListenerFiles()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if strings.Join(names, ",") != "tcp,udp,unix" || len(files) != 3 {
+		t.Errorf("ListenerFiles() = %v files named %v", len(files), names)
+	}
+
+	srv.KeepSockets()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+
+	if _, err := os.Lstat(sock); err != nil {
+		t.Errorf("socket handed over was removed on shutdown: %v", err)
+	}
+	// the dup we kept is still listening
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("socket handed over stopped listening: %v", err)
+	}
+	conn.Close()
+}
+
+// memTap keeps what it's handed, like memSink.
+type memTap struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (t *memTap) Publish(m *tcplogger.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines = append(t.lines, string(m.Data))
+}
+
+func (t *memTap) got() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+func TestServer_tap(t *testing.T) {
+	sink, routed, tap := &memSink{}, &memSink{name: "routed"}, &memTap{}
+	srv, err := tcplogger.New(tcplogger.Options{
+		Listeners: []tcplogger.ListenerConfig{
+			{Name: "plain", Network: "tcp", Address: "127.0.0.1:0"},
+			{Name: "routed", Network: "tcp", Address: "127.0.0.1:0", Output: "routed"},
+		},
+		Sinks:       []tcplogger.Sink{sink},
+		RoutedSinks: []tcplogger.Sink{routed},
+		Tap:         tap,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background()) }()
+
+	for name, line := range map[string]string{"plain": "to the sink\n", "routed": "to the routed sink\n"} {
+		conn, err := net.Dial("tcp", srv.Addrs()[name].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(line))
+		conn.Close()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+	<-served
+
+	got := tap.got()
+	sort.Strings(got)
+	if len(got) != 2 || got[0] != "to the routed sink\n" || got[1] != "to the sink\n" {
+		t.Errorf("tap got %q, want both lines", got)
+	}
+	if got := sink.got(); len(got) != 1 {
+		t.Errorf("sink got %q", got)
+	}
+}
+
+func TestServer_peers(t *testing.T) {
+	sink := &memSink{}
+	srv, err := tcplogger.New(tcplogger.Options{
+		Listeners: []tcplogger.ListenerConfig{{Name: "plain", Network: "tcp", Address: "127.0.0.1:0"}},
+		Sinks:     []tcplogger.Sink{sink},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background()) }()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		<-served
+	}()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("one\ntwo\n"))
+	time.Sleep(50 * time.Millisecond)
+
+	peers := srv.Peers()
+	if len(peers) != 1 {
+		t.Fatalf("Peers() = %+v, want 1", peers)
+	}
+	p := peers[0]
+	if p.Remote != conn.LocalAddr().String() || p.Listener != "plain" || p.Lines != 2 || p.Bytes != 8 || p.Last.IsZero() {
+		t.Errorf("Peers()[0] = %+v", p)
+	}
+
+	if err := srv.Disconnect(p.ID + 1); !errors.Is(err, tcplogger.NoSuchPeerError) {
+		t.Errorf("Disconnect() of an unknown id got error %v, want %v", err, tcplogger.NoSuchPeerError)
+	}
+	if err := srv.Disconnect(p.ID); err != nil {
+		t.Fatalf("Disconnect() got error %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection is still open after Disconnect()")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if peers := srv.Peers(); len(peers) != 0 {
+		t.Errorf("Peers() after Disconnect() = %+v", peers)
+	}
+	if got := sink.got(); len(got) != 2 {
+		t.Errorf("sink got %q, want both lines", got)
+	}
+}